@@ -0,0 +1,105 @@
+package ccapi
+
+import (
+	"encoding/json"
+	"errors"
+
+	"chaoshen.com/gopaillier/api/core"
+)
+
+// approveContext prefixes the asset and the owner's spendable balance in the
+// context of the Approve proofs.
+const approveContext = "gopaillier/approve/"
+
+func approveProofContext(assetID, cipherSpendable string) []byte {
+	return []byte(approveContext + assetID + "/" + cipherSpendable)
+}
+
+// spendContext prefixes the asset and the owner's copy of the allowance in
+// the context of the TransferFrom proofs.
+const spendContext = "gopaillier/transfer-from/"
+
+func spendProofContext(assetID, cipherAllowance string) []byte {
+	return []byte(spendContext + assetID + "/" + cipherAllowance)
+}
+
+// allowanceInfo is the tx info of Approve and TransferFrom. Opening is the
+// plain text and nonce of the owner's copy of the allowance after the call,
+// sealed to the spender, who needs both to prove the next spend.
+type allowanceInfo struct {
+	txInfo
+	Opening *gohe.Memo
+}
+
+// approveInfo also carries the owner's copy of the allowance it was prepared
+// against, the copy the opening was computed from.
+type approveInfo struct {
+	allowanceInfo
+	CipherAllowance []byte
+}
+
+// AllowanceResult is a validated Approve or TransferFrom.
+type AllowanceResult struct {
+	TxResult
+	Opening *gohe.Memo
+}
+
+// ValidateApprove checks an allowance granted by the owner like
+// ValidateTxInfo, with the spender as B but crediting nobody: the amount is
+// not negative and the owner's spendable balance covers it and the fee.
+// cipherAllowance is the owner's copy of the current allowance, the
+// encryption of zero without one. NewCipherBalanceA of the result is the
+// spendable balance left, CipherTxA the amount to add to the allowance and
+// CipherTxB the amount for the spender. The owner authorizes the call with
+// a signature of its own, which the chaincode checks.
+func ValidateApprove(approveInfoStr, cipherSpendable, cipherAllowance, pubKeyOwner, pubKeySpender, auditorPubKey, assetID string, fee *Fee) (*AllowanceResult, error) {
+	var ai approveInfo
+	err := json.Unmarshal([]byte(approveInfoStr), &ai)
+	if err != nil {
+		return nil, err
+	}
+	if string(ai.CipherAllowance) != cipherAllowance {
+		return nil, errors.New("The allowance has been changed.")
+	}
+
+	result, err := validateTxInfo(approveInfoStr, cipherSpendable, string(gohe.ZeroCipher()), pubKeyOwner, pubKeySpender, auditorPubKey, assetID, fee, approveProofContext(assetID, cipherSpendable), nil)
+	if err != nil {
+		return nil, err
+	}
+	result.NewCipherBalanceB = ""
+	return validateOpening(approveInfoStr, result, pubKeySpender)
+}
+
+// ValidateTransferFrom checks a spend of an allowance prepared by the
+// spender. The owner's copy of the allowance plays the balance of A, so the
+// amount is not negative and at most the allowance, and it is the same
+// under the keys of the owner, B and the auditor, if any. NewCipherBalanceA
+// of the result is the remaining allowance.
+//
+// The owner's balance needs no proof of its own: Approve proved the
+// allowance against the owner's spendable balance and the chaincode keeps it
+// reserved, so the amount is also at most the owner's balance. The spender
+// authorizes the spend with a signature of its own, which the chaincode
+// checks.
+func ValidateTransferFrom(spendInfoStr, cipherAllowance, cipherBalanceB, pubKeyOwner, pubKeyB, pubKeySpender, auditorPubKey, assetID string) (*AllowanceResult, error) {
+	result, err := validateTxInfo(spendInfoStr, cipherAllowance, cipherBalanceB, pubKeyOwner, pubKeyB, auditorPubKey, assetID, nil, spendProofContext(assetID, cipherAllowance), nil)
+	if err != nil {
+		return nil, err
+	}
+	return validateOpening(spendInfoStr, result, pubKeySpender)
+}
+
+// validateOpening checks the shape of the opening; only the spender can
+// tell whether it opens the allowance.
+func validateOpening(infoStr string, result *TxResult, pubKeySpender string) (*AllowanceResult, error) {
+	var ai allowanceInfo
+	err := json.Unmarshal([]byte(infoStr), &ai)
+	if err != nil {
+		return nil, err
+	}
+	err = gohe.ValidateMemo([]byte(pubKeySpender), ai.Opening)
+	if err != nil {
+		return nil, err
+	}
+	return &AllowanceResult{TxResult: *result, Opening: ai.Opening}, nil
+}
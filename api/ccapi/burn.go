@@ -0,0 +1,42 @@
+package ccapi
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+
+	"chaoshen.com/gopaillier/api/core"
+)
+
+// burnContext prefixes the asset and the address in the context of the burn
+// proof.
+const burnContext = "gopaillier/burn/"
+
+// ValidateBurn checks the owner's proof that burning the public amount from
+// cipherBalance leaves a balance that is not negative. It returns the debited
+// cipher text, the trivial encryption g^amount the owner proved against, and
+// the new balance, all under pubKey.
+func ValidateBurn(proofStr, addr, assetID, cipherBalance, pubKey string, amount *big.Int) (cipherDebit, newCipherBalance []byte, err error) {
+	if amount.Sign() < 0 || amount.BitLen() > gohe.RangeBits {
+		return nil, nil, errors.New("The amount is out of range.")
+	}
+	var proof gohe.RangeProof
+	err = json.Unmarshal([]byte(proofStr), &proof)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cipherDebit, err = gohe.Add([]byte(pubKey), gohe.ZeroCipher(), amount.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	newCipherBalance, err = gohe.SubCipher([]byte(pubKey), []byte(cipherBalance), cipherDebit)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = gohe.VerifyRange([]byte(pubKey), newCipherBalance, &proof, []byte(burnContext+assetID+"/"+addr))
+	if err != nil {
+		return nil, nil, err
+	}
+	return cipherDebit, newCipherBalance, nil
+}
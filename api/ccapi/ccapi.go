@@ -1,64 +1,466 @@
 package ccapi
 
 import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"math/big"
+
 	"chaoshen.com/gopaillier/api/core"
-	//"strconv"
 )
 
 type txInfo struct {
-	CipherBalanceA []byte
-	CipherTxA      []byte
-	CipherTXB      []byte
-	PubKeyA        []byte
-	PubKeyB        []byte
+	CipherBalanceA  []byte
+	CipherTxA       []byte
+	CipherTXB       []byte
+	CipherTxAuditor []byte              // amount under the auditor key, only with an auditor
+	PubKeyA         []byte
+	PubKeyB         []byte
+	AssetID         string              // asset transferred, empty for the default asset
+	Proof           *gohe.EqualityProof // CipherTxA, CipherTXB and CipherTxAuditor encrypt the same amount
+	AmountProof     *gohe.RangeProof    // CipherTxA encrypts a non-negative amount
+	BalanceProof    *gohe.RangeProof    // CipherBalanceA - CipherTxA - fee encrypts a non-negative balance
+	Memo            *gohe.Memo          `json:",omitempty"` // sealed to B with CipherTXB as context
+	Sig             []byte              `json:",omitempty"` // signature over the Auth and the rest of the tx info
+	feeInfo
+}
+
+// Auth is what the owner of A signs with a tx info besides the tx info
+// itself: the transaction it is submitted in and the accounts it moves
+// funds between. The proofs only show knowledge of the opening of A's
+// balance, which is public whenever a known amount was added to a balance
+// with a known opening, such as a mint into a new asset balance, so they do
+// not authorize a debit by themselves.
+type Auth struct {
+	TxID string
+	From string // address debited
+	To   string // address credited, the recipients joined by "," for TransferMany
+}
+
+// authContext prefixes the Auth and the hash of the tx info in the message
+// the owner of A signs.
+const authContext = "gopaillier/auth/"
+
+func authMessage(auth *Auth, assetID string, digest []byte) []byte {
+	return []byte(authContext + auth.TxID + "/" + auth.From + "/" + auth.To + "/" + assetID + "/" + hex.EncodeToString(digest))
+}
+
+// verifyAuth checks the signature of a tx info by pubKey. A nil auth skips
+// it, for a debit authorized otherwise, such as by the signers of an account.
+func verifyAuth(infoStr string, auth *Auth, assetID, pubKey string, sig []byte) error {
+	if auth == nil {
+		return nil
+	}
+	digest, err := infoDigest(infoStr, "Sig")
+	if err != nil {
+		return err
+	}
+	err = gohe.Verify([]byte(pubKey), authMessage(auth, assetID, digest), sig)
+	if err != nil {
+		return errors.New("The tx info is not signed by the owner of the account.")
+	}
+	return nil
+}
+
+// infoDigest hashes a JSON tx info without the field omit, the field that
+// carries a signature over it. Re-encoding the fields sorts them, so the
+// client and the chaincode hash the same bytes.
+func infoDigest(infoStr, omit string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal([]byte(infoStr), &fields)
+	if err != nil {
+		return nil, err
+	}
+	delete(fields, omit)
+	fieldBytes, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(fieldBytes)
+	return digest[:], nil
+}
+
+// TxResult is the outcome of a validated transfer.
+type TxResult struct {
+	NewCipherBalanceA string
+	NewCipherBalanceB string
+	CipherTxA         []byte     // amount debited from A, under A's key
+	CipherTxB         []byte     // amount credited to B, under B's key
+	CipherTxAuditor   []byte     // amount under the auditor key, nil without an auditor
+	Memo              *gohe.Memo // memo for B, nil without a memo
+	Fee               *FeeResult // nil without a fee
+}
+
+// txContext prefixes the asset and the sender's balance in the context of
+// the transfer proofs, so a proof is only valid for the asset and against
+// the balance it was made for.
+const txContext = "gopaillier/transfer/"
+
+func txProofContext(assetID, cipherBalanceA string) []byte {
+	return []byte(txContext + assetID + "/" + cipherBalanceA)
+}
+
+// Hold kinds. A hold debits A now and credits B, or returns the amount to A,
+// in a later transaction. The proofs are bound to the kind, so a hold cannot
+// be submitted as a transfer or as a hold of another kind.
+const (
+	HoldLock    = "lock"
+	HoldPending = "pending"
+)
+
+const holdContext = "gopaillier/hold/"
+
+func holdProofContext(kind, assetID, cipherBalanceA string) []byte {
+	return []byte(holdContext + kind + "/" + assetID + "/" + cipherBalanceA)
+}
+
+// ValidateTxInfo checks a transfer against the current balances and the
+// registered public keys of both accounts. With an auditor key the transfer
+// must also carry the amount under that key, with a fee A also pays the fee.
+// The balances are those of assetID, empty for the default asset. The key of
+// A signs the transfer with auth, unless auth is nil.
+func ValidateTxInfo(txInfoStr, cipherBalanceA, cipherBalanceB, pubKeyA, pubKeyB, auditorPubKey, assetID string, fee *Fee, auth *Auth) (*TxResult, error) {
+	return validateTxInfo(txInfoStr, cipherBalanceA, cipherBalanceB, pubKeyA, pubKeyB, auditorPubKey, assetID, fee, txProofContext(assetID, cipherBalanceA), auth)
+}
+
+// ValidateHoldInfo checks a hold of the given kind like ValidateTxInfo but
+// credits nobody. NewCipherBalanceB of the result is empty; CipherTxB is the
+// amount to credit B with on release and CipherTxA the amount to return to A.
+func ValidateHoldInfo(kind, txInfoStr, cipherBalanceA, pubKeyA, pubKeyB, auditorPubKey, assetID string, fee *Fee, auth *Auth) (*TxResult, error) {
+	if kind != HoldLock && kind != HoldPending {
+		return nil, errors.New("Unknown hold kind.")
+	}
+	result, err := validateTxInfo(txInfoStr, cipherBalanceA, string(gohe.ZeroCipher()), pubKeyA, pubKeyB, auditorPubKey, assetID, fee, holdProofContext(kind, assetID, cipherBalanceA), auth)
+	if err != nil {
+		return nil, err
+	}
+	result.NewCipherBalanceB = ""
+	return result, nil
 }
 
-func ValidateTxInfo(txInfoStr, cipherBalanceA, cipherBalanceB string) (newCipherBalanceA,newCipherBalanceB string,err error){
+// validateTxInfo checks a tx info with its proofs made in context and the
+// signature of the key of A with auth.
+func validateTxInfo(txInfoStr, cipherBalanceA, cipherBalanceB, pubKeyA, pubKeyB, auditorPubKey, assetID string, fee *Fee, context []byte, auth *Auth) (result *TxResult, err error){
 	var ti txInfo
 	err = json.Unmarshal([]byte(txInfoStr),&ti)
 	if err != nil {
-		return "","",err
+		return nil,err
 	}
 	// check whether the balance of account A has been changed
 	if string(ti.CipherBalanceA) != cipherBalanceA{
-		return "","",errors.New("The cipher balance has been changed.")
+		return nil,errors.New("The cipher balance has been changed.")
+	}
+	// check the transfer is for this asset
+	if ti.AssetID != assetID {
+		return nil,errors.New("The transfer is for another asset.")
+	}
+	// check the owner authorized it
+	err = verifyAuth(txInfoStr, auth, assetID, pubKeyA, ti.Sig)
+	if err != nil {
+		return nil,err
+	}
+
+	result, err = validateLeg(&ti, cipherBalanceB, pubKeyA, pubKeyB, auditorPubKey, context)
+	if err != nil {
+		return nil,err
+	}
+
+	// add the fee to the amount debited from A
+	debitA := ti.CipherTxA
+	if fee != nil {
+		result.Fee, err = validateFee(&ti.feeInfo, ti.CipherTxA, pubKeyA, fee, auditorPubKey, context)
+		if err != nil {
+			return nil,err
+		}
+		debitA, err = gohe.AddCipher(ti.PubKeyA, debitA, result.Fee.CipherFeeA)
+		if err != nil {
+			return nil,err
+		}
 	}
 
 	//  subtract cipher amount from account A
-	newCipherBalanceAStr ,err:= gohe.SubCipher(ti.PubKeyA,ti.CipherBalanceA,ti.CipherTxA)
+	newCipherBalanceAStr ,err:= gohe.SubCipher(ti.PubKeyA,ti.CipherBalanceA,debitA)
+
+	if err != nil {
+		return nil,err
+	}
+
+	// check the remaining balance is not negative
+	err = gohe.VerifyRange(ti.PubKeyA, newCipherBalanceAStr, ti.BalanceProof, context)
+	if err != nil {
+		return nil,err
+	}
+
+	result.NewCipherBalanceA = string(newCipherBalanceAStr)
+	return result, nil
+}
+
+// validateLeg checks the proofs of one sender to recipient amount and
+// credits the recipient. It does not touch the sender's balance.
+func validateLeg(ti *txInfo, cipherBalanceB, pubKeyA, pubKeyB, auditorPubKey string, context []byte) (*TxResult, error) {
+	// check the amounts are encrypted under the keys of the accounts
+	if string(ti.PubKeyA) != pubKeyA || string(ti.PubKeyB) != pubKeyB {
+		return nil,errors.New("The public keys do not match the accounts.")
+	}
+
+	// check all cipher texts encrypt the same amount
+	pubKeys := [][]byte{ti.PubKeyA, ti.PubKeyB}
+	ciphers := [][]byte{ti.CipherTxA, ti.CipherTXB}
+	if auditorPubKey != "" {
+		pubKeys = append(pubKeys, []byte(auditorPubKey))
+		ciphers = append(ciphers, ti.CipherTxAuditor)
+	} else if ti.CipherTxAuditor != nil {
+		return nil,errors.New("No auditor key configured for the auditor cipher.")
+	}
+	err := gohe.VerifyEqual(pubKeys, ciphers, ti.Proof, context)
+	if err != nil {
+		return nil,err
+	}
 
+	// check the amount is not negative. The equality proof binds a plain
+	// text below 2^RangeBits, so the credit and the auditor cipher hold the
+	// same amount as CipherTxA and need no range proof of their own.
+	err = gohe.VerifyRange(ti.PubKeyA, ti.CipherTxA, ti.AmountProof, context)
 	if err != nil {
-		return "","",err
+		return nil,err
+	}
+
+	// the memo can only be opened by B, check its shape
+	if ti.Memo != nil {
+		err = gohe.ValidateMemo(ti.PubKeyB, ti.Memo)
+		if err != nil {
+			return nil,err
+		}
 	}
 
 	//  Add cipher amount to account B
 	newCipherBalanceBStr, err:= gohe.AddCipher(ti.PubKeyB,[]byte(cipherBalanceB),ti.CipherTXB)
 
 	if err != nil {
-		return "","",err
+		return nil,err
+	}
+
+	return &TxResult{
+		NewCipherBalanceB: string(newCipherBalanceBStr),
+		CipherTxA:         ti.CipherTxA,
+		CipherTxB:         ti.CipherTXB,
+		CipherTxAuditor:   ti.CipherTxAuditor,
+		Memo:              ti.Memo,
+	}, nil
+}
+
+// multiTxInfo pays several recipients from one balance. Every leg carries
+// its own amount proofs, BalanceProof covers the balance left after the sum
+// of all legs.
+type multiTxInfo struct {
+	CipherBalanceA []byte
+	PubKeyA        []byte
+	Legs           []*txInfo
+	BalanceProof   *gohe.RangeProof
+	Sig            []byte // signature over the Auth and the rest of the tx info
+	// one fee on the sum of all legs
+	feeInfo
+}
+
+// MultiTxResult is the outcome of a validated TransferMany.
+type MultiTxResult struct {
+	NewCipherBalanceA  string
+	CipherTotalA       []byte      // sum of all legs, under A's key
+	CipherTotalAuditor []byte      // sum of all legs under the auditor key, nil without an auditor
+	Legs               []*TxResult // per recipient, in order, without NewCipherBalanceA
+	Fee                *FeeResult  // nil without a fee
+}
+
+// ValidateMultiTxInfo checks a transfer from A to the recipients with the
+// given balances and keys, in the order of the legs. A fee is charged once,
+// on the sum of the legs. The key of A signs the transfer with auth.
+func ValidateMultiTxInfo(txInfoStr, cipherBalanceA, pubKeyA string, cipherBalancesB, pubKeysB []string, auditorPubKey string, fee *Fee, auth *Auth) (*MultiTxResult, error) {
+	var mi multiTxInfo
+	err := json.Unmarshal([]byte(txInfoStr), &mi)
+	if err != nil {
+		return nil, err
+	}
+	if string(mi.CipherBalanceA) != cipherBalanceA {
+		return nil, errors.New("The cipher balance has been changed.")
+	}
+	if string(mi.PubKeyA) != pubKeyA {
+		return nil, errors.New("The public keys do not match the accounts.")
+	}
+	if len(mi.Legs) == 0 || len(mi.Legs) != len(cipherBalancesB) || len(mi.Legs) != len(pubKeysB) {
+		return nil, errors.New("Need one leg per recipient.")
+	}
+	err = verifyAuth(txInfoStr, auth, "", pubKeyA, mi.Sig)
+	if err != nil {
+		return nil, err
+	}
+	// TransferMany moves the default asset only
+	context := txProofContext("", cipherBalanceA)
+
+	result := &MultiTxResult{CipherTotalA: gohe.ZeroCipher()}
+	if auditorPubKey != "" {
+		result.CipherTotalAuditor = gohe.ZeroCipher()
+	}
+	for i, leg := range mi.Legs {
+		if leg == nil {
+			return nil, errors.New("Missing leg.")
+		}
+		legResult, err := validateLeg(leg, cipherBalancesB[i], pubKeyA, pubKeysB[i], auditorPubKey, context)
+		if err != nil {
+			return nil, err
+		}
+		result.CipherTotalA, err = gohe.AddCipher(mi.PubKeyA, result.CipherTotalA, legResult.CipherTxA)
+		if err != nil {
+			return nil, err
+		}
+		if auditorPubKey != "" {
+			result.CipherTotalAuditor, err = gohe.AddCipher([]byte(auditorPubKey), result.CipherTotalAuditor, legResult.CipherTxAuditor)
+			if err != nil {
+				return nil, err
+			}
+		}
+		result.Legs = append(result.Legs, legResult)
+	}
+
+	debitA := result.CipherTotalA
+	if fee != nil {
+		result.Fee, err = validateFee(&mi.feeInfo, result.CipherTotalA, pubKeyA, fee, auditorPubKey, context)
+		if err != nil {
+			return nil, err
+		}
+		debitA, err = gohe.AddCipher(mi.PubKeyA, debitA, result.Fee.CipherFeeA)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// debit the sum once and check the remaining balance is not negative
+	newCipherBalanceA, err := gohe.SubCipher(mi.PubKeyA, mi.CipherBalanceA, debitA)
+	if err != nil {
+		return nil, err
+	}
+	err = gohe.VerifyRange(mi.PubKeyA, newCipherBalanceA, mi.BalanceProof, context)
+	if err != nil {
+		return nil, err
+	}
+	result.NewCipherBalanceA = string(newCipherBalanceA)
+	return result, nil
+}
+
+// initInfo opens a new account with either an encryption of zero or an
+// amount approved by the issuer.
+type initInfo struct {
+	CipherBalance []byte
+	Amount        string          // decimal opening amount, empty or "0" for a zero opening
+	IssuerSig     []byte          // ASN.1 ECDSA signature of the issuer over the address and amount
+	Proof         *gohe.ZeroProof // proof that CipherBalance encrypts Amount
+}
+
+// ValidateInitBalance checks the opening balance of the account addr. The
+// cipher text must be in Z*_{N^2} and come with a proof that it encrypts
+// zero, or that it encrypts an opening amount signed by the issuer key.
+func ValidateInitBalance(initInfoStr, PubKey, addr, issuerKey string) (cipherBalance string, amount *big.Int, err error) {
+	var ii initInfo
+	err = json.Unmarshal([]byte(initInfoStr), &ii)
+	if err != nil {
+		return "", nil, err
+	}
+
+	err = gohe.ValidateCipher([]byte(PubKey), ii.CipherBalance)
+	if err != nil {
+		return "", nil, err
+	}
+
+	amount = new(big.Int)
+	if ii.Amount != "" {
+		_, ok := amount.SetString(ii.Amount, 10)
+		if !ok || amount.Sign() < 0 {
+			return "", nil, errors.New("The initial amount must be a non-negative integer.")
+		}
+	}
+
+	if amount.Sign() > 0 {
+		if issuerKey == "" {
+			return "", nil, errors.New("No issuer key configured to approve the initial amount.")
+		}
+		err = verifyIssuerSig(issuerKey, initBalanceDigest(addr, amount), ii.IssuerSig)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	err = gohe.VerifyPlaintext([]byte(PubKey), ii.CipherBalance, amount.Bytes(), ii.Proof, []byte(initContext+addr))
+	if err != nil {
+		return "", nil, err
+	}
+
+	return string(ii.CipherBalance), amount, nil
+}
+
+// initContext prefixes the address in the context of the opening proof.
+const initContext = "gopaillier/init-balance/"
+
+// initBalanceDigest is the message the issuer signs to approve an opening amount.
+func initBalanceDigest(addr string, amount *big.Int) []byte {
+	digest := sha256.Sum256([]byte(initContext + addr + "/" + amount.String()))
+	return digest[:]
+}
+
+func verifyIssuerSig(issuerKey string, digest, sig []byte) error {
+	block, _ := pem.Decode([]byte(issuerKey))
+	if block == nil {
+		return errors.New("The issuer key is not PEM encoded.")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return err
 	}
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return errors.New("The issuer key is not an ECDSA key.")
+	}
+	if !ecdsa.VerifyASN1(ecKey, digest, sig) {
+		return errors.New("Invalid issuer signature.")
+	}
+	return nil
+}
 
-	return string(newCipherBalanceAStr),string(newCipherBalanceBStr),nil
+// rotateInfo moves an account to a new key. The balance is re-encrypted under
+// the new key with a proof that both cipher texts hold the same amount.
+type rotateInfo struct {
+	NewPubKey     []byte
+	Sig           []byte // signature of the registry's rotation message by the current key
+	CipherBalance []byte // balance under NewPubKey
+	Proof         *gohe.EqualityProof
 }
 
+// rotateContext prefixes the address in the context of the re-encryption proof.
+const rotateContext = "gopaillier/rotate/"
 
-func ValidateInitBalance(balance, PubKey string) (cipherBalance string, err error){
-	/*
-	initBalance,err:=strconv.Atoi(balance)
+// ValidateRotation checks that the re-encrypted balance of addr holds the same
+// amount as its current balance under oldPubKey.
+func ValidateRotation(rotateInfoStr, addr, cipherBalance, oldPubKey string) (newPubKey string, sig []byte, newCipherBalance string, err error) {
+	var ri rotateInfo
+	err = json.Unmarshal([]byte(rotateInfoStr), &ri)
 	if err != nil {
-		return "",err
+		return "", nil, "", err
 	}
-	if initBalance < 0 {
-		return "", errors.New("The initial amount cannot be less than 0.")
+
+	err = gohe.ValidateCipher(ri.NewPubKey, ri.CipherBalance)
+	if err != nil {
+		return "", nil, "", err
 	}
 
-	cipherBal,err:=gohe.Encrypt([]byte(PubKey),[]byte(balance))
-	if err != nil{
-		return "",err
+	err = gohe.VerifyEqual(
+		[][]byte{[]byte(oldPubKey), ri.NewPubKey},
+		[][]byte{[]byte(cipherBalance), ri.CipherBalance},
+		ri.Proof, []byte(rotateContext+addr))
+	if err != nil {
+		return "", nil, "", err
 	}
-	*/
-	return balance,nil
 
-}
\ No newline at end of file
+	return string(ri.NewPubKey), ri.Sig, string(ri.CipherBalance), nil
+}
@@ -0,0 +1,46 @@
+package ccapi
+
+import (
+	"encoding/json"
+	"errors"
+
+	"chaoshen.com/gopaillier/api/core"
+)
+
+// closeContext prefixes the address and the txID in the context of the
+// CloseAccount proofs and signature.
+const closeContext = "gopaillier/close/"
+
+// closeInfo proves that every balance of an account encrypts zero.
+type closeInfo struct {
+	Proofs map[string]*gohe.ZeroProof // by asset ID, "" for the default asset
+	Sig    []byte                     // the account key signs the closure
+}
+
+// ValidateClose checks that the owner of addr closes the account in the
+// transaction txID and that each of its balances, keyed by asset ID, is an
+// encryption of zero, that is an n-th residue.
+func ValidateClose(closeInfoStr, addr, txID, pubKey string, balances map[string][]byte) error {
+	var ci closeInfo
+	err := json.Unmarshal([]byte(closeInfoStr), &ci)
+	if err != nil {
+		return err
+	}
+
+	context := []byte(closeContext + addr + "/" + txID)
+	err = gohe.Verify([]byte(pubKey), context, ci.Sig)
+	if err != nil {
+		return err
+	}
+	for assetID, balance := range balances {
+		proof, ok := ci.Proofs[assetID]
+		if !ok {
+			return errors.New("no zero proof for asset: " + assetID)
+		}
+		err = gohe.VerifyZero([]byte(pubKey), balance, proof, context)
+		if err != nil {
+			return errors.New("balance is not zero for asset: " + assetID)
+		}
+	}
+	return nil
+}
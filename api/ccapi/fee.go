@@ -0,0 +1,103 @@
+package ccapi
+
+import (
+	"errors"
+	"math/big"
+
+	"chaoshen.com/gopaillier/api/core"
+)
+
+// feeScale is the denominator of proportional fees, which are given in
+// basis points.
+const feeScale = 10000
+
+// Fee is the fee charged on a transfer, either a public flat fee or a
+// proportional fee the sender encrypts and proves.
+type Fee struct {
+	Flat            *big.Int // public fee per transfer, nil for a proportional fee
+	BasisPoints     int64    // proportional fee in 1/10000 of the amount
+	PubKeyCollector string   // key of the account credited with the fee
+}
+
+// feeInfo carries a proportional fee. The sender rounds the fee up, any fee
+// of at least BasisPoints/10000 of the amount is accepted.
+type feeInfo struct {
+	CipherFeeA         []byte              // fee under A's key
+	CipherFeeCollector []byte              // fee under the collector's key
+	CipherFeeAuditor   []byte              // fee under the auditor key, only with an auditor
+	FeeProof           *gohe.EqualityProof // the fee cipher texts encrypt the same fee
+	FeeRangeProof      *gohe.RangeProof    // 10000*fee - BasisPoints*amount is not negative
+}
+
+// FeeResult is the fee of a validated transfer.
+type FeeResult struct {
+	CipherFeeA         []byte // fee debited from A on top of the amount, under A's key
+	CipherFeeCollector []byte // fee credited to the collector, under its key
+	CipherFeeAuditor   []byte // fee under the auditor key, nil without an auditor
+}
+
+// validateFee checks the fee on an amount debited from A and returns it
+// under every key.
+func validateFee(fi *feeInfo, cipherAmount []byte, pubKeyA string, fee *Fee, auditorPubKey string, context []byte) (*FeeResult, error) {
+	pubKeys := [][]byte{[]byte(pubKeyA), []byte(fee.PubKeyCollector)}
+	if auditorPubKey != "" {
+		pubKeys = append(pubKeys, []byte(auditorPubKey))
+	}
+
+	if fee.Flat != nil {
+		// a public fee is added to zero under every key
+		ciphers := make([][]byte, len(pubKeys))
+		for i, pubKey := range pubKeys {
+			c, err := gohe.Add(pubKey, gohe.ZeroCipher(), fee.Flat.Bytes())
+			if err != nil {
+				return nil, err
+			}
+			ciphers[i] = c
+		}
+		result := &FeeResult{CipherFeeA: ciphers[0], CipherFeeCollector: ciphers[1]}
+		if auditorPubKey != "" {
+			result.CipherFeeAuditor = ciphers[2]
+		}
+		return result, nil
+	}
+
+	ciphers := [][]byte{fi.CipherFeeA, fi.CipherFeeCollector}
+	if auditorPubKey != "" {
+		ciphers = append(ciphers, fi.CipherFeeAuditor)
+	} else if fi.CipherFeeAuditor != nil {
+		return nil, errors.New("No auditor key configured for the auditor cipher.")
+	}
+	err := gohe.VerifyEqual(pubKeys, ciphers, fi.FeeProof, context)
+	if err != nil {
+		return nil, err
+	}
+
+	// 10000*fee - bps*amount must be in range, so the fee is not too small
+	diff, err := feeDifference(pubKeyA, fi.CipherFeeA, cipherAmount, fee.BasisPoints)
+	if err != nil {
+		return nil, err
+	}
+	err = gohe.VerifyRange([]byte(pubKeyA), diff, fi.FeeRangeProof, context)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FeeResult{
+		CipherFeeA:         fi.CipherFeeA,
+		CipherFeeCollector: fi.CipherFeeCollector,
+		CipherFeeAuditor:   fi.CipherFeeAuditor,
+	}, nil
+}
+
+// feeDifference computes an encryption of 10000*fee - bps*amount.
+func feeDifference(pubKeyA string, cipherFee, cipherAmount []byte, basisPoints int64) ([]byte, error) {
+	scaledFee, err := gohe.Mul([]byte(pubKeyA), cipherFee, big.NewInt(feeScale).Bytes())
+	if err != nil {
+		return nil, err
+	}
+	scaledAmount, err := gohe.Mul([]byte(pubKeyA), cipherAmount, big.NewInt(basisPoints).Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return gohe.SubCipher([]byte(pubKeyA), scaledFee, scaledAmount)
+}
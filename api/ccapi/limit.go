@@ -0,0 +1,53 @@
+package ccapi
+
+import (
+	"encoding/json"
+	"errors"
+
+	"chaoshen.com/gopaillier/api/core"
+)
+
+// limitContext prefixes the sender's balance in the context of the limit
+// proof.
+const limitContext = "gopaillier/limit/"
+
+// limitTxInfo is the part of a tx info ValidateSpendingLimit reads. The tx
+// info of a transfer, a hold or a TransferMany carries it when A has a
+// spending limit.
+type limitTxInfo struct {
+	CipherBalanceA []byte
+	CipherSpentA   []byte           // spending of the current window before this debit
+	LimitProof     *gohe.RangeProof // limit - (spent + debit) is not negative
+}
+
+// ValidateSpendingLimit checks that the amount cipherDebit, debited from A
+// by the transfer in txInfoStr, keeps the spending of the current window
+// within the limit, and returns the new spending. All cipher texts are
+// under pubKeyA.
+func ValidateSpendingLimit(txInfoStr, cipherLimit, cipherSpent, pubKeyA string, cipherDebit []byte) ([]byte, error) {
+	var li limitTxInfo
+	err := json.Unmarshal([]byte(txInfoStr), &li)
+	if err != nil {
+		return nil, err
+	}
+	if li.LimitProof == nil {
+		return nil, errors.New("The transfer has no spending limit proof.")
+	}
+	if string(li.CipherSpentA) != cipherSpent {
+		return nil, errors.New("The spending of the window has been changed.")
+	}
+
+	newSpent, err := gohe.AddCipher([]byte(pubKeyA), []byte(cipherSpent), cipherDebit)
+	if err != nil {
+		return nil, err
+	}
+	cipherRemainder, err := gohe.SubCipher([]byte(pubKeyA), []byte(cipherLimit), newSpent)
+	if err != nil {
+		return nil, err
+	}
+	err = gohe.VerifyRange([]byte(pubKeyA), cipherRemainder, li.LimitProof, []byte(limitContext+string(li.CipherBalanceA)))
+	if err != nil {
+		return nil, err
+	}
+	return newSpent, nil
+}
@@ -0,0 +1,136 @@
+package ccapi
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"chaoshen.com/gopaillier/api/core"
+)
+
+// ringContext prefixes the txID, the asset and the balances of the ring in
+// the context of the ring transfer proofs.
+const ringContext = "gopaillier/ring/"
+
+func ringProofContext(txID, assetID string, cipherBalances []string) []byte {
+	return []byte(ringContext + txID + "/" + assetID + "/" + strings.Join(cipherBalances, "/"))
+}
+
+// ringAuthMessage is the message the paying member signs, the context of the
+// proofs and the hash of the tx info without the debit proof.
+func ringAuthMessage(context, digest []byte) []byte {
+	return []byte(string(context) + "/" + hex.EncodeToString(digest))
+}
+
+// ringTxInfo is a transfer between two members of a ring that does not tell
+// which two. Every member gets a debit and a credit update under its key;
+// all of them encrypt zero except the debit of the sender and the credit of
+// the receiver.
+type ringTxInfo struct {
+	CipherBalances  [][]byte            // balances of the members the proofs were made against
+	AssetID         string              // asset transferred, empty for the default asset
+	CipherAmounts   [][]byte            // amount under the key of each member
+	CipherTxAuditor []byte              // amount under the auditor key, only with an auditor
+	Debits          [][]byte            // updates, one of which takes the amount
+	Credits         [][]byte            // updates, one of which adds the amount
+	Proof           *gohe.EqualityProof // CipherAmounts and CipherTxAuditor encrypt the same amount
+	AmountProof     *gohe.RangeProof    // CipherAmounts[0] encrypts a non-negative amount
+	DebitProof      *gohe.RingProof     // a member that signed the rest pays the amount and keeps a non-negative balance
+	CreditProof     *gohe.RingProof     // one credit adds the amount
+}
+
+// RingResult is the outcome of a validated ring transfer.
+type RingResult struct {
+	NewCipherBalances []string // new balance of each member
+	Updates           [][]byte // debit plus credit of each member, under its key
+	CipherTxAuditor   []byte   // amount under the auditor key, nil without an auditor
+}
+
+// ValidateRingTxInfo checks a ring transfer prepared by a member of the ring
+// whose balances and keys are cipherBalances and pubKeys, in ring order: the
+// amount is not negative, one member pays it out of a sufficient balance and
+// one member receives it, while the balances of the others do not change.
+// It does not tell who paid whom. The debit proof also shows that the
+// member who paid signed the tx info for the transaction txID.
+func ValidateRingTxInfo(ringInfoStr, txID string, cipherBalances, pubKeys []string, auditorPubKey, assetID string) (*RingResult, error) {
+	var ri ringTxInfo
+	err := json.Unmarshal([]byte(ringInfoStr), &ri)
+	if err != nil {
+		return nil, err
+	}
+	k := len(pubKeys)
+	if len(cipherBalances) != k || len(ri.CipherBalances) != k || len(ri.CipherAmounts) != k || len(ri.Debits) != k || len(ri.Credits) != k {
+		return nil, errors.New("The ring transfer does not match the ring.")
+	}
+	// check whether a balance of the ring has been changed
+	for i := range cipherBalances {
+		if string(ri.CipherBalances[i]) != cipherBalances[i] {
+			return nil, errors.New("The cipher balance has been changed.")
+		}
+	}
+	if ri.AssetID != assetID {
+		return nil, errors.New("The transfer is for another asset.")
+	}
+	context := ringProofContext(txID, assetID, cipherBalances)
+	// the debit proof carries the signature, so it signs everything else
+	digest, err := infoDigest(ringInfoStr, "DebitProof")
+	if err != nil {
+		return nil, err
+	}
+
+	// the same amount under every key, not negative
+	keys := make([][]byte, k)
+	for i, pubKey := range pubKeys {
+		keys[i] = []byte(pubKey)
+	}
+	equalKeys, equalCiphers := keys, ri.CipherAmounts
+	if auditorPubKey != "" {
+		if ri.CipherTxAuditor == nil {
+			return nil, errors.New("The transfer is missing the auditor's cipher text.")
+		}
+		equalKeys = append(append([][]byte{}, keys...), []byte(auditorPubKey))
+		equalCiphers = append(append([][]byte{}, ri.CipherAmounts...), ri.CipherTxAuditor)
+	}
+	err = gohe.VerifyEqual(equalKeys, equalCiphers, ri.Proof, context)
+	if err != nil {
+		return nil, err
+	}
+	// the equality proof binds a plain text below 2^RangeBits, so the range
+	// of the first cipher holds for all of them
+	err = gohe.VerifyRange(keys[0], ri.CipherAmounts[0], ri.AmountProof, context)
+	if err != nil {
+		return nil, err
+	}
+
+	balances := make([][]byte, k)
+	for i, balance := range cipherBalances {
+		balances[i] = []byte(balance)
+	}
+	err = gohe.VerifyRingDebit(keys, balances, ri.Debits, ri.CipherAmounts, ringAuthMessage(context, digest), ri.DebitProof, context)
+	if err != nil {
+		return nil, err
+	}
+	err = gohe.VerifyRingCredit(keys, ri.Credits, ri.CipherAmounts, ri.CreditProof, context)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &RingResult{}
+	if auditorPubKey != "" {
+		result.CipherTxAuditor = ri.CipherTxAuditor
+	}
+	for i := range keys {
+		update, err := gohe.AddCipher(keys[i], ri.Debits[i], ri.Credits[i])
+		if err != nil {
+			return nil, err
+		}
+		newBalance, err := gohe.AddCipher(keys[i], balances[i], update)
+		if err != nil {
+			return nil, err
+		}
+		result.Updates = append(result.Updates, update)
+		result.NewCipherBalances = append(result.NewCipherBalances, string(newBalance))
+	}
+	return result, nil
+}
@@ -0,0 +1,42 @@
+package ccapi
+
+import (
+	"encoding/json"
+
+	"chaoshen.com/gopaillier/api/core"
+)
+
+// seizeContext prefixes the asset ID, the address and the txID in the
+// context of the Seize re-encryption proof.
+const seizeContext = "gopaillier/seize/"
+
+// seizeInfo re-encrypts a seized balance under the key of the custody
+// account, with a proof that both cipher texts hold the same amount.
+type seizeInfo struct {
+	CipherCustody []byte
+	Proof         *gohe.EqualityProof
+}
+
+// ValidateSeizure checks that the re-encrypted balance under custodyPubKey
+// holds the same amount as the balance of addr for assetID under pubKey, and
+// returns it. The proof is bound to the transaction txID.
+func ValidateSeizure(seizeInfoStr, addr, assetID, txID, cipherBalance, pubKey, custodyPubKey string) (cipherCustody []byte, err error) {
+	var si seizeInfo
+	err = json.Unmarshal([]byte(seizeInfoStr), &si)
+	if err != nil {
+		return nil, err
+	}
+
+	err = gohe.ValidateCipher([]byte(custodyPubKey), si.CipherCustody)
+	if err != nil {
+		return nil, err
+	}
+	err = gohe.VerifyEqual(
+		[][]byte{[]byte(pubKey), []byte(custodyPubKey)},
+		[][]byte{[]byte(cipherBalance), si.CipherCustody},
+		si.Proof, []byte(seizeContext+assetID+"/"+addr+"/"+txID))
+	if err != nil {
+		return nil, err
+	}
+	return si.CipherCustody, nil
+}
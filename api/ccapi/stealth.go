@@ -0,0 +1,126 @@
+package ccapi
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+
+	"chaoshen.com/gopaillier/api/core"
+)
+
+// stealthInfo announces a stealth account. Only the receiver can tell from
+// the ephemeral key that the account is for them, and only the receiver can
+// sign with the claim key.
+type stealthInfo struct {
+	PubKey    []byte // one-time Paillier key of the account
+	Ephemeral []byte // PEM ECDH key of the sender
+	ClaimKey  []byte // PEM ECDSA key that authorizes ClaimStealth
+}
+
+// ValidateStealthInfo checks the keys of a stealth account prepared by
+// cliapi.PrepareStealth.
+func ValidateStealthInfo(stealthInfoStr string) (pubKey string, ephemeral, claimKey []byte, err error) {
+	var si stealthInfo
+	err = json.Unmarshal([]byte(stealthInfoStr), &si)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	_, err = gohe.ParsePublicKey(si.PubKey)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	_, err = parseECPublicKey(si.Ephemeral)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	_, err = parseECPublicKey(si.ClaimKey)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return string(si.PubKey), si.Ephemeral, si.ClaimKey, nil
+}
+
+// claimInfo moves a stealth account to a key of the receiver. Every balance
+// is re-encrypted under the new key with a proof that both cipher texts hold
+// the same amount.
+type claimInfo struct {
+	NewPubKey []byte
+	Balances  map[string]*reencryption // by asset ID, "" for the default asset
+	Sig       []byte                   // ASN.1 ECDSA signature of the claim key
+}
+
+type reencryption struct {
+	CipherBalance []byte
+	Proof         *gohe.EqualityProof
+}
+
+// claimContext prefixes the address and the txID in the context of the
+// claim proofs and signature.
+const claimContext = "gopaillier/claim/"
+
+// ValidateClaim checks that the holder of claimKey moves the stealth account
+// addr to a new key in the transaction txID, and that each of its balances,
+// keyed by asset ID, is re-encrypted under the new key without a change.
+func ValidateClaim(claimInfoStr, addr, txID, oldPubKey string, claimKey []byte, balances map[string][]byte) (newPubKey string, newBalances map[string][]byte, err error) {
+	var ci claimInfo
+	err = json.Unmarshal([]byte(claimInfoStr), &ci)
+	if err != nil {
+		return "", nil, err
+	}
+
+	key, err := parseECPublicKey(claimKey)
+	if err != nil {
+		return "", nil, err
+	}
+	keyHash := sha256.Sum256(ci.NewPubKey)
+	digest := sha256.Sum256([]byte(claimContext + addr + "/" + txID + "/" + hex.EncodeToString(keyHash[:])))
+	if !ecdsa.VerifyASN1(key, digest[:], ci.Sig) {
+		return "", nil, errors.New("Invalid claim signature.")
+	}
+
+	_, err = gohe.ParsePublicKey(ci.NewPubKey)
+	if err != nil {
+		return "", nil, err
+	}
+	newBalances = map[string][]byte{}
+	for assetID, balance := range balances {
+		re, ok := ci.Balances[assetID]
+		if !ok || re == nil {
+			return "", nil, errors.New("no re-encrypted balance for asset: " + assetID)
+		}
+		err = gohe.ValidateCipher(ci.NewPubKey, re.CipherBalance)
+		if err != nil {
+			return "", nil, err
+		}
+		err = gohe.VerifyEqual(
+			[][]byte{[]byte(oldPubKey), ci.NewPubKey},
+			[][]byte{balance, re.CipherBalance},
+			re.Proof, []byte(claimContext+addr+"/"+txID+"/"+assetID))
+		if err != nil {
+			return "", nil, errors.New("balance changed for asset: " + assetID)
+		}
+		newBalances[assetID] = re.CipherBalance
+	}
+	return string(ci.NewPubKey), newBalances, nil
+}
+
+func parseECPublicKey(pubKey []byte) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode(pubKey)
+	if block == nil {
+		return nil, errors.New("The key is not PEM encoded.")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("The key is not an ECDSA key.")
+	}
+	return ecKey, nil
+}
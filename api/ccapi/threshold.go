@@ -0,0 +1,43 @@
+package ccapi
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+
+	"chaoshen.com/gopaillier/api/core"
+)
+
+// atLeastContext prefixes the threshold and the balance in the context of
+// the threshold proof.
+const atLeastContext = "gopaillier/at-least/"
+
+// VerifyBalanceAtLeast checks a proof made by cliapi.ProveBalanceAtLeast
+// that cipherBalance, under pubKey, holds at least threshold. It returns
+// the threshold in canonical decimal form.
+func VerifyBalanceAtLeast(proofStr, cipherBalance, pubKey, threshold string) (string, error) {
+	var proof gohe.RangeProof
+	err := json.Unmarshal([]byte(proofStr), &proof)
+	if err != nil {
+		return "", err
+	}
+	key, err := gohe.ParsePublicKey([]byte(pubKey))
+	if err != nil {
+		return "", err
+	}
+	x, ok := new(big.Int).SetString(threshold, 10)
+	// a threshold past the range would let balance - threshold wrap mod n
+	if !ok || x.Sign() < 0 || x.BitLen() > gohe.RangeBits {
+		return "", errors.New("The threshold must be a non-negative integer below 2^RangeBits.")
+	}
+
+	cipherExcess, err := gohe.Add([]byte(pubKey), []byte(cipherBalance), new(big.Int).Sub(key.N, x).Bytes())
+	if err != nil {
+		return "", err
+	}
+	err = gohe.VerifyRange([]byte(pubKey), cipherExcess, &proof, []byte(atLeastContext+x.String()+"/"+cipherBalance))
+	if err != nil {
+		return "", err
+	}
+	return x.String(), nil
+}
@@ -0,0 +1,189 @@
+package cliapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+
+	"chaoshen.com/gopaillier/api/core"
+)
+
+const approveContext = "gopaillier/approve/"
+
+func approveProofContext(assetID, cipherSpendable string) []byte {
+	return []byte(approveContext + assetID + "/" + cipherSpendable)
+}
+
+const spendContext = "gopaillier/transfer-from/"
+
+func spendProofContext(assetID, cipherAllowance string) []byte {
+	return []byte(spendContext + assetID + "/" + cipherAllowance)
+}
+
+// allowanceInfo and approveInfo must match the Approve and TransferFrom
+// arguments expected by ccapi.ValidateApprove and ccapi.ValidateTransferFrom.
+type allowanceInfo struct {
+	txInfo
+	Opening *gohe.Memo
+}
+
+type approveInfo struct {
+	allowanceInfo
+	CipherAllowance []byte
+}
+
+// allowance is the part of the chaincode's allowance record the spender
+// needs, as returned by the Allowance query.
+type allowance struct {
+	Asset         string
+	PubKeyOwner   []byte
+	PubKeySpender []byte
+	CipherOwner   []byte
+	Opening       *gohe.Memo
+}
+
+// PrepareApprove lets the owner grant the spender an amount. The amount
+// stays in the owner's balance but is no longer spendable by the owner;
+// cipherSpendable is the spendable balance from QuerySpendable and
+// cipherAllowance CipherOwner of the current allowance, the encryption of
+// zero without one. The owner seals the opening of the new allowance to the
+// spender. assetID is empty for the default asset and fee nil for other
+// assets, as for PrepareTxInfo.
+func PrepareApprove(cipherSpendable, cipherAllowance, amount, pubKeyOwner, pubKeySpender, privKeyOwner, auditorPubKey, assetID string, fee *Fee) ([]byte, error) {
+	txBytes, err := prepareTxInfo(cipherSpendable, amount, pubKeyOwner, pubKeySpender, privKeyOwner, auditorPubKey, assetID, fee, approveProofContext(assetID, cipherSpendable))
+	if err != nil {
+		return nil, err
+	}
+	ai := &approveInfo{CipherAllowance: []byte(cipherAllowance)}
+	err = json.Unmarshal(txBytes, &ai.txInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	newAllowance, err := gohe.AddCipher([]byte(pubKeyOwner), []byte(cipherAllowance), ai.CipherTxA)
+	if err != nil {
+		return nil, err
+	}
+	plainBytes, err := gohe.Decrypt([]byte(privKeyOwner), newAllowance)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := gohe.RecoverNonce([]byte(privKeyOwner), newAllowance)
+	if err != nil {
+		return nil, err
+	}
+	ai.Opening, err = sealOpening(pubKeySpender, newAllowance, new(big.Int).SetBytes(plainBytes), new(big.Int).SetBytes(nonce))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(ai)
+}
+
+// PrepareTransferFrom lets the spender pay an amount to B from an
+// allowance. allowanceRecord is the Allowance query result; its opening
+// gives the spender the nonce of the owner's copy, so the spender proves the
+// remaining allowance under the owner's key is not negative without the
+// owner's private key.
+func PrepareTransferFrom(allowanceRecord []byte, amount, pubKeyB, privKeySpender, auditorPubKey string) ([]byte, error) {
+	var a allowance
+	err := json.Unmarshal(allowanceRecord, &a)
+	if err != nil {
+		return nil, err
+	}
+	allowed, nonce, err := openOpening(privKeySpender, a.CipherOwner, a.Opening)
+	if err != nil {
+		return nil, err
+	}
+	amt, ok := new(big.Int).SetString(amount, 10)
+	if !ok || amt.Sign() < 0 {
+		return nil, errors.New("The transfer amount must be a non-negative integer.")
+	}
+	remainder := new(big.Int).Sub(allowed, amt)
+	if remainder.Sign() < 0 {
+		return nil, errors.New("The transfer exceeds the allowance.")
+	}
+
+	context := spendProofContext(a.Asset, string(a.CipherOwner))
+	tx, nonceTx, err := prepareLeg(amt, string(a.PubKeyOwner), pubKeyB, auditorPubKey, context)
+	if err != nil {
+		return nil, err
+	}
+	tx.CipherBalanceA = a.CipherOwner
+	tx.AssetID = a.Asset
+
+	// the remaining allowance is the quotient of the cipher texts, so its
+	// nonce is the quotient of their nonces
+	cipherRemainder, err := gohe.SubCipher(a.PubKeyOwner, a.CipherOwner, tx.CipherTxA)
+	if err != nil {
+		return nil, err
+	}
+	pubKeyOwner, err := gohe.ParsePublicKey(a.PubKeyOwner)
+	if err != nil {
+		return nil, err
+	}
+	inv := new(big.Int).ModInverse(new(big.Int).SetBytes(nonceTx), pubKeyOwner.N)
+	if inv == nil {
+		return nil, errors.New("The nonce is not invertible.")
+	}
+	nonceRemainder := inv.Mul(inv, nonce).Mod(inv, pubKeyOwner.N)
+	tx.BalanceProof, err = gohe.ProveRange(a.PubKeyOwner, cipherRemainder, remainder.Bytes(), nonceRemainder.Bytes(), context)
+	if err != nil {
+		return nil, err
+	}
+
+	si := &allowanceInfo{txInfo: *tx}
+	si.Opening, err = sealOpening(string(a.PubKeySpender), cipherRemainder, remainder, nonceRemainder)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(si)
+}
+
+// The plain text of an opening is the allowance as an 8 byte big-endian
+// integer followed by the nonce of the owner's copy. It is sealed with that
+// copy as context, so an opening never applies to another allowance.
+func sealOpening(pubKeySpender string, cipherAllowance []byte, allowed, nonce *big.Int) (*gohe.Memo, error) {
+	if allowed.BitLen() > 64 {
+		return nil, errors.New("The allowance is too large.")
+	}
+	text := append(allowed.FillBytes(make([]byte, 8)), nonce.Bytes()...)
+	return gohe.SealMemo([]byte(pubKeySpender), text, cipherAllowance)
+}
+
+func openOpening(privKeySpender string, cipherAllowance []byte, opening *gohe.Memo) (allowed, nonce *big.Int, err error) {
+	text, err := gohe.OpenMemo([]byte(privKeySpender), opening, cipherAllowance)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(text) <= 8 {
+		return nil, nil, errors.New("Malformed allowance opening.")
+	}
+	return new(big.Int).SetBytes(text[:8]), new(big.Int).SetBytes(text[8:]), nil
+}
+
+// allowanceMessage must match the messages the chaincode verifies. info is
+// the tx info of the call, so a signature approves exactly that amount.
+func allowanceMessage(action, owner, spender, to, txID string, info []byte) []byte {
+	infoHash := sha256.Sum256(info)
+	return []byte("gopaillier/" + action + "/" + owner + "/" + spender + "/" + to + "/" + txID + "/" + hex.EncodeToString(infoHash[:]))
+}
+
+// SignApprove authorizes Approve with the owner's key. info is the tx info
+// from PrepareApprove and txID the ID of the transaction,
+// which the client creates before it sends the proposal.
+func SignApprove(owner, spender, txID string, info []byte, privKeyOwner string) ([]byte, error) {
+	return gohe.Sign([]byte(privKeyOwner), allowanceMessage("approve", owner, spender, "", txID, info))
+}
+
+// SignTransferFrom authorizes TransferFrom to B with the spender's key. info
+// is the spend info from PrepareTransferFrom.
+func SignTransferFrom(owner, spender, addrB, txID string, info []byte, privKeySpender string) ([]byte, error) {
+	return gohe.Sign([]byte(privKeySpender), allowanceMessage("transfer-from", owner, spender, addrB, txID, info))
+}
+
+// SignRevokeAllowance authorizes RevokeAllowance with the owner's key.
+func SignRevokeAllowance(owner, spender, txID, privKeyOwner string) ([]byte, error) {
+	return gohe.Sign([]byte(privKeyOwner), allowanceMessage("revoke-allowance", owner, spender, "", txID, nil))
+}
@@ -0,0 +1,50 @@
+package cliapi
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+
+	"chaoshen.com/gopaillier/api/core"
+)
+
+// burnContext must match the context ccapi.ValidateBurn verifies.
+const burnContext = "gopaillier/burn/"
+
+// PrepareBurn is run by the owner of addr to consent to the issuer burning
+// amount of an asset, the default asset when assetID is empty. It proves
+// that the balance left after the burn is not negative; the issuer passes the
+// proof to Burn or BurnAsset. The proof is bound to cipherBalance, so it
+// cannot be used once the balance has changed.
+func PrepareBurn(addr, assetID, cipherBalance, amount, privKey string) ([]byte, error) {
+	amt, ok := new(big.Int).SetString(amount, 10)
+	if !ok || amt.Sign() < 0 {
+		return nil, errors.New("The amount must be a non-negative integer.")
+	}
+
+	key, err := gohe.ParsePrivateKey([]byte(privKey))
+	if err != nil {
+		return nil, err
+	}
+	pubKey := string(gohe.GenPemPublicKey(&key.PublicKey))
+
+	balanceBytes, err := gohe.Decrypt([]byte(privKey), []byte(cipherBalance))
+	if err != nil {
+		return nil, err
+	}
+	remainder := new(big.Int).Sub(new(big.Int).SetBytes(balanceBytes), amt)
+	if remainder.Sign() < 0 {
+		return nil, errors.New("The balance is less than the amount.")
+	}
+
+	// the chaincode debits the trivial encryption of the public amount
+	cipherDebit, err := gohe.Add([]byte(pubKey), gohe.ZeroCipher(), amt.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	proof, err := proveRemainder(cipherBalance, cipherDebit, remainder, pubKey, privKey, []byte(burnContext+assetID+"/"+addr))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(proof)
+}
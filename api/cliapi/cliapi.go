@@ -2,54 +2,137 @@ package cliapi
 
 import (
 	"chaoshen.com/gopaillier/api/core"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"math/big"
+	"sort"
 	"strconv"
+	"strings"
 	//"fmt"
 )
 
 type txInfo struct {
-	CipherBalanceA []byte
-	CipherTxA      []byte
-	CipherTXB      []byte
-	PubKeyA        []byte
-	PubKeyB        []byte
+	CipherBalanceA  []byte
+	CipherTxA       []byte
+	CipherTXB       []byte
+	CipherTxAuditor []byte
+	PubKeyA         []byte
+	PubKeyB         []byte
+	AssetID         string
+	Proof           *gohe.EqualityProof
+	AmountProof     *gohe.RangeProof
+	BalanceProof    *gohe.RangeProof
+	Memo            *gohe.Memo `json:",omitempty"`
+	Sig             []byte     `json:",omitempty"`
+	feeInfo
+}
+
+const txContext = "gopaillier/transfer/"
+
+func txProofContext(assetID, cipherBalanceA string) []byte {
+	return []byte(txContext + assetID + "/" + cipherBalanceA)
 }
 
-func PrepareTxInfo(cipherBalanceA, transNumStr, pubKeyA, pubKeyB, privKeyA string) (txinfo []byte, err error) {
+// PrepareTxInfo encrypts the transfer amount under the keys of A and B, and
+// under auditorPubKey unless it is empty, with a proof that all cipher texts
+// encrypt the same amount and range proofs that neither the amount nor the
+// remaining balance of A is negative. assetID is empty for the default
+// asset. fee is the chaincode's fee schedule, nil if it has none or for
+// other assets, which pay no fees.
+func PrepareTxInfo(cipherBalanceA, transNumStr, pubKeyA, pubKeyB, privKeyA, auditorPubKey, assetID string, fee *Fee) ([]byte, error) {
+	return prepareTxInfo(cipherBalanceA, transNumStr, pubKeyA, pubKeyB, privKeyA, auditorPubKey, assetID, fee, txProofContext(assetID, cipherBalanceA))
+}
+
+// Hold kinds, as expected by ccapi.ValidateHoldInfo: HoldLock for Lock and
+// HoldPending for a two-phase transfer.
+const (
+	HoldLock    = "lock"
+	HoldPending = "pending"
+)
+
+const holdContext = "gopaillier/hold/"
 
-	// Check if the balance is enough
+func holdProofContext(kind, assetID, cipherBalanceA string) []byte {
+	return []byte(holdContext + kind + "/" + assetID + "/" + cipherBalanceA)
+}
+
+// PrepareHold is PrepareTxInfo for a hold of the given kind. The amount is
+// debited from A when the hold is created and later credited to B or
+// returned to A; a fee is not returned.
+func PrepareHold(kind, cipherBalanceA, transNumStr, pubKeyA, pubKeyB, privKeyA, auditorPubKey, assetID string, fee *Fee) ([]byte, error) {
+	if kind != HoldLock && kind != HoldPending {
+		return nil, errors.New("Unknown hold kind.")
+	}
+	return prepareTxInfo(cipherBalanceA, transNumStr, pubKeyA, pubKeyB, privKeyA, auditorPubKey, assetID, fee, holdProofContext(kind, assetID, cipherBalanceA))
+}
+
+func prepareTxInfo(cipherBalanceA, transNumStr, pubKeyA, pubKeyB, privKeyA, auditorPubKey, assetID string, fee *Fee, context []byte) (txinfo []byte, err error) {
+
+	// Open the balance
 	balanceA, err := gohe.Decrypt([]byte(privKeyA), []byte(cipherBalanceA))
-	amtA := new(big.Int).SetBytes(balanceA)
+	if err != nil {
+		return nil, err
+	}
+	nonceA, err := gohe.RecoverNonce([]byte(privKeyA), []byte(cipherBalanceA))
+	if err != nil {
+		return nil, err
+	}
+	return prepareOpenedTxInfo(cipherBalanceA, new(big.Int).SetBytes(balanceA), new(big.Int).SetBytes(nonceA), transNumStr, pubKeyA, pubKeyB, auditorPubKey, assetID, fee, context)
+}
+
+// prepareOpenedTxInfo is prepareTxInfo for a balance whose plain text and
+// nonce the caller knows. The nonces of the cipher texts the chaincode
+// derives follow from those of the balance and the new cipher texts, so no
+// private key is needed.
+func prepareOpenedTxInfo(cipherBalanceA string, amtA, nonceA *big.Int, transNumStr, pubKeyA, pubKeyB, auditorPubKey, assetID string, fee *Fee, context []byte) (txinfo []byte, err error) {
 	// Parse transfer amount from string
 	transNum ,err  := strconv.Atoi(transNumStr)
 	if err != nil {
 		return nil,err
 	}
+	if transNum < 0 {
+		return nil, errors.New("The transfer amount must not be negative.")
+	}
 	transBigInt := new(big.Int).SetInt64(int64(transNum))
 	//fmt.Println(amtA,transBigInt)
 	result := new(big.Int).Sub(amtA, transBigInt)
 	if result.Sign() < 0 {
 		return nil, errors.New("Insufficient balance for transfer.")
 	}
-	// Encrypt the transfer amt
 
-	CipherTxA, err := gohe.Encrypt([]byte(pubKeyA), transBigInt.Bytes())
+	tx, nonceTx, err := prepareLeg(transBigInt, pubKeyA, pubKeyB, auditorPubKey, context)
 	if err != nil {
 		return nil, err
 	}
-	CipherTxB, err := gohe.Encrypt([]byte(pubKeyB), transBigInt.Bytes())
+	tx.CipherBalanceA = []byte(cipherBalanceA)
+	tx.AssetID = assetID
+
+	feeAmount, cipherDebit, nonceDebit, err := prepareFee(&tx.feeInfo, tx.CipherTxA, nonceTx, transBigInt, fee, pubKeyA, auditorPubKey, context)
 	if err != nil {
 		return nil, err
 	}
+	result.Sub(result, feeAmount)
+	if result.Sign() < 0 {
+		return nil, errors.New("Insufficient balance for transfer and fee.")
+	}
 
-	tx := &txInfo{
-		CipherBalanceA: []byte(cipherBalanceA),
-		CipherTxA:      CipherTxA,
-		CipherTXB:      CipherTxB,
-		PubKeyA:        []byte(pubKeyA),
-		PubKeyB:        []byte(pubKeyB),
+	cipherRemainder, err := gohe.SubCipher([]byte(pubKeyA), []byte(cipherBalanceA), cipherDebit)
+	if err != nil {
+		return nil, err
+	}
+	nonceRemainder, err := divNonce(pubKeyA, nonceA, nonceDebit)
+	if err != nil {
+		return nil, err
+	}
+	tx.BalanceProof, err = gohe.ProveRange([]byte(pubKeyA), cipherRemainder, result.Bytes(), nonceRemainder.Bytes(), context)
+	if err != nil {
+		return nil, err
 	}
 
 	txByte, err := json.Marshal(tx)
@@ -59,17 +142,640 @@ func PrepareTxInfo(cipherBalanceA, transNumStr, pubKeyA, pubKeyB, privKeyA strin
 	return txByte, nil
 }
 
+// multiTxInfo must match the TransferMany argument expected by ccapi.ValidateMultiTxInfo.
+type multiTxInfo struct {
+	CipherBalanceA []byte
+	PubKeyA        []byte
+	Legs           []*txInfo
+	BalanceProof   *gohe.RangeProof
+	Sig            []byte
+	feeInfo
+}
+
+// PrepareTransferMany pays amounts[i] to the owner of pubKeysB[i] from the
+// balance of A in one transaction. The recipient addresses are passed to
+// TransferMany in the same order. The fee, if any, is paid once on the sum.
+func PrepareTransferMany(cipherBalanceA string, amounts, pubKeysB []string, pubKeyA, privKeyA, auditorPubKey string, fee *Fee) ([]byte, error) {
+	if len(amounts) == 0 || len(amounts) != len(pubKeysB) {
+		return nil, errors.New("Need one amount per recipient.")
+	}
 
-func InitBalance (amount,pubKey string) (balanceInfo []byte ,err error) {
-	amt,err:=strconv.Atoi(amount)
+	balanceA, err := gohe.Decrypt([]byte(privKeyA), []byte(cipherBalanceA))
 	if err != nil {
-		return nil ,err
+		return nil, err
+	}
+	remainder := new(big.Int).SetBytes(balanceA)
+	sum := new(big.Int)
+
+	context := txProofContext("", cipherBalanceA)
+	mi := &multiTxInfo{CipherBalanceA: []byte(cipherBalanceA), PubKeyA: []byte(pubKeyA)}
+	total, nonceTotal := gohe.ZeroCipher(), big.NewInt(1)
+	for i, amountStr := range amounts {
+		amount, ok := new(big.Int).SetString(amountStr, 10)
+		if !ok || amount.Sign() < 0 {
+			return nil, errors.New("The transfer amount must be a non-negative integer.")
+		}
+		remainder.Sub(remainder, amount)
+		sum.Add(sum, amount)
+
+		leg, nonceLeg, err := prepareLeg(amount, pubKeyA, pubKeysB[i], auditorPubKey, context)
+		if err != nil {
+			return nil, err
+		}
+		total, err = gohe.AddCipher([]byte(pubKeyA), total, leg.CipherTxA)
+		if err != nil {
+			return nil, err
+		}
+		nonceTotal, err = mulNonce(pubKeyA, nonceTotal, new(big.Int).SetBytes(nonceLeg))
+		if err != nil {
+			return nil, err
+		}
+		mi.Legs = append(mi.Legs, leg)
 	}
 
-	amtInt:=new(big.Int).SetInt64(int64(amt))
-	balanceInfo, err = gohe.Encrypt([]byte(pubKey), amtInt.Bytes())
+	feeAmount, cipherDebit, _, err := prepareFee(&mi.feeInfo, total, nonceTotal.Bytes(), sum, fee, pubKeyA, auditorPubKey, context)
 	if err != nil {
-		return nil,err
+		return nil, err
+	}
+	remainder.Sub(remainder, feeAmount)
+	if remainder.Sign() < 0 {
+		return nil, errors.New("Insufficient balance for transfer and fee.")
+	}
+
+	mi.BalanceProof, err = proveRemainder(cipherBalanceA, cipherDebit, remainder, pubKeyA, privKeyA, context)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(mi)
+}
+
+// prepareLeg encrypts one transfer amount and proves it is the same under
+// all keys and not negative. It also returns the nonce of CipherTxA.
+func prepareLeg(amount *big.Int, pubKeyA, pubKeyB, auditorPubKey string, context []byte) (*txInfo, []byte, error) {
+	// Encrypt the transfer amt under every key
+	pubKeys := [][]byte{[]byte(pubKeyA), []byte(pubKeyB)}
+	if auditorPubKey != "" {
+		pubKeys = append(pubKeys, []byte(auditorPubKey))
+	}
+	ciphers := make([][]byte, len(pubKeys))
+	nonces := make([][]byte, len(pubKeys))
+	var err error
+	for i, pubKey := range pubKeys {
+		ciphers[i], nonces[i], err = gohe.EncryptWithNonce(pubKey, amount.Bytes())
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	tx := &txInfo{
+		CipherTxA: ciphers[0],
+		CipherTXB: ciphers[1],
+		PubKeyA:   []byte(pubKeyA),
+		PubKeyB:   []byte(pubKeyB),
+	}
+	if auditorPubKey != "" {
+		tx.CipherTxAuditor = ciphers[2]
+	}
+	tx.Proof, err = gohe.ProveEqual(pubKeys, ciphers, amount.Bytes(), nonces, context)
+	if err != nil {
+		return nil, nil, err
+	}
+	tx.AmountProof, err = gohe.ProveRange(pubKeys[0], ciphers[0], amount.Bytes(), nonces[0], context)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tx, nonces[0], nil
+}
+
+// Fee is the fee schedule of the chaincode, as returned by QueryFeeSchedule,
+// with the key of the collector account resolved by the client.
+type Fee struct {
+	Flat            string // public fee per transfer, empty for a proportional fee
+	BasisPoints     int64  // proportional fee in 1/10000 of the amount
+	PubKeyCollector string
+}
+
+// feeInfo must match the proportional fee expected by ccapi.
+type feeInfo struct {
+	CipherFeeA         []byte
+	CipherFeeCollector []byte
+	CipherFeeAuditor   []byte
+	FeeProof           *gohe.EqualityProof
+	FeeRangeProof      *gohe.RangeProof
+}
+
+const feeScale = 10000
+
+// prepareFee computes the fee on an amount and, for a proportional fee,
+// fills in its cipher texts and proofs. nonceAmount is the nonce of
+// cipherAmount. It returns the fee and the cipher text the chaincode debits
+// from A, the amount plus the fee, with its nonce.
+func prepareFee(fi *feeInfo, cipherAmount, nonceAmount []byte, amount *big.Int, fee *Fee, pubKeyA, auditorPubKey string, context []byte) (*big.Int, []byte, *big.Int, error) {
+	if fee == nil {
+		return new(big.Int), cipherAmount, new(big.Int).SetBytes(nonceAmount), nil
+	}
+
+	if fee.Flat != "" {
+		flat, ok := new(big.Int).SetString(fee.Flat, 10)
+		if !ok || flat.Sign() < 0 {
+			return nil, nil, nil, errors.New("invalid flat fee")
+		}
+		cipherDebit, err := gohe.Add([]byte(pubKeyA), cipherAmount, flat.Bytes())
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		// adding a plain amount keeps the nonce
+		return flat, cipherDebit, new(big.Int).SetBytes(nonceAmount), nil
+	}
+
+	// round the fee up, so it is at least the proportional share
+	feeAmount := new(big.Int).Mul(amount, big.NewInt(fee.BasisPoints))
+	feeAmount.Add(feeAmount, big.NewInt(feeScale-1))
+	feeAmount.Div(feeAmount, big.NewInt(feeScale))
+
+	pubKeys := [][]byte{[]byte(pubKeyA), []byte(fee.PubKeyCollector)}
+	if auditorPubKey != "" {
+		pubKeys = append(pubKeys, []byte(auditorPubKey))
+	}
+	ciphers := make([][]byte, len(pubKeys))
+	nonces := make([][]byte, len(pubKeys))
+	var err error
+	for i, pubKey := range pubKeys {
+		ciphers[i], nonces[i], err = gohe.EncryptWithNonce(pubKey, feeAmount.Bytes())
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	fi.CipherFeeA = ciphers[0]
+	fi.CipherFeeCollector = ciphers[1]
+	if auditorPubKey != "" {
+		fi.CipherFeeAuditor = ciphers[2]
+	}
+
+	fi.FeeProof, err = gohe.ProveEqual(pubKeys, ciphers, feeAmount.Bytes(), nonces, context)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// prove 10000*fee - bps*amount is not negative, on the cipher text the
+	// chaincode derives from the fee and the amount
+	scaledFee, err := gohe.Mul([]byte(pubKeyA), fi.CipherFeeA, big.NewInt(feeScale).Bytes())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	scaledAmount, err := gohe.Mul([]byte(pubKeyA), cipherAmount, big.NewInt(fee.BasisPoints).Bytes())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	cipherDiff, err := gohe.SubCipher([]byte(pubKeyA), scaledFee, scaledAmount)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	keyA, err := gohe.ParsePublicKey([]byte(pubKeyA))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	nonceFee := new(big.Int).SetBytes(nonces[0])
+	nonce, err := divNonce(pubKeyA,
+		new(big.Int).Exp(nonceFee, big.NewInt(feeScale), keyA.N),
+		new(big.Int).Exp(new(big.Int).SetBytes(nonceAmount), big.NewInt(fee.BasisPoints), keyA.N))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	diff := new(big.Int).Mul(feeAmount, big.NewInt(feeScale))
+	diff.Sub(diff, new(big.Int).Mul(amount, big.NewInt(fee.BasisPoints)))
+	fi.FeeRangeProof, err = gohe.ProveRange([]byte(pubKeyA), cipherDiff, diff.Bytes(), nonce.Bytes(), context)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	cipherDebit, err := gohe.AddCipher([]byte(pubKeyA), cipherAmount, fi.CipherFeeA)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	nonceDebit, err := mulNonce(pubKeyA, new(big.Int).SetBytes(nonceAmount), nonceFee)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return feeAmount, cipherDebit, nonceDebit, nil
+}
+
+// mulNonce and divNonce give the nonce of the sum and of the difference of
+// two cipher texts under pubKey from their nonces.
+func mulNonce(pubKey string, nonce1, nonce2 *big.Int) (*big.Int, error) {
+	key, err := gohe.ParsePublicKey([]byte(pubKey))
+	if err != nil {
+		return nil, err
+	}
+	nonce := new(big.Int).Mul(nonce1, nonce2)
+	return nonce.Mod(nonce, key.N), nil
+}
+
+func divNonce(pubKey string, nonce1, nonce2 *big.Int) (*big.Int, error) {
+	key, err := gohe.ParsePublicKey([]byte(pubKey))
+	if err != nil {
+		return nil, err
+	}
+	inv := new(big.Int).ModInverse(nonce2, key.N)
+	if inv == nil {
+		return nil, errors.New("The nonce is not invertible.")
+	}
+	inv.Mul(inv, nonce1)
+	return inv.Mod(inv, key.N), nil
+}
+
+// proveRemainder proves that the balance left after debiting cipherDebit,
+// which the chaincode computes homomorphically, is not negative. The nonce
+// of that cipher text is recovered with the private key.
+func proveRemainder(cipherBalanceA string, cipherDebit []byte, remainder *big.Int, pubKeyA, privKeyA string, context []byte) (*gohe.RangeProof, error) {
+	cipherRemainder, err := gohe.SubCipher([]byte(pubKeyA), []byte(cipherBalanceA), cipherDebit)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := gohe.RecoverNonce([]byte(privKeyA), cipherRemainder)
+	if err != nil {
+		return nil, err
+	}
+	return gohe.ProveRange([]byte(pubKeyA), cipherRemainder, remainder.Bytes(), nonce, context)
+}
+
+
+// initInfo must match the opening record expected by ccapi.ValidateInitBalance.
+type initInfo struct {
+	CipherBalance []byte
+	Amount        string
+	IssuerSig     []byte
+	Proof         *gohe.ZeroProof
+}
+
+const initContext = "gopaillier/init-balance/"
+
+// InitBalance prepares the opening balance of the account of pubKey. A zero
+// amount needs no signature, any other amount must be approved by the issuer
+// with SignInitBalance.
+func InitBalance(amount, pubKey string, issuerSig []byte) (balanceInfo []byte, err error) {
+	amt, ok := new(big.Int).SetString(amount, 10)
+	if !ok || amt.Sign() < 0 {
+		return nil, errors.New("The initial amount must be a non-negative integer.")
+	}
+
+	cipher, nonce, err := gohe.EncryptWithNonce([]byte(pubKey), amt.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	proof, err := gohe.ProvePlaintext([]byte(pubKey), cipher, amt.Bytes(), nonce, []byte(initContext+calcAddr(pubKey)))
+	if err != nil {
+		return nil, err
+	}
+
+	ii := &initInfo{
+		CipherBalance: cipher,
+		Amount:        amt.String(),
+		IssuerSig:     issuerSig,
+		Proof:         proof,
+	}
+	return json.Marshal(ii)
+}
+
+// SignInitBalance is run by the issuer to approve an opening amount for addr.
+func SignInitBalance(amount, addr, issuerPrivKey string) (issuerSig []byte, err error) {
+	amt, ok := new(big.Int).SetString(amount, 10)
+	if !ok || amt.Sign() < 0 {
+		return nil, errors.New("The initial amount must be a non-negative integer.")
+	}
+
+	key, err := parseECPrivateKey(issuerPrivKey)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(initContext + addr + "/" + amt.String()))
+	return ecdsa.SignASN1(rand.Reader, key, digest[:])
+}
+
+// EncryptAmount encrypts a decimal amount under pubKey.
+func EncryptAmount(amount, pubKey string) (cipher []byte, err error) {
+	amt, err := strconv.Atoi(amount)
+	if err != nil {
+		return nil, err
+	}
+
+	amtInt := new(big.Int).SetInt64(int64(amt))
+	return gohe.Encrypt([]byte(pubKey), amtInt.Bytes())
+}
+
+func parseECPrivateKey(privKey string) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(privKey))
+	if block == nil {
+		return nil, errors.New("The private key is not PEM encoded.")
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("The private key is not an ECDSA key.")
+	}
+	return ecKey, nil
+}
+
+// calcAddr derives the account address from a PEM public key, like the chaincode.
+func calcAddr(pubKey string) string {
+	hashRes := sha256.Sum256([]byte(pubKey))
+	return hex.EncodeToString(hashRes[:])
+}
+
+// receipt must match the history receipts stored by the transfer chaincode.
+type receipt struct {
+	TxID         string
+	Type         string
+	Asset        string
+	Counterparty string
+	Delta        []byte
+	Memo         *gohe.Memo
+	MemoCipher   []byte
+	Balances     map[string][]byte
+	Timestamp    int64
+}
+
+// HistoryEntry is a decrypted receipt. Amount is negative for debits.
+type HistoryEntry struct {
+	TxID         string
+	Type         string
+	Asset        string // empty for the default asset
+	Counterparty string
+	Amount       *big.Int
+	Memo         string // memo of the sender, empty without one
+	Timestamp    int64
+}
+
+// DecryptHistory decrypts a page returned by QueryHistory. Summing the
+// amounts of all pages per asset gives the balances of the account; a "rotate"
+// receipt gives one entry per asset holding its whole balance, so the sum
+// restarts from it, and earlier entries need the private key of the earlier
+// key version.
+func DecryptHistory(historyPage []byte, privKey string) (entries []*HistoryEntry, bookmark string, err error) {
+	var page struct {
+		Receipts []*receipt
+		Bookmark string
+	}
+	err = json.Unmarshal(historyPage, &page)
+	if err != nil {
+		return nil, "", err
+	}
+
+	key, err := gohe.ParsePrivateKey([]byte(privKey))
+	if err != nil {
+		return nil, "", err
+	}
+	half := new(big.Int).Rsh(key.N, 1)
+	for _, r := range page.Receipts {
+		plain, err := gohe.Decrypt([]byte(privKey), r.Delta)
+		if err != nil {
+			return nil, "", err
+		}
+		amount := new(big.Int).SetBytes(plain)
+		if r.Type == "transfer-out" || r.Type == "burn" || r.Type == "hold" || r.Type == "seize" {
+			amount.Neg(amount)
+		}
+		// a ring update of a sender is n - amount
+		if r.Type == "ring" && amount.Cmp(half) > 0 {
+			amount.Sub(amount, key.N)
+		}
+		entries = append(entries, &HistoryEntry{
+			TxID:         r.TxID,
+			Type:         r.Type,
+			Asset:        r.Asset,
+			Counterparty: r.Counterparty,
+			Amount:       amount,
+			Memo:         openReceiptMemo(privKey, r),
+			Timestamp:    r.Timestamp,
+		})
+
+		assetIDs := make([]string, 0, len(r.Balances))
+		for assetID := range r.Balances {
+			assetIDs = append(assetIDs, assetID)
+		}
+		sort.Strings(assetIDs)
+		for _, assetID := range assetIDs {
+			plain, err := gohe.Decrypt([]byte(privKey), r.Balances[assetID])
+			if err != nil {
+				return nil, "", err
+			}
+			entries = append(entries, &HistoryEntry{
+				TxID:      r.TxID,
+				Type:      r.Type,
+				Asset:     assetID,
+				Amount:    new(big.Int).SetBytes(plain),
+				Timestamp: r.Timestamp,
+			})
+		}
+	}
+	return entries, page.Bookmark, nil
+}
+
+// AttachMemo adds a memo for the recipient to a transfer prepared by
+// PrepareTxInfo, or to a Lock or TransferPending prepared by PrepareHold,
+// where it reaches the recipient on release. Only the recipient can read it,
+// in the entries returned by DecryptHistory. It drops a signature made by
+// SignTxInfo, which has to be made again.
+func AttachMemo(txInfoBytes []byte, memo string) ([]byte, error) {
+	var ti txInfo
+	err := json.Unmarshal(txInfoBytes, &ti)
+	if err != nil {
+		return nil, err
+	}
+	// the memo is bound to the amount, so it cannot be moved to another transfer
+	ti.Memo, err = gohe.SealMemo(ti.PubKeyB, []byte(memo), ti.CipherTXB)
+	if err != nil {
+		return nil, err
+	}
+	ti.Sig = nil
+	return json.Marshal(&ti)
+}
+
+// openReceiptMemo decrypts the memo of a receipt. The sender chooses the
+// memo, so one that does not open is left out rather than failing the page.
+func openReceiptMemo(privKey string, r *receipt) string {
+	if r.Memo == nil {
+		return ""
+	}
+	context := r.Delta
+	if r.MemoCipher != nil {
+		context = r.MemoCipher
+	}
+	text, err := gohe.OpenMemo([]byte(privKey), r.Memo, context)
+	if err != nil {
+		return ""
+	}
+	return string(text)
+}
+
+const authContext = "gopaillier/auth/"
+
+// SignTxInfo signs a tx info from PrepareTxInfo, PrepareHold or
+// PrepareTransferMany with the key of the account addrA for the transaction
+// txID, which the client creates before it sends the proposal. addrsB are
+// the accounts credited, the recipients in order for TransferMany. The
+// signature covers the whole tx info, so a memo or a spending limit proof is
+// added first. A transfer proposed to the signers of an account needs none.
+func SignTxInfo(txInfo []byte, txID, privKeyA, addrA string, addrsB ...string) ([]byte, error) {
+	digest, err := infoDigest(txInfo, "Sig")
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(txInfo, &fields)
+	if err != nil {
+		return nil, err
+	}
+	var assetID string
+	if raw, ok := fields["AssetID"]; ok {
+		err = json.Unmarshal(raw, &assetID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	msg := authContext + txID + "/" + addrA + "/" + strings.Join(addrsB, ",") + "/" + assetID + "/" + hex.EncodeToString(digest)
+	sig, err := gohe.Sign([]byte(privKeyA), []byte(msg))
+	if err != nil {
+		return nil, err
+	}
+	fields["Sig"], err = json.Marshal(sig)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
+
+// infoDigest must match the hash of a tx info without its signature field
+// omit computed by ccapi.
+func infoDigest(info []byte, omit string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(info, &fields)
+	if err != nil {
+		return nil, err
+	}
+	delete(fields, omit)
+	fieldBytes, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(fieldBytes)
+	return digest[:], nil
+}
+
+// rotateInfo must match the rotation expected by ccapi.ValidateRotation.
+type rotateInfo struct {
+	NewPubKey     []byte
+	Sig           []byte
+	CipherBalance []byte
+	Proof         *gohe.EqualityProof
+}
+
+const rotateContext = "gopaillier/rotate/"
+
+// PrepareRotation moves the account addr from the key of oldPrivKey to
+// newPubKey. version is the current key version in the registry and
+// cipherBalance the current balance of the account.
+func PrepareRotation(addr string, version int, cipherBalance, oldPrivKey, newPubKey string) (rotation []byte, err error) {
+	oldKey, err := gohe.ParsePrivateKey([]byte(oldPrivKey))
+	if err != nil {
+		return nil, err
+	}
+	oldPubKey := gohe.GenPemPublicKey(&oldKey.PublicKey)
+
+	sig, err := gohe.Sign([]byte(oldPrivKey), rotateMessage(addr, version, newPubKey))
+	if err != nil {
+		return nil, err
+	}
+
+	// re-encrypt the balance and prove both cipher texts hold the same amount
+	balance, err := gohe.Decrypt([]byte(oldPrivKey), []byte(cipherBalance))
+	if err != nil {
+		return nil, err
 	}
-	return balanceInfo,nil
-}
\ No newline at end of file
+	oldNonce, err := gohe.RecoverNonce([]byte(oldPrivKey), []byte(cipherBalance))
+	if err != nil {
+		return nil, err
+	}
+	newCipher, newNonce, err := gohe.EncryptWithNonce([]byte(newPubKey), balance)
+	if err != nil {
+		return nil, err
+	}
+	proof, err := gohe.ProveEqual(
+		[][]byte{oldPubKey, []byte(newPubKey)},
+		[][]byte{[]byte(cipherBalance), newCipher},
+		balance, [][]byte{oldNonce, newNonce}, []byte(rotateContext+addr))
+	if err != nil {
+		return nil, err
+	}
+
+	ri := &rotateInfo{
+		NewPubKey:     []byte(newPubKey),
+		Sig:           sig,
+		CipherBalance: newCipher,
+		Proof:         proof,
+	}
+	return json.Marshal(ri)
+}
+
+// SignRevocation signs the revocation of addr at the current key version.
+func SignRevocation(addr string, version int, privKey string) (sig []byte, err error) {
+	return gohe.Sign([]byte(privKey), []byte("gopaillier/revoke/"+addr+"/"+strconv.Itoa(version)))
+}
+
+// SignPending authorizes a decision on a pending transfer: "accept" or
+// "reject" with the private key of the receiver, "cancel" with that of the
+// sender. pendingID is the ID returned by TransferPending.
+func SignPending(action, pendingID, privKey string) (sig []byte, err error) {
+	if action != "accept" && action != "reject" && action != "cancel" {
+		return nil, errors.New("Unknown pending transfer action.")
+	}
+	return gohe.Sign([]byte(privKey), []byte("gopaillier/pending/"+action+"/"+pendingID))
+}
+
+// rotateMessage must match the message the registry verifies on rotation.
+func rotateMessage(addr string, version int, newPubKey string) []byte {
+	keyHash := sha256.Sum256([]byte(newPubKey))
+	return []byte("gopaillier/rotate/" + addr + "/" + strconv.Itoa(version) + "/" + hex.EncodeToString(keyHash[:]))
+}
+
+// RegistryMetadata is the optional metadata of a registry record. Empty
+// fields take the registry's defaults: the client's MSP ID, the balance
+// purpose and no expiry.
+type RegistryMetadata struct {
+	DisplayName string
+	MSPID       string
+	Purpose     string // "balance", "signing" or "auditor"
+	Expiry      string // RFC 3339
+}
+
+// PrepareRegistration builds the second argument of IDChaincode's Register:
+// the metadata and a proof of possession of privKey bound to the address and
+// to the ID of the registering transaction. The client creates the
+// transaction ID before it sends the proposal. metadata may be nil.
+func PrepareRegistration(privKey, txID string, metadata *RegistryMetadata) (registration []byte, err error) {
+	key, err := gohe.ParsePrivateKey([]byte(privKey))
+	if err != nil {
+		return nil, err
+	}
+	addr := calcAddr(string(gohe.GenPemPublicKey(&key.PublicKey)))
+
+	proof, err := gohe.Sign([]byte(privKey), []byte("gopaillier/register/"+addr+"/"+txID))
+	if err != nil {
+		return nil, err
+	}
+
+	if metadata == nil {
+		metadata = &RegistryMetadata{}
+	}
+	return json.Marshal(&struct {
+		PossessionProof []byte
+		RegistryMetadata
+	}{proof, *metadata})
+}
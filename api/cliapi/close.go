@@ -0,0 +1,55 @@
+package cliapi
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+
+	"chaoshen.com/gopaillier/api/core"
+)
+
+const closeContext = "gopaillier/close/"
+
+// closeInfo must match the CloseAccount argument expected by
+// ccapi.ValidateClose.
+type closeInfo struct {
+	Proofs map[string]*gohe.ZeroProof
+	Sig    []byte
+}
+
+// PrepareClose proves that the balances of the account addr encrypt zero
+// and signs its closure. balances holds every balance of the account by
+// asset ID, "" for the default asset, and txID is the ID of the transaction,
+// which the client creates before it sends the proposal.
+func PrepareClose(addr, txID string, balances map[string][]byte, privKey string) ([]byte, error) {
+	key, err := gohe.ParsePrivateKey([]byte(privKey))
+	if err != nil {
+		return nil, err
+	}
+	pubKey := gohe.GenPemPublicKey(&key.PublicKey)
+
+	context := []byte(closeContext + addr + "/" + txID)
+	ci := &closeInfo{Proofs: map[string]*gohe.ZeroProof{}}
+	for assetID, balance := range balances {
+		plainText, err := gohe.Decrypt([]byte(privKey), balance)
+		if err != nil {
+			return nil, err
+		}
+		if new(big.Int).SetBytes(plainText).Sign() != 0 {
+			return nil, errors.New("The balance of asset " + assetID + " is not zero.")
+		}
+		nonce, err := gohe.RecoverNonce([]byte(privKey), balance)
+		if err != nil {
+			return nil, err
+		}
+		ci.Proofs[assetID], err = gohe.ProveZero(pubKey, balance, nonce, context)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ci.Sig, err = gohe.Sign([]byte(privKey), context)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(ci)
+}
@@ -0,0 +1,118 @@
+package cliapi
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+
+	"chaoshen.com/gopaillier/api/core"
+)
+
+// limitRequest must match the SetSpendingLimit argument of the transfer
+// chaincode. An empty limit removes the limit.
+type limitRequest struct {
+	Amount       string // plaintext limit, or
+	CipherAmount []byte // limit encrypted under the account key
+	Window       int64  // seconds
+}
+
+// PrepareSpendingLimit builds the argument of SetSpendingLimit, which only
+// the limit role of the chaincode submits. The account may not send more
+// of the default asset than amount per window of the given seconds; with
+// encrypt the limit is stored encrypted under pubKey, the account key. An
+// empty amount removes the limit.
+func PrepareSpendingLimit(amount string, window int64, encrypt bool, pubKey string) ([]byte, error) {
+	req := &limitRequest{}
+	if amount != "" {
+		amt, ok := new(big.Int).SetString(amount, 10)
+		if !ok || amt.Sign() < 0 {
+			return nil, errors.New("The limit must be a non-negative integer.")
+		}
+		if window <= 0 {
+			return nil, errors.New("The window must be positive.")
+		}
+		req.Amount, req.Window = amount, window
+		if encrypt {
+			var err error
+			req.CipherAmount, err = gohe.Encrypt([]byte(pubKey), amt.Bytes())
+			if err != nil {
+				return nil, err
+			}
+			req.Amount = ""
+		}
+	}
+	return json.Marshal(req)
+}
+
+const limitContext = "gopaillier/limit/"
+
+// ProveSpendingLimit adds to a tx info prepared by PrepareTxInfo,
+// PrepareHold, PrepareApprove or PrepareTransferMany the proof that its
+// amount, fees not included, keeps the spending of the current window within
+// the limit of A.
+// cipherLimit and cipherSpent are CipherLimit and CipherSpent of the
+// account's limit, cipherSpent the encryption of zero once the window of
+// Window seconds from WindowStart has passed.
+func ProveSpendingLimit(txInfo []byte, cipherLimit, cipherSpent, pubKeyA, privKeyA string) ([]byte, error) {
+	var tx struct {
+		CipherBalanceA []byte
+		CipherTxA      []byte
+		Legs           []struct{ CipherTxA []byte }
+	}
+	err := json.Unmarshal(txInfo, &tx)
+	if err != nil {
+		return nil, err
+	}
+
+	// the debit is the amount, or the sum of the legs of a TransferMany
+	debit := tx.CipherTxA
+	if tx.Legs != nil {
+		debit = gohe.ZeroCipher()
+		for _, leg := range tx.Legs {
+			debit, err = gohe.AddCipher([]byte(pubKeyA), debit, leg.CipherTxA)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	limit, err := gohe.Decrypt([]byte(privKeyA), []byte(cipherLimit))
+	if err != nil {
+		return nil, err
+	}
+	newSpent, err := gohe.AddCipher([]byte(pubKeyA), []byte(cipherSpent), debit)
+	if err != nil {
+		return nil, err
+	}
+	spent, err := gohe.Decrypt([]byte(privKeyA), newSpent)
+	if err != nil {
+		return nil, err
+	}
+	remainder := new(big.Int).Sub(new(big.Int).SetBytes(limit), new(big.Int).SetBytes(spent))
+	if remainder.Sign() < 0 {
+		return nil, errors.New("The transfer exceeds the spending limit.")
+	}
+
+	proof, err := proveRemainder(cipherLimit, newSpent, remainder, pubKeyA, privKeyA, []byte(limitContext+string(tx.CipherBalanceA)))
+	if err != nil {
+		return nil, err
+	}
+
+	// keep the other fields as they are, but for a signature of SignTxInfo,
+	// which no longer covers them
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(txInfo, &fields)
+	if err != nil {
+		return nil, err
+	}
+	delete(fields, "Sig")
+	fields["CipherSpentA"], err = json.Marshal([]byte(cipherSpent))
+	if err != nil {
+		return nil, err
+	}
+	fields["LimitProof"], err = json.Marshal(proof)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
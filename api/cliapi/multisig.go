@@ -0,0 +1,38 @@
+package cliapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"chaoshen.com/gopaillier/api/core"
+)
+
+// MultisigApproval must match the approvals SetSigners and ProposeTransfer
+// of the transfer chaincode expect. Signer is the index of the key in the
+// signer set.
+type MultisigApproval struct {
+	Signer int
+	Sig    []byte
+}
+
+// SignSigners approves the JSON signer set of SetSigners for the account.
+// Without signers the account key signs, otherwise each current signer does.
+// txID is the ID of the transaction, which the client creates before it
+// sends the proposal.
+func SignSigners(addr, txID string, multisig []byte, privKey string) ([]byte, error) {
+	return gohe.Sign([]byte(privKey), SignersMessage(addr, txID, multisig))
+}
+
+// SignersMessage is the message SignSigners signs, for an account key
+// held in threshold form to sign with PartialSign.
+func SignersMessage(addr, txID string, multisig []byte) []byte {
+	hash := sha256.Sum256(multisig)
+	return []byte("gopaillier/signers/" + addr + "/" + txID + "/" + hex.EncodeToString(hash[:]))
+}
+
+// SignProposal approves as a signer of A the transfer of the tx info from
+// PrepareTxInfo to B. assetID is empty for the default asset.
+func SignProposal(addrA, addrB, assetID string, txInfo []byte, privKey string) ([]byte, error) {
+	hash := sha256.Sum256(txInfo)
+	return gohe.Sign([]byte(privKey), []byte("gopaillier/multisig/"+addrA+"/"+addrB+"/"+assetID+"/"+hex.EncodeToString(hash[:])))
+}
@@ -0,0 +1,165 @@
+package cliapi
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"chaoshen.com/gopaillier/api/core"
+)
+
+const ringContext = "gopaillier/ring/"
+
+func ringProofContext(txID, assetID string, cipherBalances []string) []byte {
+	return []byte(ringContext + txID + "/" + assetID + "/" + strings.Join(cipherBalances, "/"))
+}
+
+// ringTxInfo must match the TransferRing argument expected by
+// ccapi.ValidateRingTxInfo.
+type ringTxInfo struct {
+	CipherBalances  [][]byte
+	AssetID         string
+	CipherAmounts   [][]byte
+	CipherTxAuditor []byte
+	Debits          [][]byte
+	Credits         [][]byte
+	Proof           *gohe.EqualityProof
+	AmountProof     *gohe.RangeProof
+	DebitProof      *gohe.RingProof
+	CreditProof     *gohe.RingProof
+}
+
+// PrepareRingTransfer pays an amount from the member sender of a ring to the
+// member receiver without telling the other members, or anybody watching
+// the ledger, which two they are. cipherBalances and pubKeys are the
+// balances and keys of the members in ring order, which is also the order of
+// the addresses passed to TransferRing, and privKeyA is the private key of
+// the sender, who signs the transfer for the transaction txID without
+// telling which member signed. assetID is empty for the default asset.
+func PrepareRingTransfer(cipherBalances, pubKeys []string, sender, receiver int, transNumStr, privKeyA, auditorPubKey, assetID, txID string) ([]byte, error) {
+	k := len(pubKeys)
+	if k < 2 || len(cipherBalances) != k {
+		return nil, errors.New("Need a balance and a key of at least two members.")
+	}
+	if sender < 0 || sender >= k || receiver < 0 || receiver >= k || sender == receiver {
+		return nil, errors.New("The sender and the receiver must be two members of the ring.")
+	}
+
+	// Check if the balance is enough
+	balanceA, err := gohe.Decrypt([]byte(privKeyA), []byte(cipherBalances[sender]))
+	if err != nil {
+		return nil, err
+	}
+	transNum, err := strconv.Atoi(transNumStr)
+	if err != nil {
+		return nil, err
+	}
+	if transNum < 0 {
+		return nil, errors.New("The transfer amount must not be negative.")
+	}
+	amount := new(big.Int).SetInt64(int64(transNum))
+	remainder := new(big.Int).Sub(new(big.Int).SetBytes(balanceA), amount)
+	if remainder.Sign() < 0 {
+		return nil, errors.New("Insufficient balance for transfer.")
+	}
+
+	context := ringProofContext(txID, assetID, cipherBalances)
+	ri := &ringTxInfo{AssetID: assetID}
+	keys := make([][]byte, k)
+	balances := make([][]byte, k)
+	var amountNonces, debitNonces, creditNonces [][]byte
+	for i := range pubKeys {
+		keys[i], balances[i] = []byte(pubKeys[i]), []byte(cipherBalances[i])
+		cipherAmount, nonce, err := gohe.EncryptWithNonce(keys[i], amount.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		ri.CipherAmounts = append(ri.CipherAmounts, cipherAmount)
+		amountNonces = append(amountNonces, nonce)
+
+		// every update is a fresh encryption of zero, shifted by the amount
+		// for the sender and the receiver
+		debit, nonce, err := gohe.EncryptWithNonce(keys[i], nil)
+		if err != nil {
+			return nil, err
+		}
+		if i == sender {
+			debit, err = gohe.SubCipher(keys[i], debit, cipherAmount)
+			if err != nil {
+				return nil, err
+			}
+		}
+		ri.Debits = append(ri.Debits, debit)
+		debitNonces = append(debitNonces, nonce)
+
+		credit, nonce, err := gohe.EncryptWithNonce(keys[i], nil)
+		if err != nil {
+			return nil, err
+		}
+		if i == receiver {
+			credit, err = gohe.AddCipher(keys[i], credit, cipherAmount)
+			if err != nil {
+				return nil, err
+			}
+		}
+		ri.Credits = append(ri.Credits, credit)
+		creditNonces = append(creditNonces, nonce)
+	}
+	ri.CipherBalances = balances
+
+	equalKeys, equalCiphers, equalNonces := keys, ri.CipherAmounts, amountNonces
+	if auditorPubKey != "" {
+		var nonce []byte
+		ri.CipherTxAuditor, nonce, err = gohe.EncryptWithNonce([]byte(auditorPubKey), amount.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		equalKeys = append(append([][]byte{}, keys...), []byte(auditorPubKey))
+		equalCiphers = append(append([][]byte{}, ri.CipherAmounts...), ri.CipherTxAuditor)
+		equalNonces = append(append([][]byte{}, amountNonces...), nonce)
+	}
+	ri.Proof, err = gohe.ProveEqual(equalKeys, equalCiphers, amount.Bytes(), equalNonces, context)
+	if err != nil {
+		return nil, err
+	}
+	ri.AmountProof, err = gohe.ProveRange(keys[0], ri.CipherAmounts[0], amount.Bytes(), amountNonces[0], context)
+	if err != nil {
+		return nil, err
+	}
+
+	newBalance, err := gohe.AddCipher(keys[sender], balances[sender], ri.Debits[sender])
+	if err != nil {
+		return nil, err
+	}
+	newNonce, err := gohe.RecoverNonce([]byte(privKeyA), newBalance)
+	if err != nil {
+		return nil, err
+	}
+	ri.CreditProof, err = gohe.ProveRingCredit(keys, ri.Credits, ri.CipherAmounts, receiver, creditNonces, context)
+	if err != nil {
+		return nil, err
+	}
+
+	// the debit proof carries the signature of everything else
+	unsigned, err := json.Marshal(ri)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := infoDigest(unsigned, "DebitProof")
+	if err != nil {
+		return nil, err
+	}
+	msg := []byte(string(context) + "/" + hex.EncodeToString(digest))
+	sig, err := gohe.Sign([]byte(privKeyA), msg)
+	if err != nil {
+		return nil, err
+	}
+	ri.DebitProof, err = gohe.ProveRingDebit(keys, balances, ri.Debits, ri.CipherAmounts, sender, debitNonces, remainder.Bytes(), newNonce, msg, sig, context)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(ri)
+}
@@ -0,0 +1,51 @@
+package cliapi
+
+import (
+	"encoding/json"
+
+	"chaoshen.com/gopaillier/api/core"
+)
+
+const seizeContext = "gopaillier/seize/"
+
+// seizeInfo must match the Seize argument expected by ccapi.ValidateSeizure.
+type seizeInfo struct {
+	CipherCustody []byte
+	Proof         *gohe.EqualityProof
+}
+
+// PrepareSeizure re-encrypts the balance of the frozen account addr for
+// assetID, "" for the default asset, under the key of the custody account,
+// for the transaction txID, which the client creates before it sends the
+// proposal. A Paillier cipher text cannot be re-encrypted without its
+// private key, so privKey is the key of the seized account, handed over by
+// its owner under the order or recovered from a key escrow.
+func PrepareSeizure(addr, assetID, txID, cipherBalance, privKey, custodyPubKey string) ([]byte, error) {
+	key, err := gohe.ParsePrivateKey([]byte(privKey))
+	if err != nil {
+		return nil, err
+	}
+	pubKey := gohe.GenPemPublicKey(&key.PublicKey)
+
+	balance, err := gohe.Decrypt([]byte(privKey), []byte(cipherBalance))
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := gohe.RecoverNonce([]byte(privKey), []byte(cipherBalance))
+	if err != nil {
+		return nil, err
+	}
+	cipherCustody, custodyNonce, err := gohe.EncryptWithNonce([]byte(custodyPubKey), balance)
+	if err != nil {
+		return nil, err
+	}
+	proof, err := gohe.ProveEqual(
+		[][]byte{pubKey, []byte(custodyPubKey)},
+		[][]byte{[]byte(cipherBalance), cipherCustody},
+		balance, [][]byte{nonce, custodyNonce}, []byte(seizeContext+assetID+"/"+addr+"/"+txID))
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(&seizeInfo{CipherCustody: cipherCustody, Proof: proof})
+}
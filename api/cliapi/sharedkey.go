@@ -0,0 +1,72 @@
+package cliapi
+
+import (
+	"crypto/rand"
+	"math/big"
+
+	"chaoshen.com/gopaillier/api/core"
+)
+
+// GenerateSharedKey deals a Paillier account key to parties holders, such
+// as the signers of an account, so that any threshold of them decrypt its
+// balance, prepare its transfers and sign for it together and no holder has
+// the private key. pubKey is the ordinary public key of the account,
+// sharedKey the public key with the verification keys of the holders, which
+// combining their partial results needs, and shares[i] the private share of
+// holder i+1. The dealer must forget the key after handing out the shares.
+func GenerateSharedKey(bits, threshold, parties int) (pubKey, sharedKey string, shares []string, err error) {
+	key, keyShares, err := gohe.GenerateSharedKey(rand.Reader, bits, threshold, parties)
+	if err != nil {
+		return "", "", nil, err
+	}
+	for _, share := range keyShares {
+		shares = append(shares, string(gohe.GenPemKeyShare(share)))
+	}
+	return string(gohe.GenPemPublicKey(&key.PublicKey)), string(gohe.GenPemSharedKey(key)), shares, nil
+}
+
+// PartialOpen is the part of a holder in opening a cipher text under the
+// shared key, such as the balance of the account for SharedDecrypt or
+// PrepareSharedTxInfo.
+func PartialOpen(share string, cipher []byte) ([]byte, error) {
+	return gohe.PartialOpen([]byte(share), cipher)
+}
+
+// SharedDecrypt decrypts a cipher text with the partial openings of at least
+// the threshold of holders.
+func SharedDecrypt(sharedKey string, cipher []byte, partials [][]byte) (string, error) {
+	plainBytes, _, err := gohe.CombineOpening([]byte(sharedKey), cipher, partials)
+	if err != nil {
+		return "", err
+	}
+	return new(big.Int).SetBytes(plainBytes).String(), nil
+}
+
+// PrepareSharedTxInfo is PrepareTxInfo for an account with a shared key.
+// partials are the holders' partial openings of cipherBalanceA; whoever
+// combines them learns the balance, but not the key.
+func PrepareSharedTxInfo(cipherBalanceA, transNumStr, sharedKeyA, pubKeyB, auditorPubKey, assetID string, fee *Fee, partials [][]byte) ([]byte, error) {
+	key, err := gohe.ParseSharedKey([]byte(sharedKeyA))
+	if err != nil {
+		return nil, err
+	}
+	balanceA, nonceA, err := gohe.CombineOpening([]byte(sharedKeyA), []byte(cipherBalanceA), partials)
+	if err != nil {
+		return nil, err
+	}
+	pubKeyA := string(gohe.GenPemPublicKey(&key.PublicKey))
+	return prepareOpenedTxInfo(cipherBalanceA, new(big.Int).SetBytes(balanceA), new(big.Int).SetBytes(nonceA), transNumStr, pubKeyA, pubKeyB, auditorPubKey, assetID, fee, txProofContext(assetID, cipherBalanceA))
+}
+
+// PartialSign is the part of a holder in a signature with the shared key.
+// msg is the message the Sign functions of this package sign, such as
+// SignersMessage.
+func PartialSign(share string, msg []byte) ([]byte, error) {
+	return gohe.PartialSign([]byte(share), msg)
+}
+
+// SharedSign combines the partial signatures of at least the threshold of
+// holders into a signature of the account key.
+func SharedSign(sharedKey string, msg []byte, partials [][]byte) ([]byte, error) {
+	return gohe.CombineSignature([]byte(sharedKey), msg, partials)
+}
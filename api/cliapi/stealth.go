@@ -0,0 +1,276 @@
+package cliapi
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+
+	"chaoshen.com/gopaillier/api/core"
+)
+
+// stealthContext separates the secrets derived from a stealth shared secret.
+const stealthContext = "gopaillier/stealth/"
+
+// stealthInfo must match the CreateStealth argument expected by
+// ccapi.ValidateStealthInfo.
+type stealthInfo struct {
+	PubKey    []byte // one-time Paillier key of the account
+	Ephemeral []byte // PEM ECDH key of the sender
+	ClaimKey  []byte // PEM ECDSA key only the receiver can sign with
+}
+
+// GenerateStealthKey generates an ECDSA P-256 key pair in PEM. A receiver
+// publishes the public keys of a scan key and of a spend key: the scan key
+// finds the stealth accounts paid to the receiver, the spend key claims
+// them, so the scan key can be handed to a scanning service.
+func GenerateStealthKey() (privKey, pubKey string, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	privDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	pubDer, err := marshalECPublicKey(&key.PublicKey)
+	if err != nil {
+		return "", "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: privDer})), string(pubDer), nil
+}
+
+// PrepareStealth derives a one-time account for the receiver of the scan
+// and spend keys. The sender opens it with CreateStealth(stealthInfo) and
+// pays to the address of pubKey, the one-time Paillier key of the given bit
+// size, like to any other account. The sender knows the one-time private
+// key too, which is why the account cannot send before the receiver claims
+// it with a key of its own.
+func PrepareStealth(scanPubKey, spendPubKey string, bits int) (info []byte, pubKey string, err error) {
+	scan, err := parseECPublicKey(scanPubKey)
+	if err != nil {
+		return nil, "", err
+	}
+	spend, err := parseECPublicKey(spendPubKey)
+	if err != nil {
+		return nil, "", err
+	}
+	ephemeral, err := ecdsa.GenerateKey(scan.Curve, rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+
+	h, seed := stealthSecrets(scan.Curve, scan.X, scan.Y, ephemeral.D)
+	key, err := gohe.GenerateKeyFromSeed(seed, bits)
+	if err != nil {
+		return nil, "", err
+	}
+	si := &stealthInfo{PubKey: gohe.GenPemPublicKey(&key.PublicKey)}
+	si.Ephemeral, err = marshalECPublicKey(&ephemeral.PublicKey)
+	if err != nil {
+		return nil, "", err
+	}
+	si.ClaimKey, err = marshalECPublicKey(claimPubKey(spend, h))
+	if err != nil {
+		return nil, "", err
+	}
+
+	info, err = json.Marshal(si)
+	if err != nil {
+		return nil, "", err
+	}
+	return info, string(si.PubKey), nil
+}
+
+// ScanStealth checks whether the stealth account announced by a
+// StealthCreated event, whose Info is stealthInfo, was made for the owner
+// of the scan key and spend key. If so it returns the one-time private key
+// of the account, which decrypts its balance.
+func ScanStealth(stealthInfo []byte, scanPrivKey, spendPubKey string) (privKey string, ok bool, err error) {
+	_, key, err := openStealth(stealthInfo, scanPrivKey, spendPubKey)
+	if err != nil || key == nil {
+		return "", false, err
+	}
+	return string(gohe.GenPemPrivateKey(key)), true, nil
+}
+
+// PrepareClaim moves the stealth account addr to newPubKey, a Paillier key
+// the sender does not know, and signs the claim with the one-time claim key
+// derived from the spend key. balances holds every balance of the account by
+// asset ID, "" for the default asset, and txID is the ID of the transaction,
+// which the client creates before it sends the proposal.
+func PrepareClaim(addr, txID string, stealthInfo []byte, balances map[string][]byte, scanPrivKey, spendPrivKey, newPubKey string) ([]byte, error) {
+	spend, err := parseECPrivateKey(spendPrivKey)
+	if err != nil {
+		return nil, err
+	}
+	spendPubKey, err := marshalECPublicKey(&spend.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	h, key, err := openStealth(stealthInfo, scanPrivKey, string(spendPubKey))
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, errors.New("The stealth account is not for these keys.")
+	}
+	oldPrivKey := gohe.GenPemPrivateKey(key)
+	oldPubKey := gohe.GenPemPublicKey(&key.PublicKey)
+
+	ci := &claimInfo{NewPubKey: []byte(newPubKey), Balances: map[string]*reencryption{}}
+	for assetID, balance := range balances {
+		plainText, err := gohe.Decrypt(oldPrivKey, balance)
+		if err != nil {
+			return nil, err
+		}
+		oldNonce, err := gohe.RecoverNonce(oldPrivKey, balance)
+		if err != nil {
+			return nil, err
+		}
+		newCipher, newNonce, err := gohe.EncryptWithNonce([]byte(newPubKey), plainText)
+		if err != nil {
+			return nil, err
+		}
+		proof, err := gohe.ProveEqual(
+			[][]byte{oldPubKey, []byte(newPubKey)},
+			[][]byte{balance, newCipher},
+			plainText, [][]byte{oldNonce, newNonce}, claimProofContext(addr, txID, assetID))
+		if err != nil {
+			return nil, err
+		}
+		ci.Balances[assetID] = &reencryption{CipherBalance: newCipher, Proof: proof}
+	}
+
+	// the claim key is h*G + spend key, its private key h + spend
+	claimKey := &ecdsa.PrivateKey{PublicKey: *claimPubKey(&spend.PublicKey, h)}
+	claimKey.D = new(big.Int).Add(h, spend.D)
+	claimKey.D.Mod(claimKey.D, spend.Curve.Params().N)
+	ci.Sig, err = ecdsa.SignASN1(rand.Reader, claimKey, claimDigest(addr, txID, newPubKey))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(ci)
+}
+
+// claimInfo must match the ClaimStealth argument expected by
+// ccapi.ValidateClaim.
+type claimInfo struct {
+	NewPubKey []byte
+	Balances  map[string]*reencryption
+	Sig       []byte
+}
+
+type reencryption struct {
+	CipherBalance []byte
+	Proof         *gohe.EqualityProof
+}
+
+const claimContext = "gopaillier/claim/"
+
+func claimProofContext(addr, txID, assetID string) []byte {
+	return []byte(claimContext + addr + "/" + txID + "/" + assetID)
+}
+
+func claimDigest(addr, txID, newPubKey string) []byte {
+	keyHash := sha256.Sum256([]byte(newPubKey))
+	digest := sha256.Sum256([]byte(claimContext + addr + "/" + txID + "/" + hex.EncodeToString(keyHash[:])))
+	return digest[:]
+}
+
+// openStealth recomputes the secrets of a stealth account with the scan
+// key. It returns a nil key if the account was made for somebody else.
+func openStealth(info []byte, scanPrivKey, spendPubKey string) (h *big.Int, key *gohe.PrivateKey, err error) {
+	var si stealthInfo
+	err = json.Unmarshal(info, &si)
+	if err != nil {
+		return nil, nil, err
+	}
+	scan, err := parseECPrivateKey(scanPrivKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	spend, err := parseECPublicKey(spendPubKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	ephemeral, err := parseECPublicKey(string(si.Ephemeral))
+	if err != nil {
+		return nil, nil, err
+	}
+	claim, err := parseECPublicKey(string(si.ClaimKey))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the claim key tells cheaply whether the account is ours
+	h, seed := stealthSecrets(scan.Curve, ephemeral.X, ephemeral.Y, scan.D)
+	expected := claimPubKey(spend, h)
+	if expected.X.Cmp(claim.X) != 0 || expected.Y.Cmp(claim.Y) != 0 {
+		return nil, nil, nil
+	}
+
+	pubKey, err := gohe.ParsePublicKey(si.PubKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err = gohe.GenerateKeyFromSeed(seed, pubKey.N.BitLen())
+	if err != nil {
+		return nil, nil, err
+	}
+	if key.N.Cmp(pubKey.N) != 0 {
+		return nil, nil, errors.New("The one-time key was not derived from the shared secret.")
+	}
+	return h, key, nil
+}
+
+// stealthSecrets derives the claim scalar h and the seed of the one-time
+// Paillier key from the ECDH secret d * (x, y), which the sender computes
+// with its ephemeral private key and the receiver with its scan key.
+func stealthSecrets(curve elliptic.Curve, x, y, d *big.Int) (h *big.Int, seed []byte) {
+	sx, _ := curve.ScalarMult(x, y, d.Bytes())
+	shared := sx.FillBytes(make([]byte, (curve.Params().BitSize+7)/8))
+
+	claimHash := sha256.Sum256(append([]byte(stealthContext+"claim/"), shared...))
+	h = new(big.Int).SetBytes(claimHash[:])
+	h.Mod(h, curve.Params().N)
+	seedHash := sha256.Sum256(append([]byte(stealthContext+"key/"), shared...))
+	return h, seedHash[:]
+}
+
+// claimPubKey computes h*G + spend.
+func claimPubKey(spend *ecdsa.PublicKey, h *big.Int) *ecdsa.PublicKey {
+	hx, hy := spend.Curve.ScalarBaseMult(h.Bytes())
+	x, y := spend.Curve.Add(hx, hy, spend.X, spend.Y)
+	return &ecdsa.PublicKey{Curve: spend.Curve, X: x, Y: y}
+}
+
+func marshalECPublicKey(key *ecdsa.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+func parseECPublicKey(pubKey string) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(pubKey))
+	if block == nil {
+		return nil, errors.New("The public key is not PEM encoded.")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("The public key is not an ECDSA key.")
+	}
+	return ecKey, nil
+}
@@ -0,0 +1,110 @@
+package cliapi
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+
+	"chaoshen.com/gopaillier/api/core"
+)
+
+// atLeastContext prefixes the threshold and the balance in the context of
+// the threshold proof, as expected by ccapi.VerifyBalanceAtLeast.
+const atLeastContext = "gopaillier/at-least/"
+
+// ProveBalanceAtLeast proves that cipherBalance, encrypted under the key of
+// privKey, holds at least threshold, a decimal amount, without revealing the
+// balance. The proof is a range proof that balance - threshold is not
+// negative and is only good for this balance: the chaincode query
+// VerifyBalanceAtLeast checks it against the current balance of the account.
+func ProveBalanceAtLeast(privKey, cipherBalance, threshold string) ([]byte, error) {
+	key, err := gohe.ParsePrivateKey([]byte(privKey))
+	if err != nil {
+		return nil, err
+	}
+	pubKey := gohe.GenPemPublicKey(&key.PublicKey)
+	x, ok := new(big.Int).SetString(threshold, 10)
+	// a threshold past the range would let balance - threshold wrap mod n
+	if !ok || x.Sign() < 0 || x.BitLen() > gohe.RangeBits {
+		return nil, errors.New("The threshold must be a non-negative integer below 2^RangeBits.")
+	}
+
+	plainText, err := gohe.Decrypt([]byte(privKey), []byte(cipherBalance))
+	if err != nil {
+		return nil, err
+	}
+	excess := new(big.Int).Sub(new(big.Int).SetBytes(plainText), x)
+	if excess.Sign() < 0 {
+		return nil, errors.New("The balance is below the threshold.")
+	}
+	nonce, err := gohe.RecoverNonce([]byte(privKey), []byte(cipherBalance))
+	if err != nil {
+		return nil, err
+	}
+
+	// adding n - threshold keeps the nonce of the balance
+	cipherExcess, err := gohe.Add(pubKey, []byte(cipherBalance), new(big.Int).Sub(key.N, x).Bytes())
+	if err != nil {
+		return nil, err
+	}
+	proof, err := gohe.ProveRange(pubKey, cipherExcess, excess.Bytes(), nonce, []byte(atLeastContext+x.String()+"/"+cipherBalance))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(proof)
+}
+
+// Attestation must match the attestation signed by the chaincode query
+// VerifyBalanceAtLeast.
+type Attestation struct {
+	Addr        string
+	Asset       string
+	Threshold   string
+	BalanceHash string
+	TxID        string
+	Timestamp   int64
+}
+
+type signedAttestation struct {
+	Attestation []byte
+	Sig         []byte
+}
+
+// VerifyAttestation checks the payload of VerifyBalanceAtLeast against
+// attestationKey, the PEM ECDSA key of the chaincode configuration, and
+// returns the attestation.
+func VerifyAttestation(signed []byte, attestationKey string) (*Attestation, error) {
+	var sa signedAttestation
+	err := json.Unmarshal(signed, &sa)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode([]byte(attestationKey))
+	if block == nil {
+		return nil, errors.New("The attestation key is not PEM encoded.")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("The attestation key is not an ECDSA key.")
+	}
+	digest := sha256.Sum256(sa.Attestation)
+	if !ecdsa.VerifyASN1(ecKey, digest[:], sa.Sig) {
+		return nil, errors.New("Invalid attestation signature.")
+	}
+
+	attestation := &Attestation{}
+	err = json.Unmarshal(sa.Attestation, attestation)
+	if err != nil {
+		return nil, err
+	}
+	return attestation, nil
+}
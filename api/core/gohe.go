@@ -3,7 +3,9 @@ package gohe
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/asn1"
+	"encoding/binary"
 	"encoding/pem"
 	"errors"
 	"fmt"
@@ -17,9 +19,25 @@ var one = big.NewInt(1)
 // too large for the size of the public key.
 var ErrMessageTooLong = errors.New("paillier: message too long for Paillier public key size")
 
+// ErrInvalidPemKey is returned when a key is not PEM encoded.
+var ErrInvalidPemKey = errors.New("paillier: key is not PEM encoded")
+
+// ErrKeyTooSmall is returned for a modulus shorter than MinKeyBits.
+var ErrKeyTooSmall = errors.New("paillier: key size too small")
+
+// ErrInvalidKey is returned for a public key whose generator is not n + 1.
+var ErrInvalidKey = errors.New("paillier: invalid public key")
+
+// MinKeyBits is the smallest modulus accepted for a public key. The
+// equality proofs rely on every modulus being larger than their responses.
+const MinKeyBits = 512
+
 // GenerateKey generates an Paillier keypair of the given bit size using the
 // random source random (for example, crypto/rand.Reader).
 func GenerateKey(random io.Reader, bits int) (*PrivateKey, error) {
+	if bits < MinKeyBits {
+		return nil, ErrKeyTooSmall
+	}
 	p, err := rand.Prime(random, bits/2)
 	if err != nil {
 		return nil, err
@@ -30,6 +48,58 @@ func GenerateKey(random io.Reader, bits int) (*PrivateKey, error) {
 		return nil, err
 	}
 
+	return newPrivateKey(p, q), nil
+}
+
+// seedKeyLabel separates the primes of GenerateKeyFromSeed from any other
+// use of the seed.
+const seedKeyLabel = "gopaillier/seed-key/v1"
+
+// GenerateKeyFromSeed derives a Paillier keypair of the given bit size from
+// seed, so every party holding the seed computes the same key. The key is
+// only as secret as the seed, which must have at least as much entropy as
+// the key is meant to resist.
+func GenerateKeyFromSeed(seed []byte, bits int) (*PrivateKey, error) {
+	if bits < MinKeyBits {
+		return nil, ErrKeyTooSmall
+	}
+	p := derivePrime(seed, "p", bits/2)
+	q := derivePrime(seed, "q", bits-bits/2)
+	if p.Cmp(q) == 0 {
+		return nil, errors.New("paillier: seed derived equal primes")
+	}
+	return newPrivateKey(p, q), nil
+}
+
+// derivePrime expands seed with SHA-256 in counter mode to a bits long odd
+// number with the two top bits set, so the product of two such primes has
+// the full size, and searches upwards for a prime. crypto/rand.Prime cannot
+// be used, it reads a random extra byte to stay non-deterministic.
+func derivePrime(seed []byte, name string, bits int) *big.Int {
+	size := (bits + 7) / 8
+	var stream []byte
+	for block := uint32(0); len(stream) < size; block++ {
+		h := sha256.New()
+		h.Write([]byte(seedKeyLabel))
+		h.Write([]byte(name))
+		binary.Write(h, binary.BigEndian, block)
+		h.Write(seed)
+		stream = h.Sum(stream)
+	}
+	p := new(big.Int).SetBytes(stream[:size])
+	p.Rsh(p, uint(size*8-bits))
+	p.SetBit(p, bits-1, 1)
+	p.SetBit(p, bits-2, 1)
+	p.SetBit(p, 0, 1)
+	two := big.NewInt(2)
+	for !p.ProbablyPrime(20) {
+		p.Add(p, two)
+	}
+	return p
+}
+
+// newPrivateKey builds the Paillier key of the primes p and q.
+func newPrivateKey(p, q *big.Int) *PrivateKey {
 	// n = p * q
 	n := new(big.Int).Mul(p, q)
 
@@ -47,7 +117,7 @@ func GenerateKey(random io.Reader, bits int) (*PrivateKey, error) {
 		},
 		L: l,
 		U: new(big.Int).ModInverse(l, n),
-	}, nil
+	}
 }
 
 // PrivateKey represents a Paillier key.
@@ -111,6 +181,52 @@ func Encrypt(pubKeyBytes []byte, plainText []byte) ([]byte, error) {
 	return c.Bytes(), nil
 }
 
+// deterministicNonceLabel separates the nonce derivation of
+// EncryptDeterministic from any other use of the seed.
+const deterministicNonceLabel = "gopaillier/deterministic-nonce/v1"
+
+// EncryptDeterministic encrypts a plain text with a nonce derived from seed
+// instead of fresh randomness, so every party holding the same seed computes
+// the same cipher text. Chaincode derives the seed from the transaction ID so
+// all endorsing peers produce identical write sets. The cipher text hides the
+// plain text only from parties that do not know the seed, and a seed must
+// never be used for two different plain texts under the same key.
+func EncryptDeterministic(pubKeyBytes []byte, plainText []byte, seed []byte) ([]byte, error) {
+	pubKey, err := ParsePublicKey(pubKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	m := new(big.Int).SetBytes(plainText)
+	if pubKey.N.Cmp(m) < 1 { // N < m
+		return nil, ErrMessageTooLong
+	}
+
+	return encrypt(pubKey, m, deriveNonce(pubKey.N, seed)).Bytes(), nil
+}
+
+// deriveNonce expands seed with SHA-256 in counter mode to 128 bits more than
+// the modulus and reduces it, retrying until the result is in Z*_n.
+func deriveNonce(n *big.Int, seed []byte) *big.Int {
+	size := (n.BitLen() + 128 + 7) / 8
+	for try := uint32(0); ; try++ {
+		var stream []byte
+		for block := uint32(0); len(stream) < size; block++ {
+			h := sha256.New()
+			h.Write([]byte(deterministicNonceLabel))
+			binary.Write(h, binary.BigEndian, try)
+			binary.Write(h, binary.BigEndian, block)
+			h.Write(seed)
+			stream = h.Sum(stream)
+		}
+		r := new(big.Int).SetBytes(stream[:size])
+		r.Mod(r, n)
+		if isUnit(r, n, n) {
+			return r
+		}
+	}
+}
+
 // Decrypt decrypts the passed cipher text.
 func Decrypt(privKeyBytes []byte, cipherText []byte) ([]byte, error) {
 
@@ -124,6 +240,10 @@ func Decrypt(privKeyBytes []byte, cipherText []byte) ([]byte, error) {
 		return nil, ErrMessageTooLong
 	}
 
+	return decrypt(privKey, c), nil
+}
+
+func decrypt(privKey *PrivateKey, c *big.Int) []byte {
 	// c^l mod n^2
 	a := new(big.Int).Exp(c, privKey.L, privKey.NSquared)
 
@@ -140,7 +260,7 @@ func Decrypt(privKeyBytes []byte, cipherText []byte) ([]byte, error) {
 		privKey.N,
 	)
 
-	return m.Bytes(), nil
+	return m.Bytes()
 }
 
 // AddCipher homomorphically adds together two cipher texts.
@@ -176,6 +296,13 @@ func SubCipher(pubKeyBytes []byte, cipher1, cipher2 []byte) ([]byte,error){
 	return new(big.Int).Mod(m, pubKey.NSquared).Bytes(),nil
 }
 
+// ZeroCipher returns the trivial encryption of zero, g^0 * 1^n = 1. It is a
+// valid cipher text under every public key and needs no randomness, so
+// chaincode can use it as the starting value of an encrypted accumulator.
+func ZeroCipher() []byte {
+	return big.NewInt(1).Bytes()
+}
+
 // Add homomorphically adds a passed constant to the encrypted integer
 // (our cipher text). We do this by multiplying the constant with our
 // ciphertext. Upon decryption, the resulting plain text will be the sum of
@@ -243,6 +370,9 @@ func MarshalPublicKey(pub *PublicKey) []byte {
 func ParsePrivateKey(key []byte) (*PrivateKey, error) {
 
 	block, _ := pem.Decode(key)
+	if block == nil {
+		return nil, ErrInvalidPemKey
+	}
 
 	var spec specPrivateKey
 	res, err := asn1.Unmarshal(block.Bytes, &spec)
@@ -261,6 +391,9 @@ func ParsePrivateKey(key []byte) (*PrivateKey, error) {
 
 func ParsePublicKey(key []byte) (*PublicKey, error) {
 	block, _ := pem.Decode(key)
+	if block == nil {
+		return nil, ErrInvalidPemKey
+	}
 
 	var spec specPublicKey
 	res, err := asn1.Unmarshal(block.Bytes, &spec)
@@ -271,6 +404,12 @@ func ParsePublicKey(key []byte) (*PublicKey, error) {
 		return nil, asn1.SyntaxError{Msg: "trailing data"}
 	}
 
+	if spec.N == nil || spec.N.BitLen() < MinKeyBits {
+		return nil, ErrKeyTooSmall
+	}
+	if spec.G == nil || spec.G.Cmp(new(big.Int).Add(spec.N, one)) != 0 {
+		return nil, ErrInvalidKey
+	}
 	pubkey := &PublicKey{spec.N, spec.G, new(big.Int).Mul(spec.N, spec.N)}
 
 	return pubkey, nil
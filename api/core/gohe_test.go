@@ -1,16 +1,18 @@
 package gohe
 
 import (
+	"bytes"
 	"testing"
 	"fmt"
 	"crypto/rand"
 	"encoding/pem"
 	"os"
 	"io/ioutil"
+	"math/big"
 )
 
 func TestMarshalPrivateKey(t *testing.T) {
-	privKey, _ := GenerateKey(rand.Reader, 128)
+	privKey, _ := GenerateKey(rand.Reader, MinKeyBits)
 
 	fmt.Println(privKey)
 	res:=MarshalPrivateKey(privKey)
@@ -32,7 +34,7 @@ func TestMarshalPrivateKey(t *testing.T) {
 }
 
 func TestGenPemPrivateKey(t *testing.T) {
-	privKey, _ := GenerateKey(rand.Reader, 128)
+	privKey, _ := GenerateKey(rand.Reader, MinKeyBits)
 	res:=GenPemPrivateKey(privKey)
 	fmt.Println(res)
 	file,err:=os.Create("priv.pem")
@@ -68,12 +70,376 @@ func TestParseKey(t *testing.T) {
 	if err != nil {
 		fmt.Println(err)
 	}
-	cipher,err:=Encrypt(pubKey,[]byte("lalala  "))
+	if privKey.N.Cmp(pubKey.N) != 0 {
+		t.Fatal("public key does not match private key")
+	}
+	cipher,err:=Encrypt(pubByte,[]byte("lalala  "))
 
-	res,_:=Decrypt(privKey,cipher)
+	res,_:=Decrypt(privByte,cipher)
 	fmt.Println("decode string",string(res))
 
 
 
 
-}
\ No newline at end of file
+}
+
+func TestProveZero(t *testing.T) {
+	privKey, _ := GenerateKey(rand.Reader, MinKeyBits)
+	pub := GenPemPublicKey(&privKey.PublicKey)
+	priv := GenPemPrivateKey(privKey)
+	context := []byte("test")
+
+	zero, nonce, err := EncryptWithNonce(pub, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := ProveZero(pub, zero, nonce, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = VerifyZero(pub, zero, proof, context); err != nil {
+		t.Fatal("valid zero proof rejected: ", err)
+	}
+	if err = VerifyZero(pub, zero, proof, []byte("other")); err == nil {
+		t.Fatal("zero proof accepted for another context")
+	}
+
+	ten, _, _ := EncryptWithNonce(pub, big.NewInt(10).Bytes())
+	if err = VerifyZero(pub, ten, proof, context); err == nil {
+		t.Fatal("zero proof accepted for a non zero cipher")
+	}
+
+	// the key owner can prove the plain text of any cipher text
+	nonce, err = RecoverNonce(priv, ten)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err = ProvePlaintext(pub, ten, big.NewInt(10).Bytes(), nonce, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = VerifyPlaintext(pub, ten, big.NewInt(10).Bytes(), proof, context); err != nil {
+		t.Fatal("valid plain text proof rejected: ", err)
+	}
+	if err = VerifyPlaintext(pub, ten, big.NewInt(11).Bytes(), proof, context); err == nil {
+		t.Fatal("plain text proof accepted for another plain text")
+	}
+
+	if ValidateCipher(pub, privKey.N.Bytes()) == nil {
+		t.Fatal("a multiple of N is not a valid cipher text")
+	}
+}
+
+func TestEncryptDeterministic(t *testing.T) {
+	privKey, _ := GenerateKey(rand.Reader, MinKeyBits)
+	pub := GenPemPublicKey(&privKey.PublicKey)
+	priv := GenPemPrivateKey(privKey)
+	m := big.NewInt(42).Bytes()
+
+	c1, err := EncryptDeterministic(pub, m, []byte("tx1/fee"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, _ := EncryptDeterministic(pub, m, []byte("tx1/fee"))
+	c3, _ := EncryptDeterministic(pub, m, []byte("tx2/fee"))
+	if !bytes.Equal(c1, c2) {
+		t.Fatal("same seed gave different cipher texts")
+	}
+	if bytes.Equal(c1, c3) {
+		t.Fatal("different seeds gave the same cipher text")
+	}
+
+	res, _ := Decrypt(priv, c1)
+	if new(big.Int).SetBytes(res).Int64() != 42 {
+		t.Fatal("wrong decryption of deterministic cipher text")
+	}
+}
+
+func TestSign(t *testing.T) {
+	privKey, _ := GenerateKey(rand.Reader, MinKeyBits)
+	pub := GenPemPublicKey(&privKey.PublicKey)
+	priv := GenPemPrivateKey(privKey)
+
+	sig, err := Sign(priv, []byte("rotate"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Verify(pub, []byte("rotate"), sig); err != nil {
+		t.Fatal("valid signature rejected: ", err)
+	}
+	if err = Verify(pub, []byte("revoke"), sig); err == nil {
+		t.Fatal("signature accepted for another message")
+	}
+
+	otherKey, _ := GenerateKey(rand.Reader, MinKeyBits)
+	if err = Verify(GenPemPublicKey(&otherKey.PublicKey), []byte("rotate"), sig); err == nil {
+		t.Fatal("signature accepted under another key")
+	}
+}
+
+func TestProveEqual(t *testing.T) {
+	keyA, _ := GenerateKey(rand.Reader, MinKeyBits)
+	keyB, _ := GenerateKey(rand.Reader, MinKeyBits+256)
+	pubs := [][]byte{GenPemPublicKey(&keyA.PublicKey), GenPemPublicKey(&keyB.PublicKey)}
+	m := big.NewInt(1234).Bytes()
+	context := []byte("test")
+
+	cA, rA, _ := EncryptWithNonce(pubs[0], m)
+	cB, rB, _ := EncryptWithNonce(pubs[1], m)
+	proof, err := ProveEqual(pubs, [][]byte{cA, cB}, m, [][]byte{rA, rB}, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = VerifyEqual(pubs, [][]byte{cA, cB}, proof, context); err != nil {
+		t.Fatal("valid equality proof rejected: ", err)
+	}
+
+	cOther, rOther, _ := EncryptWithNonce(pubs[1], big.NewInt(1235).Bytes())
+	if err = VerifyEqual(pubs, [][]byte{cA, cOther}, proof, context); err == nil {
+		t.Fatal("equality proof accepted for another cipher text")
+	}
+	proof, _ = ProveEqual(pubs, [][]byte{cA, cOther}, m, [][]byte{rA, rOther}, context)
+	if err = VerifyEqual(pubs, [][]byte{cA, cOther}, proof, context); err == nil {
+		t.Fatal("equality proof accepted for different plain texts")
+	}
+
+	// m + n_A encrypts m under A but another amount under B
+	wrapped := new(big.Int).Add(new(big.Int).SetBytes(m), keyA.N)
+	nonceA, _ := randomUnit(keyA.N)
+	cA, rA = encrypt(&keyA.PublicKey, wrapped, nonceA).Bytes(), nonceA.Bytes()
+	cB, rB, _ = EncryptWithNonce(pubs[1], wrapped.Bytes())
+	if _, err = ProveEqual(pubs, [][]byte{cA, cB}, wrapped.Bytes(), [][]byte{rA, rB}, context); err == nil {
+		t.Fatal("equality proof created for a plain text out of range")
+	}
+	proof, _ = proveEqual(pubs, [][]byte{cA, cB}, wrapped, [][]byte{rA, rB}, context)
+	if err = VerifyEqual(pubs, [][]byte{cA, cB}, proof, context); err == nil {
+		t.Fatal("equality proof accepted for a plain text above the modulus")
+	}
+
+	if _, err = GenerateKey(rand.Reader, MinKeyBits-8); err != ErrKeyTooSmall {
+		t.Fatal("key below the minimum size generated")
+	}
+}
+
+func TestProveRange(t *testing.T) {
+	key, _ := GenerateKey(rand.Reader, MinKeyBits)
+	pub := GenPemPublicKey(&key.PublicKey)
+	context := []byte("test")
+
+	m := new(big.Int).SetUint64(1<<64 - 1).Bytes()
+	c, r, _ := EncryptWithNonce(pub, m)
+	proof, err := ProveRange(pub, c, m, r, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = VerifyRange(pub, c, proof, context); err != nil {
+		t.Fatal("valid range proof rejected: ", err)
+	}
+	if err = VerifyRange(pub, c, proof, []byte("other")); err == nil {
+		t.Fatal("range proof accepted in another context")
+	}
+	cOther, _, _ := EncryptWithNonce(pub, m)
+	if err = VerifyRange(pub, cOther, proof, context); err == nil {
+		t.Fatal("range proof accepted for another cipher text")
+	}
+
+	// -1 is n - 1, far outside the range
+	neg := new(big.Int).Sub(key.N, one).Bytes()
+	c, r, _ = EncryptWithNonce(pub, neg)
+	if _, err = ProveRange(pub, c, neg, r, context); err == nil {
+		t.Fatal("range proof created for a negative value")
+	}
+}
+
+func TestProveRing(t *testing.T) {
+	var privs []*PrivateKey
+	var pubs, balances, amounts [][]byte
+	v := big.NewInt(30).Bytes()
+	for i := 0; i < 3; i++ {
+		key, _ := GenerateKey(rand.Reader, MinKeyBits)
+		privs = append(privs, key)
+		pubs = append(pubs, GenPemPublicKey(&key.PublicKey))
+		balance, _ := Encrypt(pubs[i], big.NewInt(100).Bytes())
+		balances = append(balances, balance)
+		amount, _ := Encrypt(pubs[i], v)
+		amounts = append(amounts, amount)
+	}
+	context := []byte("test")
+
+	// member 0 pays member 2, member 1 is a decoy
+	var debits, credits, debitNonces, creditNonces [][]byte
+	for i := range pubs {
+		debit, nonce, _ := EncryptWithNonce(pubs[i], nil)
+		debitNonces = append(debitNonces, nonce)
+		if i == 0 {
+			debit, _ = SubCipher(pubs[i], debit, amounts[i])
+		}
+		debits = append(debits, debit)
+		credit, nonce, _ := EncryptWithNonce(pubs[i], nil)
+		creditNonces = append(creditNonces, nonce)
+		if i == 2 {
+			credit, _ = AddCipher(pubs[i], credit, amounts[i])
+		}
+		credits = append(credits, credit)
+	}
+	remainder, _ := AddCipher(pubs[0], balances[0], debits[0])
+	remainderNonce, _ := RecoverNonce(GenPemPrivateKey(privs[0]), remainder)
+	msg := []byte("debit")
+	sig, _ := Sign(GenPemPrivateKey(privs[0]), msg)
+
+	debitProof, err := ProveRingDebit(pubs, balances, debits, amounts, 0, debitNonces, big.NewInt(70).Bytes(), remainderNonce, msg, sig, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = VerifyRingDebit(pubs, balances, debits, amounts, msg, debitProof, context); err != nil {
+		t.Fatal("valid ring debit proof rejected: ", err)
+	}
+	if err = VerifyRingDebit(pubs, balances, debits, amounts, msg, debitProof, []byte("other")); err == nil {
+		t.Fatal("ring debit proof accepted in another context")
+	}
+	if err = VerifyRingDebit(pubs, balances, debits, amounts, []byte("other"), debitProof, context); err == nil {
+		t.Fatal("ring debit proof accepted for another message")
+	}
+
+	// the debited member has to sign, a signature of another member does not do
+	otherSig, _ := Sign(GenPemPrivateKey(privs[1]), msg)
+	if _, err = ProveRingDebit(pubs, balances, debits, amounts, 0, debitNonces, big.NewInt(70).Bytes(), remainderNonce, msg, otherSig, context); err == nil {
+		t.Fatal("ring debit proof created with the signature of another member")
+	}
+	creditProof, err := ProveRingCredit(pubs, credits, amounts, 2, creditNonces, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = VerifyRingCredit(pubs, credits, amounts, creditProof, context); err != nil {
+		t.Fatal("valid ring credit proof rejected: ", err)
+	}
+	if err = VerifyRingDebit(pubs, balances, credits, amounts, msg, creditProof, context); err == nil {
+		t.Fatal("ring credit proof accepted as a debit")
+	}
+
+	// a second credit fails whatever branch the prover picks
+	credits[1], _ = AddCipher(pubs[1], credits[1], amounts[1])
+	creditProof, _ = ProveRingCredit(pubs, credits, amounts, 2, creditNonces, context)
+	if err = VerifyRingCredit(pubs, credits, amounts, creditProof, context); err == nil {
+		t.Fatal("ring credit proof accepted for two credits")
+	}
+
+	// a debit over the balance has no remainder in range
+	balances[0], _ = Encrypt(pubs[0], big.NewInt(10).Bytes())
+	remainder, _ = AddCipher(pubs[0], balances[0], debits[0])
+	remainderNonce, _ = RecoverNonce(GenPemPrivateKey(privs[0]), remainder)
+	debitProof, err = ProveRingDebit(pubs, balances, debits, amounts, 0, debitNonces, big.NewInt(10).Bytes(), remainderNonce, msg, sig, context)
+	if err == nil {
+		err = VerifyRingDebit(pubs, balances, debits, amounts, msg, debitProof, context)
+	}
+	if err == nil {
+		t.Fatal("ring debit proof accepted for an overdraft")
+	}
+}
+
+func TestGenerateKeyFromSeed(t *testing.T) {
+	key, err := GenerateKeyFromSeed([]byte("seed"), MinKeyBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.N.BitLen() != MinKeyBits {
+		t.Fatal("unexpected modulus size: ", key.N.BitLen())
+	}
+	same, _ := GenerateKeyFromSeed([]byte("seed"), MinKeyBits)
+	if !bytes.Equal(GenPemPrivateKey(key), GenPemPrivateKey(same)) {
+		t.Fatal("same seed derived different keys")
+	}
+	other, _ := GenerateKeyFromSeed([]byte("other"), MinKeyBits)
+	if other.N.Cmp(key.N) == 0 {
+		t.Fatal("different seeds derived the same key")
+	}
+
+	m := big.NewInt(42).Bytes()
+	c, _ := Encrypt(GenPemPublicKey(&key.PublicKey), m)
+	plain, err := Decrypt(GenPemPrivateKey(same), c)
+	if err != nil || !bytes.Equal(plain, m) {
+		t.Fatal("derived key does not decrypt")
+	}
+}
+
+func TestSealMemo(t *testing.T) {
+	key, _ := GenerateKey(rand.Reader, MinKeyBits)
+	pub := GenPemPublicKey(&key.PublicKey)
+	priv := GenPemPrivateKey(key)
+	other, _ := GenerateKey(rand.Reader, MinKeyBits)
+
+	memo, err := SealMemo(pub, []byte("invoice 42"), []byte("context"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ValidateMemo(pub, memo); err != nil {
+		t.Fatal(err)
+	}
+	text, err := OpenMemo(priv, memo, []byte("context"))
+	if err != nil || string(text) != "invoice 42" {
+		t.Fatal("memo does not open")
+	}
+	if _, err = OpenMemo(priv, memo, []byte("other context")); err == nil {
+		t.Fatal("memo opened with another context")
+	}
+	if _, err = OpenMemo(GenPemPrivateKey(other), memo, []byte("context")); err == nil {
+		t.Fatal("memo opened with another key")
+	}
+	if _, err = SealMemo(pub, make([]byte, MaxMemoSize+1), nil); err == nil {
+		t.Fatal("sealed a memo that is too long")
+	}
+}
+
+func TestSharedKey(t *testing.T) {
+	key, shares, err := GenerateSharedKey(rand.Reader, MinKeyBits, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := GenPemPublicKey(&key.PublicKey)
+	sharedKey := GenPemSharedKey(key)
+	var shareBytes [][]byte
+	for _, share := range shares {
+		shareBytes = append(shareBytes, GenPemKeyShare(share))
+	}
+
+	cipher, nonce, _ := EncryptWithNonce(pub, big.NewInt(42).Bytes())
+	partial := func(i int, cipher []byte) []byte {
+		p, err := PartialOpen(shareBytes[i], cipher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	// any two holders open, in any order
+	for _, pair := range [][]int{{0, 1}, {2, 0}, {1, 2}} {
+		m, r, err := CombineOpening(sharedKey, cipher, [][]byte{partial(pair[0], cipher), partial(pair[1], cipher)})
+		if err != nil || new(big.Int).SetBytes(m).Int64() != 42 || !bytes.Equal(r, nonce) {
+			t.Fatal("shared key does not open the cipher text")
+		}
+	}
+	if _, _, err = CombineOpening(sharedKey, cipher, [][]byte{partial(0, cipher), partial(0, cipher)}); err == nil {
+		t.Fatal("opened with one holder")
+	}
+	other, _ := Encrypt(pub, big.NewInt(7).Bytes())
+	if _, _, err = CombineOpening(sharedKey, cipher, [][]byte{partial(0, cipher), partial(1, other)}); err == nil {
+		t.Fatal("opened with a partial result of another cipher text")
+	}
+
+	// the holders sign for the public key
+	var partials [][]byte
+	for _, share := range shareBytes[1:] {
+		p, err := PartialSign(share, []byte("msg"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		partials = append(partials, p)
+	}
+	sig, err := CombineSignature(sharedKey, []byte("msg"), partials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Verify(pub, []byte("msg"), sig); err != nil {
+		t.Fatal("shared signature does not verify")
+	}
+}
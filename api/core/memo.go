@@ -0,0 +1,104 @@
+package gohe
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+)
+
+// memoKeyLabel separates the memo key from other hashes of the same secret.
+const memoKeyLabel = "gopaillier/memo-key/v1"
+
+// MaxMemoSize is the largest memo in bytes.
+const MaxMemoSize = 512
+
+// Memo is a short text encrypted to the holder of a Paillier key. A random
+// secret s < n is encrypted under the key, and SHA-256 of s is the AES-256
+// key that seals the text with GCM.
+type Memo struct {
+	Key   []byte // Paillier encryption of s
+	Nonce []byte // GCM nonce
+	Text  []byte // sealed text with the GCM tag
+}
+
+// SealMemo encrypts text to the holder of pubKeyBytes. context is
+// authenticated but not encrypted: a memo only opens with the context it was
+// sealed with, which binds it to a transfer.
+func SealMemo(pubKeyBytes []byte, text []byte, context []byte) (*Memo, error) {
+	if len(text) > MaxMemoSize {
+		return nil, errors.New("paillier: memo too long")
+	}
+	pubKey, err := ParsePublicKey(pubKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	s, err := rand.Int(rand.Reader, pubKey.N)
+	if err != nil {
+		return nil, err
+	}
+	key, err := Encrypt(pubKeyBytes, s.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := memoCipher(pubKey, s)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return &Memo{Key: key, Nonce: nonce, Text: aead.Seal(nil, nonce, text, context)}, nil
+}
+
+// OpenMemo decrypts a memo sealed by SealMemo with the same context.
+func OpenMemo(privKeyBytes []byte, memo *Memo, context []byte) ([]byte, error) {
+	privKey, err := ParsePrivateKey(privKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	err = ValidateMemo(GenPemPublicKey(&privKey.PublicKey), memo)
+	if err != nil {
+		return nil, err
+	}
+	s := new(big.Int).SetBytes(decrypt(privKey, new(big.Int).SetBytes(memo.Key)))
+	aead, err := memoCipher(&privKey.PublicKey, s)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, memo.Nonce, memo.Text, context)
+}
+
+// ValidateMemo checks the shape of a memo for the given key. Whether it
+// opens can only be told with the private key.
+func ValidateMemo(pubKeyBytes []byte, memo *Memo) error {
+	if memo == nil {
+		return errors.New("paillier: no memo")
+	}
+	err := ValidateCipher(pubKeyBytes, memo.Key)
+	if err != nil {
+		return err
+	}
+	// GCM uses 12 byte nonces and 16 byte tags
+	if len(memo.Nonce) != 12 || len(memo.Text) < 16 || len(memo.Text) > MaxMemoSize+16 {
+		return errors.New("paillier: malformed memo")
+	}
+	return nil
+}
+
+// memoCipher derives the AES-GCM cipher of the secret s. s is padded to the
+// size of n so the key does not depend on its leading zeros.
+func memoCipher(pubKey *PublicKey, s *big.Int) (cipher.AEAD, error) {
+	secret := s.FillBytes(make([]byte, (pubKey.N.BitLen()+7)/8))
+	key := sha256.Sum256(append([]byte(memoKeyLabel), secret...))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
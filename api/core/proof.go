@@ -0,0 +1,369 @@
+package gohe
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/big"
+)
+
+// ErrInvalidCipher is returned when a cipher text is not an element of
+// Z*_{n^2} for the given public key.
+var ErrInvalidCipher = errors.New("paillier: cipher text is not in Z*_{n^2}")
+
+// ErrInvalidProof is returned when a zero knowledge proof does not verify.
+var ErrInvalidProof = errors.New("paillier: invalid proof")
+
+// Domain separation labels of the Fiat-Shamir challenges.
+const (
+	zeroProofLabel     = "gopaillier/zero-proof/v1"
+	equalityProofLabel = "gopaillier/equality-proof/v1"
+)
+
+// statisticalBits is the statistical hiding margin of responses computed
+// over the integers.
+const statisticalBits = 128
+
+// ZeroProof is a non-interactive proof of knowledge of r such that
+// c = r^n mod n^2, i.e. that the cipher text c encrypts zero.
+type ZeroProof struct {
+	A *big.Int // commitment s^n mod n^2
+	Z *big.Int // response s * r^e mod n
+}
+
+// EqualityProof is a non-interactive proof that cipher texts under several
+// public keys encrypt the same plain text m < 2^RangeBits. For every key i it
+// proves g_i^z * w_i^n_i = a_i * c_i^e mod n_i^2 with a single integer
+// response z = x + e*m. The verifier bounds z, and every modulus has at least
+// MinKeyBits bits, so z cannot wrap around a modulus: a proof over m >= n_i,
+// which would link different plain texts under different keys, is rejected.
+type EqualityProof struct {
+	A []*big.Int // commitments g_i^x * s_i^n_i mod n_i^2
+	Z *big.Int   // response x + e*m over the integers
+	W []*big.Int // responses s_i * r_i^e mod n_i
+}
+
+// ValidateCipher checks that a cipher text is an element of Z*_{n^2}.
+func ValidateCipher(pubKeyBytes []byte, cipher []byte) error {
+	pubKey, err := ParsePublicKey(pubKeyBytes)
+	if err != nil {
+		return err
+	}
+	if !isUnit(new(big.Int).SetBytes(cipher), pubKey.NSquared, pubKey.N) {
+		return ErrInvalidCipher
+	}
+	return nil
+}
+
+// EncryptWithNonce encrypts a plain text like Encrypt and also returns the
+// random nonce r, which the caller needs to prove statements about the
+// cipher text.
+func EncryptWithNonce(pubKeyBytes []byte, plainText []byte) (cipher []byte, nonce []byte, err error) {
+	pubKey, err := ParsePublicKey(pubKeyBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m := new(big.Int).SetBytes(plainText)
+	if pubKey.N.Cmp(m) < 1 { // N < m
+		return nil, nil, ErrMessageTooLong
+	}
+
+	r, err := randomUnit(pubKey.N)
+	if err != nil {
+		return nil, nil, err
+	}
+	return encrypt(pubKey, m, r).Bytes(), r.Bytes(), nil
+}
+
+// RecoverNonce recovers the nonce r of a cipher text with the private key,
+// so a key owner can prove statements about cipher texts it did not create,
+// such as its own balance.
+func RecoverNonce(privKeyBytes []byte, cipher []byte) ([]byte, error) {
+	privKey, err := ParsePrivateKey(privKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	c := new(big.Int).SetBytes(cipher)
+	if !isUnit(c, privKey.NSquared, privKey.N) {
+		return nil, ErrInvalidCipher
+	}
+	return recoverNonce(privKey, c).Bytes(), nil
+}
+
+// ProveZero proves that cipher, created with nonce, encrypts zero. The
+// context is bound into the challenge so the proof cannot be replayed
+// elsewhere.
+func ProveZero(pubKeyBytes []byte, cipher, nonce, context []byte) (*ZeroProof, error) {
+	pubKey, err := ParsePublicKey(pubKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	return proveZero(pubKey, new(big.Int).SetBytes(cipher), new(big.Int).SetBytes(nonce), context)
+}
+
+// VerifyZero verifies a proof created by ProveZero.
+func VerifyZero(pubKeyBytes []byte, cipher []byte, proof *ZeroProof, context []byte) error {
+	pubKey, err := ParsePublicKey(pubKeyBytes)
+	if err != nil {
+		return err
+	}
+	return verifyZero(pubKey, new(big.Int).SetBytes(cipher), proof, context)
+}
+
+// ProvePlaintext proves that cipher, created with nonce, encrypts the public
+// plain text. It is a proof that cipher * g^-m encrypts zero.
+func ProvePlaintext(pubKeyBytes []byte, cipher, plainText, nonce, context []byte) (*ZeroProof, error) {
+	pubKey, err := ParsePublicKey(pubKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	u := subPlain(pubKey, new(big.Int).SetBytes(cipher), new(big.Int).SetBytes(plainText))
+	return proveZero(pubKey, u, new(big.Int).SetBytes(nonce), context)
+}
+
+// VerifyPlaintext verifies a proof created by ProvePlaintext.
+func VerifyPlaintext(pubKeyBytes []byte, cipher, plainText []byte, proof *ZeroProof, context []byte) error {
+	pubKey, err := ParsePublicKey(pubKeyBytes)
+	if err != nil {
+		return err
+	}
+	c := new(big.Int).SetBytes(cipher)
+	if !isUnit(c, pubKey.NSquared, pubKey.N) {
+		return ErrInvalidCipher
+	}
+	return verifyZero(pubKey, subPlain(pubKey, c, new(big.Int).SetBytes(plainText)), proof, context)
+}
+
+// ProveEqual proves that ciphers[i], created under pubKeys[i] with
+// nonces[i], all encrypt plainText, which must be below 2^RangeBits.
+func ProveEqual(pubKeys [][]byte, ciphers [][]byte, plainText []byte, nonces [][]byte, context []byte) (*EqualityProof, error) {
+	m := new(big.Int).SetBytes(plainText)
+	if m.BitLen() > RangeBits {
+		return nil, errors.New("paillier: plain text out of range")
+	}
+	return proveEqual(pubKeys, ciphers, m, nonces, context)
+}
+
+func proveEqual(pubKeys [][]byte, ciphers [][]byte, m *big.Int, nonces [][]byte, context []byte) (*EqualityProof, error) {
+	if len(pubKeys) == 0 || len(pubKeys) != len(ciphers) || len(pubKeys) != len(nonces) {
+		return nil, errors.New("paillier: need one cipher text and nonce per key")
+	}
+	keys, err := parsePublicKeys(pubKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	x, err := rand.Int(rand.Reader, new(big.Int).Lsh(one, equalityBound))
+	if err != nil {
+		return nil, err
+	}
+
+	proof := &EqualityProof{}
+	s := make([]*big.Int, len(keys))
+	for i, pubKey := range keys {
+		s[i], err = randomUnit(pubKey.N)
+		if err != nil {
+			return nil, err
+		}
+		proof.A = append(proof.A, encrypt(pubKey, x, s[i]))
+	}
+
+	e := equalityChallenge(keys, bytesToInts(ciphers), proof.A, context)
+	proof.Z = new(big.Int).Add(x, new(big.Int).Mul(e, m))
+	for i, pubKey := range keys {
+		proof.W = append(proof.W, zeroResponse(pubKey, s[i], new(big.Int).SetBytes(nonces[i]), e))
+	}
+	return proof, nil
+}
+
+// VerifyEqual verifies a proof created by ProveEqual.
+func VerifyEqual(pubKeys [][]byte, ciphers [][]byte, proof *EqualityProof, context []byte) error {
+	if len(pubKeys) == 0 || len(pubKeys) != len(ciphers) {
+		return errors.New("paillier: need one cipher text per key")
+	}
+	if proof == nil || proof.Z == nil || len(proof.A) != len(pubKeys) || len(proof.W) != len(pubKeys) {
+		return ErrInvalidProof
+	}
+	keys, err := parsePublicKeys(pubKeys)
+	if err != nil {
+		return err
+	}
+	cs := bytesToInts(ciphers)
+	for i, pubKey := range keys {
+		if !isUnit(cs[i], pubKey.NSquared, pubKey.N) {
+			return ErrInvalidCipher
+		}
+		if proof.A[i] == nil || proof.W[i] == nil {
+			return ErrInvalidProof
+		}
+	}
+	// z = x + e*m is below 2^(bound+1) for an honest prover
+	if proof.Z.Sign() < 0 || proof.Z.BitLen() > equalityBound+1 {
+		return ErrInvalidProof
+	}
+
+	e := equalityChallenge(keys, cs, proof.A, context)
+	for i, pubKey := range keys {
+		if !isUnit(proof.A[i], pubKey.NSquared, pubKey.N) || !isUnit(proof.W[i], pubKey.N, pubKey.N) {
+			return ErrInvalidProof
+		}
+		lhs := encrypt(pubKey, proof.Z, proof.W[i])
+		rhs := new(big.Int).Exp(cs[i], e, pubKey.NSquared)
+		rhs.Mul(rhs, proof.A[i])
+		rhs.Mod(rhs, pubKey.NSquared)
+		if lhs.Cmp(rhs) != 0 {
+			return ErrInvalidProof
+		}
+	}
+	return nil
+}
+
+// equalityBound is the bit length of the mask x, large enough to hide e*m
+// for any m below 2^RangeBits. MinKeyBits is above equalityBound+2, so the
+// difference of two responses is smaller than half of any modulus.
+const equalityBound = RangeBits + sha256.Size*8 + statisticalBits
+
+func equalityChallenge(keys []*PublicKey, ciphers, commitments []*big.Int, context []byte) *big.Int {
+	var values []*big.Int
+	for i, pubKey := range keys {
+		values = append(values, pubKey.N, ciphers[i], commitments[i])
+	}
+	return challenge(equalityProofLabel, context, values...)
+}
+
+func parsePublicKeys(pubKeys [][]byte) ([]*PublicKey, error) {
+	keys := make([]*PublicKey, len(pubKeys))
+	for i, pubKeyBytes := range pubKeys {
+		pubKey, err := ParsePublicKey(pubKeyBytes)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = pubKey
+	}
+	return keys, nil
+}
+
+func bytesToInts(bs [][]byte) []*big.Int {
+	ints := make([]*big.Int, len(bs))
+	for i, b := range bs {
+		ints[i] = new(big.Int).SetBytes(b)
+	}
+	return ints
+}
+
+func proveZero(pubKey *PublicKey, u, r *big.Int, context []byte) (*ZeroProof, error) {
+	s, a, err := zeroCommit(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	e := challenge(zeroProofLabel, context, pubKey.N, u, a)
+	return &ZeroProof{A: a, Z: zeroResponse(pubKey, s, r, e)}, nil
+}
+
+func verifyZero(pubKey *PublicKey, u *big.Int, proof *ZeroProof, context []byte) error {
+	if proof == nil || proof.A == nil || proof.Z == nil {
+		return ErrInvalidProof
+	}
+	if !isUnit(u, pubKey.NSquared, pubKey.N) {
+		return ErrInvalidCipher
+	}
+	e := challenge(zeroProofLabel, context, pubKey.N, u, proof.A)
+	if !zeroCheck(pubKey, u, proof.A, e, proof.Z) {
+		return ErrInvalidProof
+	}
+	return nil
+}
+
+// zeroCommit is the first move of the n-th residue sigma protocol.
+func zeroCommit(pubKey *PublicKey) (s, a *big.Int, err error) {
+	s, err = randomUnit(pubKey.N)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, new(big.Int).Exp(s, pubKey.N, pubKey.NSquared), nil
+}
+
+// zeroResponse answers the challenge e for the witness r of u = r^n.
+func zeroResponse(pubKey *PublicKey, s, r, e *big.Int) *big.Int {
+	z := new(big.Int).Exp(r, e, pubKey.N)
+	z.Mul(z, s)
+	return z.Mod(z, pubKey.N)
+}
+
+// zeroCheck verifies z^n = a * u^e mod n^2.
+func zeroCheck(pubKey *PublicKey, u, a, e, z *big.Int) bool {
+	if !isUnit(a, pubKey.NSquared, pubKey.N) || !isUnit(z, pubKey.N, pubKey.N) {
+		return false
+	}
+	lhs := new(big.Int).Exp(z, pubKey.N, pubKey.NSquared)
+	rhs := new(big.Int).Exp(u, e, pubKey.NSquared)
+	rhs.Mul(rhs, a)
+	rhs.Mod(rhs, pubKey.NSquared)
+	return lhs.Cmp(rhs) == 0
+}
+
+// encrypt computes g^m * r^n mod n^2.
+func encrypt(pubKey *PublicKey, m, r *big.Int) *big.Int {
+	c := new(big.Int).Exp(pubKey.G, m, pubKey.NSquared)
+	c.Mul(c, new(big.Int).Exp(r, pubKey.N, pubKey.NSquared))
+	return c.Mod(c, pubKey.NSquared)
+}
+
+// subPlain computes c * g^-m mod n^2.
+func subPlain(pubKey *PublicKey, c, m *big.Int) *big.Int {
+	neg := new(big.Int).Neg(m)
+	neg.Mod(neg, pubKey.N)
+	u := new(big.Int).Exp(pubKey.G, neg, pubKey.NSquared)
+	u.Mul(u, c)
+	return u.Mod(u, pubKey.NSquared)
+}
+
+// recoverNonce computes r = (c * g^-m)^(n^-1 mod phi(n)) mod n.
+func recoverNonce(privKey *PrivateKey, c *big.Int) *big.Int {
+	m := new(big.Int).SetBytes(decrypt(privKey, c))
+	u := subPlain(&privKey.PublicKey, c, m)
+	u.Mod(u, privKey.N)
+	d := new(big.Int).ModInverse(privKey.N, privKey.L)
+	return u.Exp(u, d, privKey.N)
+}
+
+// randomUnit returns a uniformly random element of Z*_n.
+func randomUnit(n *big.Int) (*big.Int, error) {
+	for {
+		r, err := rand.Int(rand.Reader, n)
+		if err != nil {
+			return nil, err
+		}
+		if isUnit(r, n, n) {
+			return r, nil
+		}
+	}
+}
+
+// isUnit reports whether 0 < x < bound and gcd(x, n) = 1.
+func isUnit(x, bound, n *big.Int) bool {
+	if x.Sign() <= 0 || x.Cmp(bound) >= 0 {
+		return false
+	}
+	return new(big.Int).GCD(nil, nil, x, n).Cmp(one) == 0
+}
+
+// challenge derives a Fiat-Shamir challenge from a domain label, the caller
+// supplied context and the public values of the proof.
+func challenge(label string, context []byte, values ...*big.Int) *big.Int {
+	h := sha256.New()
+	writeBytes := func(b []byte) {
+		var l [8]byte
+		binary.BigEndian.PutUint64(l[:], uint64(len(b)))
+		h.Write(l[:])
+		h.Write(b)
+	}
+	writeBytes([]byte(label))
+	writeBytes(context)
+	for _, v := range values {
+		writeBytes(v.Bytes())
+	}
+	return new(big.Int).SetBytes(h.Sum(nil))
+}
@@ -0,0 +1,216 @@
+package gohe
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+)
+
+// RangeBits is the bit length of the values a RangeProof covers. Amounts and
+// balances are below 2^RangeBits, so a cipher text of a "negative" value,
+// which is a plain text close to n, cannot pass.
+const RangeBits = 64
+
+// rangeProofLabel separates the bit challenges from other proofs.
+const rangeProofLabel = "gopaillier/range-proof/v1"
+
+// challengeModulus is the size of the challenge space, 2^256.
+var challengeModulus = new(big.Int).Lsh(one, 256)
+
+// BitProof proves that the cipher text C encrypts 0 or 1. It is an OR of two
+// zero proofs, for C and for C * g^-1, whose challenges E0 and E1 add up to
+// the Fiat-Shamir challenge, so the prover can simulate one of them.
+type BitProof struct {
+	C  *big.Int // encryption of the bit
+	A0 *big.Int // commitment of the branch "C encrypts 0"
+	A1 *big.Int // commitment of the branch "C encrypts 1"
+	E0 *big.Int // challenge of branch 0, branch 1 gets e - E0 mod 2^256
+	Z0 *big.Int
+	Z1 *big.Int
+}
+
+// RangeProof is a non-interactive proof that a cipher text c encrypts a
+// value m with 0 <= m < 2^RangeBits. It encrypts the bits b_i of m, proves
+// each is 0 or 1, and proves that prod(C_i^(2^i)) / c encrypts zero.
+type RangeProof struct {
+	Bits []*BitProof
+	Sum  *ZeroProof
+}
+
+// ProveRange proves that cipher, created with nonce, encrypts plainText and
+// that plainText is below 2^RangeBits.
+func ProveRange(pubKeyBytes []byte, cipher, plainText, nonce, context []byte) (*RangeProof, error) {
+	pubKey, err := ParsePublicKey(pubKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	if pubKey.N.BitLen() <= RangeBits+1 {
+		return nil, errors.New("paillier: modulus too small for range proofs")
+	}
+	m := new(big.Int).SetBytes(plainText)
+	if m.BitLen() > RangeBits {
+		return nil, errors.New("paillier: value out of range")
+	}
+	c := new(big.Int).SetBytes(cipher)
+
+	proof := &RangeProof{}
+	// R = prod(r_i^(2^i)) / r is the nonce of the recombination
+	R := new(big.Int).ModInverse(new(big.Int).SetBytes(nonce), pubKey.N)
+	if R == nil {
+		return nil, ErrInvalidCipher
+	}
+	for i := 0; i < RangeBits; i++ {
+		r, err := randomUnit(pubKey.N)
+		if err != nil {
+			return nil, err
+		}
+		bit, err := proveBit(pubKey, c, i, m.Bit(i), r, context)
+		if err != nil {
+			return nil, err
+		}
+		proof.Bits = append(proof.Bits, bit)
+
+		r.Exp(r, new(big.Int).Lsh(one, uint(i)), pubKey.N)
+		R.Mul(R, r)
+		R.Mod(R, pubKey.N)
+	}
+
+	proof.Sum, err = proveZero(pubKey, recombine(pubKey, c, proof.Bits), R, context)
+	if err != nil {
+		return nil, err
+	}
+	return proof, nil
+}
+
+// VerifyRange verifies a proof created by ProveRange.
+func VerifyRange(pubKeyBytes []byte, cipher []byte, proof *RangeProof, context []byte) error {
+	pubKey, err := ParsePublicKey(pubKeyBytes)
+	if err != nil {
+		return err
+	}
+	if pubKey.N.BitLen() <= RangeBits+1 {
+		return errors.New("paillier: modulus too small for range proofs")
+	}
+	c := new(big.Int).SetBytes(cipher)
+	if !isUnit(c, pubKey.NSquared, pubKey.N) {
+		return ErrInvalidCipher
+	}
+	if proof == nil || len(proof.Bits) != RangeBits {
+		return ErrInvalidProof
+	}
+
+	for i, bit := range proof.Bits {
+		if !verifyBit(pubKey, c, i, bit, context) {
+			return ErrInvalidProof
+		}
+	}
+	return verifyZero(pubKey, recombine(pubKey, c, proof.Bits), proof.Sum, context)
+}
+
+// proveBit encrypts bit b of the value in c with nonce r and proves it is
+// 0 or 1, answering the real branch and simulating the other.
+func proveBit(pubKey *PublicKey, c *big.Int, i int, b uint, r *big.Int, context []byte) (*BitProof, error) {
+	bit, w, err := commitBit(pubKey, b, r)
+	if err != nil {
+		return nil, err
+	}
+	answerBit(pubKey, bit, w, bitChallenge(pubKey, c, i, bit.C, bit.A0, bit.A1, context))
+	return bit, nil
+}
+
+// bitWitness is what the prover of a BitProof keeps between the commitments
+// and the challenge.
+type bitWitness struct {
+	b      uint
+	r, s   *big.Int // nonce of the bit and randomness of the real branch
+	ef, zf *big.Int // challenge and response of the simulated branch
+}
+
+// commitBit encrypts the bit b with nonce r and commits to both branches,
+// simulating the false one.
+func commitBit(pubKey *PublicKey, b uint, r *big.Int) (*BitProof, *bitWitness, error) {
+	bit := &BitProof{C: encrypt(pubKey, big.NewInt(int64(b)), r)}
+	u := [2]*big.Int{bit.C, subPlain(pubKey, bit.C, one)}
+	a := [2]*big.Int{}
+	w := &bitWitness{b: b, r: r}
+
+	var err error
+	w.ef, err = rand.Int(rand.Reader, challengeModulus)
+	if err != nil {
+		return nil, nil, err
+	}
+	a[1-b], w.zf, err = simulateZero(pubKey, u[1-b], w.ef)
+	if err != nil {
+		return nil, nil, err
+	}
+	w.s, a[b], err = zeroCommit(pubKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	bit.A0, bit.A1 = a[0], a[1]
+	return bit, w, nil
+}
+
+// answerBit completes a bit proof for the challenge e: the real branch gets
+// e minus the challenge of the simulated one.
+func answerBit(pubKey *PublicKey, bit *BitProof, w *bitWitness, e *big.Int) {
+	eb := new(big.Int).Sub(e, w.ef)
+	eb.Mod(eb, challengeModulus)
+	zb := zeroResponse(pubKey, w.s, w.r, eb)
+	if w.b == 0 {
+		bit.E0, bit.Z0, bit.Z1 = eb, zb, w.zf
+	} else {
+		bit.E0, bit.Z0, bit.Z1 = w.ef, w.zf, zb
+	}
+}
+
+// simulateZero answers the challenge e for u without a witness: it picks z
+// and computes the commitment a = z^n / u^e.
+func simulateZero(pubKey *PublicKey, u, e *big.Int) (a, z *big.Int, err error) {
+	z, err = randomUnit(pubKey.N)
+	if err != nil {
+		return nil, nil, err
+	}
+	a = new(big.Int).Exp(u, e, pubKey.NSquared)
+	a.ModInverse(a, pubKey.NSquared)
+	a.Mul(a, new(big.Int).Exp(z, pubKey.N, pubKey.NSquared))
+	a.Mod(a, pubKey.NSquared)
+	return a, z, nil
+}
+
+func verifyBit(pubKey *PublicKey, c *big.Int, i int, bit *BitProof, context []byte) bool {
+	if !bitWellFormed(pubKey, bit) {
+		return false
+	}
+	return checkBit(pubKey, bit, bitChallenge(pubKey, c, i, bit.C, bit.A0, bit.A1, context))
+}
+
+func bitWellFormed(pubKey *PublicKey, bit *BitProof) bool {
+	if bit == nil || bit.C == nil || bit.A0 == nil || bit.A1 == nil || bit.E0 == nil || bit.Z0 == nil || bit.Z1 == nil {
+		return false
+	}
+	return isUnit(bit.C, pubKey.NSquared, pubKey.N) && bit.E0.Sign() >= 0 && bit.E0.Cmp(challengeModulus) < 0
+}
+
+// checkBit verifies both branches of a bit proof for the challenge e.
+func checkBit(pubKey *PublicKey, bit *BitProof, e *big.Int) bool {
+	e1 := new(big.Int).Sub(e, bit.E0)
+	e1.Mod(e1, challengeModulus)
+	return zeroCheck(pubKey, bit.C, bit.A0, bit.E0, bit.Z0) &&
+		zeroCheck(pubKey, subPlain(pubKey, bit.C, one), bit.A1, e1, bit.Z1)
+}
+
+func bitChallenge(pubKey *PublicKey, c *big.Int, i int, bitCipher, a0, a1 *big.Int, context []byte) *big.Int {
+	return challenge(rangeProofLabel, context, pubKey.N, c, big.NewInt(int64(i)), bitCipher, a0, a1)
+}
+
+// recombine computes prod(C_i^(2^i)) / c, an encryption of zero exactly when
+// the bits add up to the plain text of c.
+func recombine(pubKey *PublicKey, c *big.Int, bits []*BitProof) *big.Int {
+	u := new(big.Int).ModInverse(c, pubKey.NSquared)
+	for i, bit := range bits {
+		u.Mul(u, new(big.Int).Exp(bit.C, new(big.Int).Lsh(one, uint(i)), pubKey.NSquared))
+		u.Mod(u, pubKey.NSquared)
+	}
+	return u
+}
@@ -0,0 +1,442 @@
+package gohe
+
+import (
+	"crypto/rand"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+)
+
+// Domain separation labels of the ring proofs.
+const (
+	ringDebitLabel  = "gopaillier/ring-debit/v1"
+	ringCreditLabel = "gopaillier/ring-credit/v1"
+)
+
+// RingBranch is the branch of a RingProof for member j: the update of j
+// shifted by its amount and the updates of the other members encrypt zero.
+// A debit branch also proves that the remaining balance of j is below
+// 2^RangeBits, like a RangeProof answering the challenge of the branch in
+// place of the bit challenges, and that the prover holds a signature of j.
+type RingBranch struct {
+	E    *big.Int    // challenge of the branch
+	A    []*big.Int  // zero proof commitments, one per member
+	Z    []*big.Int  // zero proof responses, one per member
+	Bits []*BitProof // debit only: bits of the remaining balance, E0 + E1 = E
+	Sum  *ZeroProof  // debit only: the bits add up to the remaining balance
+	Sig  *SigProof   // debit only: knowledge of the signature of j
+}
+
+// SigProof is a proof of knowledge of a signature created by Sign, the plain
+// text s1 and nonce s2 of the hash h of the message: it proves
+// g^Z1 * Z2^n = A * h^e mod n^2 without telling s1 or s2.
+type SigProof struct {
+	A  *big.Int // commitment g^a * b^n mod n^2
+	Z1 *big.Int // response a + e*s1 mod n
+	Z2 *big.Int // response b * s2^e mod n
+}
+
+// RingProof is a non-interactive OR proof over the members of a ring, one
+// branch per member, whose challenges add up to the Fiat-Shamir challenge
+// mod 2^256. The prover answers the branch of the real member and simulates
+// the others, so a verifier learns that the updates change the balance of
+// exactly one member by its amount, but not of which.
+type RingProof struct {
+	Branches []*RingBranch
+}
+
+// ProveRingDebit proves that updates take the plain text of amounts[index]
+// from the balance of member index, leave the balances of the other members
+// unchanged, and that the remaining balance of member index is below
+// 2^RangeBits. updates[index] * amounts[index] and updates[i] of the other
+// members must encrypt zero with nonces[i]; remainder and remainderNonce are
+// the plain text and nonce of balances[index] * updates[index].
+//
+// sig is the signature of msg by member index, from Sign. The proof shows
+// that the member whose balance is debited signed msg without telling which
+// member, so knowing the opening of a balance is not enough to debit it.
+func ProveRingDebit(pubKeys, balances, updates, amounts [][]byte, index int, nonces [][]byte, remainder, remainderNonce, msg, sig, context []byte) (*RingProof, error) {
+	r, err := newRing(pubKeys, balances, updates, amounts, msg)
+	if err != nil {
+		return nil, err
+	}
+	m := new(big.Int).SetBytes(remainder)
+	if m.BitLen() > RangeBits {
+		return nil, errors.New("paillier: value out of range")
+	}
+	if index < 0 || index >= len(r.keys) {
+		return nil, errors.New("paillier: need a member index and one nonce per member")
+	}
+	var spec specSignature
+	res, err := asn1.Unmarshal(sig, &spec)
+	if err != nil || len(res) > 0 || encrypt(r.keys[index], spec.S1, spec.S2).Cmp(r.hashes[index]) != 0 {
+		return nil, ErrInvalidSignature
+	}
+	return r.prove(index, bytesToInts(nonces), m, new(big.Int).SetBytes(remainderNonce), &spec, context)
+}
+
+// VerifyRingDebit verifies a proof created by ProveRingDebit for msg.
+func VerifyRingDebit(pubKeys, balances, updates, amounts [][]byte, msg []byte, proof *RingProof, context []byte) error {
+	r, err := newRing(pubKeys, balances, updates, amounts, msg)
+	if err != nil {
+		return err
+	}
+	return r.verify(proof, context)
+}
+
+// ProveRingCredit proves that updates add the plain text of amounts[index]
+// to the balance of member index and leave the balances of the other
+// members unchanged. updates[index] / amounts[index] and updates[i] of the
+// other members must encrypt zero with nonces[i].
+func ProveRingCredit(pubKeys, updates, amounts [][]byte, index int, nonces [][]byte, context []byte) (*RingProof, error) {
+	r, err := newRing(pubKeys, nil, updates, amounts, nil)
+	if err != nil {
+		return nil, err
+	}
+	return r.prove(index, bytesToInts(nonces), nil, nil, nil, context)
+}
+
+// VerifyRingCredit verifies a proof created by ProveRingCredit.
+func VerifyRingCredit(pubKeys, updates, amounts [][]byte, proof *RingProof, context []byte) error {
+	r, err := newRing(pubKeys, nil, updates, amounts, nil)
+	if err != nil {
+		return err
+	}
+	return r.verify(proof, context)
+}
+
+// ring is the public statement of a RingProof.
+type ring struct {
+	keys   []*PublicKey
+	label  string
+	zeros  [][]*big.Int // zeros[j][i] encrypts zero under keys[i] in branch j
+	ranges []*big.Int   // debit only: ranges[j] is in range in branch j
+	hashes []*big.Int   // debit only: hashes[j] is opened by the signature of j
+	values []*big.Int   // public values bound into the challenge
+}
+
+// newRing builds the statement of a debit proof with the signed message, or
+// of a credit proof without balances.
+func newRing(pubKeys, balances, updates, amounts [][]byte, msg []byte) (*ring, error) {
+	debit := balances != nil
+	if len(pubKeys) < 2 || len(updates) != len(pubKeys) || len(amounts) != len(pubKeys) || (debit && len(balances) != len(pubKeys)) {
+		return nil, errors.New("paillier: need at least two members and one update and amount per member")
+	}
+	keys, err := parsePublicKeys(pubKeys)
+	if err != nil {
+		return nil, err
+	}
+	us, vs, bs := bytesToInts(updates), bytesToInts(amounts), bytesToInts(balances)
+
+	r := &ring{keys: keys, label: ringCreditLabel}
+	if debit {
+		r.label = ringDebitLabel
+	}
+	for i, pubKey := range keys {
+		if debit && pubKey.N.BitLen() <= RangeBits+1 {
+			return nil, errors.New("paillier: modulus too small for range proofs")
+		}
+		if !isUnit(us[i], pubKey.NSquared, pubKey.N) || !isUnit(vs[i], pubKey.NSquared, pubKey.N) {
+			return nil, ErrInvalidCipher
+		}
+		r.values = append(r.values, pubKey.N, us[i], vs[i])
+		if debit {
+			if !isUnit(bs[i], pubKey.NSquared, pubKey.N) {
+				return nil, ErrInvalidCipher
+			}
+			r.values = append(r.values, bs[i])
+		}
+	}
+
+	for j, pubKey := range keys {
+		zeros := append([]*big.Int{}, us...)
+		shifted := new(big.Int)
+		if debit {
+			shifted.Mul(us[j], vs[j])
+			r.ranges = append(r.ranges, new(big.Int).Mod(new(big.Int).Mul(bs[j], us[j]), pubKey.NSquared))
+			r.hashes = append(r.hashes, hashToCipher(pubKey, msg))
+		} else {
+			shifted.Mul(us[j], new(big.Int).ModInverse(vs[j], pubKey.NSquared))
+		}
+		zeros[j] = shifted.Mod(shifted, pubKey.NSquared)
+		r.zeros = append(r.zeros, zeros)
+	}
+	return r, nil
+}
+
+// ringWitness is what the prover of the real branch keeps between the
+// commitments and the challenge.
+type ringWitness struct {
+	s    []*big.Int    // randomness of the zero proof commitments
+	bits []*bitWitness // debit only
+	sumS *big.Int      // debit only: randomness of the sum commitment
+	sumR *big.Int      // debit only: nonce of the recombination
+	sigA *big.Int      // debit only: randomness of the signature commitment
+	sigB *big.Int
+}
+
+func (r *ring) prove(index int, nonces []*big.Int, remainder, remainderNonce *big.Int, sig *specSignature, context []byte) (*RingProof, error) {
+	if index < 0 || index >= len(r.keys) || len(nonces) != len(r.keys) {
+		return nil, errors.New("paillier: need a member index and one nonce per member")
+	}
+
+	proof := &RingProof{Branches: make([]*RingBranch, len(r.keys))}
+	for j := range r.keys {
+		if j == index {
+			continue
+		}
+		branch, err := r.simulate(j)
+		if err != nil {
+			return nil, err
+		}
+		proof.Branches[j] = branch
+	}
+	branch, w, err := r.commit(index, remainder, remainderNonce)
+	if err != nil {
+		return nil, err
+	}
+	proof.Branches[index] = branch
+
+	// the real branch gets what the simulated ones leave of the challenge
+	branch.E = r.challenge(proof, context)
+	for j, other := range proof.Branches {
+		if j != index {
+			branch.E.Sub(branch.E, other.E)
+		}
+	}
+	branch.E.Mod(branch.E, challengeModulus)
+
+	for i, pubKey := range r.keys {
+		branch.Z = append(branch.Z, zeroResponse(pubKey, w.s[i], nonces[i], branch.E))
+	}
+	if r.ranges != nil {
+		pubKey := r.keys[index]
+		for i, bit := range branch.Bits {
+			answerBit(pubKey, bit, w.bits[i], branch.E)
+		}
+		branch.Sum.Z = zeroResponse(pubKey, w.sumS, w.sumR, branch.E)
+
+		branch.Sig.Z1 = new(big.Int).Mul(branch.E, sig.S1)
+		branch.Sig.Z1.Add(branch.Sig.Z1, w.sigA)
+		branch.Sig.Z1.Mod(branch.Sig.Z1, pubKey.N)
+		branch.Sig.Z2 = zeroResponse(pubKey, w.sigB, sig.S2, branch.E)
+	}
+	return proof, nil
+}
+
+// commit makes the commitments of the real branch j.
+func (r *ring) commit(j int, remainder, remainderNonce *big.Int) (*RingBranch, *ringWitness, error) {
+	branch := &RingBranch{}
+	w := &ringWitness{}
+	for _, pubKey := range r.keys {
+		s, a, err := zeroCommit(pubKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		w.s = append(w.s, s)
+		branch.A = append(branch.A, a)
+	}
+	if r.ranges == nil {
+		return branch, w, nil
+	}
+
+	// as in ProveRange, R = prod(r_i^(2^i)) / r is the nonce of the recombination
+	pubKey := r.keys[j]
+	w.sumR = new(big.Int).ModInverse(remainderNonce, pubKey.N)
+	if w.sumR == nil {
+		return nil, nil, ErrInvalidCipher
+	}
+	for i := 0; i < RangeBits; i++ {
+		rb, err := randomUnit(pubKey.N)
+		if err != nil {
+			return nil, nil, err
+		}
+		bit, bw, err := commitBit(pubKey, remainder.Bit(i), rb)
+		if err != nil {
+			return nil, nil, err
+		}
+		branch.Bits = append(branch.Bits, bit)
+		w.bits = append(w.bits, bw)
+
+		rb = new(big.Int).Exp(rb, new(big.Int).Lsh(one, uint(i)), pubKey.N)
+		w.sumR.Mul(w.sumR, rb)
+		w.sumR.Mod(w.sumR, pubKey.N)
+	}
+	var err error
+	branch.Sum = &ZeroProof{}
+	w.sumS, branch.Sum.A, err = zeroCommit(pubKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	w.sigA, err = rand.Int(rand.Reader, pubKey.N)
+	if err != nil {
+		return nil, nil, err
+	}
+	w.sigB, err = randomUnit(pubKey.N)
+	if err != nil {
+		return nil, nil, err
+	}
+	branch.Sig = &SigProof{A: encrypt(pubKey, w.sigA, w.sigB)}
+	return branch, w, nil
+}
+
+// simulate makes branch j for a random challenge without a witness. The
+// bits of a simulated remaining balance encrypt zero.
+func (r *ring) simulate(j int) (*RingBranch, error) {
+	e, err := rand.Int(rand.Reader, challengeModulus)
+	if err != nil {
+		return nil, err
+	}
+	branch := &RingBranch{E: e}
+	for i, pubKey := range r.keys {
+		a, z, err := simulateZero(pubKey, r.zeros[j][i], e)
+		if err != nil {
+			return nil, err
+		}
+		branch.A = append(branch.A, a)
+		branch.Z = append(branch.Z, z)
+	}
+	if r.ranges == nil {
+		return branch, nil
+	}
+
+	pubKey := r.keys[j]
+	for i := 0; i < RangeBits; i++ {
+		rb, err := randomUnit(pubKey.N)
+		if err != nil {
+			return nil, err
+		}
+		bit := &BitProof{C: encrypt(pubKey, new(big.Int), rb)}
+		bit.E0, err = rand.Int(rand.Reader, challengeModulus)
+		if err != nil {
+			return nil, err
+		}
+		e1 := new(big.Int).Sub(e, bit.E0)
+		e1.Mod(e1, challengeModulus)
+		bit.A0, bit.Z0, err = simulateZero(pubKey, bit.C, bit.E0)
+		if err != nil {
+			return nil, err
+		}
+		bit.A1, bit.Z1, err = simulateZero(pubKey, subPlain(pubKey, bit.C, one), e1)
+		if err != nil {
+			return nil, err
+		}
+		branch.Bits = append(branch.Bits, bit)
+	}
+	branch.Sum = &ZeroProof{}
+	branch.Sum.A, branch.Sum.Z, err = simulateZero(pubKey, recombine(pubKey, r.ranges[j], branch.Bits), e)
+	if err != nil {
+		return nil, err
+	}
+
+	// A = g^Z1 * Z2^n / h^e for random responses
+	branch.Sig = &SigProof{}
+	branch.Sig.Z1, err = rand.Int(rand.Reader, pubKey.N)
+	if err != nil {
+		return nil, err
+	}
+	branch.Sig.Z2, err = randomUnit(pubKey.N)
+	if err != nil {
+		return nil, err
+	}
+	he := new(big.Int).Exp(r.hashes[j], e, pubKey.NSquared)
+	branch.Sig.A = encrypt(pubKey, branch.Sig.Z1, branch.Sig.Z2)
+	branch.Sig.A.Mul(branch.Sig.A, he.ModInverse(he, pubKey.NSquared))
+	branch.Sig.A.Mod(branch.Sig.A, pubKey.NSquared)
+	return branch, nil
+}
+
+func (r *ring) verify(proof *RingProof, context []byte) error {
+	if proof == nil || len(proof.Branches) != len(r.keys) {
+		return ErrInvalidProof
+	}
+	for j, branch := range proof.Branches {
+		if !r.wellFormed(j, branch) {
+			return ErrInvalidProof
+		}
+	}
+
+	e := r.challenge(proof, context)
+	for _, branch := range proof.Branches {
+		e.Sub(e, branch.E)
+	}
+	if e.Mod(e, challengeModulus).Sign() != 0 {
+		return ErrInvalidProof
+	}
+
+	for j, branch := range proof.Branches {
+		for i, pubKey := range r.keys {
+			if !zeroCheck(pubKey, r.zeros[j][i], branch.A[i], branch.E, branch.Z[i]) {
+				return ErrInvalidProof
+			}
+		}
+		if r.ranges == nil {
+			continue
+		}
+		pubKey := r.keys[j]
+		for _, bit := range branch.Bits {
+			if !checkBit(pubKey, bit, branch.E) {
+				return ErrInvalidProof
+			}
+		}
+		if !zeroCheck(pubKey, recombine(pubKey, r.ranges[j], branch.Bits), branch.Sum.A, branch.E, branch.Sum.Z) {
+			return ErrInvalidProof
+		}
+		rhs := new(big.Int).Exp(r.hashes[j], branch.E, pubKey.NSquared)
+		rhs.Mul(rhs, branch.Sig.A)
+		if encrypt(pubKey, branch.Sig.Z1, branch.Sig.Z2).Cmp(rhs.Mod(rhs, pubKey.NSquared)) != 0 {
+			return ErrInvalidProof
+		}
+	}
+	return nil
+}
+
+// wellFormed checks the shape of branch j before its values are hashed.
+func (r *ring) wellFormed(j int, branch *RingBranch) bool {
+	if branch == nil || branch.E == nil || branch.E.Sign() < 0 || branch.E.Cmp(challengeModulus) >= 0 {
+		return false
+	}
+	if len(branch.A) != len(r.keys) || len(branch.Z) != len(r.keys) {
+		return false
+	}
+	for i := range r.keys {
+		if branch.A[i] == nil || branch.Z[i] == nil {
+			return false
+		}
+	}
+	if r.ranges == nil {
+		return branch.Bits == nil && branch.Sum == nil && branch.Sig == nil
+	}
+	if len(branch.Bits) != RangeBits || branch.Sum == nil || branch.Sum.A == nil || branch.Sum.Z == nil {
+		return false
+	}
+	pubKey := r.keys[j]
+	if branch.Sig == nil || branch.Sig.A == nil || branch.Sig.Z1 == nil || branch.Sig.Z2 == nil ||
+		!isUnit(branch.Sig.A, pubKey.NSquared, pubKey.N) || branch.Sig.Z1.Sign() < 0 || branch.Sig.Z1.Cmp(pubKey.N) >= 0 || !isUnit(branch.Sig.Z2, pubKey.N, pubKey.N) {
+		return false
+	}
+	for _, bit := range branch.Bits {
+		if !bitWellFormed(r.keys[j], bit) {
+			return false
+		}
+	}
+	return true
+}
+
+// challenge hashes the statement and the commitments of every branch.
+func (r *ring) challenge(proof *RingProof, context []byte) *big.Int {
+	values := append([]*big.Int{}, r.values...)
+	for _, branch := range proof.Branches {
+		values = append(values, branch.A...)
+		for _, bit := range branch.Bits {
+			values = append(values, bit.C, bit.A0, bit.A1)
+		}
+		if branch.Sum != nil {
+			values = append(values, branch.Sum.A)
+		}
+		if branch.Sig != nil {
+			values = append(values, branch.Sig.A)
+		}
+	}
+	return challenge(r.label, context, values...)
+}
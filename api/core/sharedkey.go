@@ -0,0 +1,500 @@
+package gohe
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"strconv"
+)
+
+// A shared key is a Paillier key whose private key is dealt to Parties
+// holders, so that any Threshold of them open a cipher text together and
+// fewer learn nothing of it (Damgard and Jurik, with Shoup's proofs of the
+// partial results). The modulus is the product of the safe primes 2p'+1 and
+// 2q'+1. With m = p'q' and D = Parties!, the holders have Shamir shares over
+// Z_nm of
+//
+//	d = 0 mod m, d = 1 mod n, so c^(4 D^2 d) = g^(4 D^2 plain)
+//	e = n^-1 mod m,           so (r^n)^(4 D^2 e) = r^(4 D^2)
+//
+// and the combination of the partial results gives the plain text and the
+// nonce of the cipher text, everything a whole private key gives Decrypt,
+// RecoverNonce and Sign. The public key is an ordinary Paillier key.
+
+// ErrInvalidShare is returned for a partial opening whose proof fails or
+// that does not belong to the shared key.
+var ErrInvalidShare = errors.New("paillier: invalid partial opening")
+
+const shareProofLabel = "gopaillier/share-proof/v1"
+
+// SharedKey is the public part of a shared key, with the verification keys
+// of the holders' partial results.
+type SharedKey struct {
+	PublicKey
+	Threshold int
+	Parties   int
+	V         *big.Int   // random square mod n^2
+	W         *big.Int   // random square mod n
+	VerifyD   []*big.Int // V^(D d_i) mod n^2 of holder i+1
+	VerifyE   []*big.Int // W^(D e_i) mod n of holder i+1
+}
+
+// KeyShare is the private share of holder Index, from 1 to Parties.
+type KeyShare struct {
+	SharedKey
+	Index int
+	D     *big.Int // share of d
+	E     *big.Int // share of e
+}
+
+type specSharedKey struct {
+	N         *big.Int
+	Threshold int
+	Parties   int
+	V         *big.Int
+	W         *big.Int
+	VerifyD   []*big.Int
+	VerifyE   []*big.Int
+}
+
+type specKeyShare struct {
+	Key   specSharedKey
+	Index int
+	D     *big.Int
+	E     *big.Int
+}
+
+type specShareProof struct {
+	E *big.Int
+	Z *big.Int
+}
+
+type specPartialOpening struct {
+	Index  int
+	C      *big.Int // c^(2 D d_i) mod n^2
+	U      *big.Int // (c mod n)^(2 D e_i) mod n
+	ProofC specShareProof
+	ProofU specShareProof
+}
+
+// GenerateSharedKey deals a Paillier key of the given bit size to parties
+// holders, threshold of whom open a cipher text. The dealer must forget the
+// key once the shares are handed out. Safe primes are slow to find for
+// large keys.
+func GenerateSharedKey(random io.Reader, bits, threshold, parties int) (*SharedKey, []*KeyShare, error) {
+	if bits < MinKeyBits {
+		return nil, nil, ErrKeyTooSmall
+	}
+	if threshold < 1 || parties < threshold {
+		return nil, nil, errors.New("paillier: threshold must be between 1 and the number of parties")
+	}
+	p, pp, err := safePrime(random, bits/2)
+	if err != nil {
+		return nil, nil, err
+	}
+	var q, qq *big.Int
+	for q == nil || q.Cmp(p) == 0 {
+		q, qq, err = safePrime(random, bits-bits/2)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	n := new(big.Int).Mul(p, q)
+	m := new(big.Int).Mul(pp, qq)
+	nm := new(big.Int).Mul(n, m)
+	d := new(big.Int).ModInverse(m, n)
+	d.Mul(d, m)
+	e := new(big.Int).ModInverse(n, m)
+	if e == nil {
+		return nil, nil, errors.New("paillier: modulus shares a factor with m")
+	}
+
+	key := &SharedKey{
+		PublicKey: PublicKey{N: n, G: new(big.Int).Add(n, one), NSquared: new(big.Int).Mul(n, n)},
+		Threshold: threshold,
+		Parties:   parties,
+	}
+	key.V, err = randomSquare(random, key.NSquared, n)
+	if err != nil {
+		return nil, nil, err
+	}
+	key.W, err = randomSquare(random, n, n)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	polyD, err := randomPolynomial(random, d, threshold, nm)
+	if err != nil {
+		return nil, nil, err
+	}
+	polyE, err := randomPolynomial(random, e, threshold, nm)
+	if err != nil {
+		return nil, nil, err
+	}
+	delta := factorial(parties)
+	shares := make([]*KeyShare, parties)
+	for i := range shares {
+		x := big.NewInt(int64(i + 1))
+		shares[i] = &KeyShare{Index: i + 1, D: evalPolynomial(polyD, x, nm), E: evalPolynomial(polyE, x, nm)}
+		key.VerifyD = append(key.VerifyD, new(big.Int).Exp(key.V, new(big.Int).Mul(delta, shares[i].D), key.NSquared))
+		key.VerifyE = append(key.VerifyE, new(big.Int).Exp(key.W, new(big.Int).Mul(delta, shares[i].E), n))
+	}
+	for _, share := range shares {
+		share.SharedKey = *key
+	}
+	return key, shares, nil
+}
+
+// PartialOpen computes the partial result of a holder for a cipher text,
+// with the proof that it used its share.
+func PartialOpen(shareBytes []byte, cipher []byte) ([]byte, error) {
+	share, err := ParseKeyShare(shareBytes)
+	if err != nil {
+		return nil, err
+	}
+	c := new(big.Int).SetBytes(cipher)
+	if !isUnit(c, share.NSquared, share.N) {
+		return nil, ErrInvalidCipher
+	}
+	return partialOpen(share, c)
+}
+
+// CombineOpening opens a cipher text with the partial results of at least
+// Threshold holders of the shared key. It returns the plain text and the
+// nonce, as Decrypt and RecoverNonce do with a whole private key.
+func CombineOpening(sharedKeyBytes []byte, cipher []byte, partials [][]byte) (plainText []byte, nonce []byte, err error) {
+	key, err := ParseSharedKey(sharedKeyBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	c := new(big.Int).SetBytes(cipher)
+	if !isUnit(c, key.NSquared, key.N) {
+		return nil, nil, ErrInvalidCipher
+	}
+	m, r, err := combineOpening(key, c, partials)
+	if err != nil {
+		return nil, nil, err
+	}
+	return m.Bytes(), r.Bytes(), nil
+}
+
+// PartialSign computes the partial result of a holder for a signature on
+// msg with the shared key.
+func PartialSign(shareBytes []byte, msg []byte) ([]byte, error) {
+	share, err := ParseKeyShare(shareBytes)
+	if err != nil {
+		return nil, err
+	}
+	return partialOpen(share, hashToCipher(&share.PublicKey, msg))
+}
+
+// CombineSignature combines the partial results of PartialSign into a
+// signature that Verify accepts for the public key of the shared key.
+func CombineSignature(sharedKeyBytes []byte, msg []byte, partials [][]byte) ([]byte, error) {
+	key, err := ParseSharedKey(sharedKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	s1, s2, err := combineOpening(key, hashToCipher(&key.PublicKey, msg), partials)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(specSignature{S1: s1, S2: s2})
+}
+
+func partialOpen(share *KeyShare, c *big.Int) ([]byte, error) {
+	delta := factorial(share.Parties)
+	u := new(big.Int).Mod(c, share.N)
+
+	exp := new(big.Int).Lsh(new(big.Int).Mul(delta, share.D), 1)
+	po := specPartialOpening{Index: share.Index}
+	po.C = new(big.Int).Exp(c, exp, share.NSquared)
+	exp = new(big.Int).Lsh(new(big.Int).Mul(delta, share.E), 1)
+	po.U = new(big.Int).Exp(u, exp, share.N)
+
+	// log_(c^4) C^2 = log_V VerifyD_i = D d_i, and likewise for U
+	var err error
+	po.ProofC, err = proveShare(share.NSquared, fourth(c, share.NSquared), square(po.C, share.NSquared),
+		share.V, share.VerifyD[share.Index-1], new(big.Int).Mul(delta, share.D))
+	if err != nil {
+		return nil, err
+	}
+	po.ProofU, err = proveShare(share.N, fourth(u, share.N), square(po.U, share.N),
+		share.W, share.VerifyE[share.Index-1], new(big.Int).Mul(delta, share.E))
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(po)
+}
+
+func combineOpening(key *SharedKey, c *big.Int, partials [][]byte) (m, r *big.Int, err error) {
+	u := new(big.Int).Mod(c, key.N)
+	var used []*specPartialOpening
+	seen := map[int]bool{}
+	for _, partial := range partials {
+		var po specPartialOpening
+		res, err := asn1.Unmarshal(partial, &po)
+		if err != nil || len(res) > 0 || po.Index < 1 || po.Index > key.Parties {
+			return nil, nil, ErrInvalidShare
+		}
+		if seen[po.Index] {
+			continue
+		}
+		if !isUnit(po.C, key.NSquared, key.N) || !isUnit(po.U, key.N, key.N) {
+			return nil, nil, ErrInvalidShare
+		}
+		err = verifyShare(key.NSquared, fourth(c, key.NSquared), square(po.C, key.NSquared), key.V, key.VerifyD[po.Index-1], po.ProofC)
+		if err == nil {
+			err = verifyShare(key.N, fourth(u, key.N), square(po.U, key.N), key.W, key.VerifyE[po.Index-1], po.ProofU)
+		}
+		if err != nil {
+			return nil, nil, errors.New("paillier: invalid partial opening of holder " + strconv.Itoa(po.Index))
+		}
+		seen[po.Index] = true
+		used = append(used, &po)
+		if len(used) == key.Threshold {
+			break
+		}
+	}
+	if len(used) < key.Threshold {
+		return nil, nil, errors.New("paillier: need " + strconv.Itoa(key.Threshold) + " partial openings, got " + strconv.Itoa(len(used)))
+	}
+
+	// interpolate at zero in the exponent: the products are c^(4 D^2 d) and
+	// (c mod n)^(4 D^2 e)
+	delta := factorial(key.Parties)
+	cc, uu := big.NewInt(1), big.NewInt(1)
+	for _, po := range used {
+		lambda := lagrange(delta, po.Index, used)
+		lambda.Lsh(lambda, 1)
+		cc.Mul(cc, expSigned(po.C, lambda, key.NSquared)).Mod(cc, key.NSquared)
+		uu.Mul(uu, expSigned(po.U, lambda, key.N)).Mod(uu, key.N)
+	}
+
+	scale := new(big.Int).Mul(delta, delta)
+	scale.Lsh(scale, 2)
+	m = new(big.Int).Sub(cc, one)
+	m.Div(m, key.N)
+	m.Mul(m, new(big.Int).ModInverse(scale, key.N)).Mod(m, key.N)
+
+	// uu is r^scale and u is r^n, with gcd(scale, n) = 1
+	alpha, beta := new(big.Int), new(big.Int)
+	new(big.Int).GCD(alpha, beta, scale, key.N)
+	r = expSigned(uu, alpha, key.N)
+	r.Mul(r, expSigned(u, beta, key.N)).Mod(r, key.N)
+
+	if encrypt(&key.PublicKey, m, r).Cmp(c) != 0 {
+		return nil, nil, ErrInvalidShare
+	}
+	return m, r, nil
+}
+
+// lagrange returns D times the Lagrange coefficient of holder i at zero for
+// the holders used, an integer since D = Parties!.
+func lagrange(delta *big.Int, i int, used []*specPartialOpening) *big.Int {
+	num := new(big.Int).Set(delta)
+	den := big.NewInt(1)
+	for _, po := range used {
+		if po.Index == i {
+			continue
+		}
+		num.Mul(num, big.NewInt(int64(po.Index)))
+		den.Mul(den, big.NewInt(int64(po.Index-i)))
+	}
+	return num.Quo(num, den)
+}
+
+// proveShare proves log_x y = log_v w = s without revealing s. The mask is
+// long enough to hide e*s statistically.
+func proveShare(mod, x, y, v, w, s *big.Int) (specShareProof, error) {
+	bound := new(big.Int).Lsh(one, uint(s.BitLen()+sha256.Size*8+statisticalBits))
+	k, err := rand.Int(rand.Reader, bound)
+	if err != nil {
+		return specShareProof{}, err
+	}
+	a := new(big.Int).Exp(x, k, mod)
+	b := new(big.Int).Exp(v, k, mod)
+	e := challenge(shareProofLabel, nil, mod, x, y, v, w, a, b)
+	z := new(big.Int).Mul(e, s)
+	z.Add(z, k)
+	return specShareProof{E: e, Z: z}, nil
+}
+
+func verifyShare(mod, x, y, v, w *big.Int, proof specShareProof) error {
+	if proof.E == nil || proof.Z == nil || proof.Z.Sign() < 0 || !isUnit(w, mod, mod) {
+		return ErrInvalidShare
+	}
+	negE := new(big.Int).Neg(proof.E)
+	a := new(big.Int).Exp(x, proof.Z, mod)
+	a.Mul(a, expSigned(y, negE, mod)).Mod(a, mod)
+	b := new(big.Int).Exp(v, proof.Z, mod)
+	b.Mul(b, expSigned(w, negE, mod)).Mod(b, mod)
+	if challenge(shareProofLabel, nil, mod, x, y, v, w, a, b).Cmp(proof.E) != 0 {
+		return ErrInvalidShare
+	}
+	return nil
+}
+
+// expSigned computes x^y mod m for a unit x and a possibly negative y.
+func expSigned(x, y, m *big.Int) *big.Int {
+	if y.Sign() >= 0 {
+		return new(big.Int).Exp(x, y, m)
+	}
+	inv := new(big.Int).ModInverse(x, m)
+	return inv.Exp(inv, new(big.Int).Neg(y), m)
+}
+
+func square(x, m *big.Int) *big.Int {
+	return new(big.Int).Exp(x, big.NewInt(2), m)
+}
+
+func fourth(x, m *big.Int) *big.Int {
+	return new(big.Int).Exp(x, big.NewInt(4), m)
+}
+
+func factorial(n int) *big.Int {
+	f := big.NewInt(1)
+	for i := 2; i <= n; i++ {
+		f.Mul(f, big.NewInt(int64(i)))
+	}
+	return f
+}
+
+// safePrime returns a bits long prime p = 2p'+1 and p'.
+func safePrime(random io.Reader, bits int) (p, pp *big.Int, err error) {
+	for {
+		pp, err = rand.Prime(random, bits-1)
+		if err != nil {
+			return nil, nil, err
+		}
+		p = new(big.Int).Lsh(pp, 1)
+		p.Add(p, one)
+		if p.ProbablyPrime(20) {
+			return p, pp, nil
+		}
+	}
+}
+
+func randomSquare(random io.Reader, mod, n *big.Int) (*big.Int, error) {
+	for {
+		x, err := rand.Int(random, mod)
+		if err != nil {
+			return nil, err
+		}
+		if isUnit(x, mod, n) {
+			return x.Exp(x, big.NewInt(2), mod), nil
+		}
+	}
+}
+
+// randomPolynomial returns the coefficients of a polynomial of degree
+// threshold-1 over Z_mod with the constant term secret.
+func randomPolynomial(random io.Reader, secret *big.Int, threshold int, mod *big.Int) ([]*big.Int, error) {
+	poly := []*big.Int{secret}
+	for i := 1; i < threshold; i++ {
+		a, err := rand.Int(random, mod)
+		if err != nil {
+			return nil, err
+		}
+		poly = append(poly, a)
+	}
+	return poly, nil
+}
+
+func evalPolynomial(poly []*big.Int, x, mod *big.Int) *big.Int {
+	y := new(big.Int)
+	for i := len(poly) - 1; i >= 0; i-- {
+		y.Mul(y, x)
+		y.Add(y, poly[i])
+		y.Mod(y, mod)
+	}
+	return y
+}
+
+func GenPemSharedKey(key *SharedKey) []byte {
+	b, _ := asn1.Marshal(sharedKeySpec(key))
+	return pem.EncodeToMemory(&pem.Block{Type: "shared key", Bytes: b})
+}
+
+func GenPemKeyShare(share *KeyShare) []byte {
+	b, _ := asn1.Marshal(specKeyShare{Key: sharedKeySpec(&share.SharedKey), Index: share.Index, D: share.D, E: share.E})
+	return pem.EncodeToMemory(&pem.Block{Type: "key share", Bytes: b})
+}
+
+func ParseSharedKey(key []byte) (*SharedKey, error) {
+	block, _ := pem.Decode(key)
+	if block == nil {
+		return nil, ErrInvalidPemKey
+	}
+	var spec specSharedKey
+	res, err := asn1.Unmarshal(block.Bytes, &spec)
+	if err != nil {
+		return nil, err
+	}
+	if len(res) > 0 {
+		return nil, asn1.SyntaxError{Msg: "trailing data"}
+	}
+	return sharedKeyFromSpec(&spec)
+}
+
+func ParseKeyShare(key []byte) (*KeyShare, error) {
+	block, _ := pem.Decode(key)
+	if block == nil {
+		return nil, ErrInvalidPemKey
+	}
+	var spec specKeyShare
+	res, err := asn1.Unmarshal(block.Bytes, &spec)
+	if err != nil {
+		return nil, err
+	}
+	if len(res) > 0 {
+		return nil, asn1.SyntaxError{Msg: "trailing data"}
+	}
+	sharedKey, err := sharedKeyFromSpec(&spec.Key)
+	if err != nil {
+		return nil, err
+	}
+	if spec.Index < 1 || spec.Index > sharedKey.Parties || spec.D == nil || spec.E == nil || spec.D.Sign() < 0 || spec.E.Sign() < 0 {
+		return nil, ErrInvalidKey
+	}
+	return &KeyShare{SharedKey: *sharedKey, Index: spec.Index, D: spec.D, E: spec.E}, nil
+}
+
+func sharedKeySpec(key *SharedKey) specSharedKey {
+	return specSharedKey{
+		N:         key.N,
+		Threshold: key.Threshold,
+		Parties:   key.Parties,
+		V:         key.V,
+		W:         key.W,
+		VerifyD:   key.VerifyD,
+		VerifyE:   key.VerifyE,
+	}
+}
+
+func sharedKeyFromSpec(spec *specSharedKey) (*SharedKey, error) {
+	if spec.N == nil || spec.N.BitLen() < MinKeyBits {
+		return nil, ErrKeyTooSmall
+	}
+	if spec.Threshold < 1 || spec.Parties < spec.Threshold || len(spec.VerifyD) != spec.Parties || len(spec.VerifyE) != spec.Parties {
+		return nil, ErrInvalidKey
+	}
+	nSquared := new(big.Int).Mul(spec.N, spec.N)
+	if spec.V == nil || spec.W == nil || !isUnit(spec.V, nSquared, spec.N) || !isUnit(spec.W, spec.N, spec.N) {
+		return nil, ErrInvalidKey
+	}
+	return &SharedKey{
+		PublicKey: PublicKey{N: spec.N, G: new(big.Int).Add(spec.N, one), NSquared: nSquared},
+		Threshold: spec.Threshold,
+		Parties:   spec.Parties,
+		V:         spec.V,
+		W:         spec.W,
+		VerifyD:   spec.VerifyD,
+		VerifyE:   spec.VerifyE,
+	}, nil
+}
@@ -0,0 +1,82 @@
+package gohe
+
+import (
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"math/big"
+)
+
+// ErrInvalidSignature is returned when a signature does not verify.
+var ErrInvalidSignature = errors.New("paillier: invalid signature")
+
+// signatureLabel separates the message hash of signatures from other hashes.
+const signatureLabel = "gopaillier/signature/v1"
+
+type specSignature struct {
+	S1 *big.Int
+	S2 *big.Int
+}
+
+// Sign signs msg with Paillier's signature scheme. The message is hashed to
+// an element h of Z*_{n^2}, which is a cipher text like any other element, and
+// the signature is its plain text s1 and nonce s2, so that g^s1 * s2^n = h.
+// Only the owner of the private key can open h.
+func Sign(privKeyBytes []byte, msg []byte) ([]byte, error) {
+	privKey, err := ParsePrivateKey(privKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	h := hashToCipher(&privKey.PublicKey, msg)
+	sig := specSignature{
+		S1: new(big.Int).SetBytes(decrypt(privKey, h)),
+		S2: recoverNonce(privKey, h),
+	}
+	return asn1.Marshal(sig)
+}
+
+// Verify checks a signature created by Sign.
+func Verify(pubKeyBytes []byte, msg []byte, sig []byte) error {
+	pubKey, err := ParsePublicKey(pubKeyBytes)
+	if err != nil {
+		return err
+	}
+
+	var spec specSignature
+	res, err := asn1.Unmarshal(sig, &spec)
+	if err != nil || len(res) > 0 {
+		return ErrInvalidSignature
+	}
+	if spec.S1.Sign() < 0 || spec.S1.Cmp(pubKey.N) >= 0 || !isUnit(spec.S2, pubKey.N, pubKey.N) {
+		return ErrInvalidSignature
+	}
+
+	if encrypt(pubKey, spec.S1, spec.S2).Cmp(hashToCipher(pubKey, msg)) != 0 {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// hashToCipher hashes msg to an element of Z*_{n^2}.
+func hashToCipher(pubKey *PublicKey, msg []byte) *big.Int {
+	size := (pubKey.NSquared.BitLen() + 128 + 7) / 8
+	for try := uint32(0); ; try++ {
+		var stream []byte
+		for block := uint32(0); len(stream) < size; block++ {
+			h := sha256.New()
+			h.Write([]byte(signatureLabel))
+			h.Write(pubKey.N.Bytes())
+			binary.Write(h, binary.BigEndian, try)
+			binary.Write(h, binary.BigEndian, block)
+			h.Write(msg)
+			stream = h.Sum(stream)
+		}
+		c := new(big.Int).SetBytes(stream[:size])
+		c.Mod(c, pubKey.NSquared)
+		if isUnit(c, pubKey.NSquared, pubKey.N) {
+			return c
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package event
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+// Version is the schema version of the event payloads. It is raised whenever
+// a field changes meaning or is removed; new fields do not change it.
+const Version = 1
+
+// Event names, as set by the chaincodes with stub.SetEvent. Clients subscribe
+// to them with a chaincode event registration on the channel's event service,
+// which delivers the name and payload without the rest of the block.
+const (
+	ConfidentialTransfer     = "ConfidentialTransfer"
+	ConfidentialTransferMany = "ConfidentialTransferMany"
+	AccountOpened            = "AccountOpened"
+	Mint                     = "Mint"
+	Burn                     = "Burn"
+	KeyRegistered            = "KeyRegistered"
+	KeyRotated               = "KeyRotated"
+	KeyRevoked               = "KeyRevoked"
+	EscrowLocked             = "EscrowLocked"
+	EscrowClaimed            = "EscrowClaimed"
+	EscrowRefunded           = "EscrowRefunded"
+	TransferPending          = "TransferPending"
+	TransferAccepted         = "TransferAccepted"
+	TransferRejected         = "TransferRejected"
+	TransferCancelled        = "TransferCancelled"
+	TransferExpired          = "TransferExpired"
+	AccountFrozen            = "AccountFrozen"
+	AccountUnfrozen          = "AccountUnfrozen"
+	AccountSeized            = "AccountSeized"
+	AllowanceApproved        = "AllowanceApproved"
+	AllowanceSpent           = "AllowanceSpent"
+	AllowanceRevoked         = "AllowanceRevoked"
+	AccountClosed            = "AccountClosed"
+	RingTransfer             = "RingTransfer"
+	StealthCreated           = "StealthCreated"
+	StealthClaimed           = "StealthClaimed"
+)
+
+// ErrUnknownEvent is returned by Parse for an event it has no schema for.
+var ErrUnknownEvent = errors.New("event: unknown event name")
+
+// TransferEvent is the payload of ConfidentialTransfer.
+type TransferEvent struct {
+	Version            int
+	TxID               string
+	From               string
+	To                 string
+	Asset              string // asset ID, empty for the default asset
+	CipherForRecipient []byte // amount under the recipient's key
+}
+
+// TransferManyEvent is the payload of ConfidentialTransferMany. To[i]
+// receives CipherForRecipient[i], under its own key.
+type TransferManyEvent struct {
+	Version            int
+	TxID               string
+	From               string
+	To                 []string
+	CipherForRecipient [][]byte
+}
+
+// HoldEvent is the payload of the escrow and pending transfer events.
+// HoldID is the txID of the transaction that created the hold. Hashlock and
+// Preimage belong to escrows; Preimage is set on EscrowClaimed so the
+// counterparty of a swap on another ledger can claim there.
+type HoldEvent struct {
+	Version            int
+	TxID               string
+	HoldID             string
+	From               string
+	To                 string
+	Asset              string // asset ID, empty for the default asset
+	Hashlock           string // hex SHA-256 of the preimage, escrows only
+	Deadline           int64  // seconds since the epoch
+	Preimage           string // hex, EscrowClaimed only
+	CipherForRecipient []byte // amount under the recipient's key
+}
+
+// AccountEvent is the payload of AccountOpened, Mint, Burn and
+// AccountClosed, which has no CipherAmount.
+type AccountEvent struct {
+	Version      int
+	TxID         string
+	Addr         string
+	Asset        string // asset ID, empty for the default asset
+	CipherAmount []byte // amount under the account key
+}
+
+// AllowanceEvent is the payload of AllowanceApproved, AllowanceSpent and
+// AllowanceRevoked. To and CipherForRecipient are set on AllowanceSpent;
+// on approval CipherForRecipient is the added allowance under the spender's
+// key.
+type AllowanceEvent struct {
+	Version            int
+	TxID               string
+	Owner              string
+	Spender            string
+	To                 string
+	Asset              string // asset ID, empty for the default asset
+	CipherForRecipient []byte
+}
+
+// RingEvent is the payload of RingTransfer. Updates[i] is the change of the
+// balance of Ring[i] under its key: minus the amount for the sender, the
+// amount for the receiver and zero for the other members.
+type RingEvent struct {
+	Version int
+	TxID    string
+	Ring    []string
+	Asset   string // asset ID, empty for the default asset
+	Updates [][]byte
+}
+
+// StealthEvent is the payload of StealthCreated and StealthClaimed. Info is
+// the stealth info of StealthCreated, which receivers pass to
+// cliapi.ScanStealth; it is empty on StealthClaimed.
+type StealthEvent struct {
+	Version int
+	TxID    string
+	Addr    string
+	Info    []byte
+}
+
+// ComplianceEvent is the payload of AccountFrozen, AccountUnfrozen and
+// AccountSeized.
+type ComplianceEvent struct {
+	Version int
+	TxID    string
+	Addr    string
+	Asset   string // asset ID of AccountSeized, empty for the default asset
+	Reason  string
+}
+
+// KeyRegisteredEvent is the payload of KeyRegistered, KeyRotated and
+// KeyRevoked. PubKey is the key that became current, empty on revocation.
+type KeyRegisteredEvent struct {
+	Version    int
+	TxID       string
+	Addr       string
+	PubKey     string
+	KeyVersion int
+}
+
+// Parse decodes the payload of the named event into its schema type and
+// rejects payloads of an unsupported version.
+func Parse(name string, payload []byte) (interface{}, error) {
+	var ev interface{}
+	switch name {
+	case ConfidentialTransfer:
+		ev = &TransferEvent{}
+	case ConfidentialTransferMany:
+		ev = &TransferManyEvent{}
+	case EscrowLocked, EscrowClaimed, EscrowRefunded,
+		TransferPending, TransferAccepted, TransferRejected, TransferCancelled, TransferExpired:
+		ev = &HoldEvent{}
+	case AccountOpened, Mint, Burn, AccountClosed:
+		ev = &AccountEvent{}
+	case AllowanceApproved, AllowanceSpent, AllowanceRevoked:
+		ev = &AllowanceEvent{}
+	case RingTransfer:
+		ev = &RingEvent{}
+	case StealthCreated, StealthClaimed:
+		ev = &StealthEvent{}
+	case AccountFrozen, AccountUnfrozen, AccountSeized:
+		ev = &ComplianceEvent{}
+	case KeyRegistered, KeyRotated, KeyRevoked:
+		ev = &KeyRegisteredEvent{}
+	default:
+		return nil, ErrUnknownEvent
+	}
+
+	var header struct{ Version int }
+	err := json.Unmarshal(payload, &header)
+	if err != nil {
+		return nil, err
+	}
+	if header.Version != Version {
+		return nil, errors.New("event: unsupported version " + strconv.Itoa(header.Version))
+	}
+
+	err = json.Unmarshal(payload, ev)
+	if err != nil {
+		return nil, err
+	}
+	return ev, nil
+}
@@ -0,0 +1,391 @@
+// Package solvency proves that the balances a custodian holds for its
+// customers on the transfer chaincode add up to at most a public reserve,
+// without revealing any balance or the total.
+//
+// Every customer balance is re-encrypted under a liability key of the
+// custodian, with a proof that it holds the same amount as the balance on
+// the ledger and a range proof that it is not negative. The re-encrypted
+// balances are the leaves of a Merkle-sum tree whose nodes carry the
+// homomorphic sum of their children, so the root carries the total. A range
+// proof on reserve - total shows the total does not exceed the reserve.
+//
+// Anyone can check the whole Report with Verify. A customer checks with
+// VerifyInclusion that its balance is counted in the published root.
+package solvency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/big"
+
+	"chaoshen.com/gopaillier/api/core"
+)
+
+// Domain separation labels of the tree hashes and the proof contexts.
+const (
+	leafLabel    = "gopaillier/solvency/leaf/v1"
+	nodeLabel    = "gopaillier/solvency/node/v1"
+	proofContext = "gopaillier/solvency/"
+)
+
+// Customer is an account the custodian holds the key of.
+type Customer struct {
+	Addr          string
+	CipherBalance []byte // balance on the ledger, under the account key
+	PrivKey       string // PEM Paillier key of the account
+}
+
+// Leaf is the liability to one customer.
+type Leaf struct {
+	Addr          string
+	PubKey        []byte              // key of the account, whose hash is Addr
+	CipherBalance []byte              // balance on the ledger
+	Liability     []byte              // the balance under the liability key
+	Proof         *gohe.EqualityProof // CipherBalance and Liability encrypt the same amount
+	RangeProof    *gohe.RangeProof    // Liability is not negative
+}
+
+// Node is a node of the Merkle-sum tree.
+type Node struct {
+	Hash []byte
+	Sum  []byte // sum of the liabilities below, under the liability key
+}
+
+// Step is one level of an inclusion path.
+type Step struct {
+	Sibling *Node
+	Left    bool // the sibling is the left child
+}
+
+// Report proves that the liabilities of a custodian are at most Reserve.
+type Report struct {
+	Epoch   string // names the report, a date or block height; the proofs are bound to it
+	PubKey  []byte // PEM liability key
+	Reserve string // decimal reserve
+	Leaves  []*Leaf
+	Root    *Node
+	Proof   *gohe.RangeProof // Reserve - Root.Sum is not negative
+}
+
+// InclusionProof shows one customer that its balance is a leaf of the tree
+// with the given root.
+type InclusionProof struct {
+	Epoch  string
+	PubKey []byte
+	Leaf   *Leaf
+	Path   []*Step // from the leaf up, levels where the node has no sibling are left out
+	Root   *Node
+}
+
+// Prove builds the report of the customers for epoch, with the PEM
+// liability key and the decimal reserve, and an inclusion proof for every
+// customer, in the order of customers. It fails if the liabilities exceed
+// the reserve. Balances and reserve - total must be below 2^gohe.RangeBits.
+func Prove(epoch string, customers []*Customer, liabilityKey, reserve string) (*Report, []*InclusionProof, error) {
+	if len(customers) == 0 {
+		return nil, nil, errors.New("solvency: no customers")
+	}
+	key, err := gohe.ParsePrivateKey([]byte(liabilityKey))
+	if err != nil {
+		return nil, nil, err
+	}
+	pubKey := gohe.GenPemPublicKey(&key.PublicKey)
+	reserveInt, ok := new(big.Int).SetString(reserve, 10)
+	if !ok || reserveInt.Sign() < 0 {
+		return nil, nil, errors.New("solvency: the reserve must be a non-negative integer")
+	}
+
+	report := &Report{Epoch: epoch, PubKey: pubKey, Reserve: reserveInt.String()}
+	seen := map[string]bool{}
+	for _, customer := range customers {
+		if seen[customer.Addr] {
+			return nil, nil, errors.New("solvency: duplicate customer " + customer.Addr)
+		}
+		seen[customer.Addr] = true
+		leaf, err := proveLeaf(epoch, customer, pubKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		report.Leaves = append(report.Leaves, leaf)
+	}
+
+	levels, err := buildTree(epoch, pubKey, report.Leaves)
+	if err != nil {
+		return nil, nil, err
+	}
+	report.Root = levels[len(levels)-1][0]
+
+	// reserve - total, whose nonce the liability key recovers
+	privKey := gohe.GenPemPrivateKey(key)
+	cipherExcess, err := excess(pubKey, report.Root.Sum, reserveInt)
+	if err != nil {
+		return nil, nil, err
+	}
+	plainText, err := gohe.Decrypt(privKey, cipherExcess)
+	if err != nil {
+		return nil, nil, err
+	}
+	// below the reserve the difference is reserve - total, above it n - (total - reserve)
+	if new(big.Int).SetBytes(plainText).Cmp(reserveInt) > 0 {
+		return nil, nil, errors.New("solvency: the liabilities exceed the reserve")
+	}
+	nonce, err := gohe.RecoverNonce(privKey, cipherExcess)
+	if err != nil {
+		return nil, nil, err
+	}
+	report.Proof, err = gohe.ProveRange(pubKey, cipherExcess, plainText, nonce, reserveContext(epoch, report.Reserve, report.Root))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	proofs := make([]*InclusionProof, len(report.Leaves))
+	for i, leaf := range report.Leaves {
+		proofs[i] = &InclusionProof{Epoch: epoch, PubKey: pubKey, Leaf: leaf, Path: path(levels, i), Root: report.Root}
+	}
+	return report, proofs, nil
+}
+
+// Verify checks every leaf of a report, that the leaves add up to its root
+// and that the root is at most the reserve.
+func Verify(report *Report) error {
+	if report == nil || len(report.Leaves) == 0 || report.Root == nil {
+		return errors.New("solvency: empty report")
+	}
+	reserve, ok := new(big.Int).SetString(report.Reserve, 10)
+	if !ok || reserve.Sign() < 0 || reserve.String() != report.Reserve {
+		return errors.New("solvency: invalid reserve")
+	}
+
+	seen := map[string]bool{}
+	for _, leaf := range report.Leaves {
+		if leaf == nil || seen[leaf.Addr] {
+			return errors.New("solvency: duplicate or missing leaf")
+		}
+		seen[leaf.Addr] = true
+		err := verifyLeaf(report.Epoch, report.PubKey, leaf)
+		if err != nil {
+			return err
+		}
+	}
+	levels, err := buildTree(report.Epoch, report.PubKey, report.Leaves)
+	if err != nil {
+		return err
+	}
+	if !sameNode(levels[len(levels)-1][0], report.Root) {
+		return errors.New("solvency: the leaves do not add up to the root")
+	}
+
+	cipherExcess, err := excess(report.PubKey, report.Root.Sum, reserve)
+	if err != nil {
+		return err
+	}
+	err = gohe.VerifyRange(report.PubKey, cipherExcess, report.Proof, reserveContext(report.Epoch, report.Reserve, report.Root))
+	if err != nil {
+		return errors.New("solvency: the liabilities exceed the reserve")
+	}
+	return nil
+}
+
+// VerifyInclusion checks that the account addr, whose balance on the ledger
+// is cipherBalance, is counted in root, the root of the report published for
+// the epoch of the proof. The report itself is checked with Verify.
+func VerifyInclusion(proof *InclusionProof, addr string, cipherBalance []byte, root *Node) error {
+	if proof == nil || proof.Leaf == nil || root == nil {
+		return errors.New("solvency: empty inclusion proof")
+	}
+	leaf := proof.Leaf
+	if leaf.Addr != addr {
+		return errors.New("solvency: the proof is for another account")
+	}
+	if !bytes.Equal(leaf.CipherBalance, cipherBalance) {
+		return errors.New("solvency: the proof is for another balance")
+	}
+	err := verifyLeaf(proof.Epoch, proof.PubKey, leaf)
+	if err != nil {
+		return err
+	}
+
+	node := leafNode(proof.Epoch, leaf)
+	for _, step := range proof.Path {
+		if step == nil || step.Sibling == nil {
+			return errors.New("solvency: malformed path")
+		}
+		if step.Left {
+			node, err = parent(proof.PubKey, step.Sibling, node)
+		} else {
+			node, err = parent(proof.PubKey, node, step.Sibling)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !sameNode(node, root) {
+		return errors.New("solvency: the account is not in the tree")
+	}
+	return nil
+}
+
+// proveLeaf re-encrypts the balance of a customer under the liability key.
+func proveLeaf(epoch string, customer *Customer, pubKey []byte) (*Leaf, error) {
+	key, err := gohe.ParsePrivateKey([]byte(customer.PrivKey))
+	if err != nil {
+		return nil, err
+	}
+	leaf := &Leaf{Addr: customer.Addr, PubKey: gohe.GenPemPublicKey(&key.PublicKey), CipherBalance: customer.CipherBalance}
+	if calcAddr(leaf.PubKey) != leaf.Addr {
+		return nil, errors.New("solvency: the key is not the key of " + leaf.Addr)
+	}
+
+	plainText, err := gohe.Decrypt([]byte(customer.PrivKey), customer.CipherBalance)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := gohe.RecoverNonce([]byte(customer.PrivKey), customer.CipherBalance)
+	if err != nil {
+		return nil, err
+	}
+	var liabilityNonce []byte
+	leaf.Liability, liabilityNonce, err = gohe.EncryptWithNonce(pubKey, plainText)
+	if err != nil {
+		return nil, err
+	}
+
+	context := leafContext(epoch, leaf.Addr)
+	leaf.Proof, err = gohe.ProveEqual(
+		[][]byte{leaf.PubKey, pubKey},
+		[][]byte{leaf.CipherBalance, leaf.Liability},
+		plainText, [][]byte{nonce, liabilityNonce}, context)
+	if err != nil {
+		return nil, err
+	}
+	leaf.RangeProof, err = gohe.ProveRange(pubKey, leaf.Liability, plainText, liabilityNonce, context)
+	if err != nil {
+		return nil, err
+	}
+	return leaf, nil
+}
+
+// verifyLeaf checks that a liability holds the balance of its account and
+// is not negative, so no leaf can lower the total.
+func verifyLeaf(epoch string, pubKey []byte, leaf *Leaf) error {
+	if calcAddr(leaf.PubKey) != leaf.Addr {
+		return errors.New("solvency: the key is not the key of " + leaf.Addr)
+	}
+	err := gohe.ValidateCipher(pubKey, leaf.Liability)
+	if err != nil {
+		return err
+	}
+	context := leafContext(epoch, leaf.Addr)
+	err = gohe.VerifyEqual(
+		[][]byte{leaf.PubKey, pubKey},
+		[][]byte{leaf.CipherBalance, leaf.Liability},
+		leaf.Proof, context)
+	if err != nil {
+		return errors.New("solvency: the liability to " + leaf.Addr + " is not its balance")
+	}
+	err = gohe.VerifyRange(pubKey, leaf.Liability, leaf.RangeProof, context)
+	if err != nil {
+		return errors.New("solvency: the liability to " + leaf.Addr + " is negative")
+	}
+	return nil
+}
+
+// buildTree returns the levels of the tree from the leaves up to the root.
+// The last node of a level with an odd number of nodes moves up unchanged.
+func buildTree(epoch string, pubKey []byte, leaves []*Leaf) ([][]*Node, error) {
+	level := make([]*Node, len(leaves))
+	for i, leaf := range leaves {
+		level[i] = leafNode(epoch, leaf)
+	}
+	levels := [][]*Node{level}
+	for len(level) > 1 {
+		var next []*Node
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			node, err := parent(pubKey, level[i], level[i+1])
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, node)
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return levels, nil
+}
+
+// path collects the siblings of leaf i from the bottom of the tree up.
+func path(levels [][]*Node, i int) []*Step {
+	var steps []*Step
+	for _, level := range levels[:len(levels)-1] {
+		if i%2 == 1 {
+			steps = append(steps, &Step{Sibling: level[i-1], Left: true})
+		} else if i+1 < len(level) {
+			steps = append(steps, &Step{Sibling: level[i+1]})
+		}
+		i /= 2
+	}
+	return steps
+}
+
+func leafNode(epoch string, leaf *Leaf) *Node {
+	return &Node{
+		Hash: hashParts(leafLabel, []byte(epoch), []byte(leaf.Addr), leaf.PubKey, leaf.CipherBalance, leaf.Liability),
+		Sum:  leaf.Liability,
+	}
+}
+
+func parent(pubKey []byte, left, right *Node) (*Node, error) {
+	sum, err := gohe.AddCipher(pubKey, left.Sum, right.Sum)
+	if err != nil {
+		return nil, err
+	}
+	return &Node{Hash: hashParts(nodeLabel, left.Hash, left.Sum, right.Hash, right.Sum), Sum: sum}, nil
+}
+
+func sameNode(a, b *Node) bool {
+	return a != nil && b != nil && bytes.Equal(a.Hash, b.Hash) && bytes.Equal(a.Sum, b.Sum)
+}
+
+// excess encrypts reserve - total without new randomness: g^reserve / total.
+func excess(pubKey, total []byte, reserve *big.Int) ([]byte, error) {
+	cipherReserve, err := gohe.Add(pubKey, gohe.ZeroCipher(), reserve.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return gohe.SubCipher(pubKey, cipherReserve, total)
+}
+
+// hashParts hashes the parts with their lengths, so no two lists of parts
+// hash the same.
+func hashParts(label string, parts ...[]byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(label))
+	var size [8]byte
+	for _, part := range parts {
+		binary.BigEndian.PutUint64(size[:], uint64(len(part)))
+		h.Write(size[:])
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+func leafContext(epoch, addr string) []byte {
+	return []byte(proofContext + epoch + "/leaf/" + addr)
+}
+
+func reserveContext(epoch, reserve string, root *Node) []byte {
+	return []byte(proofContext + epoch + "/reserve/" + reserve + "/" + hex.EncodeToString(root.Hash))
+}
+
+// calcAddr derives the account address from a PEM public key, like the chaincode.
+func calcAddr(pubKey []byte) string {
+	hashRes := sha256.Sum256(pubKey)
+	return hex.EncodeToString(hashRes[:])
+}
@@ -0,0 +1,80 @@
+package solvency
+
+import (
+	"crypto/rand"
+	"math/big"
+	"testing"
+
+	"chaoshen.com/gopaillier/api/core"
+)
+
+func newCustomers(t *testing.T, balances ...int64) []*Customer {
+	var customers []*Customer
+	for _, balance := range balances {
+		key, err := gohe.GenerateKey(rand.Reader, gohe.MinKeyBits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubKey := gohe.GenPemPublicKey(&key.PublicKey)
+		cipher, _ := gohe.Encrypt(pubKey, big.NewInt(balance).Bytes())
+		customers = append(customers, &Customer{
+			Addr:          calcAddr(pubKey),
+			CipherBalance: cipher,
+			PrivKey:       string(gohe.GenPemPrivateKey(key)),
+		})
+	}
+	return customers
+}
+
+func TestProve(t *testing.T) {
+	key, _ := gohe.GenerateKey(rand.Reader, gohe.MinKeyBits)
+	liabilityKey := string(gohe.GenPemPrivateKey(key))
+	customers := newCustomers(t, 10, 0, 25, 7, 8)
+
+	if _, _, err := Prove("2026-10-19", customers, liabilityKey, "49"); err == nil {
+		t.Fatal("proved liabilities above the reserve")
+	}
+	report, proofs, err := Prove("2026-10-19", customers, liabilityKey, "50")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Verify(report); err != nil {
+		t.Fatal(err)
+	}
+	for i, customer := range customers {
+		err = VerifyInclusion(proofs[i], customer.Addr, customer.CipherBalance, report.Root)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a proof only holds for its account, balance and root
+	if VerifyInclusion(proofs[0], customers[1].Addr, customers[0].CipherBalance, report.Root) == nil {
+		t.Fatal("inclusion verified for another account")
+	}
+	if VerifyInclusion(proofs[0], customers[0].Addr, customers[1].CipherBalance, report.Root) == nil {
+		t.Fatal("inclusion verified for another balance")
+	}
+	other, _, _ := Prove("2026-10-19", customers[1:], liabilityKey, "50")
+	if VerifyInclusion(proofs[0], customers[0].Addr, customers[0].CipherBalance, other.Root) == nil {
+		t.Fatal("inclusion verified against a tree without the account")
+	}
+
+	// the report is bound to its reserve and epoch
+	report.Reserve = "40"
+	if Verify(report) == nil {
+		t.Fatal("report verified with a lower reserve")
+	}
+	report.Reserve, report.Epoch = "50", "2026-10-20"
+	if Verify(report) == nil {
+		t.Fatal("report verified for another epoch")
+	}
+	report.Epoch = "2026-10-19"
+
+	// a negative liability cannot lower the total
+	negative := new(big.Int).Sub(key.N, big.NewInt(20))
+	report.Leaves[1].Liability, _ = gohe.Encrypt(report.PubKey, negative.Bytes())
+	if Verify(report) == nil {
+		t.Fatal("report verified with a negative liability")
+	}
+}
@@ -3,19 +3,83 @@ package main
 import (
 	"crypto"
 	"encoding/hex"
+	"encoding/json"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
 	"strings"
+	"chaoshen.com/gopaillier/api/core"
+	"chaoshen.com/gopaillier/api/event"
 )
 
 type IDChaincode struct{}
 
 var logger = shim.NewLogger("ID Chaincode")
 
+// IDConfig is the deployment configuration passed to Init.
+type IDConfig struct {
+	// TransferChaincode is the name of the transfer chaincode. Keys are only
+	// rotated through its RotateKey, which re-encrypts the balance in the
+	// same transaction; a rotation without it would strand the balance under
+	// the old key.
+	TransferChaincode string
+}
+
+// configObjectType keys the config with a composite key, which listing the
+// registry skips.
+const configObjectType = "config"
+
+/*
+args: optional JSON IDConfig
+*/
 func (t *IDChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	_, args := stub.GetFunctionAndParameters()
+	if len(args) == 0 {
+		return shim.Success(nil)
+	}
+	if len(args) != 1 {
+		logger.Error("wrong parameters")
+		return shim.Error("wrong parameters")
+	}
+
+	var config IDConfig
+	err := json.Unmarshal([]byte(args[0]), &config)
+	if err != nil {
+		logger.Error("fail to unmarshal config")
+		return shim.Error("fail to unmarshal config")
+	}
+	key, err := stub.CreateCompositeKey(configObjectType, []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(key, []byte(args[0]))
+	if err != nil {
+		logger.Error("Error on store config: ", err.Error())
+		return shim.Error("Error on store config: " + err.Error())
+	}
 	return shim.Success(nil)
 }
 
+func getConfig(stub shim.ChaincodeStubInterface) (*IDConfig, error) {
+	key, err := stub.CreateCompositeKey(configObjectType, []string{})
+	if err != nil {
+		return nil, err
+	}
+	configBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &IDConfig{}
+	if configBytes == nil {
+		return config, nil
+	}
+	err = json.Unmarshal(configBytes, config)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
 func (t *IDChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 	logger.Debug("enter Invoke")
 	function, args := stub.GetFunctionAndParameters()
@@ -24,14 +88,44 @@ func (t *IDChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return t.register(stub, args)
 	} else if function == "QueryPubkey" {
 		return t.query(stub, args)
+	} else if function == "Rotate" {
+		return t.rotate(stub, args)
+	} else if function == "Revoke" {
+		return t.revoke(stub, args)
+	} else if function == "QueryKeyHistory" {
+		return t.queryKeyHistory(stub, args)
+	} else if function == "QueryByOrg" {
+		return t.queryByOrg(stub, args)
+	} else if function == "ListRegistry" {
+		return t.listRegistry(stub, args)
 	}
 
 	return shim.Error("Invalid invoke function name.")
 }
 
 
-//query public key of user account
+// registerRequest is the second argument of Register.
+type registerRequest struct {
+	// PossessionProof is the decryption of a cipher text derived from the
+	// address and transaction ID together with its nonce, i.e. the Paillier
+	// signature of registerMessage. Only the owner of the key can produce it.
+	PossessionProof []byte
+
+	DisplayName string
+	MSPID       string // defaults to, and must match, the MSP of the client
+	Purpose     string // defaults to PurposeBalance
+	Expiry      string // RFC 3339, empty for no expiry
+}
+
+// registerMessage binds a proof of possession to one registration.
+func registerMessage(addr, txID string) []byte {
+	return []byte("gopaillier/register/" + addr + "/" + txID)
+}
 
+/*
+register a public key under its address
+args: PEM public key, JSON registerRequest
+*/
 func (t *IDChaincode) register(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
 	if len(args) != 2 {
@@ -41,6 +135,33 @@ func (t *IDChaincode) register(stub shim.ChaincodeStubInterface, args []string)
 
 	pubkey := args[0]
 	Addr := calcAddr(pubkey)
+
+	var req registerRequest
+	err := json.Unmarshal([]byte(args[1]), &req)
+	if err != nil {
+		logger.Error("fail to unmarshal register request")
+		return shim.Error("fail to unmarshal register request")
+	}
+
+	_, err = gohe.ParsePublicKey([]byte(pubkey))
+	if err != nil {
+		logger.Error("invalid public key: ", err.Error())
+		return shim.Error("invalid public key: " + err.Error())
+	}
+
+	// only the owner of the private key may register it
+	err = gohe.Verify([]byte(pubkey), registerMessage(Addr, stub.GetTxID()), req.PossessionProof)
+	if err != nil {
+		logger.Error("invalid proof of possession")
+		return shim.Error("invalid proof of possession")
+	}
+
+	err = checkMetadata(stub, &req)
+	if err != nil {
+		logger.Error("invalid registry metadata: ", err.Error())
+		return shim.Error("invalid registry metadata: " + err.Error())
+	}
+
 	UserPubKey, err := stub.GetState(Addr)
 	if err != nil {
 		logger.Error("Error on query addr")
@@ -52,12 +173,32 @@ func (t *IDChaincode) register(stub shim.ChaincodeStubInterface, args []string)
 		return shim.Error("addr already register")
 	}
 
-	err = stub.PutState(Addr, []byte(pubkey))
+	record := &KeyRecord{
+		Addr:        Addr,
+		Keys:        []KeyVersion{{Version: 1, PubKey: pubkey, TxID: stub.GetTxID()}},
+		DisplayName: req.DisplayName,
+		MSPID:       req.MSPID,
+		Purpose:     req.Purpose,
+		Expiry:      req.Expiry,
+	}
+	err = putRecord(stub, record)
 	if err != nil {
 		logger.Error("Error on store user pubkey: ", err.Error())
 		return shim.Error("Error on store user pubkey: " + err.Error())
 	}
 
+	err = putOrgIndex(stub, record)
+	if err != nil {
+		logger.Error("Error on store org index: ", err.Error())
+		return shim.Error("Error on store org index: " + err.Error())
+	}
+
+	err = setKeyEvent(stub, event.KeyRegistered, record)
+	if err != nil {
+		logger.Error("Error on set event: ", err.Error())
+		return shim.Error("Error on set event: " + err.Error())
+	}
+
 	return shim.Success([]byte(pubkey))
 }
 
@@ -69,26 +210,36 @@ func (t *IDChaincode) query(stub shim.ChaincodeStubInterface, args []string) pb.
 	}
 
 	Addr := args[0]
-	UserPubKey, err := stub.GetState(Addr)
+	record, err := getRecord(stub, Addr)
 	if err != nil {
-		logger.Error("Error on query addr")
-		return shim.Error("fail to query addr")
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
 	}
 
-	if UserPubKey == nil {
-		logger.Error("addr is not register")
-		return shim.Error("addr is not register")
+	if record.Revoked {
+		logger.Error("addr is revoked")
+		return shim.Error("addr is revoked")
+	}
+
+	expired, err := record.expired(stub)
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	if expired {
+		logger.Error("key is expired")
+		return shim.Error("key is expired")
 	}
 
-	//check addr match pub key
-	hash := calcAddr(string(UserPubKey))
+	//check addr match the first registered pub key, later versions are rotations
+	hash := calcAddr(record.Keys[0].PubKey)
 
 	if strings.Compare(hash, Addr) != 0 {
-		logger.Error("addr is not match public key in chaincode" + string(UserPubKey))
-		return shim.Error("addr is not match public key in chaincode:%s" + string(UserPubKey))
+		logger.Error("addr is not match public key in chaincode" + record.Keys[0].PubKey)
+		return shim.Error("addr is not match public key in chaincode:%s" + record.Keys[0].PubKey)
 	}
 
-	return shim.Success([]byte(UserPubKey))
+	return shim.Success([]byte(record.current().PubKey))
 }
 
 func calcAddr(cont string) string {
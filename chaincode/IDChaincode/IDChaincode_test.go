@@ -0,0 +1,325 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+	"testing"
+
+	"chaoshen.com/gopaillier/api/cliapi"
+	"chaoshen.com/gopaillier/api/core"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// lastTxID is the transaction ID of the last invoke, each invoke gets a
+// fresh one like on a real channel.
+var lastTxID = 0
+
+func invoke(stub *shim.MockStub, args ...string) ([]byte, error) {
+	lastTxID++
+	argBytes := [][]byte{}
+	for _, arg := range args {
+		argBytes = append(argBytes, []byte(arg))
+	}
+	res := stub.MockInvoke(strconv.Itoa(lastTxID), argBytes)
+	if res.Status != shim.OK {
+		return nil, errors.New(res.Message)
+	}
+	return res.Payload, nil
+}
+
+func checkInvoke(t *testing.T, stub *shim.MockStub, args ...string) []byte {
+	t.Helper()
+	payload, err := invoke(stub, args...)
+	if err != nil {
+		t.Fatal("Invoke ", args[0], " failed: ", err)
+	}
+	return payload
+}
+
+func checkInvokeFail(t *testing.T, stub *shim.MockStub, args ...string) {
+	t.Helper()
+	_, err := invoke(stub, args...)
+	if err == nil {
+		t.Fatal("Invoke ", args[0], " should fail")
+	}
+}
+
+// newRegistry returns a registry serving the transfer chaincode
+// "TransferChaincode", with every client in Org1MSP.
+func newRegistry(t *testing.T) *shim.MockStub {
+	stub := shim.NewMockStub("IDChaincode", new(IDChaincode))
+	config, _ := json.Marshal(&IDConfig{TransferChaincode: "TransferChaincode"})
+	res := stub.MockInit("init", [][]byte{[]byte("init"), config})
+	if res.Status != shim.OK {
+		t.Fatal("Init failed: ", res.Message)
+	}
+	setClientMSPID(t, "Org1MSP")
+	setInvokedChaincode(t, "IDChaincode")
+	return stub
+}
+
+// setClientMSPID makes the registry see mspID as the MSP of the submitting
+// client until the end of the test.
+func setClientMSPID(t *testing.T, mspID string) {
+	saved := clientMSPID
+	clientMSPID = func(stub shim.ChaincodeStubInterface) (string, error) {
+		return mspID, nil
+	}
+	t.Cleanup(func() { clientMSPID = saved })
+}
+
+// setInvokedChaincode makes the registry see name as the chaincode the
+// proposal invokes until the end of the test.
+func setInvokedChaincode(t *testing.T, name string) {
+	saved := invokedChaincode
+	invokedChaincode = func(stub shim.ChaincodeStubInterface) (string, error) {
+		return name, nil
+	}
+	t.Cleanup(func() { invokedChaincode = saved })
+}
+
+func genKey(t *testing.T) (pubKey, privKey string) {
+	key, err := gohe.GenerateKey(rand.Reader, gohe.MinKeyBits)
+	if err != nil {
+		t.Fatal("fail to generate key")
+	}
+	return string(gohe.GenPemPublicKey(&key.PublicKey)), string(gohe.GenPemPrivateKey(key))
+}
+
+// register registers the key of privKey with metadata and returns its address.
+func register(t *testing.T, stub *shim.MockStub, pubKey, privKey string, metadata *cliapi.RegistryMetadata) string {
+	t.Helper()
+	registration, err := cliapi.PrepareRegistration(privKey, strconv.Itoa(lastTxID+1), metadata)
+	if err != nil {
+		t.Fatal("fail to prepare registration: ", err)
+	}
+	checkInvoke(t, stub, "Register", pubKey, string(registration))
+	return calcAddr(pubKey)
+}
+
+func getKeyRecord(t *testing.T, stub *shim.MockStub, addr string) *KeyRecord {
+	t.Helper()
+	record := &KeyRecord{}
+	err := json.Unmarshal(checkInvoke(t, stub, "QueryKeyHistory", addr), record)
+	if err != nil {
+		t.Fatal("fail to unmarshal key record")
+	}
+	return record
+}
+
+func TestIDChaincode_Rotate(t *testing.T) {
+	stub := newRegistry(t)
+	pubKey, privKey := genKey(t)
+	addr := register(t, stub, pubKey, privKey, nil)
+	newPubKey, newPrivKey := genKey(t)
+
+	rotation, _ := gohe.Sign([]byte(privKey), rotateMessage(addr, 1, newPubKey))
+	forged, _ := gohe.Sign([]byte(newPrivKey), rotateMessage(addr, 1, newPubKey))
+	sig, _ := cliapi.SignRevocation(addr, 1, privKey)
+
+	// a direct rotation would strand the balance under the old key
+	checkInvokeFail(t, stub, "Rotate", addr, newPubKey, string(rotation))
+	if string(checkInvoke(t, stub, "QueryPubkey", addr)) != pubKey {
+		t.Fatal("key rotated outside the transfer chaincode")
+	}
+
+	// the rotation signature must come from the current key
+	setInvokedChaincode(t, "TransferChaincode")
+	checkInvokeFail(t, stub, "Rotate", addr, newPubKey, string(forged))
+	checkInvoke(t, stub, "Rotate", addr, newPubKey, string(rotation))
+	if string(checkInvoke(t, stub, "QueryPubkey", addr)) != newPubKey {
+		t.Fatal("QueryPubkey does not return the rotated key")
+	}
+	record := getKeyRecord(t, stub, addr)
+	if len(record.Keys) != 2 || record.current().Version != 2 || record.Keys[0].PubKey != pubKey {
+		t.Fatal("unexpected key history")
+	}
+
+	// an old key can neither be reused nor sign
+	rotation, _ = gohe.Sign([]byte(newPrivKey), rotateMessage(addr, 2, pubKey))
+	checkInvokeFail(t, stub, "Rotate", addr, pubKey, string(rotation))
+	checkInvokeFail(t, stub, "Revoke", addr, string(sig))
+
+	sig, _ = cliapi.SignRevocation(addr, 2, newPrivKey)
+	checkInvoke(t, stub, "Revoke", addr, string(sig))
+	checkInvokeFail(t, stub, "QueryPubkey", addr)
+	otherPubKey, _ := genKey(t)
+	rotation, _ = gohe.Sign([]byte(newPrivKey), rotateMessage(addr, 2, otherPubKey))
+	checkInvokeFail(t, stub, "Rotate", addr, otherPubKey, string(rotation))
+	if !getKeyRecord(t, stub, addr).Revoked {
+		t.Fatal("key history does not show the revocation")
+	}
+}
+
+func TestIDChaincode_RotateUnconfigured(t *testing.T) {
+	stub := shim.NewMockStub("IDChaincode", new(IDChaincode))
+	stub.MockInit("init", [][]byte{[]byte("init")})
+	setClientMSPID(t, "Org1MSP")
+	setInvokedChaincode(t, "TransferChaincode")
+
+	pubKey, privKey := genKey(t)
+	addr := register(t, stub, pubKey, privKey, nil)
+	newPubKey, _ := genKey(t)
+	rotation, _ := gohe.Sign([]byte(privKey), rotateMessage(addr, 1, newPubKey))
+	checkInvokeFail(t, stub, "Rotate", addr, newPubKey, string(rotation))
+}
+
+func TestIDChaincode_RegisterPossession(t *testing.T) {
+	stub := newRegistry(t)
+	pubKey, privKey := genKey(t)
+	otherPubKey, otherPrivKey := genKey(t)
+	addr := calcAddr(pubKey)
+
+	// a proof by another key, for another transaction or without any fails
+	registration, _ := cliapi.PrepareRegistration(otherPrivKey, strconv.Itoa(lastTxID+1), nil)
+	checkInvokeFail(t, stub, "Register", pubKey, string(registration))
+	registration, _ = cliapi.PrepareRegistration(privKey, strconv.Itoa(lastTxID), nil)
+	checkInvokeFail(t, stub, "Register", pubKey, string(registration))
+	checkInvokeFail(t, stub, "Register", pubKey, "{}")
+	checkInvokeFail(t, stub, "Register", pubKey, "not json")
+	checkInvokeFail(t, stub, "QueryPubkey", addr)
+
+	// keys below the minimum size are refused
+	p, _ := rand.Prime(rand.Reader, 128)
+	q, _ := rand.Prime(rand.Reader, 128)
+	n := new(big.Int).Mul(p, q)
+	smallKey := &gohe.PublicKey{N: n, G: new(big.Int).Add(n, big.NewInt(1)), NSquared: new(big.Int).Mul(n, n)}
+	_, err := invoke(stub, "Register", string(gohe.GenPemPublicKey(smallKey)), "{}")
+	if err == nil || !strings.Contains(err.Error(), gohe.ErrKeyTooSmall.Error()) {
+		t.Fatal("small key accepted: ", err)
+	}
+
+	if register(t, stub, pubKey, privKey, nil) != addr {
+		t.Fatal("unexpected address")
+	}
+	if string(checkInvoke(t, stub, "QueryPubkey", addr)) != pubKey {
+		t.Fatal("QueryPubkey does not return the registered key")
+	}
+
+	// an address is registered once, and the proof cannot be replayed
+	registration, _ = cliapi.PrepareRegistration(privKey, strconv.Itoa(lastTxID+1), nil)
+	checkInvokeFail(t, stub, "Register", pubKey, string(registration))
+	register(t, stub, otherPubKey, otherPrivKey, nil)
+}
+
+func TestIDChaincode_Metadata(t *testing.T) {
+	stub := newRegistry(t)
+	pubKey, privKey := genKey(t)
+
+	for _, metadata := range []*cliapi.RegistryMetadata{
+		{MSPID: "Org2MSP"},
+		{Purpose: "mining"},
+		{Expiry: "tomorrow"},
+	} {
+		registration, _ := cliapi.PrepareRegistration(privKey, strconv.Itoa(lastTxID+1), metadata)
+		checkInvokeFail(t, stub, "Register", pubKey, string(registration))
+	}
+
+	addr := register(t, stub, pubKey, privKey, &cliapi.RegistryMetadata{DisplayName: "alice", Purpose: PurposeSigning, Expiry: "2999-01-01T00:00:00Z"})
+	record := getKeyRecord(t, stub, addr)
+	if record.DisplayName != "alice" || record.MSPID != "Org1MSP" || record.Purpose != PurposeSigning || record.Expiry != "2999-01-01T00:00:00Z" {
+		t.Fatal("unexpected metadata ", record)
+	}
+
+	// defaults
+	pubKey, privKey = genKey(t)
+	record = getKeyRecord(t, stub, register(t, stub, pubKey, privKey, nil))
+	if record.MSPID != "Org1MSP" || record.Purpose != PurposeBalance || record.Expiry != "" {
+		t.Fatal("unexpected default metadata ", record)
+	}
+}
+
+func TestIDChaincode_Expiry(t *testing.T) {
+	stub := newRegistry(t)
+	pubKey, privKey := genKey(t)
+	addr := register(t, stub, pubKey, privKey, &cliapi.RegistryMetadata{Expiry: "2000-01-01T00:00:00Z"})
+
+	// an expired key no longer resolves, but its history does
+	checkInvokeFail(t, stub, "QueryPubkey", addr)
+	if getKeyRecord(t, stub, addr).current().PubKey != pubKey {
+		t.Fatal("unexpected key history")
+	}
+
+	// and it can still rotate, which renews the address
+	setInvokedChaincode(t, "TransferChaincode")
+	newPubKey, _ := genKey(t)
+	rotation, _ := gohe.Sign([]byte(privKey), rotateMessage(addr, 1, newPubKey))
+	checkInvoke(t, stub, "Rotate", addr, newPubKey, string(rotation))
+	if string(checkInvoke(t, stub, "QueryPubkey", addr)) != newPubKey {
+		t.Fatal("rotated key does not resolve")
+	}
+}
+
+// collectPages walks all pages of a registry query and returns the addresses.
+func collectPages(t *testing.T, stub *shim.MockStub, args ...string) []string {
+	t.Helper()
+	addrs := []string{}
+	bookmark := ""
+	for {
+		page := &RegistryPage{}
+		err := json.Unmarshal(checkInvoke(t, stub, append(args, bookmark)...), page)
+		if err != nil {
+			t.Fatal("fail to unmarshal page")
+		}
+		for _, record := range page.Records {
+			addrs = append(addrs, record.Addr)
+		}
+		if page.Bookmark == "" {
+			return addrs
+		}
+		bookmark = page.Bookmark
+	}
+}
+
+func TestIDChaincode_Listing(t *testing.T) {
+	stub := newRegistry(t)
+
+	orgs := map[string][]string{}
+	for i, mspID := range []string{"Org1MSP", "Org2MSP", "Org1MSP", "Org1MSP", "Org2MSP"} {
+		setClientMSPID(t, mspID)
+		pubKey, privKey := genKey(t)
+		addr := register(t, stub, pubKey, privKey, &cliapi.RegistryMetadata{DisplayName: strconv.Itoa(i)})
+		orgs[mspID] = append(orgs[mspID], addr)
+	}
+
+	sameAddrs := func(got, want []string) bool {
+		if len(got) != len(want) {
+			return false
+		}
+		seen := map[string]bool{}
+		for _, addr := range want {
+			seen[addr] = true
+		}
+		for _, addr := range got {
+			if !seen[addr] {
+				return false
+			}
+			delete(seen, addr)
+		}
+		return true
+	}
+
+	for mspID, want := range orgs {
+		if got := collectPages(t, stub, "QueryByOrg", mspID, "2"); !sameAddrs(got, want) {
+			t.Fatal("unexpected records of ", mspID, ": ", got)
+		}
+	}
+	if got := collectPages(t, stub, "QueryByOrg", "Org3MSP", "2"); len(got) != 0 {
+		t.Fatal("unexpected records of Org3MSP: ", got)
+	}
+
+	// the listing holds every record once and nothing else
+	all := append(append([]string{}, orgs["Org1MSP"]...), orgs["Org2MSP"]...)
+	if got := collectPages(t, stub, "ListRegistry", "2"); !sameAddrs(got, all) {
+		t.Fatal("unexpected listing: ", got)
+	}
+	if got := collectPages(t, stub, "ListRegistry", "10"); !sameAddrs(got, all) {
+		t.Fatal("unexpected listing in one page: ", got)
+	}
+	checkInvokeFail(t, stub, "ListRegistry", "0", "")
+	checkInvokeFail(t, stub, "QueryByOrg", "Org1MSP", "-1", "")
+}
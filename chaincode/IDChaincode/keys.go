@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"chaoshen.com/gopaillier/api/core"
+	"chaoshen.com/gopaillier/api/event"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/hyperledger/fabric/protos/utils"
+)
+
+// KeyRecord is the registry entry of an address. The address is the hash of
+// the first key, rotations keep the address and append a new version.
+type KeyRecord struct {
+	Addr        string
+	Keys        []KeyVersion
+	Revoked     bool
+	DisplayName string
+	MSPID       string // organization of the registering client
+	Purpose     string // one of the Purpose constants
+	Expiry      string // RFC 3339 time after which the key no longer resolves, empty for none
+}
+
+// Key purposes of a registry record.
+const (
+	PurposeBalance = "balance"
+	PurposeSigning = "signing"
+	PurposeAuditor = "auditor"
+)
+
+// KeyVersion is one key of an address.
+type KeyVersion struct {
+	Version int
+	PubKey  string
+	TxID    string // transaction that registered or rotated to the key
+}
+
+func (r *KeyRecord) current() *KeyVersion {
+	return &r.Keys[len(r.Keys)-1]
+}
+
+func getRecord(stub shim.ChaincodeStubInterface, addr string) (*KeyRecord, error) {
+	recordBytes, err := stub.GetState(addr)
+	if err != nil {
+		return nil, errors.New("fail to query addr")
+	}
+	if recordBytes == nil {
+		return nil, errors.New("addr is not register")
+	}
+
+	// addresses registered before versioning hold the bare PEM key
+	if strings.HasPrefix(string(recordBytes), "-----BEGIN") {
+		return &KeyRecord{Addr: addr, Keys: []KeyVersion{{Version: 1, PubKey: string(recordBytes)}}}, nil
+	}
+
+	record := &KeyRecord{}
+	err = json.Unmarshal(recordBytes, record)
+	if err != nil || len(record.Keys) == 0 {
+		return nil, errors.New("fail to unmarshal key record")
+	}
+	return record, nil
+}
+
+func putRecord(stub shim.ChaincodeStubInterface, record *KeyRecord) error {
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(record.Addr, recordBytes)
+}
+
+// rotateMessage is the message the current key signs to rotate addr to newPubKey.
+func rotateMessage(addr string, version int, newPubKey string) []byte {
+	keyHash := sha256.Sum256([]byte(newPubKey))
+	return []byte("gopaillier/rotate/" + addr + "/" + strconv.Itoa(version) + "/" + hex.EncodeToString(keyHash[:]))
+}
+
+// revokeMessage is the message the current key signs to revoke addr.
+func revokeMessage(addr string, version int) []byte {
+	return []byte("gopaillier/revoke/" + addr + "/" + strconv.Itoa(version))
+}
+
+// invokedChaincode returns the name of the chaincode the transaction
+// proposal invokes, which is the transfer chaincode when it calls the
+// registry. It is a variable so tests can run without a signed proposal.
+var invokedChaincode = func(stub shim.ChaincodeStubInterface) (string, error) {
+	signedProp, err := stub.GetSignedProposal()
+	if err != nil {
+		return "", err
+	}
+	if signedProp == nil {
+		return "", errors.New("no signed proposal")
+	}
+	prop, err := utils.GetProposal(signedProp.ProposalBytes)
+	if err != nil {
+		return "", err
+	}
+	spec, err := utils.GetChaincodeInvocationSpec(prop)
+	if err != nil {
+		return "", err
+	}
+	return spec.GetChaincodeSpec().GetChaincodeId().GetName(), nil
+}
+
+/*
+rotate the key of an address, authorized by the current key, even when the
+key has expired. It is only accepted from the transfer chaincode configured
+at Init, whose RotateKey re-encrypts the balance in the same transaction.
+args: addr, new PEM public key, signature of rotateMessage by the current key
+*/
+func (t *IDChaincode) rotate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		logger.Error("wrong parameters")
+		return shim.Error("wrong parameters")
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Error("fail to read config")
+		return shim.Error("fail to read config")
+	}
+	invoked, err := invokedChaincode(stub)
+	if err != nil {
+		logger.Error("fail to read proposal: ", err.Error())
+		return shim.Error("fail to read proposal: " + err.Error())
+	}
+	if config.TransferChaincode == "" || invoked != config.TransferChaincode {
+		logger.Error("keys are only rotated through the transfer chaincode")
+		return shim.Error("keys are only rotated through the transfer chaincode")
+	}
+
+	addr := args[0]
+	newPubKey := args[1]
+	sig := []byte(args[2])
+
+	record, err := getRecord(stub, addr)
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	if record.Revoked {
+		logger.Error("addr is revoked")
+		return shim.Error("addr is revoked")
+	}
+
+	_, err = gohe.ParsePublicKey([]byte(newPubKey))
+	if err != nil {
+		logger.Error("invalid public key")
+		return shim.Error("invalid public key")
+	}
+	for _, key := range record.Keys {
+		if key.PubKey == newPubKey {
+			logger.Error("key was already used by addr")
+			return shim.Error("key was already used by addr")
+		}
+	}
+
+	current := record.current()
+	err = gohe.Verify([]byte(current.PubKey), rotateMessage(addr, current.Version, newPubKey), sig)
+	if err != nil {
+		logger.Error("invalid rotation signature")
+		return shim.Error("invalid rotation signature")
+	}
+
+	record.Keys = append(record.Keys, KeyVersion{Version: current.Version + 1, PubKey: newPubKey, TxID: stub.GetTxID()})
+	// the expiry is that of the old key, which may have passed; rotating
+	// away from an expired key is how its owner renews the address
+	record.Expiry = ""
+	err = putRecord(stub, record)
+	if err != nil {
+		logger.Error("Error on store key record: ", err.Error())
+		return shim.Error("Error on store key record: " + err.Error())
+	}
+
+	err = setKeyEvent(stub, event.KeyRotated, record)
+	if err != nil {
+		logger.Error("Error on set event: ", err.Error())
+		return shim.Error("Error on set event: " + err.Error())
+	}
+
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return shim.Error("Marshal Error")
+	}
+	return shim.Success(recordBytes)
+}
+
+/*
+revoke an address for good, authorized by the current key
+args: addr, signature of revokeMessage by the current key
+*/
+func (t *IDChaincode) revoke(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		logger.Error("wrong parameters")
+		return shim.Error("wrong parameters")
+	}
+
+	addr := args[0]
+	sig := []byte(args[1])
+
+	record, err := getRecord(stub, addr)
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	if record.Revoked {
+		logger.Error("addr is revoked")
+		return shim.Error("addr is revoked")
+	}
+
+	current := record.current()
+	err = gohe.Verify([]byte(current.PubKey), revokeMessage(addr, current.Version), sig)
+	if err != nil {
+		logger.Error("invalid revocation signature")
+		return shim.Error("invalid revocation signature")
+	}
+
+	record.Revoked = true
+	err = putRecord(stub, record)
+	if err != nil {
+		logger.Error("Error on store key record: ", err.Error())
+		return shim.Error("Error on store key record: " + err.Error())
+	}
+
+	err = setKeyEvent(stub, event.KeyRevoked, record)
+	if err != nil {
+		logger.Error("Error on set event: ", err.Error())
+		return shim.Error("Error on set event: " + err.Error())
+	}
+	return shim.Success(nil)
+}
+
+/*
+query all key versions of an address, including revoked ones
+args: addr
+*/
+func (t *IDChaincode) queryKeyHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		logger.Error("wrong parameters")
+		return shim.Error("wrong parameters")
+	}
+
+	record, err := getRecord(stub, args[0])
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return shim.Error("Marshal Error")
+	}
+	return shim.Success(recordBytes)
+}
+
+func setKeyEvent(stub shim.ChaincodeStubInterface, name string, record *KeyRecord) error {
+	ev := &event.KeyRegisteredEvent{
+		Version:    event.Version,
+		TxID:       stub.GetTxID(),
+		Addr:       record.Addr,
+		KeyVersion: record.current().Version,
+	}
+	if !record.Revoked {
+		ev.PubKey = record.current().PubKey
+	}
+
+	eventBytes, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return stub.SetEvent(name, eventBytes)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// orgIndex is the object type of the (MSP ID, address) index keys.
+const orgIndex = "org~addr"
+
+// RegistryPage is one page of registry records.
+type RegistryPage struct {
+	Records  []*KeyRecord
+	Bookmark string // pass to the next call, empty on the last page
+}
+
+// clientMSPID returns the MSP ID of the submitting client. It is a variable
+// so tests can run without a signed proposal.
+var clientMSPID = func(stub shim.ChaincodeStubInterface) (string, error) {
+	return cid.GetMSPID(stub)
+}
+
+// checkMetadata validates the metadata of a register request and fills in
+// the defaults.
+func checkMetadata(stub shim.ChaincodeStubInterface, req *registerRequest) error {
+	mspID, err := clientMSPID(stub)
+	if err != nil {
+		return err
+	}
+	if req.MSPID == "" {
+		req.MSPID = mspID
+	} else if req.MSPID != mspID {
+		return errors.New("MSPID does not match the client")
+	}
+
+	switch req.Purpose {
+	case "":
+		req.Purpose = PurposeBalance
+	case PurposeBalance, PurposeSigning, PurposeAuditor:
+	default:
+		return errors.New("unknown purpose " + req.Purpose)
+	}
+
+	if req.Expiry != "" {
+		_, err = time.Parse(time.RFC3339, req.Expiry)
+		if err != nil {
+			return errors.New("expiry is not an RFC 3339 time")
+		}
+	}
+	return nil
+}
+
+// expired reports whether the record has expired at the transaction time.
+func (r *KeyRecord) expired(stub shim.ChaincodeStubInterface) (bool, error) {
+	if r.Expiry == "" {
+		return false, nil
+	}
+	expiry, err := time.Parse(time.RFC3339, r.Expiry)
+	if err != nil {
+		return false, errors.New("invalid expiry in key record")
+	}
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return false, err
+	}
+	return ts.GetSeconds() >= expiry.Unix(), nil
+}
+
+func putOrgIndex(stub shim.ChaincodeStubInterface, record *KeyRecord) error {
+	key, err := stub.CreateCompositeKey(orgIndex, []string{record.MSPID, record.Addr})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, []byte{0x00})
+}
+
+/*
+query the records registered by an organization, page by page
+args: MSP ID, page size, bookmark (empty for the first page)
+*/
+func (t *IDChaincode) queryByOrg(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		logger.Error("wrong parameters")
+		return shim.Error("wrong parameters")
+	}
+
+	pageSize, err := parsePageSize(args[1])
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	iterator, metadata, err := stub.GetStateByPartialCompositeKeyWithPagination(orgIndex, []string{args[0]}, pageSize, args[2])
+	if err != nil {
+		logger.Error("fail to query org index")
+		return shim.Error("fail to query org index")
+	}
+	kvs, bookmark, err := pageOf(iterator, metadata, func() (shim.StateQueryIteratorInterface, error) {
+		return stub.GetStateByPartialCompositeKey(orgIndex, []string{args[0]})
+	}, pageSize, args[2])
+	if err != nil {
+		logger.Error("fail to query org index")
+		return shim.Error("fail to query org index")
+	}
+
+	page := &RegistryPage{Records: []*KeyRecord{}, Bookmark: bookmark}
+	for _, kv := range kvs {
+		_, attrs, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil || len(attrs) != 2 {
+			return shim.Error("invalid org index key")
+		}
+		record, err := getRecord(stub, attrs[1])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		page.Records = append(page.Records, record)
+	}
+	return marshalPage(page)
+}
+
+/*
+list all records in address order, page by page
+args: page size, bookmark (empty for the first page)
+*/
+func (t *IDChaincode) listRegistry(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		logger.Error("wrong parameters")
+		return shim.Error("wrong parameters")
+	}
+
+	pageSize, err := parsePageSize(args[0])
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	// the open range skips composite keys, so only records are listed
+	iterator, metadata, err := stub.GetStateByRangeWithPagination("", "", pageSize, args[1])
+	if err != nil {
+		logger.Error("fail to list registry")
+		return shim.Error("fail to list registry")
+	}
+	kvs, bookmark, err := pageOf(iterator, metadata, func() (shim.StateQueryIteratorInterface, error) {
+		return stub.GetStateByRange(simpleKeyStart, "")
+	}, pageSize, args[1])
+	if err != nil {
+		logger.Error("fail to list registry")
+		return shim.Error("fail to list registry")
+	}
+
+	page := &RegistryPage{Records: []*KeyRecord{}, Bookmark: bookmark}
+	for _, kv := range kvs {
+		record, err := getRecord(stub, kv.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		page.Records = append(page.Records, record)
+	}
+	return marshalPage(page)
+}
+
+// simpleKeyStart is the smallest simple key, composite keys start with 0x00.
+const simpleKeyStart = "\x01"
+
+// pageOf collects one page of a paginated query. Stubs without pagination,
+// such as shim.MockStub, return no iterator; the page is then cut from the
+// unpaginated query, with the key of the next record as the bookmark.
+func pageOf(iterator shim.StateQueryIteratorInterface, metadata *pb.QueryResponseMetadata, unpaged func() (shim.StateQueryIteratorInterface, error), pageSize int32, bookmark string) ([]*queryresult.KV, string, error) {
+	paged := iterator != nil
+	if !paged {
+		var err error
+		iterator, err = unpaged()
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	defer iterator.Close()
+
+	kvs := []*queryresult.KV{}
+	next := ""
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return nil, "", err
+		}
+		if !paged {
+			if kv.Key < bookmark {
+				continue
+			}
+			if len(kvs) == int(pageSize) {
+				next = kv.Key
+				break
+			}
+		}
+		kvs = append(kvs, kv)
+	}
+	if paged && metadata != nil {
+		next = metadata.Bookmark
+	}
+	return kvs, next, nil
+}
+
+func parsePageSize(s string) (int32, error) {
+	pageSize, err := strconv.ParseInt(s, 10, 32)
+	if err != nil || pageSize <= 0 {
+		return 0, errors.New("invalid page size: " + s)
+	}
+	return int32(pageSize), nil
+}
+
+func marshalPage(page *RegistryPage) pb.Response {
+	pageBytes, err := json.Marshal(page)
+	if err != nil {
+		return shim.Error("Marshal Error")
+	}
+	return shim.Success(pageBytes)
+}
@@ -0,0 +1,587 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+
+	"chaoshen.com/gopaillier/api/ccapi"
+	"chaoshen.com/gopaillier/api/core"
+	"chaoshen.com/gopaillier/api/event"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// allowanceObjectType is the object type of the (owner, spender, asset)
+// allowance keys.
+const allowanceObjectType = "allowance"
+
+// Allowance is an amount the owner granted the spender. It stays in the
+// owner's balance, but Approve adds it to the account's Reserved amount, and
+// the owner's own debits are proved against the balance less the reserved
+// amount. The spender proves a spend against the owner's copy of the
+// allowance, whose plain text and nonce the last call sealed to it in
+// Opening. So a spend is at most the allowance, which is at most the
+// reserved amount, which is at most the owner's balance.
+type Allowance struct {
+	Owner         string
+	Spender       string
+	Asset         string // asset ID, empty for the default asset
+	PubKeyOwner   []byte
+	PubKeySpender []byte
+	CipherOwner   []byte     // remaining allowance under the owner's key
+	CipherAuditor []byte     // remaining allowance under the auditor key, if any
+	Opening       *gohe.Memo // CipherOwner opened for the spender, see cliapi.PrepareTransferFrom
+}
+
+// allowanceMessage must match the messages signed by cliapi.SignApprove,
+// cliapi.SignTransferFrom and cliapi.SignRevokeAllowance.
+func allowanceMessage(action, owner, spender, to, txID string, info []byte) []byte {
+	infoHash := sha256.Sum256(info)
+	return []byte("gopaillier/" + action + "/" + owner + "/" + spender + "/" + to + "/" + txID + "/" + hex.EncodeToString(infoHash[:]))
+}
+
+/*
+grant the spender an amount of the owner, adding to an existing allowance.
+The amount stays in the owner's balance, reserved for the spender; a fee is
+paid now.
+args: owner addr, spender addr, approve info prepared by cliapi.PrepareApprove, owner signature from cliapi.SignApprove, optional asset ID
+*/
+func (t *TransferChaincode) approve(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 4 && len(args) != 5 {
+		logger.Error("Incorrect number of arguments. expect 4 or 5 arguments")
+		return shim.Error("Incorrect number of arguments. expect 4 or 5 arguments")
+	}
+
+	owner, spender, approveInfo := args[0], args[1], args[2]
+	assetID := ""
+	if len(args) == 5 {
+		assetID = args[4]
+	}
+	if owner == spender {
+		logger.Error("owner and spender must differ")
+		return shim.Error("owner and spender must differ")
+	}
+
+	err := verifyAccountSig(stub, owner, allowanceMessage("approve", owner, spender, "", stub.GetTxID(), []byte(approveInfo)), []byte(args[3]))
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Error("fail to read chaincode config")
+		return shim.Error("fail to read chaincode config")
+	}
+	if assetID != "" {
+		_, err = getAsset(stub, assetID)
+		if err != nil {
+			logger.Error(err.Error())
+			return shim.Error(err.Error())
+		}
+	}
+	accountOwner, err := getAccount(stub, owner)
+	if err == nil {
+		err = checkNotFrozen(owner, accountOwner)
+	}
+	if err == nil {
+		err = checkSingleSigner(owner, accountOwner)
+	}
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	accountSpender, err := getAccount(stub, spender)
+	if err == nil {
+		err = checkNotFrozen(spender, accountSpender)
+	}
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	pubKeyOwner, err := resolvePubKey(stub, config, owner, accountOwner)
+	if err != nil {
+		logger.Error("fail to resolve owner key: ", err.Error())
+		return shim.Error("fail to resolve owner key: " + err.Error())
+	}
+	pubKeySpender, err := resolvePubKey(stub, config, spender, accountSpender)
+	if err != nil {
+		logger.Error("fail to resolve spender key: ", err.Error())
+		return shim.Error("fail to resolve spender key: " + err.Error())
+	}
+
+	allowance, err := findAllowance(stub, owner, spender, assetID)
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	if allowance == nil {
+		allowance = &Allowance{
+			Owner:         owner,
+			Spender:       spender,
+			Asset:         assetID,
+			PubKeyOwner:   pubKeyOwner,
+			PubKeySpender: pubKeySpender,
+			CipherOwner:   gohe.ZeroCipher(),
+		}
+		if config.AuditorPubKey != "" {
+			allowance.CipherAuditor = gohe.ZeroCipher()
+		}
+	}
+	if !bytes.Equal(allowance.PubKeyOwner, pubKeyOwner) || !bytes.Equal(allowance.PubKeySpender, pubKeySpender) {
+		logger.Error("a key changed since the allowance was approved, revoke it first")
+		return shim.Error("a key changed since the allowance was approved, revoke it first")
+	}
+
+	// fees are charged in the default asset only
+	var fee *ccapi.Fee
+	var collector string
+	if assetID == "" {
+		fee, collector, err = getFee(stub, config, owner)
+		if err != nil {
+			logger.Error("fail to read fee schedule: ", err.Error())
+			return shim.Error("fail to read fee schedule: " + err.Error())
+		}
+	}
+
+	spendable, err := accountOwner.spendable(pubKeyOwner, assetID)
+	if err != nil {
+		logger.Error("fail to read spendable balance: ", err.Error())
+		return shim.Error("fail to read spendable balance: " + err.Error())
+	}
+	result, err := ccapi.ValidateApprove(approveInfo, string(spendable), string(allowance.CipherOwner), string(pubKeyOwner), string(pubKeySpender), config.AuditorPubKey, assetID, fee)
+	if err != nil {
+		logger.Error("fail to validate approval: ", err.Error())
+		return shim.Error("fail to validate transaction information")
+	}
+
+	// an allowance counts toward the owner's spending limit when granted
+	if assetID == "" {
+		err = checkSpendingLimit(stub, accountOwner, pubKeyOwner, approveInfo, result.CipherTxA)
+		if err != nil {
+			logger.Error(err.Error())
+			return shim.Error(err.Error())
+		}
+	}
+
+	if result.Fee != nil {
+		err = creditFee(stub, config, collector, owner, result.Fee)
+		if err != nil {
+			logger.Error("fail to pay fee: ", err.Error())
+			return shim.Error("fail to pay fee: " + err.Error())
+		}
+	}
+
+	// reserve the amount first, so the new spendable balance adds to it
+	reserved, ok := accountOwner.Reserved[assetID]
+	if !ok {
+		reserved = gohe.ZeroCipher()
+	}
+	reserved, err = gohe.AddCipher(pubKeyOwner, reserved, result.CipherTxA)
+	if err != nil {
+		logger.Error("fail to reserve allowance: ", err.Error())
+		return shim.Error("fail to reserve allowance: " + err.Error())
+	}
+	if accountOwner.Reserved == nil {
+		accountOwner.Reserved = map[string][]byte{}
+	}
+	accountOwner.Reserved[assetID] = reserved
+	err = accountOwner.setSpendable(pubKeyOwner, assetID, []byte(result.NewCipherBalanceA))
+	if err == nil {
+		err = putAccount(stub, owner, accountOwner)
+	}
+	if err != nil {
+		logger.Error("fail to store state: ", err.Error())
+		return shim.Error(err.Error())
+	}
+	if result.Fee != nil {
+		err = putReceipt(stub, owner, &Receipt{Type: ReceiptTransferOut, Asset: assetID, Counterparty: collector, Delta: result.Fee.CipherFeeA, AuditorDelta: result.Fee.CipherFeeAuditor})
+		if err != nil {
+			logger.Error("fail to store receipt: ", err.Error())
+			return shim.Error("fail to store receipt: " + err.Error())
+		}
+	}
+
+	allowance.CipherOwner, err = gohe.AddCipher(pubKeyOwner, allowance.CipherOwner, result.CipherTxA)
+	if err == nil && allowance.CipherAuditor != nil {
+		allowance.CipherAuditor, err = gohe.AddCipher([]byte(config.AuditorPubKey), allowance.CipherAuditor, result.CipherTxAuditor)
+	}
+	if err != nil {
+		logger.Error("fail to add allowance: ", err.Error())
+		return shim.Error("fail to add allowance: " + err.Error())
+	}
+	allowance.Opening = result.Opening
+	err = putAllowance(stub, allowance)
+	if err != nil {
+		logger.Error("fail to store allowance: ", err.Error())
+		return shim.Error("fail to store allowance: " + err.Error())
+	}
+
+	return allowanceEvent(stub, event.AllowanceApproved, allowance, "", result.CipherTxB)
+}
+
+/*
+pay from an allowance to B on behalf of the owner. The amount leaves the
+owner's balance and its reserved amount, so the spendable balance is
+unchanged.
+args: owner addr, spender addr, addr B, spend info prepared by cliapi.PrepareTransferFrom, spender signature from cliapi.SignTransferFrom, optional asset ID
+*/
+func (t *TransferChaincode) transferFrom(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 5 && len(args) != 6 {
+		logger.Error("Incorrect number of arguments. expect 5 or 6 arguments")
+		return shim.Error("Incorrect number of arguments. expect 5 or 6 arguments")
+	}
+
+	owner, spender, addrB, spendInfo := args[0], args[1], args[2], args[3]
+	assetID := ""
+	if len(args) == 6 {
+		assetID = args[5]
+	}
+	if addrB == owner {
+		logger.Error("cannot pay an allowance back to its owner, revoke it instead")
+		return shim.Error("cannot pay an allowance back to its owner, revoke it instead")
+	}
+
+	allowance, err := getAllowance(stub, owner, spender, assetID)
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	err = gohe.Verify(allowance.PubKeySpender, allowanceMessage("transfer-from", owner, spender, addrB, stub.GetTxID(), []byte(spendInfo)), []byte(args[4]))
+	if err != nil {
+		logger.Error("invalid signature: ", err.Error())
+		return shim.Error("invalid signature: " + err.Error())
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Error("fail to read chaincode config")
+		return shim.Error("fail to read chaincode config")
+	}
+	accountOwner, err := getAccount(stub, owner)
+	if err == nil {
+		err = checkNotFrozen(owner, accountOwner)
+	}
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	accountB, err := getAccount(stub, addrB)
+	if err == nil {
+		err = checkNotFrozen(addrB, accountB)
+	}
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	pubKeyB, err := resolvePubKey(stub, config, addrB, accountB)
+	if err != nil {
+		logger.Error("fail to resolve receiver key: ", err.Error())
+		return shim.Error("fail to resolve receiver key: " + err.Error())
+	}
+
+	result, err := ccapi.ValidateTransferFrom(spendInfo, string(allowance.CipherOwner), string(accountB.balance(assetID)),
+		string(allowance.PubKeyOwner), string(pubKeyB), string(allowance.PubKeySpender), config.AuditorPubKey, assetID)
+	if err != nil {
+		logger.Error("fail to validate spend: ", err.Error())
+		return shim.Error("fail to validate transaction information")
+	}
+
+	allowance.CipherOwner = []byte(result.NewCipherBalanceA)
+	allowance.Opening = result.Opening
+	if allowance.CipherAuditor != nil {
+		allowance.CipherAuditor, err = gohe.SubCipher([]byte(config.AuditorPubKey), allowance.CipherAuditor, result.CipherTxAuditor)
+		if err != nil {
+			logger.Error("fail to update allowance: ", err.Error())
+			return shim.Error("fail to update allowance: " + err.Error())
+		}
+	}
+	err = putAllowance(stub, allowance)
+	if err != nil {
+		logger.Error("fail to store allowance: ", err.Error())
+		return shim.Error("fail to store allowance: " + err.Error())
+	}
+
+	reserved, ok := accountOwner.Reserved[assetID]
+	if !ok {
+		logger.Error("no amount reserved for allowances of ", owner)
+		return shim.Error("no amount reserved for allowances of " + owner)
+	}
+	balance, err := gohe.SubCipher(allowance.PubKeyOwner, accountOwner.balance(assetID), result.CipherTxA)
+	if err == nil {
+		accountOwner.setBalance(assetID, balance)
+		accountOwner.Reserved[assetID], err = gohe.SubCipher(allowance.PubKeyOwner, reserved, result.CipherTxA)
+	}
+	if err != nil {
+		logger.Error("fail to debit owner: ", err.Error())
+		return shim.Error("fail to debit owner: " + err.Error())
+	}
+	err = putAccount(stub, owner, accountOwner)
+	if err != nil {
+		logger.Error("fail to store state: ", err.Error())
+		return shim.Error(err.Error())
+	}
+	err = putReceipt(stub, owner, &Receipt{Type: ReceiptTransferOut, Asset: assetID, Counterparty: addrB, Delta: result.CipherTxA, AuditorDelta: result.CipherTxAuditor})
+	if err != nil {
+		logger.Error("fail to store receipt: ", err.Error())
+		return shim.Error("fail to store receipt: " + err.Error())
+	}
+
+	accountB.setBalance(assetID, []byte(result.NewCipherBalanceB))
+	err = putAccount(stub, addrB, accountB)
+	if err != nil {
+		logger.Error("fail to store state: ", err.Error())
+		return shim.Error(err.Error())
+	}
+	err = putReceipt(stub, addrB, &Receipt{Type: ReceiptTransferIn, Asset: assetID, Counterparty: owner, Delta: result.CipherTxB, AuditorDelta: result.CipherTxAuditor})
+	if err != nil {
+		logger.Error("fail to store receipt: ", err.Error())
+		return shim.Error("fail to store receipt: " + err.Error())
+	}
+
+	return allowanceEvent(stub, event.AllowanceSpent, allowance, addrB, result.CipherTxB)
+}
+
+/*
+end an allowance. What remains of it is no longer reserved and the owner can
+spend it again.
+args: owner addr, spender addr, owner signature from cliapi.SignRevokeAllowance, optional asset ID
+*/
+func (t *TransferChaincode) revokeAllowance(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 && len(args) != 4 {
+		logger.Error("Incorrect number of arguments. expect 3 or 4 arguments")
+		return shim.Error("Incorrect number of arguments. expect 3 or 4 arguments")
+	}
+
+	owner, spender := args[0], args[1]
+	assetID := ""
+	if len(args) == 4 {
+		assetID = args[3]
+	}
+
+	allowance, err := getAllowance(stub, owner, spender, assetID)
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	err = gohe.Verify(allowance.PubKeyOwner, allowanceMessage("revoke-allowance", owner, spender, "", stub.GetTxID(), nil), []byte(args[2]))
+	if err != nil {
+		logger.Error("invalid signature: ", err.Error())
+		return shim.Error("invalid signature: " + err.Error())
+	}
+
+	key, err := stub.CreateCompositeKey(allowanceObjectType, []string{owner, spender, assetID})
+	if err == nil {
+		err = stub.DelState(key)
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	account, err := getAccount(stub, owner)
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	keys, err := allowanceKeys(stub, owner, assetID)
+	if err != nil {
+		logger.Error("fail to read allowances: ", err.Error())
+		return shim.Error("fail to read allowances: " + err.Error())
+	}
+	if len(keys) == 0 {
+		delete(account.Reserved, assetID)
+	} else {
+		account.Reserved[assetID], err = gohe.SubCipher(allowance.PubKeyOwner, account.Reserved[assetID], allowance.CipherOwner)
+		if err != nil {
+			logger.Error("fail to release allowance: ", err.Error())
+			return shim.Error("fail to release allowance: " + err.Error())
+		}
+	}
+	err = putAccount(stub, owner, account)
+	if err != nil {
+		logger.Error("fail to store state: ", err.Error())
+		return shim.Error(err.Error())
+	}
+
+	return allowanceEvent(stub, event.AllowanceRevoked, allowance, "", nil)
+}
+
+/*
+query the balance the owner can still spend itself, the balance less the
+allowances granted
+args: addr, optional asset ID
+*/
+func (t *TransferChaincode) querySpendable(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 && len(args) != 2 {
+		logger.Error("Incorrect number of arguments. Expecting addr and optional asset ID")
+		return shim.Error("Incorrect number of arguments. Expecting addr and optional asset ID")
+	}
+
+	assetID := ""
+	if len(args) == 2 {
+		assetID = args[1]
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Error("fail to read chaincode config")
+		return shim.Error("fail to read chaincode config")
+	}
+	account, err := getAccount(stub, args[0])
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	pubKey, err := resolvePubKey(stub, config, args[0], account)
+	if err != nil {
+		logger.Error("fail to resolve public key: ", err.Error())
+		return shim.Error("fail to resolve public key: " + err.Error())
+	}
+	spendable, err := account.spendable(pubKey, assetID)
+	if err != nil {
+		logger.Error("fail to read spendable balance: ", err.Error())
+		return shim.Error("fail to read spendable balance: " + err.Error())
+	}
+	return shim.Success(spendable)
+}
+
+/*
+query the allowance of a spender
+args: owner addr, spender addr, optional asset ID
+*/
+func (t *TransferChaincode) queryAllowance(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 && len(args) != 3 {
+		logger.Error("Incorrect number of arguments. Expecting owner, spender and optional asset ID")
+		return shim.Error("Incorrect number of arguments. Expecting owner, spender and optional asset ID")
+	}
+
+	assetID := ""
+	if len(args) == 3 {
+		assetID = args[2]
+	}
+	allowance, err := getAllowance(stub, args[0], args[1], assetID)
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	allowanceBytes, err := json.Marshal(allowance)
+	if err != nil {
+		return shim.Error("Marshal Error")
+	}
+	return shim.Success(allowanceBytes)
+}
+
+// verifyAccountSig verifies a signature with the current key of addr.
+func verifyAccountSig(stub shim.ChaincodeStubInterface, addr string, msg, sig []byte) error {
+	config, err := getConfig(stub)
+	if err != nil {
+		return errors.New("fail to read chaincode config")
+	}
+	account, err := getAccount(stub, addr)
+	if err != nil {
+		return err
+	}
+	err = checkClaimed(addr, account)
+	if err != nil {
+		return err
+	}
+	pubKey, err := resolvePubKey(stub, config, addr, account)
+	if err != nil {
+		return err
+	}
+	err = gohe.Verify(pubKey, msg, sig)
+	if err != nil {
+		return errors.New("invalid signature: " + err.Error())
+	}
+	return nil
+}
+
+func getAllowance(stub shim.ChaincodeStubInterface, owner, spender, assetID string) (*Allowance, error) {
+	allowance, err := findAllowance(stub, owner, spender, assetID)
+	if err != nil {
+		return nil, err
+	}
+	if allowance == nil {
+		return nil, errors.New("no allowance of " + owner + " for " + spender)
+	}
+	return allowance, nil
+}
+
+// findAllowance returns nil without an error when there is no allowance.
+func findAllowance(stub shim.ChaincodeStubInterface, owner, spender, assetID string) (*Allowance, error) {
+	key, err := stub.CreateCompositeKey(allowanceObjectType, []string{owner, spender, assetID})
+	if err != nil {
+		return nil, err
+	}
+	allowanceBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, errors.New("Failed to get state")
+	}
+	if allowanceBytes == nil {
+		return nil, nil
+	}
+
+	allowance := &Allowance{}
+	err = json.Unmarshal(allowanceBytes, allowance)
+	if err != nil {
+		return nil, errors.New("fail to unmarshal allowance")
+	}
+	return allowance, nil
+}
+
+// allowanceKeys returns the keys of the allowances the owner granted in an
+// asset.
+func allowanceKeys(stub shim.ChaincodeStubInterface, owner, assetID string) ([]string, error) {
+	iterator, err := stub.GetStateByPartialCompositeKey(allowanceObjectType, []string{owner})
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	var keys []string
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, attrs, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil || len(attrs) != 3 {
+			return nil, errors.New("invalid allowance key")
+		}
+		if attrs[2] == assetID {
+			keys = append(keys, kv.Key)
+		}
+	}
+	return keys, nil
+}
+
+func putAllowance(stub shim.ChaincodeStubInterface, allowance *Allowance) error {
+	key, err := stub.CreateCompositeKey(allowanceObjectType, []string{allowance.Owner, allowance.Spender, allowance.Asset})
+	if err != nil {
+		return err
+	}
+	allowanceBytes, err := json.Marshal(allowance)
+	if err != nil {
+		return errors.New("Marshal Error")
+	}
+	return stub.PutState(key, allowanceBytes)
+}
+
+func allowanceEvent(stub shim.ChaincodeStubInterface, name string, allowance *Allowance, to string, cipherForRecipient []byte) pb.Response {
+	err := setEvent(stub, name, &event.AllowanceEvent{
+		Version:            event.Version,
+		TxID:               stub.GetTxID(),
+		Owner:              allowance.Owner,
+		Spender:            allowance.Spender,
+		To:                 to,
+		Asset:              allowance.Asset,
+		CipherForRecipient: cipherForRecipient,
+	})
+	if err != nil {
+		logger.Error("fail to set event: ", err.Error())
+		return shim.Error("fail to set event: " + err.Error())
+	}
+	return shim.Success([]byte("Success"))
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+
+	"chaoshen.com/gopaillier/api/core"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// assetObjectType is the object type of the asset registry keys.
+const assetObjectType = "asset"
+
+// Asset is a registry entry of an asset other than the default one, whose
+// issuer and supply are those of ChaincodeConfig.
+type Asset struct {
+	ID          string
+	IssuerMSPID string // MSP ID of the organization allowed to mint and burn the asset
+	IssuerID    string // optional client identity within IssuerMSPID
+	Decimals    int    // decimal places of the display unit, amounts are in base units
+	Supply      []byte // total supply, encrypted under the auditor key
+}
+
+// balance returns the cipher balance of an asset, the encryption of zero
+// for an asset the account never held.
+func (a *CipherAccount) balance(asset string) []byte {
+	if asset == "" {
+		return a.Balance
+	}
+	if balance, ok := a.Assets[asset]; ok {
+		return balance
+	}
+	return gohe.ZeroCipher()
+}
+
+func (a *CipherAccount) setBalance(asset string, balance []byte) {
+	if asset == "" {
+		a.Balance = balance
+		return
+	}
+	if a.Assets == nil {
+		a.Assets = map[string][]byte{}
+	}
+	a.Assets[asset] = balance
+}
+
+// spendable returns the balance of an asset less the amount reserved for
+// allowances, which only the spenders can pay out. Debits by the account key
+// are proved against it.
+func (a *CipherAccount) spendable(pubKey []byte, asset string) ([]byte, error) {
+	reserved, ok := a.Reserved[asset]
+	if !ok {
+		return a.balance(asset), nil
+	}
+	return gohe.SubCipher(pubKey, a.balance(asset), reserved)
+}
+
+// setSpendable sets the balance of an asset from a new spendable balance,
+// keeping the reserved amount.
+func (a *CipherAccount) setSpendable(pubKey []byte, asset string, spendable []byte) error {
+	if reserved, ok := a.Reserved[asset]; ok {
+		var err error
+		spendable, err = gohe.AddCipher(pubKey, spendable, reserved)
+		if err != nil {
+			return err
+		}
+	}
+	a.setBalance(asset, spendable)
+	return nil
+}
+
+/*
+register a new asset, chaincode issuer only
+args: JSON Asset without Supply
+*/
+func (t *TransferChaincode) registerAsset(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		logger.Error("Incorrect number of arguments. Expecting asset")
+		return shim.Error("Incorrect number of arguments. Expecting asset")
+	}
+
+	_, err := checkIssuer(stub)
+	if err != nil {
+		logger.Error("unauthorized asset registration: ", err.Error())
+		return shim.Error("unauthorized asset registration: " + err.Error())
+	}
+
+	asset := &Asset{}
+	err = json.Unmarshal([]byte(args[0]), asset)
+	if err != nil {
+		logger.Error("fail to unmarshal asset")
+		return shim.Error("fail to unmarshal asset")
+	}
+	if asset.ID == "" || asset.IssuerMSPID == "" || asset.Decimals < 0 {
+		logger.Error("asset needs an ID, an issuer and non-negative decimals")
+		return shim.Error("asset needs an ID, an issuer and non-negative decimals")
+	}
+
+	_, err = getAsset(stub, asset.ID)
+	if err == nil {
+		logger.Error("asset already registered: ", asset.ID)
+		return shim.Error("asset already registered: " + asset.ID)
+	}
+
+	asset.Supply = gohe.ZeroCipher()
+	err = putAsset(stub, asset)
+	if err != nil {
+		logger.Error("fail to store asset: ", err.Error())
+		return shim.Error("fail to store asset: " + err.Error())
+	}
+	return shim.Success(nil)
+}
+
+/*
+query an asset and its encrypted supply
+args: asset ID
+*/
+func (t *TransferChaincode) queryAsset(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		logger.Error("Incorrect number of arguments. Expecting asset ID")
+		return shim.Error("Incorrect number of arguments. Expecting asset ID")
+	}
+
+	asset, err := getAsset(stub, args[0])
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	assetBytes, err := json.Marshal(asset)
+	if err != nil {
+		return shim.Error("Marshal Error")
+	}
+	return shim.Success(assetBytes)
+}
+
+/*
+mint an asset, see mint
+args: asset ID, followed by the arguments of Mint
+*/
+func (t *TransferChaincode) mintAsset(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 {
+		logger.Error("Incorrect number of arguments. Expecting asset ID")
+		return shim.Error("Incorrect number of arguments. Expecting asset ID")
+	}
+	return t.issue(stub, args[0], args[1:], false)
+}
+
+/*
+burn an asset, see burn
+args: asset ID, followed by the arguments of Burn
+*/
+func (t *TransferChaincode) burnAsset(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 {
+		logger.Error("Incorrect number of arguments. Expecting asset ID")
+		return shim.Error("Incorrect number of arguments. Expecting asset ID")
+	}
+	return t.issue(stub, args[0], args[1:], true)
+}
+
+func getAsset(stub shim.ChaincodeStubInterface, id string) (*Asset, error) {
+	key, err := stub.CreateCompositeKey(assetObjectType, []string{id})
+	if err != nil {
+		return nil, err
+	}
+	assetBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, errors.New("Failed to get state")
+	}
+	if assetBytes == nil {
+		return nil, errors.New("asset not found: " + id)
+	}
+	asset := &Asset{}
+	err = json.Unmarshal(assetBytes, asset)
+	if err != nil {
+		return nil, errors.New("fail to unmarshal asset")
+	}
+	return asset, nil
+}
+
+func putAsset(stub shim.ChaincodeStubInterface, asset *Asset) error {
+	key, err := stub.CreateCompositeKey(assetObjectType, []string{asset.ID})
+	if err != nil {
+		return err
+	}
+	assetBytes, err := json.Marshal(asset)
+	if err != nil {
+		return errors.New("Marshal Error")
+	}
+	return stub.PutState(key, assetBytes)
+}
+
+// checkAssetIssuer returns the config and the asset if the submitting client
+// is the issuer of the asset.
+func checkAssetIssuer(stub shim.ChaincodeStubInterface, id string) (*ChaincodeConfig, *Asset, error) {
+	config, err := getConfig(stub)
+	if err != nil {
+		return nil, nil, err
+	}
+	asset, err := getAsset(stub, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mspID, clientID, err := clientIdentity(stub)
+	if err != nil {
+		return nil, nil, err
+	}
+	if mspID != asset.IssuerMSPID || (asset.IssuerID != "" && clientID != asset.IssuerID) {
+		return nil, nil, errors.New("client is not the issuer of " + id)
+	}
+	return config, asset, nil
+}
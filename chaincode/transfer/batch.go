@@ -0,0 +1,188 @@
+package main
+
+import (
+	"strings"
+
+	"chaoshen.com/gopaillier/api/ccapi"
+	"chaoshen.com/gopaillier/api/core"
+	"chaoshen.com/gopaillier/api/event"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+/*
+pay several recipients from one account in a single transaction. The sum of
+all amounts is debited once, so the sender's balance only changes once.
+args: sender addr, tx info prepared by cliapi.PrepareTransferMany and signed by cliapi.SignTxInfo, recipient addrs in the order of the tx info
+*/
+func (t *TransferChaincode) transferMany(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	logger.Debug("enter TransferMany")
+
+	if len(args) < 3 {
+		logger.Error("Incorrect number of arguments. expect sender, tx info and recipients")
+		return shim.Error("Incorrect number of arguments. expect sender, tx info and recipients")
+	}
+
+	addrA := args[0]
+	txInfo := args[1]
+	addrsB := args[2:]
+
+	// every account appears once, receipts are keyed by address and txID
+	seen := map[string]bool{addrA: true}
+	for _, addrB := range addrsB {
+		if seen[addrB] {
+			logger.Error("duplicate account: ", addrB)
+			return shim.Error("duplicate account: " + addrB)
+		}
+		seen[addrB] = true
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Error("fail to read chaincode config")
+		return shim.Error("fail to read chaincode config")
+	}
+
+	accountA, err := getAccount(stub, addrA)
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	pubKeyA, err := resolvePubKey(stub, config, addrA, accountA)
+	if err != nil {
+		logger.Error("fail to resolve sender key: ", err.Error())
+		return shim.Error("fail to resolve sender key: " + err.Error())
+	}
+	err = checkNotFrozen(addrA, accountA)
+	if err == nil {
+		err = checkSingleSigner(addrA, accountA)
+	}
+	if err == nil {
+		err = checkClaimed(addrA, accountA)
+	}
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	accountsB := make([]*CipherAccount, len(addrsB))
+	balancesB := make([]string, len(addrsB))
+	pubKeysB := make([]string, len(addrsB))
+	for i, addrB := range addrsB {
+		accountsB[i], err = getAccount(stub, addrB)
+		if err == nil {
+			err = checkNotFrozen(addrB, accountsB[i])
+		}
+		if err != nil {
+			logger.Error(err.Error())
+			return shim.Error(err.Error())
+		}
+		pubKeyB, err := resolvePubKey(stub, config, addrB, accountsB[i])
+		if err != nil {
+			logger.Error("fail to resolve receiver key: ", err.Error())
+			return shim.Error("fail to resolve receiver key: " + err.Error())
+		}
+		balancesB[i] = string(accountsB[i].Balance)
+		pubKeysB[i] = string(pubKeyB)
+	}
+
+	fee, collector, err := getFee(stub, config, addrA)
+	if err != nil {
+		logger.Error("fail to read fee schedule: ", err.Error())
+		return shim.Error("fail to read fee schedule: " + err.Error())
+	}
+
+	spendableA, err := accountA.spendable(pubKeyA, "")
+	if err != nil {
+		logger.Error("fail to read spendable balance: ", err.Error())
+		return shim.Error("fail to read spendable balance: " + err.Error())
+	}
+	result, err := ccapi.ValidateMultiTxInfo(txInfo, string(spendableA), string(pubKeyA), balancesB, pubKeysB, config.AuditorPubKey, fee,
+		&ccapi.Auth{TxID: stub.GetTxID(), From: addrA, To: strings.Join(addrsB, ",")})
+	if err != nil {
+		logger.Error("fail to validate transaction information: ", err.Error())
+		return shim.Error("fail to validate transaction information")
+	}
+
+	err = checkSpendingLimit(stub, accountA, pubKeyA, txInfo, result.CipherTotalA)
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	// a collector that is also a recipient gets the fee with its leg
+	deltaA, auditorDeltaA := result.CipherTotalA, result.CipherTotalAuditor
+	feeLeg := -1
+	if result.Fee != nil {
+		deltaA, auditorDeltaA, err = addFee(pubKeyA, config.AuditorPubKey, deltaA, auditorDeltaA, result.Fee.CipherFeeA, result.Fee.CipherFeeAuditor)
+		for i, addrB := range addrsB {
+			if addrB == collector {
+				feeLeg = i
+			}
+		}
+		if err == nil && feeLeg < 0 {
+			err = creditFee(stub, config, collector, addrA, result.Fee)
+		}
+		if err != nil {
+			logger.Error("fail to pay fee: ", err.Error())
+			return shim.Error("fail to pay fee: " + err.Error())
+		}
+	}
+
+	err = accountA.setSpendable(pubKeyA, "", []byte(result.NewCipherBalanceA))
+	if err == nil {
+		err = putAccount(stub, addrA, accountA)
+	}
+	if err != nil {
+		logger.Error("fail to store state: ", err.Error())
+		return shim.Error(err.Error())
+	}
+	err = putReceipt(stub, addrA, &Receipt{Type: ReceiptTransferOut, Delta: deltaA, AuditorDelta: auditorDeltaA})
+	if err != nil {
+		logger.Error("fail to store receipt: ", err.Error())
+		return shim.Error("fail to store receipt: " + err.Error())
+	}
+
+	ev := &event.TransferManyEvent{
+		Version: event.Version,
+		TxID:    stub.GetTxID(),
+		From:    addrA,
+		To:      addrsB,
+	}
+	for i, leg := range result.Legs {
+		delta, auditorDelta := leg.CipherTxB, leg.CipherTxAuditor
+		if i == feeLeg {
+			delta, auditorDelta, err = addFee([]byte(pubKeysB[i]), config.AuditorPubKey, delta, auditorDelta, result.Fee.CipherFeeCollector, result.Fee.CipherFeeAuditor)
+			if err == nil {
+				var newBalance []byte
+				newBalance, err = gohe.AddCipher([]byte(pubKeysB[i]), []byte(leg.NewCipherBalanceB), result.Fee.CipherFeeCollector)
+				leg.NewCipherBalanceB = string(newBalance)
+			}
+			if err != nil {
+				logger.Error("fail to pay fee: ", err.Error())
+				return shim.Error("fail to pay fee: " + err.Error())
+			}
+		}
+
+		accountsB[i].Balance = []byte(leg.NewCipherBalanceB)
+		err = putAccount(stub, addrsB[i], accountsB[i])
+		if err != nil {
+			logger.Error("fail to store state: ", err.Error())
+			return shim.Error(err.Error())
+		}
+		err = putReceipt(stub, addrsB[i], &Receipt{Type: ReceiptTransferIn, Counterparty: addrA, Delta: delta, AuditorDelta: auditorDelta})
+		if err != nil {
+			logger.Error("fail to store receipt: ", err.Error())
+			return shim.Error("fail to store receipt: " + err.Error())
+		}
+		ev.CipherForRecipient = append(ev.CipherForRecipient, leg.CipherTxB)
+	}
+
+	err = setEvent(stub, event.ConfidentialTransferMany, ev)
+	if err != nil {
+		logger.Error("fail to set event: ", err.Error())
+		return shim.Error("fail to set event: " + err.Error())
+	}
+
+	return shim.Success([]byte("Success"))
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+
+	"chaoshen.com/gopaillier/api/ccapi"
+	"chaoshen.com/gopaillier/api/event"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// tombstoneObjectType is the object type of the tombstones of closed
+// accounts, keyed by address.
+const tombstoneObjectType = "tombstone"
+
+// Tombstone marks a closed address, which init refuses to open again.
+type Tombstone struct {
+	Addr      string
+	TxID      string
+	Timestamp int64
+}
+
+/*
+close an account whose balances are all zero. Its state is deleted, its
+history and custody records stay. Accounts with holds that would be refunded
+to them, allowances they granted, signers or a freeze cannot be closed; holds
+to a closed account are refunded to their senders.
+args: addr, close info prepared by cliapi.PrepareClose
+*/
+func (t *TransferChaincode) closeAccount(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		logger.Error("Incorrect number of arguments. Expecting addr and close info")
+		return shim.Error("Incorrect number of arguments. Expecting addr and close info")
+	}
+
+	addr := args[0]
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Error("fail to read chaincode config")
+		return shim.Error("fail to read chaincode config")
+	}
+	account, err := getAccount(stub, addr)
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	err = checkNotFrozen(addr, account)
+	if err == nil {
+		err = checkSingleSigner(addr, account)
+	}
+	if err == nil {
+		err = checkClaimed(addr, account)
+	}
+	if err == nil {
+		err = checkNoOutboundHolds(stub, addr)
+	}
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	pubKey, err := resolvePubKey(stub, config, addr, account)
+	if err != nil {
+		logger.Error("fail to resolve public key: ", err.Error())
+		return shim.Error("fail to resolve public key: " + err.Error())
+	}
+
+	balances := map[string][]byte{"": account.Balance}
+	for assetID, balance := range account.Assets {
+		balances[assetID] = balance
+	}
+	err = ccapi.ValidateClose(args[1], addr, stub.GetTxID(), string(pubKey), balances)
+	if err != nil {
+		logger.Error("fail to validate close info: ", err.Error())
+		return shim.Error("fail to validate close info: " + err.Error())
+	}
+
+	err = stub.DelState(addr)
+	if err != nil {
+		logger.Error("fail to delete account: ", err.Error())
+		return shim.Error("fail to delete account: " + err.Error())
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = putTombstone(stub, &Tombstone{Addr: addr, TxID: stub.GetTxID(), Timestamp: now})
+	if err != nil {
+		logger.Error("fail to store tombstone: ", err.Error())
+		return shim.Error("fail to store tombstone: " + err.Error())
+	}
+
+	err = setEvent(stub, event.AccountClosed, &event.AccountEvent{
+		Version: event.Version,
+		TxID:    stub.GetTxID(),
+		Addr:    addr,
+	})
+	if err != nil {
+		logger.Error("fail to set event: ", err.Error())
+		return shim.Error("fail to set event: " + err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// getTombstone returns the tombstone of addr, nil if it was never closed.
+func getTombstone(stub shim.ChaincodeStubInterface, addr string) (*Tombstone, error) {
+	key, err := stub.CreateCompositeKey(tombstoneObjectType, []string{addr})
+	if err != nil {
+		return nil, err
+	}
+	tombstoneBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, errors.New("Failed to get state")
+	}
+	if tombstoneBytes == nil {
+		return nil, nil
+	}
+
+	tombstone := &Tombstone{}
+	err = json.Unmarshal(tombstoneBytes, tombstone)
+	if err != nil {
+		return nil, errors.New("fail to unmarshal tombstone")
+	}
+	return tombstone, nil
+}
+
+func putTombstone(stub shim.ChaincodeStubInterface, tombstone *Tombstone) error {
+	key, err := stub.CreateCompositeKey(tombstoneObjectType, []string{tombstone.Addr})
+	if err != nil {
+		return err
+	}
+	tombstoneBytes, err := json.Marshal(tombstone)
+	if err != nil {
+		return errors.New("Marshal Error")
+	}
+	return stub.PutState(key, tombstoneBytes)
+}
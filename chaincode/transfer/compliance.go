@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"chaoshen.com/gopaillier/api/ccapi"
+	"chaoshen.com/gopaillier/api/core"
+	"chaoshen.com/gopaillier/api/event"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Object types of the compliance audit records and of the custody records
+// of seized balances, keyed by (address, txID).
+const (
+	auditObjectType   = "audit"
+	custodyObjectType = "custody"
+)
+
+// errFrozen starts the message of every operation refused because an
+// account is frozen, so clients can tell it from other failures.
+const errFrozen = "account is frozen: "
+
+// AuditRecord records a compliance action on an account.
+type AuditRecord struct {
+	TxID      string
+	Action    string // "freeze", "unfreeze" or "seize"
+	Addr      string
+	Asset     string // seized asset, empty for the default asset
+	Reason    string
+	MSPID     string // identity of the compliance officer
+	ID        string
+	Timestamp int64
+}
+
+// Custody records a balance seized into the custody account.
+type Custody struct {
+	TxID        string
+	Addr        string // the seized account
+	Asset       string // asset ID, empty for the default asset
+	CustodyAddr string
+	PubKey      []byte // key of the custody account
+	Balance     []byte // seized balance under PubKey
+}
+
+// AuditPage is one page of the audit records of an account.
+type AuditPage struct {
+	Records  []*AuditRecord
+	Bookmark string // pass to the next QueryAuditLog call, empty on the last page
+}
+
+// checkNotFrozen refuses operations that move funds out of or into a frozen
+// account.
+func checkNotFrozen(addr string, account *CipherAccount) error {
+	if account.Frozen {
+		return errors.New(errFrozen + addr)
+	}
+	return nil
+}
+
+// checkCompliance verifies the client has the compliance role.
+func checkCompliance(stub shim.ChaincodeStubInterface) (mspID, id string, err error) {
+	config, err := getConfig(stub)
+	if err != nil {
+		return "", "", err
+	}
+	if config.ComplianceMSPID == "" {
+		return "", "", errors.New("compliance role is not configured")
+	}
+
+	mspID, id, err = clientIdentity(stub)
+	if err != nil {
+		return "", "", err
+	}
+	if mspID != config.ComplianceMSPID || (config.ComplianceID != "" && id != config.ComplianceID) {
+		return "", "", errors.New("client has not the compliance role")
+	}
+	return mspID, id, nil
+}
+
+/*
+freeze an account, compliance role only. A frozen account neither sends nor receives.
+args: addr, reason
+*/
+func (t *TransferChaincode) freeze(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return t.setFrozen(stub, args, true)
+}
+
+/*
+unfreeze an account, compliance role only
+args: addr, reason
+*/
+func (t *TransferChaincode) unfreeze(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return t.setFrozen(stub, args, false)
+}
+
+func (t *TransferChaincode) setFrozen(stub shim.ChaincodeStubInterface, args []string, frozen bool) pb.Response {
+	if len(args) != 2 {
+		logger.Error("Incorrect number of arguments. Expecting addr and reason")
+		return shim.Error("Incorrect number of arguments. Expecting addr and reason")
+	}
+
+	addr := args[0]
+	action, eventName := "freeze", event.AccountFrozen
+	if !frozen {
+		action, eventName = "unfreeze", event.AccountUnfrozen
+	}
+
+	mspID, id, err := checkCompliance(stub)
+	if err != nil {
+		logger.Error("unauthorized ", action, ": ", err.Error())
+		return shim.Error("unauthorized " + action + ": " + err.Error())
+	}
+	account, err := getAccount(stub, addr)
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	if account.Frozen == frozen {
+		logger.Error("account is already in that state: ", addr)
+		return shim.Error("account is already in that state: " + addr)
+	}
+
+	account.Frozen = frozen
+	err = putAccount(stub, addr, account)
+	if err != nil {
+		logger.Error("fail to store state: ", err.Error())
+		return shim.Error(err.Error())
+	}
+	return audited(stub, eventName, &AuditRecord{Action: action, Addr: addr, Reason: args[1], MSPID: mspID, ID: id})
+}
+
+/*
+seize the balance of a frozen account into the custody account, compliance
+role only. The balance becomes zero and the allowances the account granted in
+the asset end. The compliance role cannot seize on its own: re-encrypting the
+balance for the custody account needs the private key of the seized account,
+handed over by its owner or taken from a key escrow, see cliapi.PrepareSeizure.
+args: addr, reason, seizure info prepared by cliapi.PrepareSeizure, optional asset ID
+*/
+func (t *TransferChaincode) seize(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 && len(args) != 4 {
+		logger.Error("Incorrect number of arguments. Expecting addr, reason, seizure info and optional asset ID")
+		return shim.Error("Incorrect number of arguments. Expecting addr, reason, seizure info and optional asset ID")
+	}
+
+	addr := args[0]
+	assetID := ""
+	if len(args) == 4 {
+		assetID = args[3]
+	}
+
+	mspID, id, err := checkCompliance(stub)
+	if err != nil {
+		logger.Error("unauthorized seize: ", err.Error())
+		return shim.Error("unauthorized seize: " + err.Error())
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Error("fail to read chaincode config")
+		return shim.Error("fail to read chaincode config")
+	}
+	if config.CustodyAddr == "" || config.CustodyAddr == addr {
+		logger.Error("custody account is not configured or is the seized account")
+		return shim.Error("custody account is not configured or is the seized account")
+	}
+	account, err := getAccount(stub, addr)
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	if !account.Frozen {
+		logger.Error("only frozen accounts can be seized: ", addr)
+		return shim.Error("only frozen accounts can be seized: " + addr)
+	}
+	pubKey, err := resolvePubKey(stub, config, addr, account)
+	if err != nil {
+		logger.Error("fail to resolve public key: ", err.Error())
+		return shim.Error("fail to resolve public key: " + err.Error())
+	}
+	custodyAccount, err := getAccount(stub, config.CustodyAddr)
+	if err == nil {
+		err = checkNotFrozen(config.CustodyAddr, custodyAccount)
+	}
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	custodyPubKey, err := resolvePubKey(stub, config, config.CustodyAddr, custodyAccount)
+	if err != nil {
+		logger.Error("fail to resolve custody key: ", err.Error())
+		return shim.Error("fail to resolve custody key: " + err.Error())
+	}
+
+	seized := account.balance(assetID)
+	cipherCustody, err := ccapi.ValidateSeizure(args[2], addr, assetID, stub.GetTxID(), string(seized), string(pubKey), string(custodyPubKey))
+	if err != nil {
+		logger.Error("fail to validate seizure: ", err.Error())
+		return shim.Error("fail to validate seizure: " + err.Error())
+	}
+
+	custody := &Custody{TxID: stub.GetTxID(), Addr: addr, Asset: assetID, CustodyAddr: config.CustodyAddr, PubKey: custodyPubKey, Balance: cipherCustody}
+	key, err := stub.CreateCompositeKey(custodyObjectType, []string{addr, custody.TxID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	custodyBytes, err := json.Marshal(custody)
+	if err != nil {
+		return shim.Error("Marshal Error")
+	}
+	err = stub.PutState(key, custodyBytes)
+	if err != nil {
+		logger.Error("fail to store custody record: ", err.Error())
+		return shim.Error("fail to store custody record: " + err.Error())
+	}
+
+	// the seized balance no longer backs the allowances the account granted
+	keys, err := allowanceKeys(stub, addr, assetID)
+	for _, key := range keys {
+		if err == nil {
+			err = stub.DelState(key)
+		}
+	}
+	if err != nil {
+		logger.Error("fail to drop allowances: ", err.Error())
+		return shim.Error("fail to drop allowances: " + err.Error())
+	}
+	delete(account.Reserved, assetID)
+	account.setBalance(assetID, gohe.ZeroCipher())
+	err = putAccount(stub, addr, account)
+	if err != nil {
+		logger.Error("fail to store state: ", err.Error())
+		return shim.Error(err.Error())
+	}
+	err = putReceipt(stub, addr, &Receipt{Type: ReceiptSeize, Asset: assetID, Counterparty: config.CustodyAddr, Delta: seized})
+	if err != nil {
+		logger.Error("fail to store receipt: ", err.Error())
+		return shim.Error("fail to store receipt: " + err.Error())
+	}
+
+	balance, err := gohe.AddCipher(custodyPubKey, custodyAccount.balance(assetID), cipherCustody)
+	if err != nil {
+		logger.Error("fail to credit custody account: ", err.Error())
+		return shim.Error("fail to credit custody account: " + err.Error())
+	}
+	custodyAccount.setBalance(assetID, balance)
+	err = putAccount(stub, config.CustodyAddr, custodyAccount)
+	if err != nil {
+		logger.Error("fail to store state: ", err.Error())
+		return shim.Error(err.Error())
+	}
+	err = putReceipt(stub, config.CustodyAddr, &Receipt{Type: ReceiptTransferIn, Asset: assetID, Counterparty: addr, Delta: cipherCustody})
+	if err != nil {
+		logger.Error("fail to store receipt: ", err.Error())
+		return shim.Error("fail to store receipt: " + err.Error())
+	}
+	return audited(stub, event.AccountSeized, &AuditRecord{Action: "seize", Addr: addr, Asset: assetID, Reason: args[1], MSPID: mspID, ID: id})
+}
+
+/*
+query the custody record of a seizure
+args: addr, txID of the seizure
+*/
+func (t *TransferChaincode) queryCustody(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		logger.Error("Incorrect number of arguments. Expecting addr and txID")
+		return shim.Error("Incorrect number of arguments. Expecting addr and txID")
+	}
+
+	key, err := stub.CreateCompositeKey(custodyObjectType, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	custodyBytes, err := stub.GetState(key)
+	if err != nil {
+		return shim.Error("Failed to get state")
+	}
+	if custodyBytes == nil {
+		return shim.Error("no custody record for: " + args[0])
+	}
+	return shim.Success(custodyBytes)
+}
+
+/*
+query the compliance audit records of an account, page by page
+args: addr, page size, bookmark (empty for the first page)
+*/
+func (t *TransferChaincode) queryAuditLog(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		logger.Error("Incorrect number of arguments. Expecting addr, page size and bookmark")
+		return shim.Error("Incorrect number of arguments. Expecting addr, page size and bookmark")
+	}
+
+	pageSize, err := strconv.ParseInt(args[1], 10, 32)
+	if err != nil || pageSize <= 0 {
+		logger.Error("invalid page size: ", args[1])
+		return shim.Error("invalid page size: " + args[1])
+	}
+
+	values, next, err := getPage(stub, auditObjectType, []string{args[0]}, int32(pageSize), args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	page := &AuditPage{Records: []*AuditRecord{}, Bookmark: next}
+	for _, value := range values {
+		record := &AuditRecord{}
+		err = json.Unmarshal(value, record)
+		if err != nil {
+			return shim.Error("fail to unmarshal audit record")
+		}
+		page.Records = append(page.Records, record)
+	}
+
+	pageBytes, err := json.Marshal(page)
+	if err != nil {
+		return shim.Error("Marshal Error")
+	}
+	return shim.Success(pageBytes)
+}
+
+// audited stores the audit record of a compliance action and sets its event.
+func audited(stub shim.ChaincodeStubInterface, eventName string, record *AuditRecord) pb.Response {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	record.TxID = stub.GetTxID()
+	record.Timestamp = ts.GetSeconds()
+
+	key, err := stub.CreateCompositeKey(auditObjectType, []string{record.Addr, record.TxID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return shim.Error("Marshal Error")
+	}
+	err = stub.PutState(key, recordBytes)
+	if err != nil {
+		logger.Error("fail to store audit record: ", err.Error())
+		return shim.Error("fail to store audit record: " + err.Error())
+	}
+
+	err = setEvent(stub, eventName, &event.ComplianceEvent{
+		Version: event.Version,
+		TxID:    record.TxID,
+		Addr:    record.Addr,
+		Asset:   record.Asset,
+		Reason:  record.Reason,
+	})
+	if err != nil {
+		logger.Error("fail to set event: ", err.Error())
+		return shim.Error("fail to set event: " + err.Error())
+	}
+	return shim.Success(nil)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+
+	"chaoshen.com/gopaillier/api/ccapi"
+	"chaoshen.com/gopaillier/api/event"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+/*
+lock an amount of A for B under a hashlock. B gets it with Claim and the
+preimage before the deadline, A gets it back with Refund from the deadline on.
+The payload is the lock ID.
+args: addr A, addr B, tx info prepared by cliapi.PrepareHold(HoldLock, ...) and signed by cliapi.SignTxInfo, hashlock (hex SHA-256), timeout in seconds up to 10 years, optional asset ID
+*/
+func (t *TransferChaincode) lock(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 5 && len(args) != 6 {
+		logger.Error("Incorrect number of arguments. expect 5 or 6 arguments")
+		return shim.Error("Incorrect number of arguments. expect 5 or 6 arguments")
+	}
+
+	hashlock, err := hex.DecodeString(args[3])
+	if err != nil || len(hashlock) != sha256.Size {
+		logger.Error("invalid hashlock: ", args[3])
+		return shim.Error("invalid hashlock: " + args[3])
+	}
+	timeout, err := strconv.ParseInt(args[4], 10, 64)
+	if err != nil || timeout <= 0 || timeout > maxHoldTimeout {
+		logger.Error("invalid timeout: ", args[4])
+		return shim.Error("invalid timeout: " + args[4])
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	assetID := ""
+	if len(args) == 6 {
+		assetID = args[5]
+	}
+
+	hold, err := createHold(stub, ccapi.HoldLock, args[0], args[1], args[2], assetID)
+	if err != nil {
+		logger.Error("fail to lock: ", err.Error())
+		return shim.Error("fail to lock: " + err.Error())
+	}
+	hold.Hashlock = hex.EncodeToString(hashlock)
+	hold.Deadline = now + timeout
+	err = putHold(stub, ccapi.HoldLock, hold)
+	if err != nil {
+		logger.Error("fail to store lock: ", err.Error())
+		return shim.Error("fail to store lock: " + err.Error())
+	}
+
+	err = setHoldEvent(stub, event.EscrowLocked, hold, "")
+	if err != nil {
+		logger.Error("fail to set event: ", err.Error())
+		return shim.Error("fail to set event: " + err.Error())
+	}
+	return shim.Success([]byte(hold.ID))
+}
+
+/*
+claim a lock for its recipient before the deadline
+args: lock ID, preimage (hex)
+*/
+func (t *TransferChaincode) claim(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		logger.Error("Incorrect number of arguments. Expecting lock ID and preimage")
+		return shim.Error("Incorrect number of arguments. Expecting lock ID and preimage")
+	}
+
+	hold, err := getHold(stub, ccapi.HoldLock, args[0])
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	preimage, err := hex.DecodeString(args[1])
+	if err != nil {
+		logger.Error("invalid preimage")
+		return shim.Error("invalid preimage")
+	}
+	hash := sha256.Sum256(preimage)
+	if hex.EncodeToString(hash[:]) != hold.Hashlock {
+		logger.Error("preimage does not match the hashlock")
+		return shim.Error("preimage does not match the hashlock")
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if now >= hold.Deadline {
+		logger.Error("lock expired: ", hold.ID)
+		return shim.Error("lock expired: " + hold.ID)
+	}
+
+	err = releaseHold(stub, ccapi.HoldLock, hold)
+	if err != nil {
+		logger.Error("fail to claim: ", err.Error())
+		return shim.Error("fail to claim: " + err.Error())
+	}
+
+	err = setHoldEvent(stub, event.EscrowClaimed, hold, args[1])
+	if err != nil {
+		logger.Error("fail to set event: ", err.Error())
+		return shim.Error("fail to set event: " + err.Error())
+	}
+	return shim.Success([]byte("Success"))
+}
+
+/*
+refund a lock to its sender from the deadline on
+args: lock ID
+*/
+func (t *TransferChaincode) refund(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		logger.Error("Incorrect number of arguments. Expecting lock ID")
+		return shim.Error("Incorrect number of arguments. Expecting lock ID")
+	}
+
+	hold, err := getHold(stub, ccapi.HoldLock, args[0])
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if now < hold.Deadline {
+		logger.Error("lock not expired: ", hold.ID)
+		return shim.Error("lock not expired: " + hold.ID)
+	}
+
+	err = returnHold(stub, ccapi.HoldLock, hold)
+	if err != nil {
+		logger.Error("fail to refund: ", err.Error())
+		return shim.Error("fail to refund: " + err.Error())
+	}
+
+	err = setHoldEvent(stub, event.EscrowRefunded, hold, "")
+	if err != nil {
+		logger.Error("fail to set event: ", err.Error())
+		return shim.Error("fail to set event: " + err.Error())
+	}
+	return shim.Success([]byte("Success"))
+}
+
+/*
+query an open lock
+args: lock ID
+*/
+func (t *TransferChaincode) queryLock(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		logger.Error("Incorrect number of arguments. Expecting lock ID")
+		return shim.Error("Incorrect number of arguments. Expecting lock ID")
+	}
+
+	hold, err := getHold(stub, ccapi.HoldLock, args[0])
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	holdBytes, err := json.Marshal(hold)
+	if err != nil {
+		return shim.Error("Marshal Error")
+	}
+	return shim.Success(holdBytes)
+}
+
+func setHoldEvent(stub shim.ChaincodeStubInterface, name string, hold *Hold, preimage string) error {
+	return setEvent(stub, name, &event.HoldEvent{
+		Version:            event.Version,
+		TxID:               stub.GetTxID(),
+		HoldID:             hold.ID,
+		From:               hold.From,
+		To:                 hold.To,
+		Asset:              hold.Asset,
+		Hashlock:           hold.Hashlock,
+		Deadline:           hold.Deadline,
+		Preimage:           preimage,
+		CipherForRecipient: hold.CipherTo,
+	})
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+
+	"chaoshen.com/gopaillier/api/ccapi"
+	"chaoshen.com/gopaillier/api/core"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// feeScheduleKey holds the FeeSchedule, absent when transfers are free.
+const feeScheduleKey = "FEE_SCHEDULE"
+
+// FeeSchedule is the fee charged on every Transfer and TransferMany of the
+// default asset. Transfers of other assets are free.
+type FeeSchedule struct {
+	Flat        string // public fee per transfer, or
+	BasisPoints int64  // fee in 1/10000 of the amount, encrypted and proved by the sender
+	Collector   string // addr of the account credited with the fees
+}
+
+/*
+set the fee schedule, issuer only. An empty schedule "{}" removes the fee.
+args: JSON FeeSchedule
+*/
+func (t *TransferChaincode) setFeeSchedule(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		logger.Error("Incorrect number of arguments. Expecting fee schedule")
+		return shim.Error("Incorrect number of arguments. Expecting fee schedule")
+	}
+
+	_, err := checkIssuer(stub)
+	if err != nil {
+		logger.Error("unauthorized fee schedule: ", err.Error())
+		return shim.Error("unauthorized fee schedule: " + err.Error())
+	}
+
+	schedule := &FeeSchedule{}
+	err = json.Unmarshal([]byte(args[0]), schedule)
+	if err != nil {
+		logger.Error("fail to unmarshal fee schedule")
+		return shim.Error("fail to unmarshal fee schedule")
+	}
+
+	if *schedule == (FeeSchedule{}) {
+		err = stub.DelState(feeScheduleKey)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		return shim.Success(nil)
+	}
+
+	err = checkFeeSchedule(stub, schedule)
+	if err != nil {
+		logger.Error("invalid fee schedule: ", err.Error())
+		return shim.Error("invalid fee schedule: " + err.Error())
+	}
+
+	scheduleBytes, err := json.Marshal(schedule)
+	if err != nil {
+		return shim.Error("Marshal Error")
+	}
+	err = stub.PutState(feeScheduleKey, scheduleBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+func checkFeeSchedule(stub shim.ChaincodeStubInterface, schedule *FeeSchedule) error {
+	if (schedule.Flat == "") == (schedule.BasisPoints == 0) {
+		return errors.New("need either a flat fee or basis points")
+	}
+	if schedule.Flat != "" {
+		flat, ok := new(big.Int).SetString(schedule.Flat, 10)
+		if !ok || flat.Sign() < 0 {
+			return errors.New("flat fee must be a non-negative integer")
+		}
+	}
+	if schedule.BasisPoints < 0 || schedule.BasisPoints > 10000 {
+		return errors.New("basis points must be between 0 and 10000")
+	}
+	_, err := getAccount(stub, schedule.Collector)
+	if err != nil {
+		return errors.New("collector: " + err.Error())
+	}
+	return nil
+}
+
+/*
+query the fee schedule, empty when transfers are free
+*/
+func (t *TransferChaincode) queryFeeSchedule(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		logger.Error("Incorrect number of arguments. Expecting none")
+		return shim.Error("Incorrect number of arguments. Expecting none")
+	}
+
+	scheduleBytes, err := stub.GetState(feeScheduleKey)
+	if err != nil {
+		return shim.Error("Failed to get state")
+	}
+	return shim.Success(scheduleBytes)
+}
+
+// getFee returns the fee a transfer from addrA pays and the collector addr,
+// or a nil fee when there is no schedule or the collector is the sender.
+func getFee(stub shim.ChaincodeStubInterface, config *ChaincodeConfig, addrA string) (*ccapi.Fee, string, error) {
+	scheduleBytes, err := stub.GetState(feeScheduleKey)
+	if err != nil {
+		return nil, "", err
+	}
+	if scheduleBytes == nil {
+		return nil, "", nil
+	}
+	schedule := &FeeSchedule{}
+	err = json.Unmarshal(scheduleBytes, schedule)
+	if err != nil {
+		return nil, "", err
+	}
+	if schedule.Collector == addrA {
+		return nil, "", nil
+	}
+
+	collector, err := getAccount(stub, schedule.Collector)
+	if err != nil {
+		return nil, "", err
+	}
+	pubKey, err := resolvePubKey(stub, config, schedule.Collector, collector)
+	if err != nil {
+		return nil, "", err
+	}
+
+	fee := &ccapi.Fee{BasisPoints: schedule.BasisPoints, PubKeyCollector: string(pubKey)}
+	if schedule.Flat != "" {
+		fee.Flat, _ = new(big.Int).SetString(schedule.Flat, 10)
+	}
+	return fee, schedule.Collector, nil
+}
+
+// creditFee credits a fee to the collector account. A collector that is
+// also a recipient of the transfer gets the fee with its transfer instead.
+func creditFee(stub shim.ChaincodeStubInterface, config *ChaincodeConfig, collector, payer string, fee *ccapi.FeeResult) error {
+	account, err := getAccount(stub, collector)
+	if err != nil {
+		return err
+	}
+	pubKey, err := resolvePubKey(stub, config, collector, account)
+	if err != nil {
+		return err
+	}
+	account.Balance, err = gohe.AddCipher(pubKey, account.Balance, fee.CipherFeeCollector)
+	if err != nil {
+		return err
+	}
+	err = putAccount(stub, collector, account)
+	if err != nil {
+		return err
+	}
+	return putReceipt(stub, collector, &Receipt{Type: ReceiptFee, Counterparty: payer, Delta: fee.CipherFeeCollector, AuditorDelta: fee.CipherFeeAuditor})
+}
+
+// addFee adds a fee to the deltas of a receipt, so the receipt shows the
+// whole change of the balance.
+func addFee(pubKey []byte, auditorPubKey string, delta, auditorDelta, cipherFee, cipherFeeAuditor []byte) ([]byte, []byte, error) {
+	delta, err := gohe.AddCipher(pubKey, delta, cipherFee)
+	if err != nil {
+		return nil, nil, err
+	}
+	if auditorPubKey != "" {
+		auditorDelta, err = gohe.AddCipher([]byte(auditorPubKey), auditorDelta, cipherFeeAuditor)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return delta, auditorDelta, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"chaoshen.com/gopaillier/api/core"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// historyObjectType is the object type of the (address, txID) receipt keys.
+const historyObjectType = "history"
+
+// Receipt types. The delta is subtracted from the balance for
+// ReceiptTransferOut, ReceiptBurn, ReceiptHold and ReceiptSeize and added
+// for all others, with two exceptions.
+//
+// The delta of ReceiptRotate is the whole balance under the new key, with
+// the balances of the other assets in Balances.
+//
+// The delta of ReceiptRing is signed: n - amount is a debit of amount.
+const (
+	ReceiptOpen        = "open"
+	ReceiptTransferOut = "transfer-out"
+	ReceiptTransferIn  = "transfer-in"
+	ReceiptMint        = "mint"
+	ReceiptBurn        = "burn"
+	ReceiptRotate      = "rotate"
+	ReceiptFee         = "fee"
+	ReceiptHold        = "hold"
+	ReceiptRefund      = "refund"
+	ReceiptSeize       = "seize"
+	ReceiptRing        = "ring"
+)
+
+// Receipt records how one transaction changed the balance of one account.
+type Receipt struct {
+	TxID         string
+	Type         string
+	Asset        string            // asset ID, empty for the default asset
+	Counterparty string            // other account of a transfer, empty for the sender of TransferMany
+	Delta        []byte            // cipher amount under the account key
+	AuditorDelta []byte            // cipher amount under the auditor key, if any
+	Memo         *gohe.Memo        `json:",omitempty"` // memo of the sender of a transfer-in, see cliapi.AttachMemo
+	MemoCipher   []byte            `json:",omitempty"` // amount the memo is bound to, when Delta also holds a fee
+	Balances     map[string][]byte `json:",omitempty"` // other asset balances under the new key of a ReceiptRotate
+	Timestamp    int64             // transaction time in seconds since the epoch
+}
+
+// HistoryPage is one page of the receipts of an account.
+type HistoryPage struct {
+	Receipts []*Receipt
+	Bookmark string // pass to the next QueryHistory call, empty on the last page
+}
+
+// putReceipt stores a receipt for addr under the current transaction.
+func putReceipt(stub shim.ChaincodeStubInterface, addr string, receipt *Receipt) error {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return err
+	}
+	receipt.TxID = stub.GetTxID()
+	receipt.Timestamp = ts.GetSeconds()
+
+	key, err := stub.CreateCompositeKey(historyObjectType, []string{addr, receipt.TxID})
+	if err != nil {
+		return err
+	}
+	receiptBytes, err := json.Marshal(receipt)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, receiptBytes)
+}
+
+/*
+query the receipts of an account, page by page
+args: addr, page size, bookmark (empty for the first page)
+*/
+func (t *TransferChaincode) queryHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		logger.Error("Incorrect number of arguments. Expecting addr, page size and bookmark")
+		return shim.Error("Incorrect number of arguments. Expecting addr, page size and bookmark")
+	}
+
+	addr := args[0]
+	pageSize, err := strconv.ParseInt(args[1], 10, 32)
+	if err != nil || pageSize <= 0 {
+		logger.Error("invalid page size: ", args[1])
+		return shim.Error("invalid page size: " + args[1])
+	}
+	bookmark := args[2]
+
+	page, err := getHistoryPage(stub, addr, int32(pageSize), bookmark)
+	if err != nil {
+		logger.Error("fail to query history for: ", addr, err.Error())
+		return shim.Error("fail to query history for: " + addr + ": " + err.Error())
+	}
+
+	pageBytes, err := json.Marshal(page)
+	if err != nil {
+		return shim.Error("Marshal Error")
+	}
+	return shim.Success(pageBytes)
+}
+
+func getHistoryPage(stub shim.ChaincodeStubInterface, addr string, pageSize int32, bookmark string) (*HistoryPage, error) {
+	values, next, err := getPage(stub, historyObjectType, []string{addr}, pageSize, bookmark)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &HistoryPage{Receipts: []*Receipt{}, Bookmark: next}
+	for _, value := range values {
+		receipt := &Receipt{}
+		err = json.Unmarshal(value, receipt)
+		if err != nil {
+			return nil, err
+		}
+		page.Receipts = append(page.Receipts, receipt)
+	}
+	return page, nil
+}
+
+// getPage reads one page of the records of objectType under the partial key
+// keys. Stubs without pagination, such as shim.MockStub, return no iterator;
+// the page is then cut from the unpaginated query, with the key of the next
+// record as the bookmark.
+func getPage(stub shim.ChaincodeStubInterface, objectType string, keys []string, pageSize int32, bookmark string) (values [][]byte, next string, err error) {
+	iterator, metadata, err := stub.GetStateByPartialCompositeKeyWithPagination(objectType, keys, pageSize, bookmark)
+	if err != nil {
+		return nil, "", err
+	}
+	paged := iterator != nil
+	if !paged {
+		iterator, err = stub.GetStateByPartialCompositeKey(objectType, keys)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	defer iterator.Close()
+
+	values = [][]byte{}
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return nil, "", err
+		}
+		if !paged {
+			if kv.Key < bookmark {
+				continue
+			}
+			if len(values) == int(pageSize) {
+				next = kv.Key
+				break
+			}
+		}
+		values = append(values, kv.Value)
+	}
+	if paged && metadata != nil {
+		next = metadata.Bookmark
+	}
+	return values, next, nil
+}
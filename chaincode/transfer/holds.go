@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+
+	"chaoshen.com/gopaillier/api/ccapi"
+	"chaoshen.com/gopaillier/api/core"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// holdIndexObjectType is the object type of the (from, kind, ID) index of
+// open holds, the holds that would be refunded to an account.
+const holdIndexObjectType = "hold~from"
+
+// maxHoldTimeout is the longest a hold can stay open, 10 years, which keeps
+// deadlines far from overflowing.
+const maxHoldTimeout = 10 * 365 * 24 * 60 * 60
+
+// Hold is an amount debited from From and not yet credited to anybody. It is
+// stored under the composite key (kind, ID) and settled exactly once, by
+// releaseHold to To or by returnHold to From.
+type Hold struct {
+	ID            string // txID of the transaction that created the hold
+	From          string
+	To            string
+	Asset         string     // asset ID, empty for the default asset
+	PubKeyFrom    []byte     // key CipherFrom is encrypted under
+	PubKeyTo      []byte     // key CipherTo is encrypted under
+	CipherFrom    []byte     // amount under the key of From
+	CipherTo      []byte     // amount under the key of To
+	CipherAuditor []byte     // amount under the auditor key, if any
+	Hashlock      string     `json:",omitempty"` // hex SHA-256 of the preimage releasing an escrow
+	Deadline      int64      // seconds since the epoch
+	Memo          *gohe.Memo `json:",omitempty"` // memo for To, receipted on release
+}
+
+// createHold validates a hold prepared by cliapi.PrepareHold and debits the
+// amount and the fee, if any, from addrA. The fee goes to the collector at
+// once and is not returned. The caller completes and stores the hold.
+func createHold(stub shim.ChaincodeStubInterface, kind, addrA, addrB, txInfo, assetID string) (*Hold, error) {
+	if addrA == addrB {
+		return nil, errors.New("A' addr is the same B'Addr")
+	}
+	if assetID != "" {
+		_, err := getAsset(stub, assetID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		return nil, errors.New("fail to read chaincode config")
+	}
+	accountA, err := getAccount(stub, addrA)
+	if err != nil {
+		return nil, err
+	}
+	accountB, err := getAccount(stub, addrB)
+	if err != nil {
+		return nil, err
+	}
+	pubKeyA, err := resolvePubKey(stub, config, addrA, accountA)
+	if err != nil {
+		return nil, errors.New("fail to resolve sender key: " + err.Error())
+	}
+	pubKeyB, err := resolvePubKey(stub, config, addrB, accountB)
+	if err != nil {
+		return nil, errors.New("fail to resolve receiver key: " + err.Error())
+	}
+	err = checkNotFrozen(addrA, accountA)
+	if err == nil {
+		err = checkNotFrozen(addrB, accountB)
+	}
+	if err == nil {
+		err = checkSingleSigner(addrA, accountA)
+	}
+	if err == nil {
+		err = checkClaimed(addrA, accountA)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// fees are charged in the default asset only
+	var fee *ccapi.Fee
+	var collector string
+	if assetID == "" {
+		fee, collector, err = getFee(stub, config, addrA)
+		if err != nil {
+			return nil, errors.New("fail to read fee schedule: " + err.Error())
+		}
+	}
+
+	spendableA, err := accountA.spendable(pubKeyA, assetID)
+	if err != nil {
+		return nil, err
+	}
+	result, err := ccapi.ValidateHoldInfo(kind, txInfo, string(spendableA), string(pubKeyA), string(pubKeyB), config.AuditorPubKey, assetID, fee,
+		&ccapi.Auth{TxID: stub.GetTxID(), From: addrA, To: addrB})
+	if err != nil {
+		logger.Error("fail to validate hold: ", err.Error())
+		return nil, errors.New("fail to validate transaction information")
+	}
+
+	if assetID == "" {
+		err = checkSpendingLimit(stub, accountA, pubKeyA, txInfo, result.CipherTxA)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	deltaA, auditorDeltaA := result.CipherTxA, result.CipherTxAuditor
+	if result.Fee != nil {
+		deltaA, auditorDeltaA, err = addFee(pubKeyA, config.AuditorPubKey, deltaA, auditorDeltaA, result.Fee.CipherFeeA, result.Fee.CipherFeeAuditor)
+		if err == nil {
+			err = creditFee(stub, config, collector, addrA, result.Fee)
+		}
+		if err != nil {
+			return nil, errors.New("fail to pay fee: " + err.Error())
+		}
+	}
+
+	err = accountA.setSpendable(pubKeyA, assetID, []byte(result.NewCipherBalanceA))
+	if err == nil {
+		err = putAccount(stub, addrA, accountA)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = putReceipt(stub, addrA, &Receipt{Type: ReceiptHold, Asset: assetID, Counterparty: addrB, Delta: deltaA, AuditorDelta: auditorDeltaA})
+	if err != nil {
+		return nil, errors.New("fail to store receipt: " + err.Error())
+	}
+
+	return &Hold{
+		ID:            stub.GetTxID(),
+		From:          addrA,
+		To:            addrB,
+		Asset:         assetID,
+		PubKeyFrom:    pubKeyA,
+		PubKeyTo:      pubKeyB,
+		CipherFrom:    result.CipherTxA,
+		CipherTo:      result.CipherTxB,
+		CipherAuditor: result.CipherTxAuditor,
+		Memo:          result.Memo,
+	}, nil
+}
+
+// releaseHold credits the held amount to To and deletes the hold. A frozen
+// To cannot receive it; returning it to a frozen From is allowed.
+func releaseHold(stub shim.ChaincodeStubInterface, kind string, hold *Hold) error {
+	account, err := getAccount(stub, hold.To)
+	if err != nil {
+		return err
+	}
+	err = checkNotFrozen(hold.To, account)
+	if err != nil {
+		return err
+	}
+	err = settleHold(stub, hold.To, hold.From, hold.Asset, hold.PubKeyTo, hold.CipherTo, hold.CipherAuditor, hold.Memo, ReceiptTransferIn)
+	if err != nil {
+		return err
+	}
+	return delHold(stub, kind, hold)
+}
+
+// returnHold credits the held amount back to From and deletes the hold.
+func returnHold(stub shim.ChaincodeStubInterface, kind string, hold *Hold) error {
+	err := settleHold(stub, hold.From, hold.To, hold.Asset, hold.PubKeyFrom, hold.CipherFrom, hold.CipherAuditor, nil, ReceiptRefund)
+	if err != nil {
+		return err
+	}
+	return delHold(stub, kind, hold)
+}
+
+// settleHold adds a held amount to the balance of addr. The amount is
+// encrypted under the key addr had when the hold was created, so a key
+// rotated since cannot be credited.
+func settleHold(stub shim.ChaincodeStubInterface, addr, counterparty, assetID string, pubKey, cipherAmount, cipherAuditor []byte, memo *gohe.Memo, receiptType string) error {
+	config, err := getConfig(stub)
+	if err != nil {
+		return errors.New("fail to read chaincode config")
+	}
+	account, err := getAccount(stub, addr)
+	if err != nil {
+		return err
+	}
+	currentKey, err := resolvePubKey(stub, config, addr, account)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(currentKey, pubKey) {
+		return errors.New("the key of " + addr + " changed since the hold was created")
+	}
+
+	balance, err := gohe.AddCipher(pubKey, account.balance(assetID), cipherAmount)
+	if err != nil {
+		return err
+	}
+	account.setBalance(assetID, balance)
+	err = putAccount(stub, addr, account)
+	if err != nil {
+		return err
+	}
+	return putReceipt(stub, addr, &Receipt{Type: receiptType, Asset: assetID, Counterparty: counterparty, Delta: cipherAmount, AuditorDelta: cipherAuditor, Memo: memo})
+}
+
+func getHold(stub shim.ChaincodeStubInterface, kind, id string) (*Hold, error) {
+	key, err := stub.CreateCompositeKey(kind, []string{id})
+	if err != nil {
+		return nil, err
+	}
+	holdBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, errors.New("Failed to get state")
+	}
+	if holdBytes == nil {
+		return nil, errors.New("no " + kind + ": " + id)
+	}
+
+	hold := &Hold{}
+	err = json.Unmarshal(holdBytes, hold)
+	if err != nil {
+		return nil, errors.New("fail to unmarshal " + kind)
+	}
+	return hold, nil
+}
+
+func putHold(stub shim.ChaincodeStubInterface, kind string, hold *Hold) error {
+	key, err := stub.CreateCompositeKey(kind, []string{hold.ID})
+	if err != nil {
+		return err
+	}
+	holdBytes, err := json.Marshal(hold)
+	if err != nil {
+		return errors.New("Marshal Error")
+	}
+	err = stub.PutState(key, holdBytes)
+	if err != nil {
+		return err
+	}
+	indexKey, err := stub.CreateCompositeKey(holdIndexObjectType, []string{hold.From, kind, hold.ID})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(indexKey, []byte{0x00})
+}
+
+func delHold(stub shim.ChaincodeStubInterface, kind string, hold *Hold) error {
+	key, err := stub.CreateCompositeKey(kind, []string{hold.ID})
+	if err != nil {
+		return err
+	}
+	err = stub.DelState(key)
+	if err != nil {
+		return err
+	}
+	indexKey, err := stub.CreateCompositeKey(holdIndexObjectType, []string{hold.From, kind, hold.ID})
+	if err != nil {
+		return err
+	}
+	return stub.DelState(indexKey)
+}
+
+// checkNoOutboundHolds refuses to change the key of an account while open
+// holds would still be refunded to it or allowances it granted are open,
+// because refunds, allowances and the reserved amount are encrypted under
+// the key the account had when they were made.
+func checkNoOutboundHolds(stub shim.ChaincodeStubInterface, addr string) error {
+	iterator, err := stub.GetStateByPartialCompositeKey(holdIndexObjectType, []string{addr})
+	if err != nil {
+		return err
+	}
+	defer iterator.Close()
+	if iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return err
+		}
+		_, attrs, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil || len(attrs) != 3 {
+			return errors.New("invalid hold index key")
+		}
+		return errors.New("account has an open " + attrs[1] + ": " + attrs[2])
+	}
+
+	allowances, err := stub.GetStateByPartialCompositeKey(allowanceObjectType, []string{addr})
+	if err != nil {
+		return err
+	}
+	defer allowances.Close()
+	if allowances.HasNext() {
+		return errors.New("account has granted an allowance, revoke it first")
+	}
+	return nil
+}
+
+// txTime returns the transaction timestamp in seconds since the epoch, the
+// clock of hold deadlines.
+func txTime(stub shim.ChaincodeStubInterface) (int64, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return 0, err
+	}
+	return ts.GetSeconds(), nil
+}
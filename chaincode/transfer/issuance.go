@@ -0,0 +1,358 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+
+	"chaoshen.com/gopaillier/api/ccapi"
+	"chaoshen.com/gopaillier/api/core"
+	"chaoshen.com/gopaillier/api/event"
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// State keys of the chaincode wide records. Account addresses are lower case
+// hex strings, so these can never collide with an account.
+const (
+	configKey      = "CONFIG"
+	totalSupplyKey = "TOTAL_SUPPLY"
+)
+
+// ChaincodeConfig is the deployment configuration passed to Init.
+type ChaincodeConfig struct {
+	IssuerMSPID      string // MSP ID of the organization allowed to mint and burn
+	IssuerID         string // optional client identity within IssuerMSPID, see cid.GetID
+	IssuerSigningKey string // PEM ECDSA key approving non-zero opening balances
+	AuditorPubKey    string // PEM Paillier key of the total supply and of every transfer amount
+	IDChaincode      string // optional name of the IDChaincode resolving account keys
+	IDChannel        string // channel of IDChaincode, empty for the same channel
+	PendingTTL       int64  // seconds a pending transfer can be accepted, 0 for defaultPendingTTL
+	ComplianceMSPID  string // MSP ID of the organization allowed to freeze and seize accounts
+	ComplianceID     string // optional client identity within ComplianceMSPID
+	CustodyAddr      string // account receiving the balances seized by the compliance role
+	AttestationKey   string // PEM ECDSA public key of the attestations signed by VerifyBalanceAtLeast
+	LimitMSPID       string // MSP ID of the organization allowed to set and lift spending limits
+	LimitID          string // optional client identity within LimitMSPID
+}
+
+// clientIdentity returns the MSP ID and the identity of the submitting
+// client. It is a variable so tests can run without a signed proposal.
+var clientIdentity = func(stub shim.ChaincodeStubInterface) (mspID, id string, err error) {
+	mspID, err = cid.GetMSPID(stub)
+	if err != nil {
+		return "", "", err
+	}
+	id, err = cid.GetID(stub)
+	if err != nil {
+		return "", "", err
+	}
+	return mspID, id, nil
+}
+
+func initConfig(stub shim.ChaincodeStubInterface, configStr string) error {
+	var config ChaincodeConfig
+	err := json.Unmarshal([]byte(configStr), &config)
+	if err != nil {
+		return err
+	}
+
+	if config.AuditorPubKey != "" {
+		_, err = gohe.ParsePublicKey([]byte(config.AuditorPubKey))
+		if err != nil {
+			return errors.New("invalid auditor public key")
+		}
+	}
+	if config.IssuerSigningKey != "" {
+		block, _ := pem.Decode([]byte(config.IssuerSigningKey))
+		if block == nil {
+			return errors.New("invalid issuer signing key")
+		}
+		_, err = x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return errors.New("invalid issuer signing key")
+		}
+	}
+
+	if config.AttestationKey != "" {
+		block, _ := pem.Decode([]byte(config.AttestationKey))
+		if block == nil {
+			return errors.New("invalid attestation key")
+		}
+		_, err = x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return errors.New("invalid attestation key")
+		}
+	}
+
+	if config.PendingTTL < 0 || config.PendingTTL > maxHoldTimeout {
+		return errors.New("invalid pending transfer TTL")
+	}
+
+	configBytes, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(configKey, configBytes)
+	if err != nil {
+		return err
+	}
+
+	// keep the supply across upgrades, it is only created once
+	supply, err := stub.GetState(totalSupplyKey)
+	if err != nil {
+		return err
+	}
+	if supply == nil && config.AuditorPubKey != "" {
+		return stub.PutState(totalSupplyKey, gohe.ZeroCipher())
+	}
+	return nil
+}
+
+func getConfig(stub shim.ChaincodeStubInterface) (*ChaincodeConfig, error) {
+	configBytes, err := stub.GetState(configKey)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &ChaincodeConfig{}
+	if configBytes == nil {
+		return config, nil
+	}
+	err = json.Unmarshal(configBytes, config)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// checkIssuer returns the config if the submitting client is the issuer.
+func checkIssuer(stub shim.ChaincodeStubInterface) (*ChaincodeConfig, error) {
+	config, err := getConfig(stub)
+	if err != nil {
+		return nil, err
+	}
+	if config.IssuerMSPID == "" || config.AuditorPubKey == "" {
+		return nil, errors.New("issuer is not configured")
+	}
+
+	mspID, id, err := clientIdentity(stub)
+	if err != nil {
+		return nil, err
+	}
+	if mspID != config.IssuerMSPID || (config.IssuerID != "" && id != config.IssuerID) {
+		return nil, errors.New("client is not the issuer")
+	}
+	return config, nil
+}
+
+/*
+mint credits a public amount, which the chaincode encrypts, to an account.
+args: addr, amount
+*/
+func (t *TransferChaincode) mint(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return t.issue(stub, "", args, false)
+}
+
+/*
+burn debits a public amount from an account. The owner consents with a proof,
+see cliapi.PrepareBurn, that the balance left is not negative.
+args: addr, amount, burn proof
+*/
+func (t *TransferChaincode) burn(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return t.issue(stub, "", args, true)
+}
+
+// issue mints or burns an amount of an asset, the default asset when it is
+// empty, updating the account balance and the total supply.
+func (t *TransferChaincode) issue(stub shim.ChaincodeStubInterface, assetID string, args []string, burn bool) pb.Response {
+	if !burn && len(args) != 2 {
+		logger.Error("Incorrect number of arguments. expect 2 arguments")
+		return shim.Error("Incorrect number of arguments. expect 2 arguments")
+	}
+	if burn && len(args) != 3 {
+		logger.Error("Incorrect number of arguments. expect 3 arguments")
+		return shim.Error("Incorrect number of arguments. expect 3 arguments")
+	}
+
+	addr := args[0]
+	amount, ok := new(big.Int).SetString(args[1], 10)
+	if !ok || amount.Sign() < 0 || amount.BitLen() > gohe.RangeBits {
+		logger.Error("invalid amount")
+		return shim.Error("invalid amount")
+	}
+
+	var config *ChaincodeConfig
+	var asset *Asset
+	var err error
+	if assetID == "" {
+		config, err = checkIssuer(stub)
+	} else {
+		config, asset, err = checkAssetIssuer(stub, assetID)
+	}
+	if err != nil {
+		logger.Error("unauthorized issuance: ", err.Error())
+		return shim.Error("unauthorized issuance: " + err.Error())
+	}
+
+	account, err := getAccount(stub, addr)
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	pubKey, err := resolvePubKey(stub, config, addr, account)
+	if err != nil {
+		logger.Error("fail to resolve public key: ", err.Error())
+		return shim.Error("fail to resolve public key: " + err.Error())
+	}
+
+	var cipherAmount, balance []byte
+	if burn {
+		// the reserved amount of allowances cannot be burnt
+		balance, err = account.spendable(pubKey, assetID)
+		if err == nil {
+			cipherAmount, balance, err = ccapi.ValidateBurn(args[2], addr, assetID, string(balance), string(pubKey), amount)
+		}
+		if err == nil {
+			err = account.setSpendable(pubKey, assetID, balance)
+		}
+		if err != nil {
+			logger.Error("invalid burn proof: ", err.Error())
+			return shim.Error("invalid burn proof: " + err.Error())
+		}
+	} else {
+		cipherAmount, err = encryptOnChain(stub, pubKey, amount, "issue/"+assetID+"/"+addr)
+		if err != nil {
+			logger.Error("fail to encrypt amount: ", err.Error())
+			return shim.Error("fail to encrypt amount: " + err.Error())
+		}
+		balance, err = gohe.AddCipher(pubKey, account.balance(assetID), cipherAmount)
+		if err != nil {
+			logger.Error("fail to update balance: ", err.Error())
+			return shim.Error("fail to update balance: " + err.Error())
+		}
+		account.setBalance(assetID, balance)
+	}
+
+	cipherSupplyDelta, err := encryptOnChain(stub, []byte(config.AuditorPubKey), amount, "issue/"+assetID+"/supply")
+	if err != nil {
+		logger.Error("fail to encrypt amount: ", err.Error())
+		return shim.Error("fail to encrypt amount: " + err.Error())
+	}
+	var supply []byte
+	if asset != nil {
+		supply = asset.Supply
+	} else {
+		supply, err = stub.GetState(totalSupplyKey)
+		if err != nil {
+			return shim.Error("Failed to get state")
+		}
+	}
+	if burn {
+		supply, err = gohe.SubCipher([]byte(config.AuditorPubKey), supply, cipherSupplyDelta)
+	} else {
+		supply, err = gohe.AddCipher([]byte(config.AuditorPubKey), supply, cipherSupplyDelta)
+	}
+	if err != nil {
+		logger.Error("fail to update total supply: ", err.Error())
+		return shim.Error("fail to update total supply: " + err.Error())
+	}
+
+	err = putAccount(stub, addr, account)
+	if err != nil {
+		logger.Error("fail to store state: ", err.Error())
+		return shim.Error(err.Error())
+	}
+	if asset != nil {
+		asset.Supply = supply
+		err = putAsset(stub, asset)
+	} else {
+		err = stub.PutState(totalSupplyKey, supply)
+	}
+	if err != nil {
+		logger.Error("fail to store state: ", err.Error())
+		return shim.Error(err.Error())
+	}
+
+	receiptType, eventName := ReceiptMint, event.Mint
+	if burn {
+		receiptType, eventName = ReceiptBurn, event.Burn
+	}
+	err = putReceipt(stub, addr, &Receipt{Type: receiptType, Asset: assetID, Delta: cipherAmount, AuditorDelta: cipherSupplyDelta})
+	if err != nil {
+		logger.Error("fail to store receipt: ", err.Error())
+		return shim.Error("fail to store receipt: " + err.Error())
+	}
+
+	err = setEvent(stub, eventName, &event.AccountEvent{
+		Version:      event.Version,
+		TxID:         stub.GetTxID(),
+		Addr:         addr,
+		Asset:        assetID,
+		CipherAmount: cipherAmount,
+	})
+	if err != nil {
+		logger.Error("fail to set event: ", err.Error())
+		return shim.Error("fail to set event: " + err.Error())
+	}
+
+	return shim.Success([]byte("Success"))
+}
+
+// resolvePubKey returns the public key of addr. With an IDChaincode configured
+// the registry is the only source of keys, so rotated and revoked keys take
+// effect immediately; otherwise, and for stealth accounts, which are not
+// registered, the key stored in the account is used.
+func resolvePubKey(stub shim.ChaincodeStubInterface, config *ChaincodeConfig, addr string, account *CipherAccount) ([]byte, error) {
+	if config.IDChaincode == "" || (account != nil && account.Stealth != nil) {
+		if account == nil || account.PublicKey == nil {
+			return nil, errors.New("no public key for " + addr)
+		}
+		return account.PublicKey, nil
+	}
+
+	res := stub.InvokeChaincode(config.IDChaincode, [][]byte{[]byte("QueryPubkey"), []byte(addr)}, config.IDChannel)
+	if res.Status != shim.OK {
+		return nil, errors.New(res.Message)
+	}
+	return res.Payload, nil
+}
+
+// addTotalSupply adds a public amount to the encrypted total supply.
+func addTotalSupply(stub shim.ChaincodeStubInterface, config *ChaincodeConfig, amount *big.Int) error {
+	supply, err := stub.GetState(totalSupplyKey)
+	if err != nil {
+		return err
+	}
+	if supply == nil {
+		return errors.New("total supply is not configured")
+	}
+	supply, err = gohe.Add([]byte(config.AuditorPubKey), supply, amount.Bytes())
+	if err != nil {
+		return err
+	}
+	return stub.PutState(totalSupplyKey, supply)
+}
+
+/*
+query the total supply, encrypted under the auditor key
+*/
+func (t *TransferChaincode) queryTotalSupply(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		logger.Error("Incorrect number of arguments. Expecting none")
+		return shim.Error("Incorrect number of arguments. Expecting none")
+	}
+
+	supply, err := stub.GetState(totalSupplyKey)
+	if err != nil {
+		return shim.Error("Failed to get state")
+	}
+	if supply == nil {
+		return shim.Error("total supply is not configured")
+	}
+	return shim.Success(supply)
+}
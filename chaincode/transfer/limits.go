@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+
+	"chaoshen.com/gopaillier/api/ccapi"
+	"chaoshen.com/gopaillier/api/core"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// SpendingLimit caps the amount of the default asset an account sends per
+// window; other assets are not limited. Fees do not count toward the limit.
+// A first window is aligned to the epoch, a window of 86400 seconds is a UTC
+// day.
+type SpendingLimit struct {
+	Amount      string `json:",omitempty"` // plaintext limit, empty when only CipherLimit is known
+	CipherLimit []byte // limit under the account key
+	Window      int64  // seconds
+	WindowStart int64  // start of the window CipherSpent belongs to
+	CipherSpent []byte // amount sent in that window, under the account key
+}
+
+// limitRequest is the argument of SetSpendingLimit, see
+// cliapi.PrepareSpendingLimit.
+type limitRequest struct {
+	Amount       string
+	CipherAmount []byte
+	Window       int64
+}
+
+// checkLimitRole verifies the client has the role that sets spending limits.
+// The account key cannot set them, or whoever holds it could lift the limit
+// before spending.
+func checkLimitRole(stub shim.ChaincodeStubInterface, config *ChaincodeConfig) error {
+	if config.LimitMSPID == "" {
+		return errors.New("limit role is not configured")
+	}
+
+	mspID, id, err := clientIdentity(stub)
+	if err != nil {
+		return err
+	}
+	if mspID != config.LimitMSPID || (config.LimitID != "" && id != config.LimitID) {
+		return errors.New("client has not the limit role")
+	}
+	return nil
+}
+
+/*
+set or remove the spending limit of an account, limit role only. What was
+spent in the current window is kept while the new window still covers the
+time of the transaction.
+args: addr, limit request prepared by cliapi.PrepareSpendingLimit
+*/
+func (t *TransferChaincode) setSpendingLimit(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		logger.Error("Incorrect number of arguments. Expecting addr and limit")
+		return shim.Error("Incorrect number of arguments. Expecting addr and limit")
+	}
+
+	addr := args[0]
+	req := &limitRequest{}
+	err := json.Unmarshal([]byte(args[1]), req)
+	if err != nil {
+		logger.Error("fail to unmarshal limit")
+		return shim.Error("fail to unmarshal limit")
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Error("fail to read chaincode config")
+		return shim.Error("fail to read chaincode config")
+	}
+	err = checkLimitRole(stub, config)
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	account, err := getAccount(stub, addr)
+	if err == nil {
+		err = checkClaimed(addr, account)
+	}
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	pubKey, err := resolvePubKey(stub, config, addr, account)
+	if err != nil {
+		logger.Error("fail to resolve public key: ", err.Error())
+		return shim.Error("fail to resolve public key: " + err.Error())
+	}
+
+	if req.Amount == "" && req.CipherAmount == nil && req.Window == 0 {
+		account.Limit = nil
+	} else {
+		limit, err := newSpendingLimit(pubKey, req)
+		if err != nil {
+			logger.Error("invalid limit: ", err.Error())
+			return shim.Error("invalid limit: " + err.Error())
+		}
+		now, err := txTime(stub)
+		if err != nil {
+			logger.Error(err.Error())
+			return shim.Error(err.Error())
+		}
+		old := account.Limit
+		if old != nil && old.WindowStart <= now && now < old.WindowStart+limit.Window {
+			limit.WindowStart, limit.CipherSpent = old.WindowStart, old.CipherSpent
+		}
+		account.Limit = limit
+	}
+
+	err = putAccount(stub, addr, account)
+	if err != nil {
+		logger.Error("fail to store state: ", err.Error())
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+func newSpendingLimit(pubKey []byte, req *limitRequest) (*SpendingLimit, error) {
+	if req.Window <= 0 {
+		return nil, errors.New("window must be positive")
+	}
+	limit := &SpendingLimit{Window: req.Window, CipherSpent: gohe.ZeroCipher()}
+	if (req.Amount == "") == (req.CipherAmount == nil) {
+		return nil, errors.New("need either a plaintext or an encrypted limit")
+	}
+	if req.Amount != "" {
+		amount, ok := new(big.Int).SetString(req.Amount, 10)
+		if !ok || amount.Sign() < 0 {
+			return nil, errors.New("limit must be a non-negative integer")
+		}
+		// the trivial encryption, so clients can compute it too
+		cipherLimit, err := gohe.Add(pubKey, gohe.ZeroCipher(), amount.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		limit.Amount, limit.CipherLimit = req.Amount, cipherLimit
+		return limit, nil
+	}
+	limit.CipherLimit = req.CipherAmount
+	return limit, nil
+}
+
+// checkSpendingLimit adds a debit of the default asset to the spending of
+// the current window of account, verifying the proof in txInfo that it
+// stays within the limit. The caller stores the account.
+func checkSpendingLimit(stub shim.ChaincodeStubInterface, account *CipherAccount, pubKey []byte, txInfo string, cipherDebit []byte) error {
+	limit := account.Limit
+	if limit == nil {
+		return nil
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return err
+	}
+	// a new window starts aligned to the epoch once the current one ended
+	start, spent := limit.WindowStart, limit.CipherSpent
+	if now < start || now >= start+limit.Window {
+		start, spent = now-now%limit.Window, gohe.ZeroCipher()
+	}
+
+	newSpent, err := ccapi.ValidateSpendingLimit(txInfo, string(limit.CipherLimit), string(spent), string(pubKey), cipherDebit)
+	if err != nil {
+		return errors.New("spending limit: " + err.Error())
+	}
+	limit.WindowStart, limit.CipherSpent = start, newSpent
+	return nil
+}
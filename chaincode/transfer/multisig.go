@@ -0,0 +1,364 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"chaoshen.com/gopaillier/api/core"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// proposalObjectType is the object type of the multisig transfer proposals.
+const proposalObjectType = "proposal"
+
+// Multisig is an m-of-n set of signers whose approval a transfer from the
+// account needs. It gates the debit only. The account key can be held in
+// threshold form by the same parties, a key from cliapi.GenerateSharedKey:
+// then no signer has the private key, and the signers decrypt the balance
+// and prepare the tx info together with cliapi.PrepareSharedTxInfo.
+type Multisig struct {
+	Threshold int
+	Signers   []string // PEM Paillier public keys of the signers
+}
+
+// MultisigApproval is the signature of the signer with index Signer.
+type MultisigApproval struct {
+	Signer int
+	Sig    []byte
+}
+
+// Proposal is a transfer from an account with signers waiting for approvals.
+type Proposal struct {
+	ID       string // txID of ProposeTransfer
+	From     string
+	To       string
+	Asset    string // asset ID, empty for the default asset
+	TxInfo   string
+	Signers  string // hash of the signer set the approvals are checked against
+	Approved []bool // by signer index
+}
+
+// checkSingleSigner refuses to debit an account with signers outside of
+// ProposeTransfer.
+func checkSingleSigner(addr string, account *CipherAccount) error {
+	if account.Multisig != nil {
+		return errors.New("account " + addr + " needs the approval of its signers, use ProposeTransfer")
+	}
+	return nil
+}
+
+// signersMessage must match the message signed by cliapi.SignSigners.
+func signersMessage(addr, txID string, multisigBytes []byte) []byte {
+	hash := sha256.Sum256(multisigBytes)
+	return []byte("gopaillier/signers/" + addr + "/" + txID + "/" + hex.EncodeToString(hash[:]))
+}
+
+// signersHash identifies a signer set, so approvals given under one set are
+// not counted under another of the same size.
+func signersHash(multisig *Multisig) string {
+	multisigBytes, _ := json.Marshal(multisig)
+	hash := sha256.Sum256(multisigBytes)
+	return hex.EncodeToString(hash[:])
+}
+
+// proposalMessage must match the message signed by cliapi.SignProposal. The
+// tx info is bound to the balance of A, so a signature is good for one
+// transfer only.
+func proposalMessage(addrA, addrB, assetID, txInfo string) []byte {
+	hash := sha256.Sum256([]byte(txInfo))
+	return []byte("gopaillier/multisig/" + addrA + "/" + addrB + "/" + assetID + "/" + hex.EncodeToString(hash[:]))
+}
+
+/*
+set, replace or remove the signers of an account. Without signers the
+account key approves, otherwise the threshold of the current signers does.
+args: addr, JSON Multisig ("{}" removes the signers), JSON []MultisigApproval (Signer is ignored for the account key)
+*/
+func (t *TransferChaincode) setSigners(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		logger.Error("Incorrect number of arguments. Expecting addr, signers and approvals")
+		return shim.Error("Incorrect number of arguments. Expecting addr, signers and approvals")
+	}
+
+	addr := args[0]
+	multisig := &Multisig{}
+	err := json.Unmarshal([]byte(args[1]), multisig)
+	if err != nil {
+		logger.Error("fail to unmarshal signers")
+		return shim.Error("fail to unmarshal signers")
+	}
+	var approvals []*MultisigApproval
+	err = json.Unmarshal([]byte(args[2]), &approvals)
+	if err != nil {
+		logger.Error("fail to unmarshal approvals")
+		return shim.Error("fail to unmarshal approvals")
+	}
+
+	account, err := getAccount(stub, addr)
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	msg := signersMessage(addr, stub.GetTxID(), []byte(args[1]))
+	if account.Multisig == nil {
+		if len(approvals) != 1 {
+			err = errors.New("need the signature of the account key")
+		} else {
+			err = verifyAccountSig(stub, addr, msg, approvals[0].Sig)
+		}
+	} else {
+		err = checkApprovals(account.Multisig, msg, approvals)
+	}
+	if err != nil {
+		logger.Error("unauthorized signers: ", err.Error())
+		return shim.Error("unauthorized signers: " + err.Error())
+	}
+
+	if multisig.Threshold == 0 && len(multisig.Signers) == 0 {
+		account.Multisig = nil
+	} else {
+		err = checkMultisig(multisig)
+		if err != nil {
+			logger.Error("invalid signers: ", err.Error())
+			return shim.Error("invalid signers: " + err.Error())
+		}
+		account.Multisig = multisig
+	}
+
+	err = putAccount(stub, addr, account)
+	if err != nil {
+		logger.Error("fail to store state: ", err.Error())
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+func checkMultisig(multisig *Multisig) error {
+	if multisig.Threshold < 1 || multisig.Threshold > len(multisig.Signers) {
+		return errors.New("threshold must be between 1 and the number of signers")
+	}
+	seen := map[string]bool{}
+	for _, signer := range multisig.Signers {
+		_, err := gohe.ParsePublicKey([]byte(signer))
+		if err != nil {
+			return errors.New("invalid signer key")
+		}
+		if seen[signer] {
+			return errors.New("duplicate signer")
+		}
+		seen[signer] = true
+	}
+	return nil
+}
+
+// checkApprovals verifies that a threshold of distinct signers signed msg.
+func checkApprovals(multisig *Multisig, msg []byte, approvals []*MultisigApproval) error {
+	approved := make([]bool, len(multisig.Signers))
+	count := 0
+	for _, approval := range approvals {
+		err := verifySigner(multisig, approval, msg)
+		if err != nil {
+			return err
+		}
+		if !approved[approval.Signer] {
+			approved[approval.Signer] = true
+			count++
+		}
+	}
+	if count < multisig.Threshold {
+		return errors.New("need " + strconv.Itoa(multisig.Threshold) + " signers, got " + strconv.Itoa(count))
+	}
+	return nil
+}
+
+func verifySigner(multisig *Multisig, approval *MultisigApproval, msg []byte) error {
+	if approval == nil || approval.Signer < 0 || approval.Signer >= len(multisig.Signers) {
+		return errors.New("unknown signer")
+	}
+	err := gohe.Verify([]byte(multisig.Signers[approval.Signer]), msg, approval.Sig)
+	if err != nil {
+		return errors.New("invalid signature of signer " + strconv.Itoa(approval.Signer))
+	}
+	return nil
+}
+
+/*
+propose a transfer from an account with signers. Approvals collected off-chain
+may come with the proposal; the transfer runs as soon as the threshold is met.
+The payload is the proposal ID. A proposal is stale once the balance of A
+changes before its last approval and has to be made again.
+args: addr A, addr B, tx info prepared by cliapi.PrepareTxInfo, JSON []MultisigApproval (may be empty), optional asset ID
+*/
+func (t *TransferChaincode) proposeTransfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 4 && len(args) != 5 {
+		logger.Error("Incorrect number of arguments. expect 4 or 5 arguments")
+		return shim.Error("Incorrect number of arguments. expect 4 or 5 arguments")
+	}
+
+	proposal := &Proposal{ID: stub.GetTxID(), From: args[0], To: args[1], TxInfo: args[2]}
+	if len(args) == 5 {
+		proposal.Asset = args[4]
+	}
+	var approvals []*MultisigApproval
+	if args[3] != "" {
+		err := json.Unmarshal([]byte(args[3]), &approvals)
+		if err != nil {
+			logger.Error("fail to unmarshal approvals")
+			return shim.Error("fail to unmarshal approvals")
+		}
+	}
+
+	account, err := getAccount(stub, proposal.From)
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	if account.Multisig == nil {
+		logger.Error("account has no signers: ", proposal.From)
+		return shim.Error("account has no signers: " + proposal.From)
+	}
+
+	proposal.Signers = signersHash(account.Multisig)
+	proposal.Approved = make([]bool, len(account.Multisig.Signers))
+	for _, approval := range approvals {
+		err = t.addApproval(account.Multisig, proposal, approval)
+		if err != nil {
+			logger.Error(err.Error())
+			return shim.Error(err.Error())
+		}
+	}
+	return t.advanceProposal(stub, account.Multisig, proposal)
+}
+
+/*
+approve a proposed transfer as one of the signers
+args: proposal ID, signer index, signature from cliapi.SignProposal
+*/
+func (t *TransferChaincode) approveTransfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		logger.Error("Incorrect number of arguments. Expecting proposal ID, signer index and signature")
+		return shim.Error("Incorrect number of arguments. Expecting proposal ID, signer index and signature")
+	}
+
+	signer, err := strconv.Atoi(args[1])
+	if err != nil {
+		logger.Error("invalid signer index: ", args[1])
+		return shim.Error("invalid signer index: " + args[1])
+	}
+	proposal, err := getProposal(stub, args[0])
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	account, err := getAccount(stub, proposal.From)
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	// the approvals are only good for the signers they were given by
+	if account.Multisig == nil || signersHash(account.Multisig) != proposal.Signers {
+		logger.Error("the signers changed since the proposal")
+		return shim.Error("the signers changed since the proposal")
+	}
+
+	err = t.addApproval(account.Multisig, proposal, &MultisigApproval{Signer: signer, Sig: []byte(args[2])})
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	return t.advanceProposal(stub, account.Multisig, proposal)
+}
+
+/*
+query an open proposal
+args: proposal ID
+*/
+func (t *TransferChaincode) queryProposal(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		logger.Error("Incorrect number of arguments. Expecting proposal ID")
+		return shim.Error("Incorrect number of arguments. Expecting proposal ID")
+	}
+
+	proposal, err := getProposal(stub, args[0])
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	proposalBytes, err := json.Marshal(proposal)
+	if err != nil {
+		return shim.Error("Marshal Error")
+	}
+	return shim.Success(proposalBytes)
+}
+
+func (t *TransferChaincode) addApproval(multisig *Multisig, proposal *Proposal, approval *MultisigApproval) error {
+	err := verifySigner(multisig, approval, proposalMessage(proposal.From, proposal.To, proposal.Asset, proposal.TxInfo))
+	if err != nil {
+		return err
+	}
+	proposal.Approved[approval.Signer] = true
+	return nil
+}
+
+// advanceProposal runs the transfer of a proposal once enough signers
+// approved it and stores it otherwise.
+func (t *TransferChaincode) advanceProposal(stub shim.ChaincodeStubInterface, multisig *Multisig, proposal *Proposal) pb.Response {
+	count := 0
+	for _, approved := range proposal.Approved {
+		if approved {
+			count++
+		}
+	}
+
+	key, err := stub.CreateCompositeKey(proposalObjectType, []string{proposal.ID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if count < multisig.Threshold {
+		proposalBytes, err := json.Marshal(proposal)
+		if err != nil {
+			return shim.Error("Marshal Error")
+		}
+		err = stub.PutState(key, proposalBytes)
+		if err != nil {
+			logger.Error("fail to store proposal: ", err.Error())
+			return shim.Error("fail to store proposal: " + err.Error())
+		}
+		return shim.Success([]byte(proposal.ID))
+	}
+
+	err = stub.DelState(key)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	res := t.doTransfer(stub, []string{proposal.From, proposal.To, proposal.TxInfo, proposal.Asset}, true)
+	if res.Status != shim.OK {
+		return res
+	}
+	return shim.Success([]byte(proposal.ID))
+}
+
+func getProposal(stub shim.ChaincodeStubInterface, id string) (*Proposal, error) {
+	key, err := stub.CreateCompositeKey(proposalObjectType, []string{id})
+	if err != nil {
+		return nil, err
+	}
+	proposalBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, errors.New("Failed to get state")
+	}
+	if proposalBytes == nil {
+		return nil, errors.New("no proposal: " + id)
+	}
+
+	proposal := &Proposal{}
+	err = json.Unmarshal(proposalBytes, proposal)
+	if err != nil {
+		return nil, errors.New("fail to unmarshal proposal")
+	}
+	return proposal, nil
+}
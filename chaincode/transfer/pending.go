@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+
+	"chaoshen.com/gopaillier/api/ccapi"
+	"chaoshen.com/gopaillier/api/core"
+	"chaoshen.com/gopaillier/api/event"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// defaultPendingTTL is the time a pending transfer can be accepted when
+// ChaincodeConfig.PendingTTL is not set, 7 days.
+const defaultPendingTTL = 7 * 24 * 60 * 60
+
+/*
+debit A for a transfer B has to accept. B credits it with Accept or returns
+it with Reject, A returns it with Cancel before acceptance, and anyone
+returns it with Expire after the TTL. The payload is the pending transfer ID.
+args: addr A, addr B, tx info prepared by cliapi.PrepareHold(HoldPending, ...) and signed by cliapi.SignTxInfo, optional asset ID
+*/
+func (t *TransferChaincode) transferPending(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 && len(args) != 4 {
+		logger.Error("Incorrect number of arguments. expect 3 or 4 arguments")
+		return shim.Error("Incorrect number of arguments. expect 3 or 4 arguments")
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Error("fail to read chaincode config")
+		return shim.Error("fail to read chaincode config")
+	}
+	ttl := config.PendingTTL
+	if ttl == 0 {
+		ttl = defaultPendingTTL
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	assetID := ""
+	if len(args) == 4 {
+		assetID = args[3]
+	}
+
+	hold, err := createHold(stub, ccapi.HoldPending, args[0], args[1], args[2], assetID)
+	if err != nil {
+		logger.Error("fail to create pending transfer: ", err.Error())
+		return shim.Error("fail to create pending transfer: " + err.Error())
+	}
+	hold.Deadline = now + ttl
+	err = putHold(stub, ccapi.HoldPending, hold)
+	if err != nil {
+		logger.Error("fail to store pending transfer: ", err.Error())
+		return shim.Error("fail to store pending transfer: " + err.Error())
+	}
+
+	err = setHoldEvent(stub, event.TransferPending, hold, "")
+	if err != nil {
+		logger.Error("fail to set event: ", err.Error())
+		return shim.Error("fail to set event: " + err.Error())
+	}
+	return shim.Success([]byte(hold.ID))
+}
+
+/*
+credit a pending transfer to its receiver before it expires
+args: pending transfer ID, signature of the receiver from cliapi.SignPending("accept", ...)
+*/
+func (t *TransferChaincode) accept(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	hold, err := checkPendingDecision(stub, args, "accept")
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if now >= hold.Deadline {
+		logger.Error("pending transfer expired: ", hold.ID)
+		return shim.Error("pending transfer expired: " + hold.ID)
+	}
+
+	err = releaseHold(stub, ccapi.HoldPending, hold)
+	if err != nil {
+		logger.Error("fail to accept: ", err.Error())
+		return shim.Error("fail to accept: " + err.Error())
+	}
+	return settledPending(stub, event.TransferAccepted, hold)
+}
+
+/*
+return a pending transfer to its sender on behalf of the receiver
+args: pending transfer ID, signature of the receiver from cliapi.SignPending("reject", ...)
+*/
+func (t *TransferChaincode) reject(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	hold, err := checkPendingDecision(stub, args, "reject")
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	err = returnHold(stub, ccapi.HoldPending, hold)
+	if err != nil {
+		logger.Error("fail to reject: ", err.Error())
+		return shim.Error("fail to reject: " + err.Error())
+	}
+	return settledPending(stub, event.TransferRejected, hold)
+}
+
+/*
+return a pending transfer to its sender on behalf of the sender
+args: pending transfer ID, signature of the sender from cliapi.SignPending("cancel", ...)
+*/
+func (t *TransferChaincode) cancel(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	hold, err := checkPendingDecision(stub, args, "cancel")
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	err = returnHold(stub, ccapi.HoldPending, hold)
+	if err != nil {
+		logger.Error("fail to cancel: ", err.Error())
+		return shim.Error("fail to cancel: " + err.Error())
+	}
+	return settledPending(stub, event.TransferCancelled, hold)
+}
+
+/*
+return an expired pending transfer to its sender
+args: pending transfer ID
+*/
+func (t *TransferChaincode) expire(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		logger.Error("Incorrect number of arguments. Expecting pending transfer ID")
+		return shim.Error("Incorrect number of arguments. Expecting pending transfer ID")
+	}
+
+	hold, err := getHold(stub, ccapi.HoldPending, args[0])
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if now < hold.Deadline {
+		logger.Error("pending transfer not expired: ", hold.ID)
+		return shim.Error("pending transfer not expired: " + hold.ID)
+	}
+
+	err = returnHold(stub, ccapi.HoldPending, hold)
+	if err != nil {
+		logger.Error("fail to expire: ", err.Error())
+		return shim.Error("fail to expire: " + err.Error())
+	}
+	return settledPending(stub, event.TransferExpired, hold)
+}
+
+/*
+query an open pending transfer
+args: pending transfer ID
+*/
+func (t *TransferChaincode) queryPending(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		logger.Error("Incorrect number of arguments. Expecting pending transfer ID")
+		return shim.Error("Incorrect number of arguments. Expecting pending transfer ID")
+	}
+
+	hold, err := getHold(stub, ccapi.HoldPending, args[0])
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	holdBytes, err := json.Marshal(hold)
+	if err != nil {
+		return shim.Error("Marshal Error")
+	}
+	return shim.Success(holdBytes)
+}
+
+// checkPendingDecision reads the pending transfer of args[0] and verifies
+// args[1] is the signature of action by the receiver, or by the sender for
+// "cancel", under the key the hold was created with.
+func checkPendingDecision(stub shim.ChaincodeStubInterface, args []string, action string) (*Hold, error) {
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting pending transfer ID and signature")
+	}
+
+	hold, err := getHold(stub, ccapi.HoldPending, args[0])
+	if err != nil {
+		return nil, err
+	}
+	pubKey := hold.PubKeyTo
+	if action == "cancel" {
+		pubKey = hold.PubKeyFrom
+	}
+	err = gohe.Verify(pubKey, pendingMessage(action, hold.ID), []byte(args[1]))
+	if err != nil {
+		return nil, errors.New("invalid signature: " + err.Error())
+	}
+	return hold, nil
+}
+
+// pendingMessage must match the message signed by cliapi.SignPending.
+func pendingMessage(action, id string) []byte {
+	return []byte("gopaillier/pending/" + action + "/" + id)
+}
+
+func settledPending(stub shim.ChaincodeStubInterface, name string, hold *Hold) pb.Response {
+	err := setHoldEvent(stub, name, hold, "")
+	if err != nil {
+		logger.Error("fail to set event: ", err.Error())
+		return shim.Error("fail to set event: " + err.Error())
+	}
+	return shim.Success([]byte("Success"))
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"strconv"
+
+	"chaoshen.com/gopaillier/api/ccapi"
+	"chaoshen.com/gopaillier/api/event"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// maxRingSize bounds the members of a ring transfer. The proofs grow with
+// the square of the ring size.
+const maxRingSize = 16
+
+/*
+transfer between two members of a ring without telling which two. Every
+member's balance is updated, by zero for all but the sender and the
+receiver. No fee is charged, as the payer is unknown, and the auditor only
+learns the amount, from the tx info. Accounts that are
+frozen, have signers or a spending limit cannot be members, since those
+rules apply to a sender the chaincode does not know.
+args: tx info prepared by cliapi.PrepareRingTransfer for this txID, asset ID (empty for the default asset), member addrs in ring order
+*/
+func (t *TransferChaincode) transferRing(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	logger.Debug("enter TransferRing")
+
+	if len(args) < 4 {
+		logger.Error("Incorrect number of arguments. expect tx info, asset and at least two members")
+		return shim.Error("Incorrect number of arguments. expect tx info, asset and at least two members")
+	}
+
+	txInfo := args[0]
+	assetID := args[1]
+	addrs := args[2:]
+	if len(addrs) > maxRingSize {
+		logger.Error("ring is larger than ", maxRingSize)
+		return shim.Error("ring is larger than " + strconv.Itoa(maxRingSize))
+	}
+	if assetID != "" {
+		_, err := getAsset(stub, assetID)
+		if err != nil {
+			logger.Error(err.Error())
+			return shim.Error(err.Error())
+		}
+	}
+
+	// every account appears once, receipts are keyed by address and txID
+	seen := map[string]bool{}
+	for _, addr := range addrs {
+		if seen[addr] {
+			logger.Error("duplicate account: ", addr)
+			return shim.Error("duplicate account: " + addr)
+		}
+		seen[addr] = true
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Error("fail to read chaincode config")
+		return shim.Error("fail to read chaincode config")
+	}
+
+	accounts := make([]*CipherAccount, len(addrs))
+	balances := make([]string, len(addrs))
+	pubKeys := make([]string, len(addrs))
+	for i, addr := range addrs {
+		accounts[i], err = getAccount(stub, addr)
+		if err == nil {
+			err = checkNotFrozen(addr, accounts[i])
+		}
+		if err == nil {
+			err = checkSingleSigner(addr, accounts[i])
+		}
+		if err == nil {
+			err = checkClaimed(addr, accounts[i])
+		}
+		if err != nil {
+			logger.Error(err.Error())
+			return shim.Error(err.Error())
+		}
+		if accounts[i].Limit != nil {
+			logger.Error("account with a spending limit cannot join a ring: ", addr)
+			return shim.Error("account with a spending limit cannot join a ring: " + addr)
+		}
+		pubKey, err := resolvePubKey(stub, config, addr, accounts[i])
+		if err != nil {
+			logger.Error("fail to resolve member key: ", err.Error())
+			return shim.Error("fail to resolve member key: " + err.Error())
+		}
+		balance, err := accounts[i].spendable(pubKey, assetID)
+		if err != nil {
+			logger.Error("fail to read spendable balance: ", err.Error())
+			return shim.Error("fail to read spendable balance: " + err.Error())
+		}
+		balances[i] = string(balance)
+		pubKeys[i] = string(pubKey)
+	}
+
+	result, err := ccapi.ValidateRingTxInfo(txInfo, stub.GetTxID(), balances, pubKeys, config.AuditorPubKey, assetID)
+	if err != nil {
+		logger.Error("fail to validate transaction information: ", err.Error())
+		return shim.Error("fail to validate transaction information")
+	}
+
+	for i, addr := range addrs {
+		err = accounts[i].setSpendable([]byte(pubKeys[i]), assetID, []byte(result.NewCipherBalances[i]))
+		if err == nil {
+			err = putAccount(stub, addr, accounts[i])
+		}
+		if err != nil {
+			logger.Error("fail to store state: ", err.Error())
+			return shim.Error(err.Error())
+		}
+		err = putReceipt(stub, addr, &Receipt{Type: ReceiptRing, Asset: assetID, Delta: result.Updates[i]})
+		if err != nil {
+			logger.Error("fail to store receipt: ", err.Error())
+			return shim.Error("fail to store receipt: " + err.Error())
+		}
+	}
+
+	err = setEvent(stub, event.RingTransfer, &event.RingEvent{
+		Version: event.Version,
+		TxID:    stub.GetTxID(),
+		Ring:    addrs,
+		Asset:   assetID,
+		Updates: result.Updates,
+	})
+	if err != nil {
+		logger.Error("fail to set event: ", err.Error())
+		return shim.Error("fail to set event: " + err.Error())
+	}
+
+	return shim.Success([]byte("Success"))
+}
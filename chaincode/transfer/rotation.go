@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+
+	"chaoshen.com/gopaillier/api/ccapi"
+	"chaoshen.com/gopaillier/api/event"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// keyRecord is the part of IDChaincode's key record returned by Rotate and
+// QueryKeyHistory.
+type keyRecord struct {
+	Keys []struct {
+		Version int
+		PubKey  string
+	}
+	Revoked bool
+}
+
+// queryKeyRecord reads the key record of addr from IDChaincode.
+func queryKeyRecord(stub shim.ChaincodeStubInterface, config *ChaincodeConfig, function, addr string, args ...[]byte) (*keyRecord, error) {
+	res := stub.InvokeChaincode(config.IDChaincode, append([][]byte{[]byte(function), []byte(addr)}, args...), config.IDChannel)
+	if res.Status != shim.OK {
+		return nil, errors.New(res.Message)
+	}
+	record := &keyRecord{}
+	err := json.Unmarshal(res.Payload, record)
+	if err != nil || len(record.Keys) == 0 {
+		return nil, errors.New("fail to unmarshal key record")
+	}
+	return record, nil
+}
+
+/*
+rotate the key of an account in IDChaincode and re-encrypt its balance under
+the new key in the same transaction. Holds that would be refunded to the
+account must be settled and allowances it granted revoked first.
+args: addr, rotation info prepared by cliapi.PrepareRotation
+*/
+func (t *TransferChaincode) rotateKey(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		logger.Error("Incorrect number of arguments. expect 2 arguments")
+		return shim.Error("Incorrect number of arguments. expect 2 arguments")
+	}
+
+	addr := args[0]
+	rotation := args[1]
+
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Error("fail to read chaincode config")
+		return shim.Error("fail to read chaincode config")
+	}
+	if config.IDChaincode == "" {
+		logger.Error("key rotation needs IDChaincode")
+		return shim.Error("key rotation needs IDChaincode")
+	}
+
+	account, err := getAccount(stub, addr)
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	if account.Stealth != nil {
+		logger.Error("stealth accounts change keys with ClaimStealth")
+		return shim.Error("stealth accounts change keys with ClaimStealth")
+	}
+	// the rotation info re-encrypts the default balance only
+	if len(account.Assets) > 0 {
+		logger.Error("key rotation of accounts holding other assets is not supported")
+		return shim.Error("key rotation of accounts holding other assets is not supported")
+	}
+	err = checkNoOutboundHolds(stub, addr)
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	// QueryPubkey refuses expired keys, which must still be able to rotate
+	current, err := queryKeyRecord(stub, config, "QueryKeyHistory", addr)
+	if err != nil {
+		logger.Error("fail to query key record: ", err.Error())
+		return shim.Error("fail to query key record: " + err.Error())
+	}
+	if current.Revoked {
+		logger.Error("addr is revoked")
+		return shim.Error("addr is revoked")
+	}
+	oldPubKey := current.Keys[len(current.Keys)-1].PubKey
+
+	newPubKey, sig, newCipherBalance, err := ccapi.ValidateRotation(rotation, addr, string(account.Balance), oldPubKey)
+	if err != nil {
+		logger.Error("fail to validate re-encrypted balance: ", err.Error())
+		return shim.Error("fail to validate re-encrypted balance: " + err.Error())
+	}
+
+	// the registry checks the signature of the current key
+	record, err := queryKeyRecord(stub, config, "Rotate", addr, []byte(newPubKey), sig)
+	if err != nil {
+		logger.Error("fail to rotate key: ", err.Error())
+		return shim.Error("fail to rotate key: " + err.Error())
+	}
+
+	account.Balance = []byte(newCipherBalance)
+	err = putAccount(stub, addr, account)
+	if err != nil {
+		logger.Error("fail to store state: ", err.Error())
+		return shim.Error(err.Error())
+	}
+
+	err = putReceipt(stub, addr, &Receipt{Type: ReceiptRotate, Delta: account.Balance})
+	if err != nil {
+		logger.Error("fail to store receipt: ", err.Error())
+		return shim.Error("fail to store receipt: " + err.Error())
+	}
+
+	err = setEvent(stub, event.KeyRotated, &event.KeyRegisteredEvent{
+		Version:    event.Version,
+		TxID:       stub.GetTxID(),
+		Addr:       addr,
+		PubKey:     newPubKey,
+		KeyVersion: record.Keys[len(record.Keys)-1].Version,
+	})
+	if err != nil {
+		logger.Error("fail to set event: ", err.Error())
+		return shim.Error("fail to set event: " + err.Error())
+	}
+
+	return shim.Success([]byte("Success"))
+}
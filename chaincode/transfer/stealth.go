@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+
+	"chaoshen.com/gopaillier/api/ccapi"
+	"chaoshen.com/gopaillier/api/core"
+	"chaoshen.com/gopaillier/api/event"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Stealth marks a one-time account opened by a sender for a receiver that
+// published a scan key and a spend key. The sender derives the one-time
+// Paillier key and so knows its private key: until the receiver claims the
+// account with a key of its own, it can receive but not send.
+type Stealth struct {
+	Ephemeral []byte // PEM ECDH key of the sender
+	ClaimKey  []byte // PEM ECDSA key that authorizes ClaimStealth
+	Claimed   bool
+}
+
+// checkClaimed refuses to debit or authorize for a stealth account that its
+// receiver has not claimed yet.
+func checkClaimed(addr string, account *CipherAccount) error {
+	if account.Stealth != nil && !account.Stealth.Claimed {
+		return errors.New("stealth account " + addr + " is not claimed yet, use ClaimStealth")
+	}
+	return nil
+}
+
+/*
+open a stealth account with a zero balance. The payload is its address, which
+the sender then pays with Transfer like any other account. Stealth accounts
+keep their key in the account even with an IDChaincode configured, which must
+not know the key: a stealth account under a registered key is refused.
+args: stealth info prepared by cliapi.PrepareStealth
+*/
+func (t *TransferChaincode) createStealth(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		logger.Error("Incorrect number of arguments. Expecting stealth info")
+		return shim.Error("Incorrect number of arguments. Expecting stealth info")
+	}
+
+	pubKey, ephemeral, claimKey, err := ccapi.ValidateStealthInfo(args[0])
+	if err != nil {
+		logger.Error("fail to validate stealth info: ", err.Error())
+		return shim.Error("fail to validate stealth info: " + err.Error())
+	}
+	addr, err := t.calcAddr(pubKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	accountBytes, err := stub.GetState(addr)
+	if err != nil {
+		logger.Error("Error on query addr")
+		return shim.Error("fail to query addr")
+	}
+	if accountBytes != nil {
+		logger.Error("addr already register")
+		return shim.Error("addr already register")
+	}
+	tombstone, err := getTombstone(stub, addr)
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	if tombstone != nil {
+		logger.Error("addr was closed in: ", tombstone.TxID)
+		return shim.Error("addr was closed in: " + tombstone.TxID)
+	}
+	// a registered key belongs to an owner that opens its account with init,
+	// a stealth account under it would take the address and its payments
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Error("fail to read chaincode config")
+		return shim.Error("fail to read chaincode config")
+	}
+	if config.IDChaincode != "" {
+		if _, err = resolvePubKey(stub, config, addr, nil); err == nil {
+			logger.Error("addr is registered in ", config.IDChaincode)
+			return shim.Error("addr is registered in " + config.IDChaincode)
+		}
+	}
+
+	account := &CipherAccount{
+		Balance:   gohe.ZeroCipher(),
+		PublicKey: []byte(pubKey),
+		Stealth:   &Stealth{Ephemeral: ephemeral, ClaimKey: claimKey},
+	}
+	err = putAccount(stub, addr, account)
+	if err != nil {
+		logger.Error("fail to store state: ", err.Error())
+		return shim.Error(err.Error())
+	}
+
+	err = putReceipt(stub, addr, &Receipt{Type: ReceiptOpen, Delta: account.Balance})
+	if err != nil {
+		logger.Error("fail to store receipt: ", err.Error())
+		return shim.Error("fail to store receipt: " + err.Error())
+	}
+
+	err = setEvent(stub, event.StealthCreated, &event.StealthEvent{
+		Version: event.Version,
+		TxID:    stub.GetTxID(),
+		Addr:    addr,
+		Info:    []byte(args[0]),
+	})
+	if err != nil {
+		logger.Error("fail to set event: ", err.Error())
+		return shim.Error("fail to set event: " + err.Error())
+	}
+	return shim.Success([]byte(addr))
+}
+
+/*
+claim a stealth account: move it to a key only the receiver knows and
+re-encrypt all of its balances under that key. The address stays the same.
+args: addr, claim info prepared by cliapi.PrepareClaim
+*/
+func (t *TransferChaincode) claimStealth(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		logger.Error("Incorrect number of arguments. Expecting addr and claim info")
+		return shim.Error("Incorrect number of arguments. Expecting addr and claim info")
+	}
+
+	addr := args[0]
+	account, err := getAccount(stub, addr)
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	if account.Stealth == nil || account.Stealth.Claimed {
+		logger.Error("not an unclaimed stealth account: ", addr)
+		return shim.Error("not an unclaimed stealth account: " + addr)
+	}
+	err = checkNotFrozen(addr, account)
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	balances := map[string][]byte{"": account.Balance}
+	for assetID, balance := range account.Assets {
+		balances[assetID] = balance
+	}
+	newPubKey, newBalances, err := ccapi.ValidateClaim(args[1], addr, stub.GetTxID(), string(account.PublicKey), account.Stealth.ClaimKey, balances)
+	if err != nil {
+		logger.Error("fail to validate claim info: ", err.Error())
+		return shim.Error("fail to validate claim info: " + err.Error())
+	}
+
+	account.PublicKey = []byte(newPubKey)
+	account.Balance = newBalances[""]
+	var assets map[string][]byte
+	for assetID := range account.Assets {
+		account.Assets[assetID] = newBalances[assetID]
+		if assets == nil {
+			assets = map[string][]byte{}
+		}
+		assets[assetID] = newBalances[assetID]
+	}
+	account.Stealth.Claimed = true
+	err = putAccount(stub, addr, account)
+	if err != nil {
+		logger.Error("fail to store state: ", err.Error())
+		return shim.Error(err.Error())
+	}
+
+	// receipts are keyed by transaction, one carries every balance of the claim
+	err = putReceipt(stub, addr, &Receipt{Type: ReceiptRotate, Delta: account.Balance, Balances: assets})
+	if err != nil {
+		logger.Error("fail to store receipt: ", err.Error())
+		return shim.Error("fail to store receipt: " + err.Error())
+	}
+
+	err = setEvent(stub, event.StealthClaimed, &event.StealthEvent{
+		Version: event.Version,
+		TxID:    stub.GetTxID(),
+		Addr:    addr,
+	})
+	if err != nil {
+		logger.Error("fail to set event: ", err.Error())
+		return shim.Error("fail to set event: " + err.Error())
+	}
+	return shim.Success(nil)
+}
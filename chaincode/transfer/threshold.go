@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+
+	"chaoshen.com/gopaillier/api/ccapi"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// attestationKeyEnv names the environment variable of the chaincode
+// container holding the path of the PEM ECDSA key that signs attestations.
+// The private key stays with the endorsing peers, ChaincodeConfig.AttestationKey
+// publishes its public key.
+const attestationKeyEnv = "GOPAILLIER_ATTESTATION_KEY"
+
+// Attestation states that the balance of an account was at least a threshold.
+type Attestation struct {
+	Addr        string
+	Asset       string // asset ID, empty for the default asset
+	Threshold   string // decimal amount the balance is at least
+	BalanceHash string // hex SHA-256 of the cipher balance the proof was checked against
+	TxID        string
+	Timestamp   int64 // proposal time in seconds since the epoch
+}
+
+// SignedAttestation is the payload of VerifyBalanceAtLeast, checked by
+// cliapi.VerifyAttestation.
+type SignedAttestation struct {
+	Attestation []byte // JSON Attestation
+	Sig         []byte // ASN.1 ECDSA signature of the SHA-256 of Attestation, RFC 6979 nonce
+}
+
+// attestationKey loads the key signing attestations. It is a variable so
+// tests can run without a key file.
+var attestationKey = func() (*ecdsa.PrivateKey, error) {
+	path := os.Getenv(attestationKeyEnv)
+	if path == "" {
+		return nil, errors.New(attestationKeyEnv + " is not set")
+	}
+	keyBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(keyBytes)
+	if block == nil {
+		return nil, errors.New("attestation key is not PEM encoded")
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("attestation key is not an ECDSA key")
+	}
+	return ecKey, nil
+}
+
+// signAttestation signs an attestation with the attestation key, which must
+// match the configured public key.
+func signAttestation(config *ChaincodeConfig, attestation *Attestation) ([]byte, error) {
+	if config.AttestationKey == "" {
+		return nil, errors.New("attestation key is not configured")
+	}
+	key, err := attestationKey()
+	if err != nil {
+		return nil, errors.New("fail to load attestation key: " + err.Error())
+	}
+	pubDer, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(config.AttestationKey))
+	if block == nil || !bytes.Equal(block.Bytes, pubDer) {
+		return nil, errors.New("attestation key does not match the configured key")
+	}
+
+	attestationBytes, err := json.Marshal(attestation)
+	if err != nil {
+		return nil, errors.New("Marshal Error")
+	}
+	digest := sha256.Sum256(attestationBytes)
+	sig, err := signDeterministic(key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&SignedAttestation{Attestation: attestationBytes, Sig: sig})
+}
+
+// signDeterministic signs a SHA-256 digest with the nonce of RFC 6979, so
+// every endorsing peer returns the same signature of the same attestation
+// and VerifyBalanceAtLeast can be submitted like any other transaction.
+// ecdsa.SignASN1 mixes random bytes into its nonce.
+func signDeterministic(key *ecdsa.PrivateKey, digest []byte) ([]byte, error) {
+	n := key.Curve.Params().N
+	e := bitsToInt(digest, n)
+	drbg := newNonceGenerator(key.D, e, n)
+	for {
+		k := drbg.next()
+		x, _ := key.Curve.ScalarBaseMult(k.Bytes())
+		r := new(big.Int).Mod(x, n)
+		if r.Sign() == 0 {
+			continue
+		}
+		s := new(big.Int).Mul(r, key.D)
+		s.Add(s, e)
+		s.Mul(s, new(big.Int).ModInverse(k, n))
+		s.Mod(s, n)
+		if s.Sign() == 0 {
+			continue
+		}
+		return asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	}
+}
+
+// bitsToInt is bits2int of RFC 6979: the leftmost bits of b, as many as n
+// has.
+func bitsToInt(b []byte, n *big.Int) *big.Int {
+	v := new(big.Int).SetBytes(b)
+	if excess := len(b)*8 - n.BitLen(); excess > 0 {
+		v.Rsh(v, uint(excess))
+	}
+	return v
+}
+
+// nonceGenerator is the HMAC-SHA256 DRBG of RFC 6979 section 3.2.
+type nonceGenerator struct {
+	n    *big.Int
+	k, v []byte
+}
+
+func newNonceGenerator(d, e, n *big.Int) *nonceGenerator {
+	size := (n.BitLen() + 7) / 8
+	octets := func(x *big.Int) []byte {
+		return x.FillBytes(make([]byte, size))
+	}
+	g := &nonceGenerator{n: n, k: make([]byte, sha256.Size), v: bytes.Repeat([]byte{1}, sha256.Size)}
+	seed := append(octets(d), octets(new(big.Int).Mod(e, n))...)
+	for _, b := range []byte{0, 1} {
+		g.k = g.mac(g.v, []byte{b}, seed)
+		g.v = g.mac(g.v)
+	}
+	return g
+}
+
+func (g *nonceGenerator) mac(data ...[]byte) []byte {
+	h := hmac.New(sha256.New, g.k)
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// next returns the next candidate nonce in [1, n).
+func (g *nonceGenerator) next() *big.Int {
+	for {
+		var t []byte
+		for len(t)*8 < g.n.BitLen() {
+			g.v = g.mac(g.v)
+			t = append(t, g.v...)
+		}
+		k := bitsToInt(t, g.n)
+		// step h.3 moves on after every candidate, taken or not
+		g.k = g.mac(g.v, []byte{0})
+		g.v = g.mac(g.v)
+		if k.Sign() > 0 && k.Cmp(g.n) < 0 {
+			return k
+		}
+	}
+}
+
+/*
+check that the current balance of an account is at least a threshold,
+without revealing it. The payload is a JSON SignedAttestation.
+args: addr, threshold, proof from cliapi.ProveBalanceAtLeast, optional asset ID
+*/
+func (t *TransferChaincode) verifyBalanceAtLeast(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 && len(args) != 4 {
+		logger.Error("Incorrect number of arguments. expect 3 or 4 arguments")
+		return shim.Error("Incorrect number of arguments. expect 3 or 4 arguments")
+	}
+
+	addr := args[0]
+	assetID := ""
+	if len(args) == 4 && args[3] != "" {
+		assetID = args[3]
+		_, err := getAsset(stub, assetID)
+		if err != nil {
+			logger.Error(err.Error())
+			return shim.Error(err.Error())
+		}
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Error("fail to read chaincode config")
+		return shim.Error("fail to read chaincode config")
+	}
+	account, err := getAccount(stub, addr)
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	pubKey, err := resolvePubKey(stub, config, addr, account)
+	if err != nil {
+		logger.Error("fail to resolve public key: ", err.Error())
+		return shim.Error("fail to resolve public key: " + err.Error())
+	}
+
+	balance := account.balance(assetID)
+	threshold, err := ccapi.VerifyBalanceAtLeast(args[2], string(balance), string(pubKey), args[1])
+	if err != nil {
+		logger.Error("fail to verify threshold proof: ", err.Error())
+		return shim.Error("fail to verify threshold proof: " + err.Error())
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	balanceHash := sha256.Sum256(balance)
+	signed, err := signAttestation(config, &Attestation{
+		Addr:        addr,
+		Asset:       assetID,
+		Threshold:   threshold,
+		BalanceHash: hex.EncodeToString(balanceHash[:]),
+		TxID:        stub.GetTxID(),
+		Timestamp:   now,
+	})
+	if err != nil {
+		logger.Error("fail to sign attestation: ", err.Error())
+		return shim.Error("fail to sign attestation: " + err.Error())
+	}
+	return shim.Success(signed)
+}
@@ -4,11 +4,14 @@ import (
 	"crypto"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"math/big"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
 	"strings"
 	"chaoshen.com/gopaillier/api/ccapi"
 	"chaoshen.com/gopaillier/api/core"
+	"chaoshen.com/gopaillier/api/event"
 )
 
 //var logger = util.GetLog("TransChaincode Demo")
@@ -19,12 +22,35 @@ var logger = shim.NewLogger("Transfer Chaincode")
 type TransferChaincode struct{}
 
 type CipherAccount struct {
-	Balance  []byte
-	PublicKey []byte
+	Balance  []byte // balance of the default asset
+	PublicKey []byte // nil when keys are resolved through IDChaincode
 	Remark   []byte
+	Assets   map[string][]byte // balances of other assets by asset ID
+	Frozen   bool              // set by the compliance role, see Freeze
+	Limit    *SpendingLimit    `json:",omitempty"` // nil without a spending limit
+	Multisig *Multisig         `json:",omitempty"` // nil when the account key alone transfers
+	Stealth  *Stealth          `json:",omitempty"` // nil unless opened by CreateStealth
+	Reserved map[string][]byte `json:",omitempty"` // sum of the allowances granted by asset ID, see Approve
 }
 
+/*
+Init optionally takes a JSON encoded ChaincodeConfig as its only argument.
+*/
 func (t *TransferChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	_, args := stub.GetFunctionAndParameters()
+	if len(args) == 0 {
+		return shim.Success(nil)
+	}
+	if len(args) != 1 {
+		logger.Error("Incorrect number of arguments. Expecting chaincode config")
+		return shim.Error("Incorrect number of arguments. Expecting chaincode config")
+	}
+
+	err := initConfig(stub, args[0])
+	if err != nil {
+		logger.Error("fail to init chaincode config: ", err.Error())
+		return shim.Error("fail to init chaincode config: " + err.Error())
+	}
 	return shim.Success(nil)
 }
 
@@ -37,26 +63,129 @@ func (t *TransferChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response
 	} else if function == "Transfer" {
 		return t.transfer(stub, args)
 
+	} else if function == "TransferMany" {
+		return t.transferMany(stub, args)
 	} else if function == "init" {
 		return t.init(stub, args)
 	} else if function == "HomoAdd" {
 		return t.homoAdd(stub, args)
+	} else if function == "Mint" {
+		return t.mint(stub, args)
+	} else if function == "Burn" {
+		return t.burn(stub, args)
+	} else if function == "QueryTotalSupply" {
+		return t.queryTotalSupply(stub, args)
+	} else if function == "QueryHistory" {
+		return t.queryHistory(stub, args)
+	} else if function == "RotateKey" {
+		return t.rotateKey(stub, args)
+	} else if function == "SetFeeSchedule" {
+		return t.setFeeSchedule(stub, args)
+	} else if function == "QueryFeeSchedule" {
+		return t.queryFeeSchedule(stub, args)
+	} else if function == "RegisterAsset" {
+		return t.registerAsset(stub, args)
+	} else if function == "QueryAsset" {
+		return t.queryAsset(stub, args)
+	} else if function == "MintAsset" {
+		return t.mintAsset(stub, args)
+	} else if function == "BurnAsset" {
+		return t.burnAsset(stub, args)
+	} else if function == "Lock" {
+		return t.lock(stub, args)
+	} else if function == "Claim" {
+		return t.claim(stub, args)
+	} else if function == "Refund" {
+		return t.refund(stub, args)
+	} else if function == "QueryLock" {
+		return t.queryLock(stub, args)
+	} else if function == "TransferPending" {
+		return t.transferPending(stub, args)
+	} else if function == "Accept" {
+		return t.accept(stub, args)
+	} else if function == "Reject" {
+		return t.reject(stub, args)
+	} else if function == "Cancel" {
+		return t.cancel(stub, args)
+	} else if function == "Expire" {
+		return t.expire(stub, args)
+	} else if function == "QueryPending" {
+		return t.queryPending(stub, args)
+	} else if function == "Freeze" {
+		return t.freeze(stub, args)
+	} else if function == "Unfreeze" {
+		return t.unfreeze(stub, args)
+	} else if function == "Seize" {
+		return t.seize(stub, args)
+	} else if function == "QueryCustody" {
+		return t.queryCustody(stub, args)
+	} else if function == "QueryAuditLog" {
+		return t.queryAuditLog(stub, args)
+	} else if function == "SetSpendingLimit" {
+		return t.setSpendingLimit(stub, args)
+	} else if function == "Approve" {
+		return t.approve(stub, args)
+	} else if function == "TransferFrom" {
+		return t.transferFrom(stub, args)
+	} else if function == "RevokeAllowance" {
+		return t.revokeAllowance(stub, args)
+	} else if function == "Allowance" {
+		return t.queryAllowance(stub, args)
+	} else if function == "QuerySpendable" {
+		return t.querySpendable(stub, args)
+	} else if function == "SetSigners" {
+		return t.setSigners(stub, args)
+	} else if function == "ProposeTransfer" {
+		return t.proposeTransfer(stub, args)
+	} else if function == "ApproveTransfer" {
+		return t.approveTransfer(stub, args)
+	} else if function == "QueryProposal" {
+		return t.queryProposal(stub, args)
+	} else if function == "CloseAccount" {
+		return t.closeAccount(stub, args)
+	} else if function == "TransferRing" {
+		return t.transferRing(stub, args)
+	} else if function == "CreateStealth" {
+		return t.createStealth(stub, args)
+	} else if function == "ClaimStealth" {
+		return t.claimStealth(stub, args)
+	} else if function == "VerifyBalanceAtLeast" {
+		return t.verifyBalanceAtLeast(stub, args)
 	}
 
 	return shim.Error("Invalid invoke function name: " + function)
 }
 
+/*
+transfer an amount from A to B. Accounts with signers transfer with ProposeTransfer.
+args: addr A, addr B, tx info prepared by cliapi.PrepareTxInfo and signed by cliapi.SignTxInfo, optional asset ID
+*/
 func (t *TransferChaincode) transfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return t.doTransfer(stub, args, false)
+}
+
+// doTransfer transfers from A, from an account with signers only once they
+// approved.
+func (t *TransferChaincode) doTransfer(stub shim.ChaincodeStubInterface, args []string, approved bool) pb.Response {
 	logger.Debug("enter Transfer")
 
-	if len(args) != 3 {
-		logger.Error("Incorrect number of arguments. expect 3 arguments")
-		return shim.Error("Incorrect number of arguments. expect 3 arguments")
+	if len(args) != 3 && len(args) != 4 {
+		logger.Error("Incorrect number of arguments. expect 3 or 4 arguments")
+		return shim.Error("Incorrect number of arguments. expect 3 or 4 arguments")
 	}
 
 	AddrA := args[0]
 	AddrB := args[1]
 	txInfo := args[2]
+	assetID := ""
+	if len(args) == 4 && args[3] != "" {
+		assetID = args[3]
+		_, err := getAsset(stub, assetID)
+		if err != nil {
+			logger.Error(err.Error())
+			return shim.Error(err.Error())
+		}
+	}
 
 	if strings.Compare(AddrA, AddrB) == 0 {
 		logger.Error("A' addr is the same B'Addr")
@@ -101,16 +230,100 @@ func (t *TransferChaincode) transfer(stub shim.ChaincodeStubInterface, args []st
 	logger.Debugf("validate transfer information")
 	logger.Debugf("tx information: ")
 	logger.Debugf("%+v\n", string(txInfo))
-	cipherBalanceA := transferAStruct.Balance
-	cipherBalanceB := transferBStruct.Balance
-	newCipherBalanceA,newCipherBalanceB,err:=ccapi.ValidateTxInfo(txInfo,string(cipherBalanceA),string(cipherBalanceB))
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Error("fail to read chaincode config")
+		return shim.Error("fail to read chaincode config")
+	}
+	pubKeyA, err := resolvePubKey(stub, config, AddrA, &transferAStruct)
+	if err != nil {
+		logger.Error("fail to resolve sender key: ", err.Error())
+		return shim.Error("fail to resolve sender key: " + err.Error())
+	}
+	pubKeyB, err := resolvePubKey(stub, config, AddrB, &transferBStruct)
+	if err != nil {
+		logger.Error("fail to resolve receiver key: ", err.Error())
+		return shim.Error("fail to resolve receiver key: " + err.Error())
+	}
+
+	err = checkNotFrozen(AddrA, &transferAStruct)
+	if err == nil {
+		err = checkNotFrozen(AddrB, &transferBStruct)
+	}
+	if err == nil && !approved {
+		err = checkSingleSigner(AddrA, &transferAStruct)
+	}
+	if err == nil {
+		err = checkClaimed(AddrA, &transferAStruct)
+	}
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	// fees are charged in the default asset only
+	var fee *ccapi.Fee
+	var collector string
+	if assetID == "" {
+		fee, collector, err = getFee(stub, config, AddrA)
+		if err != nil {
+			logger.Error("fail to read fee schedule: ", err.Error())
+			return shim.Error("fail to read fee schedule: " + err.Error())
+		}
+	}
+
+	cipherBalanceA, err := transferAStruct.spendable(pubKeyA, assetID)
+	if err != nil {
+		logger.Error("fail to read spendable balance: ", err.Error())
+		return shim.Error("fail to read spendable balance: " + err.Error())
+	}
+	cipherBalanceB := transferBStruct.balance(assetID)
+	// the signers approved the tx info of a proposal, otherwise the key of A signs it
+	var auth *ccapi.Auth
+	if !approved {
+		auth = &ccapi.Auth{TxID: stub.GetTxID(), From: AddrA, To: AddrB}
+	}
+	txResult,err:=ccapi.ValidateTxInfo(txInfo,string(cipherBalanceA),string(cipherBalanceB),string(pubKeyA),string(pubKeyB),config.AuditorPubKey,assetID,fee,auth)
 	if err != nil {
 		logger.Error("fail to validate transaction information")
 		return shim.Error("fail to validate transaction information")
 	}
 
+	if assetID == "" {
+		err = checkSpendingLimit(stub, &transferAStruct, pubKeyA, txInfo, txResult.CipherTxA)
+		if err != nil {
+			logger.Error(err.Error())
+			return shim.Error(err.Error())
+		}
+	}
+
+	// pay the fee, receipts show the whole change of a balance
+	deltaA, auditorDeltaA := txResult.CipherTxA, txResult.CipherTxAuditor
+	deltaB, auditorDeltaB := txResult.CipherTxB, txResult.CipherTxAuditor
+	if txResult.Fee != nil {
+		deltaA, auditorDeltaA, err = addFee(pubKeyA, config.AuditorPubKey, deltaA, auditorDeltaA, txResult.Fee.CipherFeeA, txResult.Fee.CipherFeeAuditor)
+		if err == nil && collector == AddrB {
+			deltaB, auditorDeltaB, err = addFee(pubKeyB, config.AuditorPubKey, deltaB, auditorDeltaB, txResult.Fee.CipherFeeCollector, txResult.Fee.CipherFeeAuditor)
+			if err == nil {
+				var newBalanceB []byte
+				newBalanceB, err = gohe.AddCipher(pubKeyB, []byte(txResult.NewCipherBalanceB), txResult.Fee.CipherFeeCollector)
+				txResult.NewCipherBalanceB = string(newBalanceB)
+			}
+		} else if err == nil {
+			err = creditFee(stub, config, collector, AddrA, txResult.Fee)
+		}
+		if err != nil {
+			logger.Error("fail to pay fee: ", err.Error())
+			return shim.Error("fail to pay fee: " + err.Error())
+		}
+	}
+
 	// update a's balance
-	transferAStruct.Balance = []byte(newCipherBalanceA)
+	err = transferAStruct.setSpendable(pubKeyA, assetID, []byte(txResult.NewCipherBalanceA))
+	if err != nil {
+		logger.Error("fail to update balance: ", err.Error())
+		return shim.Error("fail to update balance: " + err.Error())
+	}
 
 
 	AvalbytesUpdate, err := json.Marshal(transferAStruct)
@@ -127,7 +340,7 @@ func (t *TransferChaincode) transfer(stub shim.ChaincodeStubInterface, args []st
 	}
 
 	// update b's balance
-	transferBStruct.Balance = []byte(newCipherBalanceB)
+	transferBStruct.setBalance(assetID, []byte(txResult.NewCipherBalanceB))
 	BvalbytesUpdate, err := json.Marshal(transferBStruct)
 	if err != nil {
 		logger.Error("fail to marshal balance update info")
@@ -140,6 +353,33 @@ func (t *TransferChaincode) transfer(stub shim.ChaincodeStubInterface, args []st
 		return shim.Error(err.Error())
 	}
 
+	// record the transfer in both histories
+	err = putReceipt(stub, AddrA, &Receipt{Type: ReceiptTransferOut, Asset: assetID, Counterparty: AddrB, Delta: deltaA, AuditorDelta: auditorDeltaA})
+	if err == nil {
+		receiptB := &Receipt{Type: ReceiptTransferIn, Asset: assetID, Counterparty: AddrA, Delta: deltaB, AuditorDelta: auditorDeltaB, Memo: txResult.Memo}
+		if txResult.Memo != nil && collector == AddrB {
+			receiptB.MemoCipher = txResult.CipherTxB
+		}
+		err = putReceipt(stub, AddrB, receiptB)
+	}
+	if err != nil {
+		logger.Error("fail to store receipt: ", err.Error())
+		return shim.Error("fail to store receipt: " + err.Error())
+	}
+
+	err = setEvent(stub, event.ConfidentialTransfer, &event.TransferEvent{
+		Version:            event.Version,
+		TxID:               stub.GetTxID(),
+		From:               AddrA,
+		To:                 AddrB,
+		Asset:              assetID,
+		CipherForRecipient: txResult.CipherTxB,
+	})
+	if err != nil {
+		logger.Error("fail to set event: ", err.Error())
+		return shim.Error("fail to set event: " + err.Error())
+	}
+
 	return shim.Success([]byte("Success"))
 }
 
@@ -168,16 +408,57 @@ func (t *TransferChaincode) init(stub shim.ChaincodeStubInterface, args []string
 		return shim.Error("addr already register")
 	}
 
+	// a closed address stays closed
+	tombstone, err := getTombstone(stub, hashPubkey)
+	if err != nil {
+		logger.Error(err.Error())
+		return shim.Error(err.Error())
+	}
+	if tombstone != nil {
+		logger.Error("addr was closed in: ", tombstone.TxID)
+		return shim.Error("addr was closed in: " + tombstone.TxID)
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Error("fail to read chaincode config")
+		return shim.Error("fail to read chaincode config")
+	}
+
+	// the key must be the one registered for the address
+	if config.IDChaincode != "" {
+		registeredKey, err := resolvePubKey(stub, config, hashPubkey, nil)
+		if err != nil {
+			logger.Error("fail to resolve public key: ", err.Error())
+			return shim.Error("fail to resolve public key: " + err.Error())
+		}
+		if string(registeredKey) != PubKey {
+			logger.Error("public key is not the registered key of the addr")
+			return shim.Error("public key is not the registered key of the addr")
+		}
+	}
+
 	//validate balance
-	cipherBalance, err := ccapi.ValidateInitBalance(balanceStr, PubKey)
+	cipherBalance, amount, err := ccapi.ValidateInitBalance(balanceStr, PubKey, hashPubkey, config.IssuerSigningKey)
 	if err != nil {
-		logger.Error("fail to Validate InitBalance ")
-		return shim.Error("fail toValidate InitBalance")
+		logger.Error("fail to Validate InitBalance: ", err.Error())
+		return shim.Error("fail toValidate InitBalance: " + err.Error())
+	}
+
+	// an approved opening amount is new supply
+	if amount.Sign() > 0 && config.AuditorPubKey != "" {
+		err = addTotalSupply(stub, config, amount)
+		if err != nil {
+			logger.Error("fail to update total supply: ", err.Error())
+			return shim.Error("fail to update total supply: " + err.Error())
+		}
 	}
 
 	logger.Debug("prepare init balance record:")
 	account := &CipherAccount{}
-	account.PublicKey = []byte(PubKey)
+	if config.IDChaincode == "" {
+		account.PublicKey = []byte(PubKey)
+	}
 	account.Balance = []byte(cipherBalance)
 
 	accountBytes, err := json.Marshal(account)
@@ -196,19 +477,52 @@ func (t *TransferChaincode) init(stub shim.ChaincodeStubInterface, args []string
 		return shim.Error("fail to store trans record")
 	}
 
+	err = putReceipt(stub, hashPubkey, &Receipt{Type: ReceiptOpen, Delta: account.Balance})
+	if err != nil {
+		logger.Error("fail to store receipt: ", err.Error())
+		return shim.Error("fail to store receipt: " + err.Error())
+	}
+
+	err = setEvent(stub, event.AccountOpened, &event.AccountEvent{
+		Version:      event.Version,
+		TxID:         stub.GetTxID(),
+		Addr:         hashPubkey,
+		CipherAmount: account.Balance,
+	})
+	if err != nil {
+		logger.Error("fail to set event: ", err.Error())
+		return shim.Error("fail to set event: " + err.Error())
+	}
+
 	return shim.Success([]byte("Success"))
 }
 
 /*
-query account's balance
+query account's balance. Without an asset ID it returns the whole account,
+with one the cipher balance of that asset.
+args: addr, optional asset ID
 */
 func (t *TransferChaincode) queryBalance(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	if len(args) != 1 {
+	if len(args) != 1 && len(args) != 2 {
 		logger.Error("Incorrect number of arguments. Expecting addr to query")
 		return shim.Error("Incorrect number of arguments. Expecting addr to query")
 	}
 
 	Addr := string(args[0])
+	if len(args) == 2 && args[1] != "" {
+		_, err := getAsset(stub, args[1])
+		if err != nil {
+			logger.Error(err.Error())
+			return shim.Error(err.Error())
+		}
+		account, err := getAccount(stub, Addr)
+		if err != nil {
+			logger.Error(err.Error())
+			return shim.Error(err.Error())
+		}
+		return shim.Success(account.balance(args[1]))
+	}
+
 	// Get the state from the ledger
 	balance, err := stub.GetState(Addr)
 	if err != nil {
@@ -248,6 +562,53 @@ func (t *TransferChaincode) homoAdd(stub shim.ChaincodeStubInterface, args []str
 	return shim.Success(homoaddRes)
 }
 
+// getAccount reads and unmarshals the account stored at addr.
+func getAccount(stub shim.ChaincodeStubInterface, addr string) (*CipherAccount, error) {
+	accountBytes, err := stub.GetState(addr)
+	if err != nil {
+		return nil, errors.New("Failed to get state")
+	}
+	if accountBytes == nil {
+		return nil, errors.New("Entity not found")
+	}
+
+	account := &CipherAccount{}
+	err = json.Unmarshal(accountBytes, account)
+	if err != nil {
+		return nil, errors.New("fail to unmarshal user's trans record")
+	}
+	return account, nil
+}
+
+// putAccount marshals and stores account at addr.
+func putAccount(stub shim.ChaincodeStubInterface, addr string, account *CipherAccount) error {
+	accountBytes, err := json.Marshal(account)
+	if err != nil {
+		return errors.New("Marshal Error")
+	}
+	return stub.PutState(addr, accountBytes)
+}
+
+// setEvent marshals and sets the chaincode event of the transaction. Fabric
+// keeps a single event per transaction, so it is called at most once.
+func setEvent(stub shim.ChaincodeStubInterface, name string, payload interface{}) error {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return stub.SetEvent(name, payloadBytes)
+}
+
+// encryptOnChain encrypts a public amount with a nonce derived from the
+// transaction ID and label, so every endorsing peer writes the same cipher
+// text. Each label must be used at most once per transaction and key.
+// Anybody can derive the nonce, so added to a balance with a known opening,
+// such as ZeroCipher, it leaves the opening of the result public too. The
+// balance stays the owner's since every debit needs the owner's signature.
+func encryptOnChain(stub shim.ChaincodeStubInterface, pubKey []byte, amount *big.Int, label string) ([]byte, error) {
+	seed := []byte(stub.GetTxID() + "/" + label)
+	return gohe.EncryptDeterministic(pubKey, amount.Bytes(), seed)
+}
 
 func (t *TransferChaincode) calcAddr(cont string) (string, error) {
 
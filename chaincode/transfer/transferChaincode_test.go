@@ -11,6 +11,17 @@ import (
 	"chaoshen.com/gopaillier/api/core"
 	"crypto/rand"
 	"chaoshen.com/gopaillier/api/cliapi"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/pem"
+	"encoding/asn1"
+	"strconv"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"chaoshen.com/gopaillier/api/event"
+	"crypto/sha256"
+	"time"
+	"strings"
 )
 
 func init(){
@@ -80,8 +91,159 @@ func checkQuery(t *testing.T, stub *shim.MockStub, name string, value string) {
 	}
 }
 
+func checkInvokeFail(t *testing.T, stub *shim.MockStub, args [][]byte) {
+	res := stub.MockInvoke(strconv.Itoa(lastTxID+1), args)
+	if res.Status == shim.OK {
+		fmt.Println("Invoke", string(args[0]), "should fail")
+		t.FailNow()
+	} else {
+		fmt.Println(string(args[0]), "failed as expected: ", res.Message)
+	}
+}
+
+// signTx signs a tx info for the next checkInvoke, or for a checkInvokeFail
+// before it.
+func signTx(t *testing.T, txInfo []byte, privKey, addrA string, addrsB ...string) []byte {
+	signed, err := cliapi.SignTxInfo(txInfo, strconv.Itoa(lastTxID+1), privKey, addrA, addrsB...)
+	if err != nil {
+		t.Fatal("fail to sign tx info: ", err.Error())
+	}
+	return signed
+}
+
+// genIssuerKey returns the PEM public and private ECDSA key of the issuer.
+func genIssuerKey(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("fail to generate issuer key")
+	}
+	pubDer, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	privDer, _ := x509.MarshalECPrivateKey(key)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDer})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: privDer}))
+}
+
+// initAccount opens the account of pubKey with an amount approved by the issuer.
+func initAccount(t *testing.T, stub *shim.MockStub, amount, pubKey, issuerPrivKey string) {
+	addr, _ := getHash(pubKey)
+	sig, err := cliapi.SignInitBalance(amount, addr, issuerPrivKey)
+	if err != nil {
+		t.Fatal("fail to sign initbalance info")
+	}
+	initBalanceInfo, err := cliapi.InitBalance(amount, pubKey, sig)
+	if err != nil {
+		t.Fatal("fail to generate initbalance info")
+	}
+	checkInvoke(t, stub, [][]byte{[]byte("init"), []byte(pubKey), initBalanceInfo})
+}
+
+// newChaincode starts a TransferChaincode with config and a fresh issuer
+// signing key, and returns the issuer's private key for initAccount.
+func newChaincode(t *testing.T, config *ChaincodeConfig) (*shim.MockStub, string) {
+	stub := shim.NewMockStub("TransferChaincode", new(TransferChaincode))
+	issuerPub, issuerPriv := genIssuerKey(t)
+	config.IssuerSigningKey = issuerPub
+	configBytes, _ := json.Marshal(config)
+	checkInit(t, stub, [][]byte{[]byte("init"), configBytes})
+	return stub, issuerPriv
+}
+
+// genKey returns a fresh PEM public and private Paillier key.
+func genKey(t *testing.T) (string, string) {
+	key, err := gohe.GenerateKey(rand.Reader, gohe.MinKeyBits)
+	if err != nil {
+		t.Fatal("fail to generate key")
+	}
+	return string(gohe.GenPemPublicKey(&key.PublicKey)), string(gohe.GenPemPrivateKey(key))
+}
+
+// newAccounts generates the keys of n accounts and opens the first
+// len(amounts) of them with the amounts, approved by the issuer.
+func newAccounts(t *testing.T, stub *shim.MockStub, n int, issuerPrivKey string, amounts ...string) (pubKeys, privKeys, addrs []string) {
+	for i := 0; i < n; i++ {
+		pubKey, privKey := genKey(t)
+		addr, _ := getHash(pubKey)
+		pubKeys = append(pubKeys, pubKey)
+		privKeys = append(privKeys, privKey)
+		addrs = append(addrs, addr)
+		if i < len(amounts) {
+			initAccount(t, stub, amounts[i], pubKey, issuerPrivKey)
+		}
+	}
+	return pubKeys, privKeys, addrs
+}
+
+// setClientIdentity makes the chaincode see mspID and id as the submitting
+// client until the end of the test.
+func setClientIdentity(t *testing.T, mspID, id string) {
+	saved := clientIdentity
+	clientIdentity = func(stub shim.ChaincodeStubInterface) (string, string, error) {
+		return mspID, id, nil
+	}
+	t.Cleanup(func() { clientIdentity = saved })
+}
+
+// expireHold moves the deadline of a hold into the past, as if its time to
+// live had passed.
+func expireHold(t *testing.T, stub *shim.MockStub, kind, id string) {
+	key, _ := stub.CreateCompositeKey(kind, []string{id})
+	hold := &Hold{}
+	err := json.Unmarshal(stub.State[key], hold)
+	if err != nil {
+		t.Fatal("no ", kind, " ", id)
+	}
+	hold.Deadline = time.Now().Unix() - 1
+	stub.State[key], _ = json.Marshal(hold)
+}
+
+// checkReceipt checks the amount of the history receipt of addr in txID.
+func checkReceipt(t *testing.T, stub *shim.MockStub, addr string, txID string, plaintext int64, privkey string) {
+	key, _ := stub.CreateCompositeKey(historyObjectType, []string{addr, txID})
+	receiptBytes := stub.State[key]
+	if receiptBytes == nil {
+		t.Fatal("no receipt for ", addr, " in tx ", txID)
+	}
+	receipt := &Receipt{}
+	err := json.Unmarshal(receiptBytes, receipt)
+	if err != nil {
+		t.Fatal("fail to unmarshal receipt")
+	}
+	plainBytes, err := gohe.Decrypt([]byte(privkey), receipt.Delta)
+	if err != nil || new(big.Int).SetBytes(plainBytes).Int64() != plaintext {
+		t.Fatal("unexpected receipt amount for ", addr)
+	}
+}
+
+// checkTransferEvent checks the last event of stub is a transfer from -> to.
+func checkTransferEvent(t *testing.T, stub *shim.MockStub, from, to string, plaintext int64, privkey string) {
+	var ev *pb.ChaincodeEvent
+	for len(stub.ChaincodeEventsChannel) > 0 {
+		ev = <-stub.ChaincodeEventsChannel
+	}
+	if ev == nil {
+		t.Fatal("no chaincode event")
+	}
+	parsed, err := event.Parse(ev.EventName, ev.Payload)
+	if err != nil {
+		t.Fatal("fail to parse event: ", err)
+	}
+	transfer, ok := parsed.(*event.TransferEvent)
+	if !ok || transfer.From != from || transfer.To != to {
+		t.Fatal("unexpected event ", ev.EventName)
+	}
+	plainBytes, err := gohe.Decrypt([]byte(privkey), transfer.CipherForRecipient)
+	if err != nil || new(big.Int).SetBytes(plainBytes).Int64() != plaintext {
+		t.Fatal("unexpected event amount")
+	}
+}
+
+// lastTxID is the transaction ID of the last checkInvoke call, each call
+// gets a fresh one like on a real channel.
+var lastTxID = 0
+
 func checkInvoke(t *testing.T, stub *shim.MockStub, args [][]byte) {
-	res := stub.MockInvoke("1", args)
+	lastTxID++
+	res := stub.MockInvoke(strconv.Itoa(lastTxID), args)
 	if res.Status != shim.OK {
 		fmt.Println("Invoke", args, "failed", string(res.Message))
 		t.FailNow()
@@ -95,7 +257,7 @@ func TestHeDemoChaincode_register(t *testing.T) {
 	scc := new(TransferChaincode)
 	stub := shim.NewMockStub("TransferChaincode", scc)
 
-	privKeyA,err :=  gohe.GenerateKey(rand.Reader,128)
+	privKeyA,err :=  gohe.GenerateKey(rand.Reader, gohe.MinKeyBits)
 	if err != nil {
 		t.Fatalf("fail to generate key for sender")
 		t.FailNow()
@@ -104,7 +266,7 @@ func TestHeDemoChaincode_register(t *testing.T) {
 	privKeyStrA:=string(gohe.GenPemPrivateKey(privKeyA))
 	hashAddrA,_:= getHash(pubKeyStrA)
 
-	privKeyB,err :=  gohe.GenerateKey(rand.Reader,128)
+	privKeyB,err :=  gohe.GenerateKey(rand.Reader, gohe.MinKeyBits)
 	if err != nil {
 		t.Fatalf("fail to generate key for sender")
 		t.FailNow()
@@ -114,19 +276,12 @@ func TestHeDemoChaincode_register(t *testing.T) {
 
 	hashAddrB,_:= getHash(pubKeyStrB)
 
+	issuerPub, issuerPriv := genIssuerKey(t)
+	config, _ := json.Marshal(&ChaincodeConfig{IssuerSigningKey: issuerPub})
+	checkInit(t, stub, [][]byte{[]byte("init"), config})
 
-	initBalanceInfoA, err := cliapi.InitBalance("100", pubKeyStrA)
-	if err != nil {
-		t.Fatal("fail to generate initbalance info")
-	}
-
-	initBalanceInfoB, err :=cliapi.InitBalance("200", pubKeyStrB)
-	if err != nil {
-		t.Fatal("fail to generate initbalance info")
-	}
-
-	checkInvoke(t, stub, [][]byte{[]byte("init"), []byte(pubKeyStrA), []byte(initBalanceInfoA)})
-	checkInvoke(t, stub, [][]byte{[]byte("init"), []byte(pubKeyStrB), []byte(initBalanceInfoB)})
+	initAccount(t, stub, "100", pubKeyStrA, issuerPriv)
+	initAccount(t, stub, "200", pubKeyStrB, issuerPriv)
 	checkState(t, stub, hashAddrA, 100,privKeyStrA)
 	checkState(t, stub, hashAddrB, 200,privKeyStrB)
 
@@ -140,12 +295,12 @@ func TestHeDemoChaincode_register(t *testing.T) {
 	}
 	cipherA := accountAStruct.Balance
 	//prepare a->b 10
-	txInfo, err:= cliapi.PrepareTxInfo(string(cipherA),"10",pubKeyStrA,pubKeyStrB,string(gohe.GenPemPrivateKey(privKeyA)))
+	txInfo, err:= cliapi.PrepareTxInfo(string(cipherA),"10",pubKeyStrA,pubKeyStrB,string(gohe.GenPemPrivateKey(privKeyA)),"","",nil)
 	if err !=nil {
 		t.Fatal("fail to prepare tx info: ", err.Error())
 	}
 	//send transaction
-	checkInvoke(t, stub, [][]byte{[]byte("Transfer"), []byte(hashAddrA), []byte(hashAddrB),[]byte(txInfo)})
+	checkInvoke(t, stub, [][]byte{[]byte("Transfer"), []byte(hashAddrA), []byte(hashAddrB),signTx(t, txInfo, privKeyStrA, hashAddrA, hashAddrB)})
 	//check balance
 	checkState(t, stub, hashAddrA, 90,privKeyStrA)
 	checkState(t, stub, hashAddrB, 210,privKeyStrB)
@@ -159,12 +314,12 @@ func TestHeDemoChaincode_register(t *testing.T) {
 	}
 	cipherA = accountAStruct.Balance
 	//prepare a->b 10
-	txInfo, err = cliapi.PrepareTxInfo(string(cipherA),"10",pubKeyStrA,pubKeyStrB,string(gohe.GenPemPrivateKey(privKeyA)))
+	txInfo, err = cliapi.PrepareTxInfo(string(cipherA),"10",pubKeyStrA,pubKeyStrB,string(gohe.GenPemPrivateKey(privKeyA)),"","",nil)
 	if err !=nil {
 		t.Fatal("fail to prepare tx info")
 	}
 	//send transaction
-	checkInvoke(t, stub, [][]byte{[]byte("Transfer"), []byte(hashAddrA), []byte(hashAddrB),[]byte(txInfo)})
+	checkInvoke(t, stub, [][]byte{[]byte("Transfer"), []byte(hashAddrA), []byte(hashAddrB),signTx(t, txInfo, privKeyStrA, hashAddrA, hashAddrB)})
 	//check balance
 	checkState(t, stub, hashAddrA, 80,privKeyStrA)
 	checkState(t, stub, hashAddrB, 220,privKeyStrB)
@@ -178,16 +333,24 @@ func TestHeDemoChaincode_register(t *testing.T) {
 	}
 	cipherA = accountAStruct.Balance
 	//prepare b->a 50
-	txInfo, err = cliapi.PrepareTxInfo(string(cipherA),"50",pubKeyStrB,pubKeyStrA,string(gohe.GenPemPrivateKey(privKeyB)))
+	txInfo, err = cliapi.PrepareTxInfo(string(cipherA),"50",pubKeyStrB,pubKeyStrA,string(gohe.GenPemPrivateKey(privKeyB)),"","",nil)
 	if err !=nil {
 		t.Fatal("fail to prepare tx info")
 	}
 	//send transaction
-	checkInvoke(t, stub, [][]byte{[]byte("Transfer"), []byte(hashAddrB), []byte(hashAddrA),[]byte(txInfo)})
+	//an unsigned or misdirected transfer is rejected
+	checkInvokeFail(t, stub, [][]byte{[]byte("Transfer"), []byte(hashAddrB), []byte(hashAddrA),[]byte(txInfo)})
+	checkInvokeFail(t, stub, [][]byte{[]byte("Transfer"), []byte(hashAddrB), []byte(hashAddrA),signTx(t, txInfo, privKeyStrB, hashAddrB, hashAddrB)})
+	checkInvoke(t, stub, [][]byte{[]byte("Transfer"), []byte(hashAddrB), []byte(hashAddrA),signTx(t, txInfo, privKeyStrB, hashAddrB, hashAddrA)})
 	//check balance
 	checkState(t, stub, hashAddrA, 130,privKeyStrA)
 	checkState(t, stub, hashAddrB, 170,privKeyStrB)
 
+	checkReceipt(t, stub, hashAddrA, strconv.Itoa(lastTxID), 50, privKeyStrA)
+	checkReceipt(t, stub, hashAddrB, strconv.Itoa(lastTxID), 50, privKeyStrB)
+
+	checkTransferEvent(t, stub, hashAddrB, hashAddrA, 50, privKeyStrA)
+
 
 }
 
@@ -197,7 +360,7 @@ func TestHeDemoChaincode_InitBalance(t *testing.T) {
 
 	//checkInit(t, stub, [][]byte{[]byte("init"), []byte("A"), []byte("123"), []byte("B"), []byte("234")})
 
-	privKeyA,err :=  gohe.GenerateKey(rand.Reader,128)
+	privKeyA,err :=  gohe.GenerateKey(rand.Reader, gohe.MinKeyBits)
 	if err != nil {
 		t.Fatalf("fail to generate key for sender")
 		t.FailNow()
@@ -207,14 +370,33 @@ func TestHeDemoChaincode_InitBalance(t *testing.T) {
 	fmt.Println(privKeyStrA)
 	hashAddrA,_:= getHash(pubKeyStrA)
 
-	initBalanceInfoA, err := cliapi.InitBalance("100", pubKeyStrA)
+	issuerPub, issuerPriv := genIssuerKey(t)
+	config, _ := json.Marshal(&ChaincodeConfig{IssuerSigningKey: issuerPub})
+	checkInit(t, stub, [][]byte{[]byte("init"), config})
+
+	// a raw cipher text, an unsigned amount and a forged signature are rejected
+	rawCipher, _ := cliapi.EncryptAmount("100", pubKeyStrA)
+	checkInvokeFail(t, stub, [][]byte{[]byte("init"), []byte(pubKeyStrA), rawCipher})
+	unsigned, _ := cliapi.InitBalance("100", pubKeyStrA, nil)
+	checkInvokeFail(t, stub, [][]byte{[]byte("init"), []byte(pubKeyStrA), unsigned})
+	_, otherPriv := genIssuerKey(t)
+	forgedSig, _ := cliapi.SignInitBalance("100", hashAddrA, otherPriv)
+	forged, _ := cliapi.InitBalance("100", pubKeyStrA, forgedSig)
+	checkInvokeFail(t, stub, [][]byte{[]byte("init"), []byte(pubKeyStrA), forged})
 
+	initAccount(t, stub, "100", pubKeyStrA, issuerPriv)
+	checkState(t, stub, hashAddrA, 100,privKeyStrA)
+
+	// a zero opening needs no issuer
+	privKeyB, _ := gohe.GenerateKey(rand.Reader, gohe.MinKeyBits)
+	pubKeyStrB := string(gohe.GenPemPublicKey(&privKeyB.PublicKey))
+	hashAddrB, _ := getHash(pubKeyStrB)
+	initBalanceInfoB, err := cliapi.InitBalance("0", pubKeyStrB, nil)
 	if err != nil {
 		t.Fatal("fail to generate initbalance info")
 	}
-
-	checkInvoke(t, stub, [][]byte{[]byte("init"), []byte(pubKeyStrA), []byte(initBalanceInfoA)})
-	checkState(t, stub, hashAddrA, 100,privKeyStrA)
+	checkInvoke(t, stub, [][]byte{[]byte("init"), []byte(pubKeyStrB), initBalanceInfoB})
+	checkState(t, stub, hashAddrB, 0, string(gohe.GenPemPrivateKey(privKeyB)))
 
 	//plainBytes,err:=gohe.Decrypt([]byte(privkey),[]byte(accountStruct.Balance))
 
@@ -224,3 +406,1448 @@ func TestHeDemoChaincode_InitBalance(t *testing.T) {
 }
 
 
+
+func TestHeDemoChaincode_MintBurn(t *testing.T) {
+	scc := new(TransferChaincode)
+	stub := shim.NewMockStub("TransferChaincode", scc)
+
+	setClientIdentity(t, "IssuerMSP", "issuer")
+
+	auditorKey, err := gohe.GenerateKey(rand.Reader, gohe.MinKeyBits)
+	if err != nil {
+		t.Fatal("fail to generate key for auditor")
+	}
+	auditorPubStr := string(gohe.GenPemPublicKey(&auditorKey.PublicKey))
+	auditorPrivStr := string(gohe.GenPemPrivateKey(auditorKey))
+
+	config, _ := json.Marshal(&ChaincodeConfig{IssuerMSPID: "IssuerMSP", AuditorPubKey: auditorPubStr})
+	checkInit(t, stub, [][]byte{[]byte("init"), config})
+
+	privKeyA, err := gohe.GenerateKey(rand.Reader, gohe.MinKeyBits)
+	if err != nil {
+		t.Fatal("fail to generate key for sender")
+	}
+	pubKeyStrA := string(gohe.GenPemPublicKey(&privKeyA.PublicKey))
+	privKeyStrA := string(gohe.GenPemPrivateKey(privKeyA))
+	hashAddrA, _ := getHash(pubKeyStrA)
+
+	initBalanceInfoA, err := cliapi.InitBalance("0", pubKeyStrA, nil)
+	if err != nil {
+		t.Fatal("fail to generate initbalance info")
+	}
+	checkInvoke(t, stub, [][]byte{[]byte("init"), []byte(pubKeyStrA), initBalanceInfoA})
+
+	checkInvoke(t, stub, [][]byte{[]byte("Mint"), []byte(hashAddrA), []byte("70")})
+	checkState(t, stub, hashAddrA, 70, privKeyStrA)
+
+	// the nonce of a mint follows from its txID, so whoever knows the
+	// opening of the prior balance knows that of the minted one, but only
+	// the owner's signature moves it
+	pubKeyStrB, privKeyStrB := genKey(t)
+	hashAddrB, _ := getHash(pubKeyStrB)
+	initBalanceInfoB, _ := cliapi.InitBalance("0", pubKeyStrB, nil)
+	checkInvoke(t, stub, [][]byte{[]byte("init"), []byte(pubKeyStrB), initBalanceInfoB})
+	accountA := &CipherAccount{}
+	json.Unmarshal(stub.State[hashAddrA], accountA)
+	txInfo, err := cliapi.PrepareTxInfo(string(accountA.Balance), "70", pubKeyStrA, pubKeyStrB, privKeyStrA, auditorPubStr, "", nil)
+	if err != nil {
+		t.Fatal("fail to prepare tx info: ", err.Error())
+	}
+	checkInvokeFail(t, stub, [][]byte{[]byte("Transfer"), []byte(hashAddrA), []byte(hashAddrB), signTx(t, txInfo, privKeyStrB, hashAddrA, hashAddrB)})
+	checkState(t, stub, hashAddrA, 70, privKeyStrA)
+
+	// a burn needs the owner's proof that the balance stays positive
+	checkInvokeFail(t, stub, [][]byte{[]byte("Burn"), []byte(hashAddrA), []byte("20")})
+	_, err = cliapi.PrepareBurn(hashAddrA, "", string(accountA.Balance), "71", privKeyStrA)
+	if err == nil {
+		t.Fatal("burning more than the balance should fail")
+	}
+	burnProof, err := cliapi.PrepareBurn(hashAddrA, "", string(accountA.Balance), "20", privKeyStrA)
+	if err != nil {
+		t.Fatal("fail to prepare burn: ", err.Error())
+	}
+	checkInvokeFail(t, stub, [][]byte{[]byte("Burn"), []byte(hashAddrA), []byte("30"), burnProof})
+	checkInvoke(t, stub, [][]byte{[]byte("Burn"), []byte(hashAddrA), []byte("20"), burnProof})
+	checkState(t, stub, hashAddrA, 50, privKeyStrA)
+	// the proof is bound to the balance it was made for
+	checkInvokeFail(t, stub, [][]byte{[]byte("Burn"), []byte(hashAddrA), []byte("20"), burnProof})
+
+	checkInvoke(t, stub, [][]byte{[]byte("Mint"), []byte(hashAddrA), []byte("15")})
+	checkState(t, stub, hashAddrA, 65, privKeyStrA)
+	json.Unmarshal(stub.State[hashAddrA], accountA)
+	burnProof, _ = cliapi.PrepareBurn(hashAddrA, "", string(accountA.Balance), "15", privKeyStrA)
+	checkInvoke(t, stub, [][]byte{[]byte("Burn"), []byte(hashAddrA), []byte("15"), burnProof})
+	checkState(t, stub, hashAddrA, 50, privKeyStrA)
+
+	res := stub.MockInvoke("1", [][]byte{[]byte("QueryTotalSupply")})
+	if res.Status != shim.OK {
+		t.Fatal("fail to query total supply: ", res.Message)
+	}
+	supply, err := gohe.Decrypt([]byte(auditorPrivStr), res.Payload)
+	if err != nil || new(big.Int).SetBytes(supply).Int64() != 50 {
+		t.Fatal("unexpected total supply")
+	}
+
+	// transfers carry the amount under the auditor key
+	json.Unmarshal(stub.State[hashAddrA], accountA)
+	txInfo, _ = cliapi.PrepareTxInfo(string(accountA.Balance), "20", pubKeyStrA, pubKeyStrB, privKeyStrA, "", "", nil)
+	checkInvokeFail(t, stub, [][]byte{[]byte("Transfer"), []byte(hashAddrA), []byte(hashAddrB), signTx(t, txInfo, privKeyStrA, hashAddrA, hashAddrB)})
+	txInfo, err = cliapi.PrepareTxInfo(string(accountA.Balance), "20", pubKeyStrA, pubKeyStrB, privKeyStrA, auditorPubStr, "", nil)
+	if err != nil {
+		t.Fatal("fail to prepare tx info: ", err.Error())
+	}
+	checkInvoke(t, stub, [][]byte{[]byte("Transfer"), []byte(hashAddrA), []byte(hashAddrB), signTx(t, txInfo, privKeyStrA, hashAddrA, hashAddrB)})
+	checkState(t, stub, hashAddrA, 30, privKeyStrA)
+
+	receipt := &Receipt{}
+	key, _ := stub.CreateCompositeKey(historyObjectType, []string{hashAddrA, strconv.Itoa(lastTxID)})
+	json.Unmarshal(stub.State[key], receipt)
+	audited, err := gohe.Decrypt([]byte(auditorPrivStr), receipt.AuditorDelta)
+	if err != nil || new(big.Int).SetBytes(audited).Int64() != 20 {
+		t.Fatal("auditor cannot read the transfer amount")
+	}
+
+	// anybody else is refused
+	setClientIdentity(t, "Org1MSP", "user1")
+	res = stub.MockInvoke("1", [][]byte{[]byte("Mint"), []byte(hashAddrA), []byte("70")})
+	if res.Status == shim.OK {
+		t.Fatal("mint by a non issuer should fail")
+	}
+}
+
+func TestHeDemoChaincode_History(t *testing.T) {
+	scc := new(TransferChaincode)
+	stub := shim.NewMockStub("TransferChaincode", scc)
+
+	issuerPub, issuerPriv := genIssuerKey(t)
+	config, _ := json.Marshal(&ChaincodeConfig{IssuerSigningKey: issuerPub})
+	checkInit(t, stub, [][]byte{[]byte("init"), config})
+
+	privKeyA, _ := gohe.GenerateKey(rand.Reader, gohe.MinKeyBits)
+	pubKeyStrA := string(gohe.GenPemPublicKey(&privKeyA.PublicKey))
+	privKeyStrA := string(gohe.GenPemPrivateKey(privKeyA))
+	hashAddrA, _ := getHash(pubKeyStrA)
+	privKeyB, _ := gohe.GenerateKey(rand.Reader, gohe.MinKeyBits)
+	pubKeyStrB := string(gohe.GenPemPublicKey(&privKeyB.PublicKey))
+	privKeyStrB := string(gohe.GenPemPrivateKey(privKeyB))
+	hashAddrB, _ := getHash(pubKeyStrB)
+	initAccount(t, stub, "100", pubKeyStrA, issuerPriv)
+	initAccount(t, stub, "0", pubKeyStrB, issuerPriv)
+
+	transfer := func(from, to, pubFrom, pubTo, privFrom, amount string) {
+		account := &CipherAccount{}
+		json.Unmarshal(stub.State[from], account)
+		txInfo, err := cliapi.PrepareTxInfo(string(account.Balance), amount, pubFrom, pubTo, privFrom, "", "", nil)
+		if err != nil {
+			t.Fatal("fail to prepare tx info: ", err.Error())
+		}
+		checkInvoke(t, stub, [][]byte{[]byte("Transfer"), []byte(from), []byte(to), signTx(t, txInfo, privFrom, from, to)})
+	}
+	for i := 0; i < 3; i++ {
+		transfer(hashAddrA, hashAddrB, pubKeyStrA, pubKeyStrB, privKeyStrA, "10")
+	}
+	transfer(hashAddrB, hashAddrA, pubKeyStrB, pubKeyStrA, privKeyStrB, "5")
+
+	// the receipts of A come in pages of two, which sum up to the balance
+	types := map[string]int{}
+	sum := new(big.Int)
+	pages := 0
+	bookmark := ""
+	for {
+		res := stub.MockInvoke("1", [][]byte{[]byte("QueryHistory"), []byte(hashAddrA), []byte("2"), []byte(bookmark)})
+		if res.Status != shim.OK {
+			t.Fatal("fail to query history: ", res.Message)
+		}
+		entries, next, err := cliapi.DecryptHistory(res.Payload, privKeyStrA)
+		if err != nil {
+			t.Fatal("fail to decrypt history: ", err)
+		}
+		pages++
+		if len(entries) > 2 || (next != "" && len(entries) != 2) {
+			t.Fatal("unexpected page size ", len(entries))
+		}
+		for _, entry := range entries {
+			types[entry.Type]++
+			sum.Add(sum, entry.Amount)
+			if entry.Type != ReceiptOpen && entry.Counterparty != hashAddrB {
+				t.Fatal("unexpected counterparty ", entry.Counterparty)
+			}
+		}
+		if next == "" {
+			break
+		}
+		bookmark = next
+	}
+	if pages != 3 || types[ReceiptOpen] != 1 || types[ReceiptTransferOut] != 3 || types[ReceiptTransferIn] != 1 {
+		t.Fatal("unexpected receipts ", pages, types)
+	}
+	if sum.Int64() != 75 {
+		t.Fatal("receipts sum up to ", sum)
+	}
+	checkState(t, stub, hashAddrA, 75, privKeyStrA)
+
+	// an unknown address has an empty history
+	res := stub.MockInvoke("1", [][]byte{[]byte("QueryHistory"), []byte("unknown"), []byte("2"), []byte("")})
+	entries, next, err := cliapi.DecryptHistory(res.Payload, privKeyStrA)
+	if res.Status != shim.OK || err != nil || len(entries) != 0 || next != "" {
+		t.Fatal("unexpected history of an unknown address")
+	}
+	checkInvokeFail(t, stub, [][]byte{[]byte("QueryHistory"), []byte(hashAddrA), []byte("0"), []byte("")})
+}
+
+func TestHeDemoChaincode_TransferMany(t *testing.T) {
+	stub, issuerPriv := newChaincode(t, &ChaincodeConfig{})
+
+	pubKeys, privKeys, addrs := newAccounts(t, stub, 3, issuerPriv, "100", "0", "5")
+
+	accountA := &CipherAccount{}
+	json.Unmarshal(stub.State[addrs[0]], accountA)
+	if _, err := cliapi.PrepareTransferMany(string(accountA.Balance), []string{"60", "50"}, pubKeys[1:], pubKeys[0], privKeys[0], "", nil); err == nil {
+		t.Fatal("overdraft should be refused")
+	}
+	txInfo, err := cliapi.PrepareTransferMany(string(accountA.Balance), []string{"30", "20"}, pubKeys[1:], pubKeys[0], privKeys[0], "", nil)
+	if err != nil {
+		t.Fatal("fail to prepare tx info: ", err.Error())
+	}
+
+	// recipients must be given in the order of the legs
+	checkInvokeFail(t, stub, [][]byte{[]byte("TransferMany"), []byte(addrs[0]), signTx(t, txInfo, privKeys[0], addrs[0], addrs[2], addrs[1]), []byte(addrs[2]), []byte(addrs[1])})
+	checkInvoke(t, stub, [][]byte{[]byte("TransferMany"), []byte(addrs[0]), signTx(t, txInfo, privKeys[0], addrs[0], addrs[1], addrs[2]), []byte(addrs[1]), []byte(addrs[2])})
+	checkState(t, stub, addrs[0], 50, privKeys[0])
+	checkState(t, stub, addrs[1], 30, privKeys[1])
+	checkState(t, stub, addrs[2], 25, privKeys[2])
+	checkReceipt(t, stub, addrs[0], strconv.Itoa(lastTxID), 50, privKeys[0])
+	checkReceipt(t, stub, addrs[2], strconv.Itoa(lastTxID), 20, privKeys[2])
+
+	// the balance has changed, so the same tx info cannot be replayed
+	checkInvokeFail(t, stub, [][]byte{[]byte("TransferMany"), []byte(addrs[0]), signTx(t, txInfo, privKeys[0], addrs[0], addrs[1], addrs[2]), []byte(addrs[1]), []byte(addrs[2])})
+}
+
+func TestHeDemoChaincode_Fees(t *testing.T) {
+	setClientIdentity(t, "IssuerMSP", "issuer")
+
+	auditorPubStr, _ := genKey(t)
+	stub, issuerPriv := newChaincode(t, &ChaincodeConfig{IssuerMSPID: "IssuerMSP", AuditorPubKey: auditorPubStr})
+
+	pubKeys, privKeys, addrs := newAccounts(t, stub, 3, issuerPriv, "100", "0", "0")
+	collector := addrs[2]
+
+	transfer := func(from, to int, amount string, fee *cliapi.Fee) {
+		account := &CipherAccount{}
+		json.Unmarshal(stub.State[addrs[from]], account)
+		txInfo, err := cliapi.PrepareTxInfo(string(account.Balance), amount, pubKeys[from], pubKeys[to], privKeys[from], auditorPubStr, "", fee)
+		if err != nil {
+			t.Fatal("fail to prepare tx info: ", err.Error())
+		}
+		checkInvoke(t, stub, [][]byte{[]byte("Transfer"), []byte(addrs[from]), []byte(addrs[to]), signTx(t, txInfo, privKeys[from], addrs[from], addrs[to])})
+	}
+
+	// flat fee
+	schedule, _ := json.Marshal(&FeeSchedule{Flat: "2", Collector: collector})
+	checkInvoke(t, stub, [][]byte{[]byte("SetFeeSchedule"), schedule})
+	account := &CipherAccount{}
+	json.Unmarshal(stub.State[addrs[0]], account)
+	txInfo, _ := cliapi.PrepareTxInfo(string(account.Balance), "10", pubKeys[0], pubKeys[1], privKeys[0], auditorPubStr, "", nil)
+	checkInvokeFail(t, stub, [][]byte{[]byte("Transfer"), []byte(addrs[0]), []byte(addrs[1]), signTx(t, txInfo, privKeys[0], addrs[0], addrs[1])})
+	transfer(0, 1, "10", &cliapi.Fee{Flat: "2", PubKeyCollector: pubKeys[2]})
+	checkState(t, stub, addrs[0], 88, privKeys[0])
+	checkState(t, stub, addrs[1], 10, privKeys[1])
+	checkState(t, stub, collector, 2, privKeys[2])
+	checkReceipt(t, stub, addrs[0], strconv.Itoa(lastTxID), 12, privKeys[0])
+	checkReceipt(t, stub, collector, strconv.Itoa(lastTxID), 2, privKeys[2])
+
+	// proportional fee of 1.5%, rounded up
+	schedule, _ = json.Marshal(&FeeSchedule{BasisPoints: 150, Collector: collector})
+	checkInvoke(t, stub, [][]byte{[]byte("SetFeeSchedule"), schedule})
+	fee := &cliapi.Fee{BasisPoints: 150, PubKeyCollector: pubKeys[2]}
+	transfer(0, 1, "20", fee)
+	checkState(t, stub, addrs[0], 67, privKeys[0])
+	checkState(t, stub, addrs[1], 30, privKeys[1])
+	checkState(t, stub, collector, 3, privKeys[2])
+
+	// the collector may be the recipient
+	transfer(1, 2, "10", fee)
+	checkState(t, stub, addrs[1], 19, privKeys[1])
+	checkState(t, stub, collector, 14, privKeys[2])
+	checkReceipt(t, stub, collector, strconv.Itoa(lastTxID), 11, privKeys[2])
+
+	// and pays no fee itself
+	transfer(2, 0, "4", nil)
+	checkState(t, stub, collector, 10, privKeys[2])
+	checkState(t, stub, addrs[0], 71, privKeys[0])
+
+	setClientIdentity(t, "Org1MSP", "user1")
+	checkInvokeFail(t, stub, [][]byte{[]byte("SetFeeSchedule"), []byte("{}")})
+}
+
+func TestHeDemoChaincode_Assets(t *testing.T) {
+	setClientIdentity(t, "IssuerMSP", "issuer")
+
+	auditorPubStr, auditorPrivStr := genKey(t)
+	stub, issuerPriv := newChaincode(t, &ChaincodeConfig{IssuerMSPID: "IssuerMSP", AuditorPubKey: auditorPubStr})
+
+	asset, _ := json.Marshal(&Asset{ID: "GOLD", IssuerMSPID: "GoldMSP", Decimals: 2})
+	checkInvoke(t, stub, [][]byte{[]byte("RegisterAsset"), asset})
+	checkInvokeFail(t, stub, [][]byte{[]byte("RegisterAsset"), asset})
+
+	pubKeys, privKeys, addrs := newAccounts(t, stub, 2, issuerPriv, "0", "0")
+
+	// only the asset issuer mints it
+	checkInvokeFail(t, stub, [][]byte{[]byte("MintAsset"), []byte("GOLD"), []byte(addrs[0]), []byte("50")})
+	setClientIdentity(t, "GoldMSP", "minter")
+	checkInvokeFail(t, stub, [][]byte{[]byte("Mint"), []byte(addrs[0]), []byte("50")})
+	checkInvoke(t, stub, [][]byte{[]byte("MintAsset"), []byte("GOLD"), []byte(addrs[0]), []byte("50")})
+	checkState(t, stub, addrs[0], 0, privKeys[0])
+
+	res := stub.MockInvoke("1", [][]byte{[]byte("QueryBalance"), []byte(addrs[0]), []byte("GOLD")})
+	if res.Status != shim.OK {
+		t.Fatal("fail to query asset balance: ", res.Message)
+	}
+	txInfo, err := cliapi.PrepareTxInfo(string(res.Payload), "20", pubKeys[0], pubKeys[1], privKeys[0], auditorPubStr, "GOLD", nil)
+	if err != nil {
+		t.Fatal("fail to prepare tx info: ", err.Error())
+	}
+	// the tx info is bound to its asset
+	checkInvokeFail(t, stub, [][]byte{[]byte("Transfer"), []byte(addrs[0]), []byte(addrs[1]), signTx(t, txInfo, privKeys[0], addrs[0], addrs[1])})
+	// the opening of a minted balance follows from the txID of the mint, but
+	// only the owner's key authorizes a debit
+	checkInvokeFail(t, stub, [][]byte{[]byte("Transfer"), []byte(addrs[0]), []byte(addrs[1]), txInfo, []byte("GOLD")})
+	checkInvokeFail(t, stub, [][]byte{[]byte("Transfer"), []byte(addrs[0]), []byte(addrs[1]), signTx(t, txInfo, privKeys[1], addrs[0], addrs[1]), []byte("GOLD")})
+	checkInvoke(t, stub, [][]byte{[]byte("Transfer"), []byte(addrs[0]), []byte(addrs[1]), signTx(t, txInfo, privKeys[0], addrs[0], addrs[1]), []byte("GOLD")})
+
+	for i, expected := range []int64{30, 20} {
+		res = stub.MockInvoke("1", [][]byte{[]byte("QueryBalance"), []byte(addrs[i]), []byte("GOLD")})
+		plainBytes, err := gohe.Decrypt([]byte(privKeys[i]), res.Payload)
+		if err != nil || new(big.Int).SetBytes(plainBytes).Int64() != expected {
+			t.Fatal("unexpected GOLD balance of account ", i)
+		}
+	}
+
+	res = stub.MockInvoke("1", [][]byte{[]byte("QueryAsset"), []byte("GOLD")})
+	gold := &Asset{}
+	json.Unmarshal(res.Payload, gold)
+	supply, err := gohe.Decrypt([]byte(auditorPrivStr), gold.Supply)
+	if err != nil || new(big.Int).SetBytes(supply).Int64() != 50 {
+		t.Fatal("unexpected GOLD supply")
+	}
+}
+
+func TestHeDemoChaincode_Escrow(t *testing.T) {
+	auditorPubStr, _ := genKey(t)
+	stub, issuerPriv := newChaincode(t, &ChaincodeConfig{IssuerMSPID: "IssuerMSP", AuditorPubKey: auditorPubStr})
+
+	pubKeys, privKeys, addrs := newAccounts(t, stub, 2, issuerPriv, "100", "0")
+
+	preimage := make([]byte, 32)
+	rand.Read(preimage)
+	hash := sha256.Sum256(preimage)
+	hashlock := []byte(hex.EncodeToString(hash[:]))
+
+	lockInfo := func(amount string) []byte {
+		account := &CipherAccount{}
+		json.Unmarshal(stub.State[addrs[0]], account)
+		txInfo, err := cliapi.PrepareHold(cliapi.HoldLock, string(account.Balance), amount, pubKeys[0], pubKeys[1], privKeys[0], auditorPubStr, "", nil)
+		if err != nil {
+			t.Fatal("fail to prepare hold: ", err.Error())
+		}
+		return signTx(t, txInfo, privKeys[0], addrs[0], addrs[1])
+	}
+
+	// a lock cannot be submitted as a transfer
+	txInfo := lockInfo("30")
+	checkInvokeFail(t, stub, [][]byte{[]byte("Transfer"), []byte(addrs[0]), []byte(addrs[1]), txInfo})
+	checkInvoke(t, stub, [][]byte{[]byte("Lock"), []byte(addrs[0]), []byte(addrs[1]), txInfo, hashlock, []byte("3600")})
+	lockID := []byte(strconv.Itoa(lastTxID))
+	checkState(t, stub, addrs[0], 70, privKeys[0])
+	checkState(t, stub, addrs[1], 0, privKeys[1])
+	checkReceipt(t, stub, addrs[0], string(lockID), 30, privKeys[0])
+
+	checkInvokeFail(t, stub, [][]byte{[]byte("Refund"), lockID})
+	checkInvokeFail(t, stub, [][]byte{[]byte("Claim"), lockID, []byte(hex.EncodeToString(preimage[1:]))})
+	checkInvoke(t, stub, [][]byte{[]byte("Claim"), lockID, []byte(hex.EncodeToString(preimage))})
+	checkState(t, stub, addrs[1], 30, privKeys[1])
+	checkReceipt(t, stub, addrs[1], strconv.Itoa(lastTxID), 30, privKeys[1])
+	var ev *pb.ChaincodeEvent
+	for len(stub.ChaincodeEventsChannel) > 0 {
+		ev = <-stub.ChaincodeEventsChannel
+	}
+	parsed, err := event.Parse(ev.EventName, ev.Payload)
+	if claimed, ok := parsed.(*event.HoldEvent); err != nil || !ok || claimed.Preimage != hex.EncodeToString(preimage) {
+		t.Fatal("unexpected claim event")
+	}
+	checkInvokeFail(t, stub, [][]byte{[]byte("Claim"), lockID, []byte(hex.EncodeToString(preimage))})
+
+	// after the deadline only the sender gets the amount back
+	checkInvoke(t, stub, [][]byte{[]byte("Lock"), []byte(addrs[0]), []byte(addrs[1]), lockInfo("20"), hashlock, []byte("1")})
+	lockID = []byte(strconv.Itoa(lastTxID))
+	checkState(t, stub, addrs[0], 50, privKeys[0])
+	res := stub.MockInvoke("1", [][]byte{[]byte("QueryLock"), lockID})
+	lock := &Hold{}
+	json.Unmarshal(res.Payload, lock)
+	time.Sleep(time.Until(time.Unix(lock.Deadline, 0)))
+	checkInvokeFail(t, stub, [][]byte{[]byte("Claim"), lockID, []byte(hex.EncodeToString(preimage))})
+	checkInvoke(t, stub, [][]byte{[]byte("Refund"), lockID})
+	checkState(t, stub, addrs[0], 70, privKeys[0])
+	checkState(t, stub, addrs[1], 30, privKeys[1])
+	checkReceipt(t, stub, addrs[0], strconv.Itoa(lastTxID), 20, privKeys[0])
+	checkInvokeFail(t, stub, [][]byte{[]byte("Refund"), lockID})
+}
+
+func TestHeDemoChaincode_Pending(t *testing.T) {
+	stub, issuerPriv := newChaincode(t, &ChaincodeConfig{PendingTTL: 3600})
+
+	pubKeys, privKeys, addrs := newAccounts(t, stub, 2, issuerPriv, "100", "0")
+
+	send := func(amount string) string {
+		account := &CipherAccount{}
+		json.Unmarshal(stub.State[addrs[0]], account)
+		txInfo, err := cliapi.PrepareHold(cliapi.HoldPending, string(account.Balance), amount, pubKeys[0], pubKeys[1], privKeys[0], "", "", nil)
+		if err != nil {
+			t.Fatal("fail to prepare hold: ", err.Error())
+		}
+		checkInvoke(t, stub, [][]byte{[]byte("TransferPending"), []byte(addrs[0]), []byte(addrs[1]), signTx(t, txInfo, privKeys[0], addrs[0], addrs[1])})
+		return strconv.Itoa(lastTxID)
+	}
+	sign := func(action, id string, privKey string) []byte {
+		sig, err := cliapi.SignPending(action, id, privKey)
+		if err != nil {
+			t.Fatal("fail to sign: ", err.Error())
+		}
+		return sig
+	}
+
+	// accepted by the receiver only
+	id := send("30")
+	checkState(t, stub, addrs[0], 70, privKeys[0])
+	checkState(t, stub, addrs[1], 0, privKeys[1])
+	checkInvokeFail(t, stub, [][]byte{[]byte("Accept"), []byte(id), sign("accept", id, privKeys[0])})
+	checkInvokeFail(t, stub, [][]byte{[]byte("Accept"), []byte(id), sign("reject", id, privKeys[1])})
+	checkInvoke(t, stub, [][]byte{[]byte("Accept"), []byte(id), sign("accept", id, privKeys[1])})
+	checkState(t, stub, addrs[1], 30, privKeys[1])
+	checkInvokeFail(t, stub, [][]byte{[]byte("Cancel"), []byte(id), sign("cancel", id, privKeys[0])})
+
+	// rejected and cancelled transfers go back to the sender
+	id = send("20")
+	checkState(t, stub, addrs[0], 50, privKeys[0])
+	checkInvoke(t, stub, [][]byte{[]byte("Reject"), []byte(id), sign("reject", id, privKeys[1])})
+	checkState(t, stub, addrs[0], 70, privKeys[0])
+	checkReceipt(t, stub, addrs[0], strconv.Itoa(lastTxID), 20, privKeys[0])
+	id = send("10")
+	checkInvokeFail(t, stub, [][]byte{[]byte("Cancel"), []byte(id), sign("cancel", id, privKeys[1])})
+	checkInvoke(t, stub, [][]byte{[]byte("Cancel"), []byte(id), sign("cancel", id, privKeys[0])})
+	checkState(t, stub, addrs[0], 70, privKeys[0])
+
+	// and so do expired ones
+	id = send("5")
+	checkInvokeFail(t, stub, [][]byte{[]byte("Expire"), []byte(id)})
+	expireHold(t, stub, cliapi.HoldPending, id)
+	checkInvokeFail(t, stub, [][]byte{[]byte("Accept"), []byte(id), sign("accept", id, privKeys[1])})
+	checkInvoke(t, stub, [][]byte{[]byte("Expire"), []byte(id)})
+	checkState(t, stub, addrs[0], 70, privKeys[0])
+	checkState(t, stub, addrs[1], 30, privKeys[1])
+}
+
+func TestHeDemoChaincode_Compliance(t *testing.T) {
+	setClientIdentity(t, "Org1MSP", "user1")
+
+	custodyPub, custodyPriv := genKey(t)
+	custodyAddr, _ := getHash(custodyPub)
+	stub, issuerPriv := newChaincode(t, &ChaincodeConfig{ComplianceMSPID: "RegulatorMSP", CustodyAddr: custodyAddr})
+
+	pubKeys, privKeys, addrs := newAccounts(t, stub, 2, issuerPriv, "100", "0")
+	initAccount(t, stub, "5", custodyPub, issuerPriv)
+
+	txInfo := func(from, to int, amount string) []byte {
+		account := &CipherAccount{}
+		json.Unmarshal(stub.State[addrs[from]], account)
+		txInfo, err := cliapi.PrepareTxInfo(string(account.Balance), amount, pubKeys[from], pubKeys[to], privKeys[from], "", "", nil)
+		if err != nil {
+			t.Fatal("fail to prepare tx info: ", err.Error())
+		}
+		return signTx(t, txInfo, privKeys[from], addrs[from], addrs[to])
+	}
+	checkFrozen := func(args [][]byte) {
+		res := stub.MockInvoke(strconv.Itoa(lastTxID+1), args)
+		if res.Status == shim.OK || !strings.HasPrefix(res.Message, errFrozen) {
+			t.Fatal("expected a frozen account error, got: ", res.Message)
+		}
+	}
+
+	checkInvokeFail(t, stub, [][]byte{[]byte("Freeze"), []byte(addrs[1]), []byte("investigation")})
+	setClientIdentity(t, "RegulatorMSP", "officer")
+	checkInvoke(t, stub, [][]byte{[]byte("Freeze"), []byte(addrs[1]), []byte("investigation")})
+	checkInvokeFail(t, stub, [][]byte{[]byte("Freeze"), []byte(addrs[1]), []byte("investigation")})
+
+	// frozen receivers and senders are refused
+	checkFrozen([][]byte{[]byte("Transfer"), []byte(addrs[0]), []byte(addrs[1]), txInfo(0, 1, "10")})
+	checkInvoke(t, stub, [][]byte{[]byte("Unfreeze"), []byte(addrs[1]), []byte("cleared")})
+	checkInvoke(t, stub, [][]byte{[]byte("Transfer"), []byte(addrs[0]), []byte(addrs[1]), txInfo(0, 1, "10")})
+	checkInvoke(t, stub, [][]byte{[]byte("Freeze"), []byte(addrs[1]), []byte("second investigation")})
+	checkFrozen([][]byte{[]byte("Transfer"), []byte(addrs[1]), []byte(addrs[0]), txInfo(1, 0, "5")})
+
+	// seizure moves the balance to the custody account
+	seizeInfo := func(addr, privKey string) []byte {
+		account := &CipherAccount{}
+		json.Unmarshal(stub.State[addr], account)
+		seizeInfo, err := cliapi.PrepareSeizure(addr, "", strconv.Itoa(lastTxID+1), string(account.Balance), privKey, custodyPub)
+		if err != nil {
+			t.Fatal("fail to prepare seizure: ", err.Error())
+		}
+		return seizeInfo
+	}
+	checkInvokeFail(t, stub, [][]byte{[]byte("Seize"), []byte(addrs[0]), []byte("not frozen"), seizeInfo(addrs[0], privKeys[0])})
+	forged, _ := cliapi.PrepareSeizure(addrs[1], "", strconv.Itoa(lastTxID+1), string(gohe.ZeroCipher()), privKeys[1], custodyPub)
+	checkInvokeFail(t, stub, [][]byte{[]byte("Seize"), []byte(addrs[1]), []byte("court order"), forged})
+	// the proof is bound to the transaction
+	account := &CipherAccount{}
+	json.Unmarshal(stub.State[addrs[1]], account)
+	replayed, _ := cliapi.PrepareSeizure(addrs[1], "", strconv.Itoa(lastTxID+2), string(account.Balance), privKeys[1], custodyPub)
+	checkInvokeFail(t, stub, [][]byte{[]byte("Seize"), []byte(addrs[1]), []byte("court order"), replayed})
+	checkInvoke(t, stub, [][]byte{[]byte("Seize"), []byte(addrs[1]), []byte("court order"), seizeInfo(addrs[1], privKeys[1])})
+	seizeTx := strconv.Itoa(lastTxID)
+	checkState(t, stub, addrs[1], 0, privKeys[1])
+	checkReceipt(t, stub, addrs[1], seizeTx, 10, privKeys[1])
+	checkState(t, stub, custodyAddr, 15, custodyPriv)
+	checkReceipt(t, stub, custodyAddr, seizeTx, 10, custodyPriv)
+	res := stub.MockInvoke("1", [][]byte{[]byte("QueryCustody"), []byte(addrs[1]), []byte(seizeTx)})
+	custody := &Custody{}
+	json.Unmarshal(res.Payload, custody)
+	plainBytes, err := gohe.Decrypt([]byte(custodyPriv), custody.Balance)
+	if err != nil || new(big.Int).SetBytes(plainBytes).Int64() != 10 || custody.CustodyAddr != custodyAddr {
+		t.Fatal("unexpected custody record")
+	}
+
+	res = stub.MockInvoke("1", [][]byte{[]byte("QueryAuditLog"), []byte(addrs[1]), []byte("10"), []byte("")})
+	page := &AuditPage{}
+	json.Unmarshal(res.Payload, page)
+	if len(page.Records) != 4 {
+		t.Fatal("expected 4 audit records, got ", len(page.Records))
+	}
+	res = stub.MockInvoke("1", [][]byte{[]byte("QueryAuditLog"), []byte(addrs[1]), []byte("3"), []byte("")})
+	json.Unmarshal(res.Payload, page)
+	if len(page.Records) != 3 || page.Bookmark == "" {
+		t.Fatal("expected a first page of 3 audit records")
+	}
+	res = stub.MockInvoke("1", [][]byte{[]byte("QueryAuditLog"), []byte(addrs[1]), []byte("3"), []byte(page.Bookmark)})
+	page = &AuditPage{}
+	json.Unmarshal(res.Payload, page)
+	if len(page.Records) != 1 || page.Records[0].Action != "seize" || page.Bookmark != "" {
+		t.Fatal("expected the seizure on the last page")
+	}
+}
+
+func TestHeDemoChaincode_SpendingLimit(t *testing.T) {
+	setClientIdentity(t, "Org1MSP", "user1")
+	stub, issuerPriv := newChaincode(t, &ChaincodeConfig{LimitMSPID: "RiskMSP"})
+
+	pubKeys, privKeys, addrs := newAccounts(t, stub, 2, issuerPriv, "200", "0")
+
+	setLimit := func(amount string, window int64, encrypt bool) [][]byte {
+		req, err := cliapi.PrepareSpendingLimit(amount, window, encrypt, pubKeys[0])
+		if err != nil {
+			t.Fatal("fail to prepare limit: ", err.Error())
+		}
+		return [][]byte{[]byte("SetSpendingLimit"), []byte(addrs[0]), req}
+	}
+	transfer := func(amount string, limited bool) ([]byte, error) {
+		account := &CipherAccount{}
+		json.Unmarshal(stub.State[addrs[0]], account)
+		txInfo, err := cliapi.PrepareTxInfo(string(account.Balance), amount, pubKeys[0], pubKeys[1], privKeys[0], "", "", nil)
+		if err == nil && limited {
+			spent := account.Limit.CipherSpent
+			now := time.Now().Unix()
+			if now >= account.Limit.WindowStart+account.Limit.Window {
+				spent = gohe.ZeroCipher()
+			}
+			txInfo, err = cliapi.ProveSpendingLimit(txInfo, string(account.Limit.CipherLimit), string(spent), pubKeys[0], privKeys[0])
+		}
+		if err != nil {
+			return nil, err
+		}
+		return signTx(t, txInfo, privKeys[0], addrs[0], addrs[1]), nil
+	}
+
+	// only the limit role sets the limit, not the holder of the account key
+	checkInvokeFail(t, stub, setLimit("50", 86400, false))
+	setClientIdentity(t, "RiskMSP", "officer")
+	checkInvoke(t, stub, setLimit("50", 86400, false))
+
+	txInfo, _ := transfer("30", false)
+	checkInvokeFail(t, stub, [][]byte{[]byte("Transfer"), []byte(addrs[0]), []byte(addrs[1]), txInfo})
+	txInfo, err := transfer("30", true)
+	if err != nil {
+		t.Fatal("fail to prove limit: ", err.Error())
+	}
+	checkInvoke(t, stub, [][]byte{[]byte("Transfer"), []byte(addrs[0]), []byte(addrs[1]), txInfo})
+	if _, err = transfer("21", true); err == nil {
+		t.Fatal("transfer over the limit proved")
+	}
+	txInfo, _ = transfer("20", true)
+	checkInvoke(t, stub, [][]byte{[]byte("Transfer"), []byte(addrs[0]), []byte(addrs[1]), txInfo})
+	checkState(t, stub, addrs[1], 50, privKeys[1])
+
+	// an encrypted limit for the same window keeps what was spent
+	checkInvoke(t, stub, setLimit("100", 86400, true))
+	account := &CipherAccount{}
+	json.Unmarshal(stub.State[addrs[0]], account)
+	if account.Limit.Amount != "" {
+		t.Fatal("encrypted limit stored in plaintext")
+	}
+	if _, err = transfer("51", true); err == nil {
+		t.Fatal("transfer over the limit proved")
+	}
+
+	// and so does a longer window, which still covers the current one
+	checkInvoke(t, stub, setLimit("100", 2*86400, false))
+	if _, err = transfer("51", true); err == nil {
+		t.Fatal("window change reset the spending")
+	}
+	txInfo, _ = transfer("50", true)
+	checkInvoke(t, stub, [][]byte{[]byte("Transfer"), []byte(addrs[0]), []byte(addrs[1]), txInfo})
+	checkState(t, stub, addrs[0], 100, privKeys[0])
+
+	// the account key cannot lift the limit, the limit role can
+	setClientIdentity(t, "Org1MSP", "user1")
+	checkInvokeFail(t, stub, setLimit("", 0, false))
+	setClientIdentity(t, "RiskMSP", "officer")
+	checkInvoke(t, stub, setLimit("", 0, false))
+	txInfo, _ = transfer("60", false)
+	checkInvoke(t, stub, [][]byte{[]byte("Transfer"), []byte(addrs[0]), []byte(addrs[1]), txInfo})
+	checkState(t, stub, addrs[1], 160, privKeys[1])
+}
+
+func TestHeDemoChaincode_Allowance(t *testing.T) {
+	auditorPubStr, auditorPrivStr := genKey(t)
+	stub, issuerPriv := newChaincode(t, &ChaincodeConfig{AuditorPubKey: auditorPubStr})
+
+	// owner, spender, recipient
+	pubKeys, privKeys, addrs := newAccounts(t, stub, 3, issuerPriv, "100", "0", "0")
+
+	spendable := func() string {
+		res := stub.MockInvoke("1", [][]byte{[]byte("QuerySpendable"), []byte(addrs[0])})
+		if res.Status != shim.OK {
+			t.Fatal("fail to query spendable balance: ", res.Message)
+		}
+		return string(res.Payload)
+	}
+	allowance := func() []byte {
+		res := stub.MockInvoke("1", [][]byte{[]byte("Allowance"), []byte(addrs[0]), []byte(addrs[1])})
+		return res.Payload
+	}
+	approve := func(amount string, signer string) [][]byte {
+		cipherAllowance := string(gohe.ZeroCipher())
+		if record := allowance(); record != nil {
+			a := &Allowance{}
+			json.Unmarshal(record, a)
+			cipherAllowance = string(a.CipherOwner)
+		}
+		approveInfo, err := cliapi.PrepareApprove(spendable(), cipherAllowance, amount, pubKeys[0], pubKeys[1], privKeys[0], auditorPubStr, "", nil)
+		if err != nil {
+			t.Fatal("fail to prepare allowance: ", err.Error())
+		}
+		sig, _ := cliapi.SignApprove(addrs[0], addrs[1], strconv.Itoa(lastTxID+1), approveInfo, signer)
+		return [][]byte{[]byte("Approve"), []byte(addrs[0]), []byte(addrs[1]), approveInfo, sig}
+	}
+	spend := func(amount string, signer string) [][]byte {
+		spendInfo, err := cliapi.PrepareTransferFrom(allowance(), amount, pubKeys[2], privKeys[1], auditorPubStr)
+		if err != nil {
+			t.Fatal("fail to prepare spend: ", err.Error())
+		}
+		sig, _ := cliapi.SignTransferFrom(addrs[0], addrs[1], addrs[2], strconv.Itoa(lastTxID+1), spendInfo, signer)
+		return [][]byte{[]byte("TransferFrom"), []byte(addrs[0]), []byte(addrs[1]), []byte(addrs[2]), spendInfo, sig}
+	}
+	decrypt := func(cipher []byte, privKey string) int64 {
+		plainBytes, err := gohe.Decrypt([]byte(privKey), cipher)
+		if err != nil {
+			t.Fatal("fail to decrypt: ", err.Error())
+		}
+		return new(big.Int).SetBytes(plainBytes).Int64()
+	}
+
+	// approving reserves the amount but leaves it in the owner's balance
+	checkInvokeFail(t, stub, approve("40", privKeys[1]))
+	checkInvoke(t, stub, approve("30", privKeys[0]))
+	checkInvoke(t, stub, approve("10", privKeys[0]))
+	checkState(t, stub, addrs[0], 100, privKeys[0])
+	if decrypt([]byte(spendable()), privKeys[0]) != 60 {
+		t.Fatal("unexpected spendable balance")
+	}
+	if _, err := cliapi.PrepareApprove(spendable(), string(gohe.ZeroCipher()), "61", pubKeys[0], pubKeys[1], privKeys[0], auditorPubStr, "", nil); err == nil {
+		t.Fatal("allowance over the spendable balance prepared")
+	}
+
+	// the owner can only spend what is not reserved
+	account := &CipherAccount{}
+	json.Unmarshal(stub.State[addrs[0]], account)
+	txInfo, _ := cliapi.PrepareTxInfo(string(account.Balance), "70", pubKeys[0], pubKeys[2], privKeys[0], auditorPubStr, "", nil)
+	checkInvokeFail(t, stub, [][]byte{[]byte("Transfer"), []byte(addrs[0]), []byte(addrs[2]), signTx(t, txInfo, privKeys[0], addrs[0], addrs[2])})
+	if _, err := cliapi.PrepareTxInfo(spendable(), "61", pubKeys[0], pubKeys[2], privKeys[0], auditorPubStr, "", nil); err == nil {
+		t.Fatal("transfer of a reserved amount prepared")
+	}
+
+	// spends leave the owner's balance and the reserved amount
+	checkInvokeFail(t, stub, spend("15", privKeys[0]))
+	checkInvoke(t, stub, spend("15", privKeys[1]))
+	checkReceipt(t, stub, addrs[2], strconv.Itoa(lastTxID), 15, privKeys[2])
+	checkReceipt(t, stub, addrs[0], strconv.Itoa(lastTxID), 15, privKeys[0])
+	checkInvoke(t, stub, spend("5", privKeys[1]))
+	checkState(t, stub, addrs[2], 20, privKeys[2])
+	checkState(t, stub, addrs[0], 80, privKeys[0])
+	if decrypt([]byte(spendable()), privKeys[0]) != 60 {
+		t.Fatal("spend changed the spendable balance")
+	}
+	if _, err := cliapi.PrepareTransferFrom(allowance(), "21", pubKeys[2], privKeys[1], auditorPubStr); err == nil {
+		t.Fatal("spend over the allowance prepared")
+	}
+
+	// the owner's and the auditor's copies of the allowance decreased
+	a := &Allowance{}
+	json.Unmarshal(allowance(), a)
+	if decrypt(a.CipherOwner, privKeys[0]) != 20 || decrypt(a.CipherAuditor, auditorPrivStr) != 20 {
+		t.Fatal("unexpected remaining allowance")
+	}
+
+	// revoking releases the rest to the owner
+	sig, _ := cliapi.SignRevokeAllowance(addrs[0], addrs[1], strconv.Itoa(lastTxID+1), privKeys[1])
+	checkInvokeFail(t, stub, [][]byte{[]byte("RevokeAllowance"), []byte(addrs[0]), []byte(addrs[1]), sig})
+	sig, _ = cliapi.SignRevokeAllowance(addrs[0], addrs[1], strconv.Itoa(lastTxID+1), privKeys[0])
+	checkInvoke(t, stub, [][]byte{[]byte("RevokeAllowance"), []byte(addrs[0]), []byte(addrs[1]), sig})
+	checkState(t, stub, addrs[0], 80, privKeys[0])
+	json.Unmarshal(stub.State[addrs[0]], account)
+	if spendable() != string(account.Balance) {
+		t.Fatal("revoke left an amount reserved")
+	}
+	checkInvokeFail(t, stub, [][]byte{[]byte("Allowance"), []byte(addrs[0]), []byte(addrs[1])})
+}
+
+func TestHeDemoChaincode_Multisig(t *testing.T) {
+	stub, issuerPriv := newChaincode(t, &ChaincodeConfig{})
+
+	// shared account, recipient, then three signers
+	pubKeys, privKeys, addrs := newAccounts(t, stub, 5, issuerPriv, "100", "0")
+
+	multisig, _ := json.Marshal(&Multisig{Threshold: 2, Signers: pubKeys[2:]})
+	setSigners := func(multisig []byte, privKeys ...string) [][]byte {
+		var approvals []*cliapi.MultisigApproval
+		for i, privKey := range privKeys {
+			sig, _ := cliapi.SignSigners(addrs[0], strconv.Itoa(lastTxID+1), multisig, privKey)
+			approvals = append(approvals, &cliapi.MultisigApproval{Signer: i, Sig: sig})
+		}
+		approvalsBytes, _ := json.Marshal(approvals)
+		return [][]byte{[]byte("SetSigners"), []byte(addrs[0]), multisig, approvalsBytes}
+	}
+	checkInvokeFail(t, stub, setSigners(multisig, privKeys[1]))
+	checkInvoke(t, stub, setSigners(multisig, privKeys[0]))
+
+	prepare := func(amount string) []byte {
+		account := &CipherAccount{}
+		json.Unmarshal(stub.State[addrs[0]], account)
+		txInfo, err := cliapi.PrepareTxInfo(string(account.Balance), amount, pubKeys[0], pubKeys[1], privKeys[0], "", "", nil)
+		if err != nil {
+			t.Fatal("fail to prepare tx info: ", err.Error())
+		}
+		return txInfo
+	}
+
+	// the account key alone no longer moves funds
+	txInfo := prepare("30")
+	checkInvokeFail(t, stub, [][]byte{[]byte("Transfer"), []byte(addrs[0]), []byte(addrs[1]), signTx(t, txInfo, privKeys[0], addrs[0], addrs[1])})
+
+	// on-chain approvals
+	res := stub.MockInvoke(strconv.Itoa(lastTxID+1), [][]byte{[]byte("ProposeTransfer"), []byte(addrs[0]), []byte(addrs[1]), txInfo, []byte("")})
+	lastTxID++
+	if res.Status != shim.OK {
+		t.Fatal("fail to propose: ", res.Message)
+	}
+	proposalID := string(res.Payload)
+	sig, _ := cliapi.SignProposal(addrs[0], addrs[1], "", txInfo, privKeys[2])
+	checkInvokeFail(t, stub, [][]byte{[]byte("ApproveTransfer"), []byte(proposalID), []byte("1"), sig})
+	checkInvoke(t, stub, [][]byte{[]byte("ApproveTransfer"), []byte(proposalID), []byte("0"), sig})
+	checkState(t, stub, addrs[0], 100, privKeys[0])
+	checkInvoke(t, stub, [][]byte{[]byte("QueryProposal"), []byte(proposalID)})
+	sig, _ = cliapi.SignProposal(addrs[0], addrs[1], "", txInfo, privKeys[4])
+	checkInvoke(t, stub, [][]byte{[]byte("ApproveTransfer"), []byte(proposalID), []byte("2"), sig})
+	checkState(t, stub, addrs[0], 70, privKeys[0])
+	checkState(t, stub, addrs[1], 30, privKeys[1])
+	checkInvokeFail(t, stub, [][]byte{[]byte("QueryProposal"), []byte(proposalID)})
+
+	// approvals collected off-chain execute right away
+	txInfo = prepare("20")
+	var approvals []*cliapi.MultisigApproval
+	for _, i := range []int{0, 1} {
+		sig, _ := cliapi.SignProposal(addrs[0], addrs[1], "", txInfo, privKeys[2+i])
+		approvals = append(approvals, &cliapi.MultisigApproval{Signer: i, Sig: sig})
+	}
+	approvalsBytes, _ := json.Marshal(approvals)
+	checkInvoke(t, stub, [][]byte{[]byte("ProposeTransfer"), []byte(addrs[0]), []byte(addrs[1]), txInfo, approvalsBytes})
+	checkState(t, stub, addrs[0], 50, privKeys[0])
+
+	// approvals do not carry over to a new signer set of the same size
+	txInfo = prepare("10")
+	res = stub.MockInvoke(strconv.Itoa(lastTxID+1), [][]byte{[]byte("ProposeTransfer"), []byte(addrs[0]), []byte(addrs[1]), txInfo, []byte("")})
+	lastTxID++
+	if res.Status != shim.OK {
+		t.Fatal("fail to propose: ", res.Message)
+	}
+	proposalID = string(res.Payload)
+	sig, _ = cliapi.SignProposal(addrs[0], addrs[1], "", txInfo, privKeys[4])
+	checkInvoke(t, stub, [][]byte{[]byte("ApproveTransfer"), []byte(proposalID), []byte("2"), sig})
+	newSigner, _ := genKey(t)
+	sameSize, _ := json.Marshal(&Multisig{Threshold: 2, Signers: []string{pubKeys[2], pubKeys[3], newSigner}})
+	checkInvoke(t, stub, setSigners(sameSize, privKeys[2], privKeys[3]))
+	sig, _ = cliapi.SignProposal(addrs[0], addrs[1], "", txInfo, privKeys[3])
+	checkInvokeFail(t, stub, [][]byte{[]byte("ApproveTransfer"), []byte(proposalID), []byte("1"), sig})
+	checkState(t, stub, addrs[0], 50, privKeys[0])
+
+	// the signers remove themselves and the account key is back in charge
+	checkInvokeFail(t, stub, setSigners([]byte("{}"), privKeys[2]))
+	checkInvoke(t, stub, setSigners([]byte("{}"), privKeys[2], privKeys[3]))
+	checkInvoke(t, stub, [][]byte{[]byte("Transfer"), []byte(addrs[0]), []byte(addrs[1]), signTx(t, prepare("10"), privKeys[0], addrs[0], addrs[1])})
+	checkState(t, stub, addrs[0], 40, privKeys[0])
+}
+
+func TestHeDemoChaincode_SharedKey(t *testing.T) {
+	stub, issuerPriv := newChaincode(t, &ChaincodeConfig{})
+
+	// the account key is shared by its three signers, two of whom act
+	pubKey, sharedKey, shares, err := cliapi.GenerateSharedKey(gohe.MinKeyBits, 2, 3)
+	if err != nil {
+		t.Fatal("fail to generate shared key: ", err.Error())
+	}
+	initAccount(t, stub, "100", pubKey, issuerPriv)
+	addr, _ := getHash(pubKey)
+	pubKeys, privKeys, addrs := newAccounts(t, stub, 4, issuerPriv, "0")
+
+	partialOpen := func(cipher []byte, holders ...int) [][]byte {
+		var partials [][]byte
+		for _, i := range holders {
+			partial, err := cliapi.PartialOpen(shares[i], cipher)
+			if err != nil {
+				t.Fatal("fail to open partially: ", err.Error())
+			}
+			partials = append(partials, partial)
+		}
+		return partials
+	}
+	balance := func() []byte {
+		account := &CipherAccount{}
+		json.Unmarshal(stub.State[addr], account)
+		return account.Balance
+	}
+	if _, err = cliapi.SharedDecrypt(sharedKey, balance(), partialOpen(balance(), 1)); err == nil {
+		t.Fatal("one holder decrypted")
+	}
+	if plain, err := cliapi.SharedDecrypt(sharedKey, balance(), partialOpen(balance(), 1, 2)); err != nil || plain != "100" {
+		t.Fatal("unexpected shared balance")
+	}
+
+	// the holders sign for the account key to hand it to the signers
+	multisig, _ := json.Marshal(&Multisig{Threshold: 2, Signers: pubKeys[1:]})
+	msg := cliapi.SignersMessage(addr, strconv.Itoa(lastTxID+1), multisig)
+	var partials [][]byte
+	for _, i := range []int{0, 2} {
+		partial, _ := cliapi.PartialSign(shares[i], msg)
+		partials = append(partials, partial)
+	}
+	sig, err := cliapi.SharedSign(sharedKey, msg, partials)
+	if err != nil {
+		t.Fatal("fail to sign: ", err.Error())
+	}
+	approvalsBytes, _ := json.Marshal([]*cliapi.MultisigApproval{{Sig: sig}})
+	checkInvoke(t, stub, [][]byte{[]byte("SetSigners"), []byte(addr), multisig, approvalsBytes})
+
+	// and prepare a transfer without any of them holding the key
+	txInfo, err := cliapi.PrepareSharedTxInfo(string(balance()), "30", sharedKey, pubKeys[0], "", "", nil, partialOpen(balance(), 0, 1))
+	if err != nil {
+		t.Fatal("fail to prepare tx info: ", err.Error())
+	}
+	var approvals []*cliapi.MultisigApproval
+	for _, i := range []int{0, 2} {
+		sig, _ := cliapi.SignProposal(addr, addrs[0], "", txInfo, privKeys[1+i])
+		approvals = append(approvals, &cliapi.MultisigApproval{Signer: i, Sig: sig})
+	}
+	approvalsBytes, _ = json.Marshal(approvals)
+	checkInvoke(t, stub, [][]byte{[]byte("ProposeTransfer"), []byte(addr), []byte(addrs[0]), txInfo, approvalsBytes})
+	checkState(t, stub, addrs[0], 30, privKeys[0])
+	if plain, err := cliapi.SharedDecrypt(sharedKey, balance(), partialOpen(balance(), 0, 2)); err != nil || plain != "70" {
+		t.Fatal("unexpected shared balance after the transfer")
+	}
+}
+
+func TestHeDemoChaincode_CloseAccount(t *testing.T) {
+	stub, issuerPriv := newChaincode(t, &ChaincodeConfig{})
+
+	pubKeys, privKeys, addrs := newAccounts(t, stub, 2, issuerPriv, "50", "0")
+
+	balances := func() map[string][]byte {
+		account := &CipherAccount{}
+		json.Unmarshal(stub.State[addrs[0]], account)
+		return map[string][]byte{"": account.Balance}
+	}
+	if _, err := cliapi.PrepareClose(addrs[0], strconv.Itoa(lastTxID+1), balances(), privKeys[0]); err == nil {
+		t.Fatal("close of a non-zero balance prepared")
+	}
+
+	// the whole balance is pending for B
+	txInfo, err := cliapi.PrepareHold(cliapi.HoldPending, string(balances()[""]), "50", pubKeys[0], pubKeys[1], privKeys[0], "", "", nil)
+	if err != nil {
+		t.Fatal("fail to prepare pending transfer: ", err.Error())
+	}
+	checkInvoke(t, stub, [][]byte{[]byte("TransferPending"), []byte(addrs[0]), []byte(addrs[1]), signTx(t, txInfo, privKeys[0], addrs[0], addrs[1])})
+	pendingID := strconv.Itoa(lastTxID)
+	closeInfo, _ := cliapi.PrepareClose(addrs[0], strconv.Itoa(lastTxID+1), balances(), privKeys[0])
+	checkInvokeFail(t, stub, [][]byte{[]byte("CloseAccount"), []byte(addrs[0]), closeInfo})
+	sig, _ := cliapi.SignPending("accept", pendingID, privKeys[1])
+	checkInvoke(t, stub, [][]byte{[]byte("Accept"), []byte(pendingID), sig})
+
+	// proofs are bound to the transaction and the owner's key
+	closeInfo, _ = cliapi.PrepareClose(addrs[0], strconv.Itoa(lastTxID+1), balances(), privKeys[0])
+	checkInvoke(t, stub, [][]byte{[]byte("QueryBalance"), []byte(addrs[0])})
+	checkInvokeFail(t, stub, [][]byte{[]byte("CloseAccount"), []byte(addrs[0]), closeInfo})
+	closeInfo, _ = cliapi.PrepareClose(addrs[0], strconv.Itoa(lastTxID+1), map[string][]byte{"": gohe.ZeroCipher()}, privKeys[1])
+	checkInvokeFail(t, stub, [][]byte{[]byte("CloseAccount"), []byte(addrs[0]), closeInfo})
+
+	// holds A would be credited cannot block the close, B gets them back
+	accountB := &CipherAccount{}
+	json.Unmarshal(stub.State[addrs[1]], accountB)
+	lockInfo, err := cliapi.PrepareHold(cliapi.HoldLock, string(accountB.Balance), "0", pubKeys[1], pubKeys[0], privKeys[1], "", "", nil)
+	if err != nil {
+		t.Fatal("fail to prepare hold: ", err.Error())
+	}
+	hashlock := []byte(hex.EncodeToString(make([]byte, sha256.Size)))
+	checkInvoke(t, stub, [][]byte{[]byte("Lock"), []byte(addrs[1]), []byte(addrs[0]), signTx(t, lockInfo, privKeys[1], addrs[1], addrs[0]), hashlock, []byte(strconv.Itoa(maxHoldTimeout))})
+	lockID := strconv.Itoa(lastTxID)
+
+	closeInfo, _ = cliapi.PrepareClose(addrs[0], strconv.Itoa(lastTxID+1), balances(), privKeys[0])
+	checkInvoke(t, stub, [][]byte{[]byte("CloseAccount"), []byte(addrs[0]), closeInfo})
+	checkInvokeFail(t, stub, [][]byte{[]byte("QueryBalance"), []byte(addrs[0])})
+	expireHold(t, stub, cliapi.HoldLock, lockID)
+	checkInvoke(t, stub, [][]byte{[]byte("Refund"), []byte(lockID)})
+	checkState(t, stub, addrs[1], 50, privKeys[1])
+
+	// the address cannot be opened again
+	initBalanceInfo, _ := cliapi.InitBalance("0", pubKeys[0], nil)
+	checkInvokeFail(t, stub, [][]byte{[]byte("init"), []byte(pubKeys[0]), initBalanceInfo})
+}
+
+func TestHeDemoChaincode_TransferRing(t *testing.T) {
+	auditorPubStr, _ := genKey(t)
+	stub, issuerPriv := newChaincode(t, &ChaincodeConfig{AuditorPubKey: auditorPubStr})
+
+	pubKeys, privKeys, addrs := newAccounts(t, stub, 4, issuerPriv, "100", "100", "100", "100")
+
+	balances := func() []string {
+		var balances []string
+		for _, addr := range addrs {
+			account := &CipherAccount{}
+			json.Unmarshal(stub.State[addr], account)
+			balances = append(balances, string(account.Balance))
+		}
+		return balances
+	}
+	ring := func(txInfo []byte) [][]byte {
+		args := [][]byte{[]byte("TransferRing"), txInfo, []byte("")}
+		for _, addr := range addrs {
+			args = append(args, []byte(addr))
+		}
+		return args
+	}
+
+	// member 1 pays member 3, members 0 and 2 are decoys
+	txInfo, err := cliapi.PrepareRingTransfer(balances(), pubKeys, 1, 3, "30", privKeys[1], auditorPubStr, "", strconv.Itoa(lastTxID+1))
+	if err != nil {
+		t.Fatal("fail to prepare ring transfer: ", err.Error())
+	}
+	checkInvokeFail(t, stub, [][]byte{[]byte("TransferRing"), txInfo, []byte(""), []byte(addrs[0]), []byte(addrs[1])})
+	// the debit is authorized for one transaction only
+	if res := stub.MockInvoke(strconv.Itoa(lastTxID+2), ring(txInfo)); res.Status == shim.OK {
+		t.Fatal("ring transfer accepted under another txID")
+	}
+	checkInvoke(t, stub, ring(txInfo))
+	for i, amount := range []int64{100, 70, 100, 130} {
+		checkState(t, stub, addrs[i], amount, privKeys[i])
+	}
+
+	// the members find their change in the event
+	var ev *event.RingEvent
+	for len(stub.ChaincodeEventsChannel) > 0 {
+		e := <-stub.ChaincodeEventsChannel
+		parsed, err := event.Parse(e.EventName, e.Payload)
+		if err != nil {
+			t.Fatal("fail to parse event: ", err.Error())
+		}
+		ev, _ = parsed.(*event.RingEvent)
+	}
+	if ev == nil || len(ev.Updates) != len(addrs) {
+		t.Fatal("no ring transfer event")
+	}
+	plainBytes, _ := gohe.Decrypt([]byte(privKeys[3]), ev.Updates[3])
+	if new(big.Int).SetBytes(plainBytes).Int64() != 30 {
+		t.Fatal("unexpected update of the receiver")
+	}
+
+	// the proofs are bound to the balances of the whole ring
+	checkInvokeFail(t, stub, ring(txInfo))
+	if _, err = cliapi.PrepareRingTransfer(balances(), pubKeys, 1, 0, "71", privKeys[1], auditorPubStr, "", strconv.Itoa(lastTxID+1)); err == nil {
+		t.Fatal("ring transfer over the balance prepared")
+	}
+	txInfo, _ = cliapi.PrepareRingTransfer(balances(), pubKeys, 1, 0, "70", privKeys[1], auditorPubStr, "", strconv.Itoa(lastTxID+1))
+	checkInvoke(t, stub, ring(txInfo))
+	checkState(t, stub, addrs[1], 0, privKeys[1])
+	checkState(t, stub, addrs[0], 170, privKeys[0])
+}
+
+func TestHeDemoChaincode_Stealth(t *testing.T) {
+	setClientIdentity(t, "IssuerMSP", "issuer")
+	auditorPub, _ := genKey(t)
+	stub, issuerPriv := newChaincode(t, &ChaincodeConfig{IssuerMSPID: "IssuerMSP", AuditorPubKey: auditorPub})
+	asset, _ := json.Marshal(&Asset{ID: "GOLD", IssuerMSPID: "IssuerMSP"})
+	checkInvoke(t, stub, [][]byte{[]byte("RegisterAsset"), asset})
+
+	senderKey, _ := gohe.GenerateKey(rand.Reader, gohe.MinKeyBits)
+	senderPub := string(gohe.GenPemPublicKey(&senderKey.PublicKey))
+	senderPriv := string(gohe.GenPemPrivateKey(senderKey))
+	senderAddr, _ := getHash(senderPub)
+	initAccount(t, stub, "100", senderPub, issuerPriv)
+
+	// the receiver publishes a scan key and a spend key
+	scanPriv, scanPub, _ := cliapi.GenerateStealthKey()
+	spendPriv, spendPub, _ := cliapi.GenerateStealthKey()
+	otherScanPriv, _, _ := cliapi.GenerateStealthKey()
+
+	stealthInfo, oneTimePub, err := cliapi.PrepareStealth(scanPub, spendPub, gohe.MinKeyBits)
+	if err != nil {
+		t.Fatal("fail to prepare stealth account: ", err.Error())
+	}
+	stealthAddr, _ := getHash(oneTimePub)
+	checkInvoke(t, stub, [][]byte{[]byte("CreateStealth"), stealthInfo})
+	checkInvokeFail(t, stub, [][]byte{[]byte("CreateStealth"), stealthInfo})
+
+	balance := func(addr string) []byte {
+		account := &CipherAccount{}
+		json.Unmarshal(stub.State[addr], account)
+		return account.Balance
+	}
+	txInfo, _ := cliapi.PrepareTxInfo(string(balance(senderAddr)), "30", senderPub, oneTimePub, senderPriv, auditorPub, "", nil)
+	checkInvoke(t, stub, [][]byte{[]byte("Transfer"), []byte(senderAddr), []byte(stealthAddr), signTx(t, txInfo, senderPriv, senderAddr, stealthAddr)})
+	checkInvoke(t, stub, [][]byte{[]byte("MintAsset"), []byte("GOLD"), []byte(stealthAddr), []byte("7")})
+
+	// only the scan key of the receiver finds the account
+	if _, ok, err := cliapi.ScanStealth(stealthInfo, otherScanPriv, spendPub); ok || err != nil {
+		t.Fatal("stealth account found with another scan key")
+	}
+	oneTimePriv, ok, err := cliapi.ScanStealth(stealthInfo, scanPriv, spendPub)
+	if !ok || err != nil {
+		t.Fatal("fail to scan stealth account")
+	}
+	checkState(t, stub, stealthAddr, 30, oneTimePriv)
+
+	// the sender knows the one-time key, so it cannot send before the claim
+	txInfo, _ = cliapi.PrepareTxInfo(string(balance(stealthAddr)), "30", oneTimePub, senderPub, oneTimePriv, auditorPub, "", nil)
+	checkInvokeFail(t, stub, [][]byte{[]byte("Transfer"), []byte(stealthAddr), []byte(senderAddr), signTx(t, txInfo, oneTimePriv, stealthAddr, senderAddr)})
+
+	newKey, _ := gohe.GenerateKey(rand.Reader, gohe.MinKeyBits)
+	newPub := string(gohe.GenPemPublicKey(&newKey.PublicKey))
+	newPriv := string(gohe.GenPemPrivateKey(newKey))
+	res := stub.MockInvoke("1", [][]byte{[]byte("QueryBalance"), []byte(stealthAddr), []byte("GOLD")})
+	balances := map[string][]byte{"": balance(stealthAddr), "GOLD": res.Payload}
+	if _, err := cliapi.PrepareClaim(stealthAddr, strconv.Itoa(lastTxID+1), stealthInfo, balances, otherScanPriv, spendPriv, newPub); err == nil {
+		t.Fatal("claim prepared with another scan key")
+	}
+	// the claim is bound to the transaction
+	claimInfo, err := cliapi.PrepareClaim(stealthAddr, strconv.Itoa(lastTxID+2), stealthInfo, balances, scanPriv, spendPriv, newPub)
+	if err != nil {
+		t.Fatal("fail to prepare claim: ", err.Error())
+	}
+	checkInvokeFail(t, stub, [][]byte{[]byte("ClaimStealth"), []byte(stealthAddr), claimInfo})
+	// a re-encryption of another amount is rejected
+	inflated, _ := cliapi.EncryptAmount("1000", oneTimePub)
+	claimInfo, _ = cliapi.PrepareClaim(stealthAddr, strconv.Itoa(lastTxID+1), stealthInfo, map[string][]byte{"": inflated, "GOLD": res.Payload}, scanPriv, spendPriv, newPub)
+	checkInvokeFail(t, stub, [][]byte{[]byte("ClaimStealth"), []byte(stealthAddr), claimInfo})
+	claimInfo, _ = cliapi.PrepareClaim(stealthAddr, strconv.Itoa(lastTxID+1), stealthInfo, balances, scanPriv, spendPriv, newPub)
+	checkInvoke(t, stub, [][]byte{[]byte("ClaimStealth"), []byte(stealthAddr), claimInfo})
+	claimTx := strconv.Itoa(lastTxID)
+	checkState(t, stub, stealthAddr, 30, newPriv)
+
+	// the claim receipt restarts the history of every asset
+	res = stub.MockInvoke("1", [][]byte{[]byte("QueryHistory"), []byte(stealthAddr), []byte("10"), []byte("")})
+	page := &HistoryPage{}
+	json.Unmarshal(res.Payload, page)
+	// earlier receipts are under the one-time key
+	claimPage := &HistoryPage{}
+	for _, receipt := range page.Receipts {
+		if receipt.TxID == claimTx {
+			claimPage.Receipts = append(claimPage.Receipts, receipt)
+		}
+	}
+	claimPageBytes, _ := json.Marshal(claimPage)
+	entries, _, err := cliapi.DecryptHistory(claimPageBytes, newPriv)
+	if err != nil {
+		t.Fatal("fail to decrypt history: ", err.Error())
+	}
+	claimed := map[string]int64{}
+	for _, entry := range entries {
+		if entry.Type == ReceiptRotate {
+			claimed[entry.Asset] = entry.Amount.Int64()
+		}
+	}
+	if len(claimed) != 2 || claimed[""] != 30 || claimed["GOLD"] != 7 {
+		t.Fatal("unexpected claim receipt: ", claimed)
+	}
+	checkInvokeFail(t, stub, [][]byte{[]byte("ClaimStealth"), []byte(stealthAddr), claimInfo})
+
+	txInfo, _ = cliapi.PrepareTxInfo(string(balance(stealthAddr)), "10", newPub, senderPub, newPriv, auditorPub, "", nil)
+	checkInvoke(t, stub, [][]byte{[]byte("Transfer"), []byte(stealthAddr), []byte(senderAddr), signTx(t, txInfo, newPriv, stealthAddr, senderAddr)})
+	checkState(t, stub, stealthAddr, 20, newPriv)
+	checkState(t, stub, senderAddr, 80, senderPriv)
+}
+
+func TestHeDemoChaincode_Memo(t *testing.T) {
+	setClientIdentity(t, "IssuerMSP", "issuer")
+
+	auditorPubStr, _ := genKey(t)
+	stub, issuerPriv := newChaincode(t, &ChaincodeConfig{IssuerMSPID: "IssuerMSP", AuditorPubKey: auditorPubStr})
+
+	pubKeys, privKeys, addrs := newAccounts(t, stub, 3, issuerPriv, "100", "0", "0")
+	schedule, _ := json.Marshal(&FeeSchedule{Flat: "2", Collector: addrs[2]})
+	checkInvoke(t, stub, [][]byte{[]byte("SetFeeSchedule"), schedule})
+	fee := &cliapi.Fee{Flat: "2", PubKeyCollector: pubKeys[2]}
+
+	prepare := func(from, to int, amount, memo string) []byte {
+		account := &CipherAccount{}
+		json.Unmarshal(stub.State[addrs[from]], account)
+		txInfo, _ := cliapi.PrepareTxInfo(string(account.Balance), amount, pubKeys[from], pubKeys[to], privKeys[from], auditorPubStr, "", fee)
+		txInfo, err := cliapi.AttachMemo(txInfo, memo)
+		if err != nil {
+			t.Fatal("fail to attach memo: ", err.Error())
+		}
+		return txInfo
+	}
+	checkMemo := func(i int, txID, memo string) {
+		res := stub.MockInvoke("1", [][]byte{[]byte("QueryHistory"), []byte(addrs[i]), []byte("100"), []byte("")})
+		entries, _, err := cliapi.DecryptHistory(res.Payload, privKeys[i])
+		if err != nil {
+			t.Fatal("fail to decrypt history: ", err.Error())
+		}
+		for _, entry := range entries {
+			if entry.TxID == txID {
+				if entry.Memo != memo {
+					t.Fatal("unexpected memo: ", entry.Memo)
+				}
+				return
+			}
+		}
+		t.Fatal("no receipt for: ", txID)
+	}
+
+	txInfo := prepare(0, 1, "10", "invoice 42")
+	checkInvoke(t, stub, [][]byte{[]byte("Transfer"), []byte(addrs[0]), []byte(addrs[1]), signTx(t, txInfo, privKeys[0], addrs[0], addrs[1])})
+	checkMemo(1, strconv.Itoa(lastTxID), "invoice 42")
+	checkState(t, stub, addrs[1], 10, privKeys[1])
+
+	// the memo is bound to the amount, a copy in another transfer does not open
+	var sealed, replay map[string]json.RawMessage
+	json.Unmarshal(txInfo, &sealed)
+	json.Unmarshal(prepare(0, 1, "1", "other"), &replay)
+	replay["Memo"] = sealed["Memo"]
+	txInfo, _ = json.Marshal(replay)
+	checkInvoke(t, stub, [][]byte{[]byte("Transfer"), []byte(addrs[0]), []byte(addrs[1]), signTx(t, txInfo, privKeys[0], addrs[0], addrs[1])})
+	checkMemo(1, strconv.Itoa(lastTxID), "")
+
+	// the receipt of a collector also holds the fee
+	checkInvoke(t, stub, [][]byte{[]byte("Transfer"), []byte(addrs[0]), []byte(addrs[2]), signTx(t, prepare(0, 2, "5", "invoice 43"), privKeys[0], addrs[0], addrs[2])})
+	checkMemo(2, strconv.Itoa(lastTxID), "invoice 43")
+
+	// a pending transfer delivers its memo on acceptance
+	account := &CipherAccount{}
+	json.Unmarshal(stub.State[addrs[0]], account)
+	txInfo, _ = cliapi.PrepareHold(cliapi.HoldPending, string(account.Balance), "7", pubKeys[0], pubKeys[1], privKeys[0], auditorPubStr, "", fee)
+	txInfo, _ = cliapi.AttachMemo(txInfo, "invoice 44")
+	checkInvoke(t, stub, [][]byte{[]byte("TransferPending"), []byte(addrs[0]), []byte(addrs[1]), signTx(t, txInfo, privKeys[0], addrs[0], addrs[1])})
+	pendingID := strconv.Itoa(lastTxID)
+	sig, _ := cliapi.SignPending("accept", pendingID, privKeys[1])
+	checkInvoke(t, stub, [][]byte{[]byte("Accept"), []byte(pendingID), sig})
+	checkMemo(1, strconv.Itoa(lastTxID), "invoice 44")
+	checkState(t, stub, addrs[1], 18, privKeys[1])
+}
+
+func TestHeDemoChaincode_BalanceAtLeast(t *testing.T) {
+	signingKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	pubDer, _ := x509.MarshalPKIXPublicKey(&signingKey.PublicKey)
+	attestationPub := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDer}))
+	saved := attestationKey
+	attestationKey = func() (*ecdsa.PrivateKey, error) { return signingKey, nil }
+	t.Cleanup(func() { attestationKey = saved })
+	stub, issuerPriv := newChaincode(t, &ChaincodeConfig{AttestationKey: attestationPub})
+
+	pubKeys, privKeys, addrs := newAccounts(t, stub, 2, issuerPriv, "100", "0")
+
+	balance := func() []byte {
+		account := &CipherAccount{}
+		json.Unmarshal(stub.State[addrs[0]], account)
+		return account.Balance
+	}
+	if _, err := cliapi.ProveBalanceAtLeast(privKeys[0], string(balance()), "101"); err == nil {
+		t.Fatal("proved more than the balance")
+	}
+	proof, err := cliapi.ProveBalanceAtLeast(privKeys[0], string(balance()), "100")
+	if err != nil {
+		t.Fatal("fail to prove threshold: ", err.Error())
+	}
+	res := stub.MockInvoke("1", [][]byte{[]byte("VerifyBalanceAtLeast"), []byte(addrs[0]), []byte("100"), proof})
+	if res.Status != shim.OK {
+		t.Fatal("fail to verify threshold: ", res.Message)
+	}
+	attestation, err := cliapi.VerifyAttestation(res.Payload, attestationPub)
+	if err != nil || attestation.Addr != addrs[0] || attestation.Threshold != "100" {
+		t.Fatal("unexpected attestation: ", string(res.Payload))
+	}
+	otherPub, _ := genIssuerKey(t)
+	if _, err := cliapi.VerifyAttestation(res.Payload, otherPub); err == nil {
+		t.Fatal("attestation verified with another key")
+	}
+
+	// endorsers of the same proposal return the same payload
+	for {
+		args := [][]byte{[]byte("VerifyBalanceAtLeast"), []byte(addrs[0]), []byte("100"), proof}
+		first, second := stub.MockInvoke("2", args), stub.MockInvoke("2", args)
+		a, _ := cliapi.VerifyAttestation(first.Payload, attestationPub)
+		b, _ := cliapi.VerifyAttestation(second.Payload, attestationPub)
+		if a == nil || b == nil {
+			t.Fatal("fail to verify threshold")
+		}
+		// the mock stub stamps every call, a real proposal has one timestamp
+		if a.Timestamp != b.Timestamp {
+			continue
+		}
+		if string(first.Payload) != string(second.Payload) {
+			t.Fatal("endorsements of the same proposal differ")
+		}
+		break
+	}
+
+	// a threshold past the range wraps: 0 - (n-1) = 1 mod n is in range
+	balanceB := &CipherAccount{}
+	json.Unmarshal(stub.State[addrs[1]], balanceB)
+	keyB, _ := gohe.ParsePrivateKey([]byte(privKeys[1]))
+	huge := new(big.Int).Sub(keyB.N, big.NewInt(1)).String()
+	if _, err := cliapi.ProveBalanceAtLeast(privKeys[1], string(balanceB.Balance), huge); err == nil {
+		t.Fatal("proved a threshold past the range")
+	}
+	nonce, _ := gohe.RecoverNonce([]byte(privKeys[1]), balanceB.Balance)
+	cipherExcess, _ := gohe.Add([]byte(pubKeys[1]), balanceB.Balance, []byte{1})
+	wrapped, err := gohe.ProveRange([]byte(pubKeys[1]), cipherExcess, []byte{1}, nonce, []byte("gopaillier/at-least/"+huge+"/"+string(balanceB.Balance)))
+	if err != nil {
+		t.Fatal("fail to prove range: ", err.Error())
+	}
+	wrappedProof, _ := json.Marshal(wrapped)
+	res = stub.MockInvoke("1", [][]byte{[]byte("VerifyBalanceAtLeast"), []byte(addrs[1]), []byte(huge), wrappedProof})
+	if res.Status == shim.OK {
+		t.Fatal("proof verified for a threshold past the range")
+	}
+
+	// the proof is bound to the threshold, the account and its balance
+	res = stub.MockInvoke("1", [][]byte{[]byte("VerifyBalanceAtLeast"), []byte(addrs[0]), []byte("50"), proof})
+	if res.Status == shim.OK {
+		t.Fatal("proof verified for another threshold")
+	}
+	res = stub.MockInvoke("1", [][]byte{[]byte("VerifyBalanceAtLeast"), []byte(addrs[1]), []byte("100"), proof})
+	if res.Status == shim.OK {
+		t.Fatal("proof verified for another account")
+	}
+	txInfo, _ := cliapi.PrepareTxInfo(string(balance()), "1", pubKeys[0], pubKeys[1], privKeys[0], "", "", nil)
+	checkInvoke(t, stub, [][]byte{[]byte("Transfer"), []byte(addrs[0]), []byte(addrs[1]), signTx(t, txInfo, privKeys[0], addrs[0], addrs[1])})
+	res = stub.MockInvoke("1", [][]byte{[]byte("VerifyBalanceAtLeast"), []byte(addrs[0]), []byte("100"), proof})
+	if res.Status == shim.OK {
+		t.Fatal("proof verified against a changed balance")
+	}
+	proof, _ = cliapi.ProveBalanceAtLeast(privKeys[0], string(balance()), "50")
+	res = stub.MockInvoke("1", [][]byte{[]byte("VerifyBalanceAtLeast"), []byte(addrs[0]), []byte("50"), proof})
+	if res.Status != shim.OK {
+		t.Fatal("fail to verify threshold: ", res.Message)
+	}
+}
+
+func TestHeDemoChaincode_SignDeterministic(t *testing.T) {
+	// RFC 6979 A.2.5, P-256 with SHA-256 and the message "sample"
+	d, _ := new(big.Int).SetString("C9AFA9D845BA75166B5C215767B1D6934E50C3DB36E89B127B8A622B120F6721", 16)
+	key := &ecdsa.PrivateKey{D: d}
+	key.Curve = elliptic.P256()
+	key.X, key.Y = key.Curve.ScalarBaseMult(d.Bytes())
+	digest := sha256.Sum256([]byte("sample"))
+
+	sig, err := signDeterministic(key, digest[:])
+	if err != nil {
+		t.Fatal("fail to sign: ", err.Error())
+	}
+	var rs struct{ R, S *big.Int }
+	asn1.Unmarshal(sig, &rs)
+	if fmt.Sprintf("%X", rs.R) != "EFD48B2AACB6A8FD1140DD9CD45E81D69D2C877B56AAF991C34D0EA84EAF3716" ||
+		fmt.Sprintf("%X", rs.S) != "F7CB1C942D657C41D436C7A1B6E29F65F3E900DBB9AFF4064DC4AB2F843ACDA8" {
+		t.Fatal("unexpected signature: ", rs.R, rs.S)
+	}
+	if !ecdsa.VerifyASN1(&key.PublicKey, digest[:], sig) {
+		t.Fatal("fail to verify signature")
+	}
+}
+
+// registryChaincode stands in for IDChaincode's QueryPubkey, QueryKeyHistory
+// and Rotate.
+type registryChaincode struct {
+	keys map[string]string
+}
+
+func (r *registryChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	return shim.Success(nil)
+}
+
+func (r *registryChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	function, args := stub.GetFunctionAndParameters()
+	if function == "Rotate" && len(args) == 3 {
+		// the signature is checked by IDChaincode itself
+		r.keys[args[0]] = args[1]
+		return shim.Success([]byte(`{"Keys":[{"Version":1},{"Version":2}]}`))
+	}
+	if (function != "QueryPubkey" && function != "QueryKeyHistory") || len(args) != 1 {
+		return shim.Error("Invalid invoke function name.")
+	}
+	key, ok := r.keys[args[0]]
+	if !ok {
+		return shim.Error("addr is not register")
+	}
+	if function == "QueryKeyHistory" {
+		record, _ := json.Marshal(map[string]interface{}{"Keys": []interface{}{map[string]interface{}{"Version": 1, "PubKey": key}}})
+		return shim.Success(record)
+	}
+	return shim.Success([]byte(key))
+}
+
+func TestHeDemoChaincode_Registry(t *testing.T) {
+	scc := new(TransferChaincode)
+	stub := shim.NewMockStub("TransferChaincode", scc)
+	registry := &registryChaincode{keys: map[string]string{}}
+	stub.MockPeerChaincode("IDChaincode", shim.NewMockStub("IDChaincode", registry))
+
+	config, _ := json.Marshal(&ChaincodeConfig{IDChaincode: "IDChaincode"})
+	checkInit(t, stub, [][]byte{[]byte("init"), config})
+
+	privKeyA, _ := gohe.GenerateKey(rand.Reader, gohe.MinKeyBits)
+	pubKeyStrA := string(gohe.GenPemPublicKey(&privKeyA.PublicKey))
+	privKeyStrA := string(gohe.GenPemPrivateKey(privKeyA))
+	hashAddrA, _ := getHash(pubKeyStrA)
+	privKeyB, _ := gohe.GenerateKey(rand.Reader, gohe.MinKeyBits)
+	pubKeyStrB := string(gohe.GenPemPublicKey(&privKeyB.PublicKey))
+	hashAddrB, _ := getHash(pubKeyStrB)
+
+	// unregistered keys cannot open an account
+	initBalanceInfoA, _ := cliapi.InitBalance("0", pubKeyStrA, nil)
+	checkInvokeFail(t, stub, [][]byte{[]byte("init"), []byte(pubKeyStrA), initBalanceInfoA})
+
+	registry.keys[hashAddrA] = pubKeyStrA
+	registry.keys[hashAddrB] = pubKeyStrB
+
+	// a stealth account cannot squat the address of a registered key, it
+	// would take every later payment to it
+	_, scanPub, _ := cliapi.GenerateStealthKey()
+	_, spendPub, _ := cliapi.GenerateStealthKey()
+	stealthInfo, _, err := cliapi.PrepareStealth(scanPub, spendPub, gohe.MinKeyBits)
+	if err != nil {
+		t.Fatal("fail to prepare stealth account: ", err.Error())
+	}
+	var squat map[string]interface{}
+	json.Unmarshal(stealthInfo, &squat)
+	squat["PubKey"] = []byte(pubKeyStrA)
+	squatInfo, _ := json.Marshal(squat)
+	checkInvokeFail(t, stub, [][]byte{[]byte("CreateStealth"), squatInfo})
+	checkInvoke(t, stub, [][]byte{[]byte("CreateStealth"), stealthInfo})
+
+	checkInvoke(t, stub, [][]byte{[]byte("init"), []byte(pubKeyStrA), initBalanceInfoA})
+	initBalanceInfoB, _ := cliapi.InitBalance("0", pubKeyStrB, nil)
+	checkInvoke(t, stub, [][]byte{[]byte("init"), []byte(pubKeyStrB), initBalanceInfoB})
+
+	accountA := &CipherAccount{}
+	json.Unmarshal(stub.State[hashAddrA], accountA)
+	if accountA.PublicKey != nil {
+		t.Fatal("account should not keep a copy of the registered key")
+	}
+	checkState(t, stub, hashAddrA, 0, privKeyStrA)
+
+	// a revoked receiver key stops transfers immediately
+	delete(registry.keys, hashAddrB)
+	txInfo, err := cliapi.PrepareTxInfo(string(accountA.Balance), "0", pubKeyStrA, pubKeyStrB, privKeyStrA, "", "", nil)
+	if err != nil {
+		t.Fatal("fail to prepare tx info: ", err.Error())
+	}
+	txInfo = signTx(t, txInfo, privKeyStrA, hashAddrA, hashAddrB)
+	checkInvokeFail(t, stub, [][]byte{[]byte("Transfer"), []byte(hashAddrA), []byte(hashAddrB), txInfo})
+
+	registry.keys[hashAddrB] = pubKeyStrB
+	checkInvoke(t, stub, [][]byte{[]byte("Transfer"), []byte(hashAddrA), []byte(hashAddrB), txInfo})
+}
+
+func TestHeDemoChaincode_RotateKey(t *testing.T) {
+	scc := new(TransferChaincode)
+	stub := shim.NewMockStub("TransferChaincode", scc)
+	registry := &registryChaincode{keys: map[string]string{}}
+	stub.MockPeerChaincode("IDChaincode", shim.NewMockStub("IDChaincode", registry))
+
+	issuerPub, issuerPriv := genIssuerKey(t)
+	config, _ := json.Marshal(&ChaincodeConfig{IssuerSigningKey: issuerPub, IDChaincode: "IDChaincode"})
+	checkInit(t, stub, [][]byte{[]byte("init"), config})
+
+	oldKey, _ := gohe.GenerateKey(rand.Reader, gohe.MinKeyBits)
+	oldPubStr := string(gohe.GenPemPublicKey(&oldKey.PublicKey))
+	oldPrivStr := string(gohe.GenPemPrivateKey(oldKey))
+	addr, _ := getHash(oldPubStr)
+	registry.keys[addr] = oldPubStr
+	initAccount(t, stub, "100", oldPubStr, issuerPriv)
+
+	newKey, _ := gohe.GenerateKey(rand.Reader, gohe.MinKeyBits)
+	newPubStr := string(gohe.GenPemPublicKey(&newKey.PublicKey))
+	newPrivStr := string(gohe.GenPemPrivateKey(newKey))
+
+	account := &CipherAccount{}
+	json.Unmarshal(stub.State[addr], account)
+
+	// a re-encryption of another amount is rejected
+	otherBalance, _ := cliapi.EncryptAmount("1000", oldPubStr)
+	forged, err := cliapi.PrepareRotation(addr, 1, string(otherBalance), oldPrivStr, newPubStr)
+	if err != nil {
+		t.Fatal("fail to prepare rotation: ", err.Error())
+	}
+	checkInvokeFail(t, stub, [][]byte{[]byte("RotateKey"), []byte(addr), forged})
+
+	// a refund under the old key could not be credited after the rotation
+	pubKeyB, _ := genKey(t)
+	addrB, _ := getHash(pubKeyB)
+	registry.keys[addrB] = pubKeyB
+	initAccount(t, stub, "0", pubKeyB, issuerPriv)
+	lockInfo, err := cliapi.PrepareHold(cliapi.HoldLock, string(account.Balance), "10", oldPubStr, pubKeyB, oldPrivStr, "", "", nil)
+	if err != nil {
+		t.Fatal("fail to prepare hold: ", err.Error())
+	}
+	lockInfo = signTx(t, lockInfo, oldPrivStr, addr, addrB)
+	hashlock := []byte(hex.EncodeToString(make([]byte, sha256.Size)))
+	checkInvokeFail(t, stub, [][]byte{[]byte("Lock"), []byte(addr), []byte(addrB), lockInfo, hashlock, []byte(strconv.Itoa(maxHoldTimeout + 1))})
+	checkInvoke(t, stub, [][]byte{[]byte("Lock"), []byte(addr), []byte(addrB), lockInfo, hashlock, []byte("3600")})
+	lockID := strconv.Itoa(lastTxID)
+	json.Unmarshal(stub.State[addr], account)
+	rotation, err := cliapi.PrepareRotation(addr, 1, string(account.Balance), oldPrivStr, newPubStr)
+	if err != nil {
+		t.Fatal("fail to prepare rotation: ", err.Error())
+	}
+	checkInvokeFail(t, stub, [][]byte{[]byte("RotateKey"), []byte(addr), rotation})
+
+	expireHold(t, stub, cliapi.HoldLock, lockID)
+	checkInvoke(t, stub, [][]byte{[]byte("Refund"), []byte(lockID)})
+	json.Unmarshal(stub.State[addr], account)
+	rotation, err = cliapi.PrepareRotation(addr, 1, string(account.Balance), oldPrivStr, newPubStr)
+	if err != nil {
+		t.Fatal("fail to prepare rotation: ", err.Error())
+	}
+	checkInvoke(t, stub, [][]byte{[]byte("RotateKey"), []byte(addr), rotation})
+	checkState(t, stub, addr, 100, newPrivStr)
+	if registry.keys[addr] != newPubStr {
+		t.Fatal("registry key was not rotated")
+	}
+}